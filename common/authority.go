@@ -0,0 +1,318 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	// EnrolledCertFile is the name of the file within the data directory that the DTLS certificate issued by the built-in certificate authority is kept in, unless a DTLS certificate file is configured.
+	EnrolledCertFile = "dtls.crt"
+
+	// EnrolledKeyFile is the name of the file within the data directory that the DTLS key is kept in, unless a DTLS key file is configured.
+	EnrolledKeyFile = "dtls.key"
+
+	// EnrolledCAFile is the name of the file within the data directory that the certificate of the built-in certificate authority is kept in, unless a DTLS CA certificate file is configured.
+	EnrolledCAFile = "dtls-ca.crt"
+
+	// The validity of issued certificates starts slightly in the past, to allow for clock skew between nodes.
+	certificateBackdate = time.Minute
+)
+
+// CertificateRequest represents a node asking the built-in certificate authority for a DTLS certificate, either to enroll using a join token or to renew the certificate it holds.
+type CertificateRequest struct {
+	// The machine id of the node, which the certificate is issued to.
+	MachineID string `json:"machineID"`
+
+	// The PEM encoded certificate signing request, carrying the public key to certify.
+	CSR []byte `json:"csr"`
+
+	// The one-time join token authorizing a node without a certificate to enroll.
+	Token string `json:"token,omitempty"`
+
+	// The PEM encoded certificate being renewed, which authorizes a renewal when it is still valid and certifies the same key.
+	Certificate []byte `json:"certificate,omitempty"`
+}
+
+// Bytes returns a byte slice representation of a CertificateRequest object, if there is an error while marshalling data a nil slice is returned.
+func (request *CertificateRequest) Bytes() []byte {
+	buf, _ := json.Marshal(request)
+	return buf
+}
+
+// String returns a string representation of a CertificateRequest object, if there is an error while marshalling data an empty string is returned.
+func (request *CertificateRequest) String() string {
+	return string(request.Bytes())
+}
+
+// ParseCertificateRequest creates a new CertificateRequest object based on the supplied string representation.
+func ParseCertificateRequest(data string) (*CertificateRequest, error) {
+	request := &CertificateRequest{}
+	if err := json.Unmarshal([]byte(data), request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// IssuedCertificate represents a DTLS certificate issued by the built-in certificate authority.
+type IssuedCertificate struct {
+	// The PEM encoded certificate.
+	Certificate []byte `json:"certificate"`
+
+	// The PEM encoded certificate of the certificate authority that issued it.
+	CA []byte `json:"ca"`
+}
+
+// Bytes returns a byte slice representation of an IssuedCertificate object, if there is an error while marshalling data a nil slice is returned.
+func (issued *IssuedCertificate) Bytes() []byte {
+	buf, _ := json.Marshal(issued)
+	return buf
+}
+
+// String returns a string representation of an IssuedCertificate object, if there is an error while marshalling data an empty string is returned.
+func (issued *IssuedCertificate) String() string {
+	return string(issued.Bytes())
+}
+
+// ParseIssuedCertificate creates a new IssuedCertificate object based on the supplied string representation.
+func ParseIssuedCertificate(data string) (*IssuedCertificate, error) {
+	issued := &IssuedCertificate{}
+	if err := json.Unmarshal([]byte(data), issued); err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+// Authority represents the built-in certificate authority, which issues DTLS certificates bound to the machine id of the nodes they are issued to.
+type Authority struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+}
+
+// Certificate returns the PEM encoded certificate of the certificate authority.
+func (authority *Authority) Certificate() []byte {
+	return authority.certPEM
+}
+
+// Verify parses the PEM encoded certificate, and returns it if it was issued by the certificate authority and is valid at the supplied time.
+func (authority *Authority) Verify(data []byte, now time.Time) (*x509.Certificate, error) {
+	cert, err := ParseCertificatePEM(data)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.cert)
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: now,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Issue returns a PEM encoded certificate for the public key, which is bound to the machine id and valid for the supplied length of time or until the certificate authority expires.
+func (authority *Authority) Issue(machineID string, pub crypto.PublicKey, now time.Time, ttl time.Duration) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.New("error generating a certificate serial number: " + err.Error())
+	}
+
+	notAfter := now.Add(ttl)
+	if notAfter.After(authority.cert.NotAfter) {
+		notAfter = authority.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: machineID},
+		URIs:         []*url.URL{{Scheme: MachineIDScheme, Host: machineID}},
+		NotBefore:    now.Add(-certificateBackdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, authority.cert, pub, authority.key)
+	if err != nil {
+		return nil, errors.New("error issuing a certificate: " + err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// LoadAuthority loads the built-in certificate authority from the supplied PEM encoded certificate and unencrypted key files.
+func LoadAuthority(certFile, keyFile string) (*Authority, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.New("error reading the certificate authority certificate: " + err.Error())
+	}
+
+	cert, err := ParseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, errors.New("error parsing the certificate authority certificate: " + err.Error())
+	}
+	if !cert.IsCA {
+		return nil, errors.New("the certificate authority certificate is not a CA certificate")
+	}
+
+	key, err := LoadCertificateKey(keyFile)
+	if err != nil {
+		return nil, errors.New("error loading the certificate authority key: " + err.Error())
+	}
+	if !PublicKeysEqual(cert.PublicKey, key.Public()) {
+		return nil, errors.New("the certificate authority key does not match its certificate")
+	}
+
+	return &Authority{
+		cert:    cert,
+		certPEM: certPEM,
+		key:     key,
+	}, nil
+}
+
+// ParseCertificatePEM parses the first PEM encoded certificate in the supplied data.
+func ParseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// ParseCSR parses the PEM encoded certificate signing request, which must be signed by the key it carries.
+func ParseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no PEM encoded certificate signing request found")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+// NewCSR returns a PEM encoded certificate signing request for the key, on behalf of the supplied machine id.
+func NewCSR(key crypto.Signer, machineID string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: machineID},
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, errors.New("error creating a certificate signing request: " + err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// GenerateCertificateKey generates a new key for a DTLS certificate, using the P-384 curve which both DTLS providers support.
+func GenerateCertificateKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+}
+
+// LoadCertificateKey loads an unencrypted PEM encoded PKCS #8, EC or PKCS #1 private key from the supplied file.
+func LoadCertificateKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		var key interface{}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("the private key type is not supported")
+		}
+		return signer, nil
+	}
+	return nil, errors.New("no PEM encoded private key found")
+}
+
+// SaveCertificateKey writes the key to the supplied file as a PEM encoded PKCS #8 private key, which is only readable by its owner.
+func SaveCertificateKey(file string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// PublicKeysEqual returns whether or not the supplied public keys are the same.
+func PublicKeysEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	return ok && key.Equal(b)
+}
+
+// RenewalDue returns whether or not the certificate has passed two thirds of its lifetime at the supplied time, and so should be renewed.
+func RenewalDue(cert *x509.Certificate, now time.Time) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return !now.Before(cert.NotBefore.Add(lifetime * 2 / 3))
+}
+
+// WriteFileAtomic writes the data to a temporary file and swaps it in, so that a crash never leaves a truncated file behind and readers never see a partially written one.
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(path.Dir(file), path.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -6,6 +6,7 @@ package common
 import (
 	"encoding/binary"
 	"net"
+	"syscall"
 )
 
 const (
@@ -31,11 +32,17 @@ const (
 	// HeaderSize - The size of the data perpended tp the real packet.
 	HeaderSize = IPLength
 
-	// OverflowSize - An extra buffer for overflow of the MTU for plugins and other things to use incase its necessary.
+	// OverflowSize - An extra buffer at the end of the packet buffers for plugins and other things to use incase its necessary.
 	OverflowSize = 35
 
-	// MTU - The max size packet to receive from the TUN device.
-	MTU = MaxPacketLength - HeaderSize - OverflowSize
+	// MaxMTU - The max size packet to receive from the TUN device when no plugins are enabled, the actual MTU leaves room for the enabled plugins and is stored in Config.MTU.
+	MaxMTU = MaxPacketLength - HeaderSize
+
+	// MinMTU - The smallest MTU the TUN device is allowed to have, which is the minimum MTU ipv6 requires.
+	MinMTU = 1280
+
+	// MaxBufferLength - The size of the buffers packets are processed in, which leaves room to encapsulate a full sized packet for a relay node.
+	MaxBufferLength = MaxPacketLength + RelayHeaderSize + OverflowSize
 )
 
 // IPtoInt takes an ipv4 net.IP and returns a uint32 that represents it.
@@ -84,3 +91,56 @@ func StringInSlice(a string, slice []string) bool {
 	}
 	return false
 }
+
+// NewSockaddr returns the syscall.Sockaddr representation of the supplied ip address and port.
+func NewSockaddr(ip net.IP, port int) syscall.Sockaddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return sa
+	}
+
+	sa := &syscall.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	return sa
+}
+
+// ParseSockaddr returns the ip address and port represented by the supplied syscall.Sockaddr, ipv4 mapped ipv6 addresses are returned in their 4 byte form.
+func ParseSockaddr(sa syscall.Sockaddr) (net.IP, int) {
+	switch addr := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(append([]byte{}, addr.Addr[:]...)), addr.Port
+	case *syscall.SockaddrInet6:
+		ip := net.IP(append([]byte{}, addr.Addr[:]...))
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, addr.Port
+		}
+		return ip, addr.Port
+	}
+	return nil, 0
+}
+
+// SockaddrEquals returns true if both syscall.Sockaddr objects represent the same ip address and port.
+func SockaddrEquals(a, b syscall.Sockaddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	aAddr, aPort := sockaddrKey(a)
+	bAddr, bPort := sockaddrKey(b)
+	return aPort == bPort && aAddr == bAddr
+}
+
+// sockaddrKey returns the ipv6 form of the address and the port of the supplied syscall.Sockaddr without allocating, since it is used on the packet path.
+func sockaddrKey(sa syscall.Sockaddr) ([net.IPv6len]byte, int) {
+	var addr [net.IPv6len]byte
+	switch sockaddr := sa.(type) {
+	case *syscall.SockaddrInet4:
+		addr[10], addr[11] = 0xff, 0xff
+		copy(addr[12:], sockaddr.Addr[:])
+		return addr, sockaddr.Port
+	case *syscall.SockaddrInet6:
+		return sockaddr.Addr, sockaddr.Port
+	}
+	return addr, -1
+}
@@ -4,13 +4,25 @@
 package common
 
 import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"net/url"
 	"os"
+	"path"
 	"runtime"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/supernomad/quantum/crypto"
 )
 
 const (
@@ -129,6 +141,57 @@ func TestIPtoInt(t *testing.T) {
 	}
 }
 
+func TestSockaddr(t *testing.T) {
+	v4 := NewSockaddr(net.ParseIP("1.2.3.4"), 1099)
+	if _, ok := v4.(*syscall.SockaddrInet4); !ok {
+		t.Fatal("NewSockaddr did not return an ipv4 sockaddr for an ipv4 address.")
+	}
+
+	mapped := &syscall.SockaddrInet6{Port: 1099}
+	copy(mapped.Addr[:], net.ParseIP("1.2.3.4").To16())
+
+	ip, port := ParseSockaddr(mapped)
+	if len(ip) != net.IPv4len || !ip.Equal(net.ParseIP("1.2.3.4")) || port != 1099 {
+		t.Fatalf("ParseSockaddr did not return the right value, got: %s %d", ip, port)
+	}
+
+	if !SockaddrEquals(v4, mapped) || SockaddrEquals(v4, NewSockaddr(net.ParseIP("dead::beef"), 1099)) || SockaddrEquals(v4, nil) {
+		t.Fatal("SockaddrEquals did not compare the sockaddrs correctly.")
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	buf := make([]byte, MaxEndpointSize)
+	for _, expected := range []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("dead::beef")} {
+		n := PutEndpoint(buf, expected, 40000)
+
+		ip, port, ok := Endpoint(buf[:n])
+		if !ok || !ip.Equal(expected) || port != 40000 {
+			t.Fatalf("Endpoint did not return the right value, got: %s %d, expected: %s", ip, port, expected)
+		}
+	}
+
+	if _, _, ok := Endpoint(buf[:3]); ok {
+		t.Fatal("Endpoint returned a truncated endpoint.")
+	}
+}
+
+func TestFrame(t *testing.T) {
+	packet := make([]byte, FrameHeaderSize+EthernetHeaderSize+20)
+	packet[0] = FrameMarker
+	copy(packet[FrameStart:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01})
+
+	if !IsFrame(packet) || IsControl(packet) || IsFrame(packet[:EthernetHeaderSize]) {
+		t.Fatal("IsFrame didn't tell a frame apart from the other packets.")
+	}
+	if !IsMulticastMAC(DestinationMAC(packet)) || IsMulticastMAC(SourceMAC(packet)) {
+		t.Fatal("IsMulticastMAC didn't tell a broadcast mac address apart from a unicast one.")
+	}
+	if MACtoInt(SourceMAC(packet)) != 0x020000000001 || SourceMAC(packet).String() != "02:00:00:00:00:01" {
+		t.Fatal("SourceMAC didn't return the source mac address of the frame.")
+	}
+}
+
 func TestIncrementIP(t *testing.T) {
 	expected := net.ParseIP("10.0.0.1")
 
@@ -148,7 +211,7 @@ func testYamlConfig(t *testing.T, args []string) {
 	os.Setenv("QUANTUM_FLOATING_IPS", "10.99.1.1,10.99.1.2,hello")
 	os.Setenv("_QUANTUM_REAL_DEVICE_NAME_", "quantum0")
 
-	os.Args = append(args, "-n", "100", "--datastore-prefix", "woot", "--datastore-tls-skip-verify", "-6", "fd00:dead:beef::2", "--network", "", "--network-backend", "", "--network-lease-time", "0")
+	os.Args = append(args, "-n", "100", "--datastore-prefix", "woot", "--datastore-tls-skip-verify", "-6", "fd00:dead:beef::2", "--network", "", "--network-backend", "", "--network-lease-time", "0", "--plugin-options", "mock.level=3,mock.mode=fast")
 	cfg, err := NewConfig(NewLogger(NoopLogger))
 	if err != nil {
 		t.Fatalf("NewConfig returned an error, %s", err)
@@ -177,6 +240,12 @@ func testYamlConfig(t *testing.T, args []string) {
 	if len(cfg.Plugins) != 2 {
 		t.Fatal("NewConfig didn't pick up file replacement for Plugins")
 	}
+	if cfg.PluginOption("mock", "name", "") != "yaml" || cfg.PluginOption("mock", "level", "") != "3" || cfg.PluginOption("mock", "mode", "") != "fast" || cfg.PluginOption("mock", "missing", "default") != "default" {
+		t.Fatal("NewConfig didn't merge the plugin options into the plugin configuration sections of the file")
+	}
+	if cfg.DeviceType != TAPDeviceType || len(cfg.HardwareAddr) != MACLength || cfg.HardwareAddr[0] != 0x02 || NewMapping(cfg).MAC != cfg.HardwareAddr.String() {
+		t.Fatal("NewConfig didn't pick up the file replacement for DeviceType, or didn't derive a locally administered mac address for the TAP device")
+	}
 	if len(cfg.FloatingIPs) != 2 {
 		t.Fatal("NewConfig didn't pick up environment variable replacement for FloatingIPs")
 	}
@@ -228,6 +297,12 @@ func testJSONConfig(t *testing.T, args []string) {
 	if len(cfg.Plugins) != 1 || cfg.Plugins[0] != "compression" {
 		t.Fatal("NewConfig didn't pick up file replacement for Plugins")
 	}
+	if cfg.PluginOption("mock", "name", "") != "json" {
+		t.Fatal("NewConfig didn't pick up the plugin configuration sections of the file")
+	}
+	if cfg.DeviceType != TUNDeviceType || cfg.DeviceOffloads || cfg.HardwareAddr != nil || NewMapping(cfg).MAC != "" {
+		t.Fatal("NewConfig didn't default to a TUN device without a mac address")
+	}
 
 	// Reset os.Args
 	os.Args = args
@@ -377,6 +452,23 @@ func TestNewMapping(t *testing.T) {
 	}
 }
 
+func TestMappingCodecs(t *testing.T) {
+	cfg := &Config{
+		PrivateIP:         net.ParseIP("10.99.0.1"),
+		Plugins:           []string{"encryption"},
+		CompressionCodecs: []string{"lz4", "snappy"},
+	}
+	if mapping := NewMapping(cfg); mapping.HasCodecs() || len(mapping.SupportedPlugins) != 1 {
+		t.Fatal("NewMapping advertised compression codecs without the compression plugin.")
+	}
+
+	cfg.Plugins = append(cfg.Plugins, "compression")
+	mapping := NewMapping(cfg)
+	if !mapping.HasCodecs() || strings.Join(mapping.SupportedPlugins, ",") != "encryption,compression,compression:lz4,compression:snappy" || len(cfg.Plugins) != 2 {
+		t.Fatal("NewMapping did not advertise the compression codecs alongside the plugins.")
+	}
+}
+
 func TestParseMapping(t *testing.T) {
 	cfg := &Config{
 		PrivateIP:     net.ParseIP("0.0.0.0"),
@@ -386,8 +478,7 @@ func TestParseMapping(t *testing.T) {
 		IsIPv6Enabled: true,
 		ListenPort:    80,
 		MachineID:     "123456",
-		PublicKey:     []byte("AES256Key-32Characters1234567890"),
-		PublicSalt:    []byte("AES256Salt32Characters1234567890"),
+		Keys:          NewKeyring(NewKey(0)),
 	}
 
 	expected := NewMapping(cfg)
@@ -398,6 +489,15 @@ func TestParseMapping(t *testing.T) {
 	if !testEq(actual.IPv4, expected.IPv4) || actual.Port != expected.Port || !testEq(actual.PrivateIP, expected.PrivateIP) {
 		t.Fatalf("ParseMapping did not return the right value, got: %v, expected: %v", actual, expected)
 	}
+	if len(actual.Candidates) != 2 || !SockaddrEquals(actual.Candidates[0], NewSockaddr(cfg.PublicIPv6, 80)) || !SockaddrEquals(actual.Candidates[1], NewSockaddr(cfg.PublicIPv4, 80)) || actual.Address != "dead::beef" {
+		t.Fatalf("ParseMapping did not keep both address families in order of preference, got: %v", actual.Candidates)
+	}
+	if _, ok := actual.Cipher(cfg.Keys.Sending(), actual.KeyID); !ok {
+		t.Fatal("ParseMapping did not return a mapping able to derive the shared cipher.")
+	}
+	if _, ok := actual.Cipher(cfg.Keys.Sending(), actual.KeyID+1); ok {
+		t.Fatal("Cipher derived a shared cipher for a key id that was never published.")
+	}
 
 	cfg.IsIPv6Enabled = false
 	expected = NewMapping(cfg)
@@ -409,6 +509,19 @@ func TestParseMapping(t *testing.T) {
 		t.Fatalf("ParseMapping did not return the right value, got: %v, expected: %v", actual, expected)
 	}
 
+	cfg.SetReflexive(net.ParseIP("2.2.2.2"), 40000)
+	expected = NewMapping(cfg)
+	actual, err = ParseMapping(expected.String(), cfg)
+	if err != nil {
+		t.Fatalf("Error occurred during test: %s", err)
+	}
+	if len(actual.Candidates) != 2 || !SockaddrEquals(actual.Candidates[0], actual.Sockaddr) || !SockaddrEquals(actual.Candidates[1], NewSockaddr(net.ParseIP("2.2.2.2"), 40000)) {
+		t.Fatalf("ParseMapping did not return the right candidates, got: %v", actual.Candidates)
+	}
+	if via := actual.Via(actual.Candidates[1]); via.Address != "2.2.2.2" || via.Port != 40000 || actual.Port != 80 {
+		t.Fatalf("Via did not return the right value, got: %v", via)
+	}
+
 	cfg.IsIPv4Enabled = false
 	expected = NewMapping(cfg)
 	actual, err = ParseMapping(expected.String(), cfg)
@@ -417,6 +530,281 @@ func TestParseMapping(t *testing.T) {
 	}
 }
 
+func TestKeyring(t *testing.T) {
+	keys := NewKeyring(NewKey(0))
+	now := time.Now()
+	first := keys.Current()
+
+	if keys.Expired(now, time.Hour, 100) {
+		t.Fatal("Expired reported a fresh key as expired.")
+	}
+	keys.Used(100)
+	if !keys.Expired(now, time.Hour, 100) {
+		t.Fatal("Expired did not report a key that encrypted too much data as expired.")
+	}
+	if !keys.Expired(now.Add(time.Hour), time.Hour, 0) {
+		t.Fatal("Expired did not report an old key as expired.")
+	}
+
+	second := keys.Rotate(now)
+	if second.ID != first.ID+1 || keys.Current() != second || keys.Previous() != first {
+		t.Fatal("Rotate did not replace the current key.")
+	}
+	if keys.Sending() != first {
+		t.Fatal("Sending did not keep using the previous key during the grace period.")
+	}
+	if key, ok := keys.Get(first.ID); !ok || key != first {
+		t.Fatal("Get did not return the previous key during the grace period.")
+	}
+	if keys.Expired(now.Add(2*time.Hour), time.Hour, 100) {
+		t.Fatal("Expired reported the keys as expired before they settled.")
+	}
+
+	if keys.Settle(now.Add(time.Second), time.Minute) {
+		t.Fatal("Settle dropped the previous key before the grace period passed.")
+	}
+	if !keys.Settle(now.Add(time.Minute), time.Minute) || keys.Sending() != second || keys.Previous() != nil {
+		t.Fatal("Settle did not switch to the current key after the grace period.")
+	}
+	if _, ok := keys.Get(first.ID); ok {
+		t.Fatal("Get returned a key that was retired.")
+	}
+	if keys.Expired(now.Add(time.Minute), 0, 100) {
+		t.Fatal("Settle did not reset the volume encrypted with the current key.")
+	}
+
+	mapping := &Mapping{}
+	mapping.setKeys(&Config{Keys: keys})
+	keys.Rotate(now)
+	rotated := &Mapping{}
+	rotated.setKeys(&Config{Keys: keys})
+	if _, _, ok := mapping.Key(second.ID); !ok || rotated.KeyID != second.ID+1 || !testEq(rotated.PreviousPublicKey, second.PublicKey) {
+		t.Fatal("Mappings did not publish the current and previous keys.")
+	}
+}
+
+func TestKeyringCiphers(t *testing.T) {
+	local, remote := NewKey(0), NewKey(0)
+	localKeys, remoteKeys := NewKeyring(local), NewKeyring(remote)
+
+	ciphers, err := localKeys.Ciphers(local, remote.PublicKey, remote.PublicSalt, HKDFCryptoVersion, crypto.AESCipher, crypto.AESCipher)
+	if err != nil {
+		t.Fatalf("Ciphers returned an error: %s", err)
+	}
+	if ciphers.Outgoing == ciphers.Incoming {
+		t.Fatal("Ciphers did not derive a separate AES object per direction.")
+	}
+	if cached, _ := localKeys.Ciphers(local, remote.PublicKey, remote.PublicSalt, HKDFCryptoVersion, crypto.AESCipher, crypto.AESCipher); cached != ciphers {
+		t.Fatal("Ciphers did not cache the AES objects by public key.")
+	}
+
+	remoteCiphers, _ := remoteKeys.Ciphers(remote, local.PublicKey, local.PublicSalt, HKDFCryptoVersion, crypto.AESCipher, crypto.AESCipher)
+	buf := make([]byte, 64)
+	copy(buf, "some packet data")
+	length, _ := ciphers.Outgoing.Encrypt(buf, 16, nil)
+	if _, _, err := remoteCiphers.Incoming.Decrypt(buf[:length], nil); err != nil {
+		t.Fatal("The outgoing AES object of one node did not match the incoming AES object of the other.")
+	}
+	length, _ = ciphers.Outgoing.Encrypt(buf, 16, nil)
+	if _, _, err := remoteCiphers.Outgoing.Decrypt(buf[:length], nil); err == nil {
+		t.Fatal("The AES objects for both directions used the same key.")
+	}
+
+	legacy, _ := localKeys.Ciphers(local, remote.PublicKey, remote.PublicSalt, LegacyCryptoVersion, crypto.AESCipher, crypto.AESCipher)
+	if legacy.Outgoing != legacy.Incoming || legacy == ciphers {
+		t.Fatal("Ciphers did not derive a single shared AES object for the legacy version.")
+	}
+
+	localKeys.Prune(time.Now().Add(time.Minute))
+	if pruned, _ := localKeys.Ciphers(local, remote.PublicKey, remote.PublicSalt, HKDFCryptoVersion, crypto.AESCipher, crypto.AESCipher); pruned == ciphers {
+		t.Fatal("Prune did not drop unused AES objects.")
+	}
+
+	cfg := &Config{PublicIPv4: net.ParseIP("1.1.1.1"), IsIPv4Enabled: true, Keys: localKeys}
+	mapping := NewMapping(&Config{PublicIPv4: net.ParseIP("1.1.1.2"), Keys: remoteKeys})
+	mapping.CryptoVersion = 0
+	parsed, err := ParseMapping(mapping.String(), cfg)
+	if err != nil {
+		t.Fatalf("ParseMapping returned an error: %s", err)
+	}
+	if c, ok := parsed.Cipher(local, remote.ID); !ok || c.Outgoing != c.Incoming {
+		t.Fatal("ParseMapping did not fall back to the legacy version for a mapping without one.")
+	}
+
+	cfg.Ciphers = []string{crypto.AESCipher, crypto.ChaChaCipher}
+	mapping = NewMapping(&Config{PublicIPv4: net.ParseIP("1.1.1.2"), Keys: remoteKeys, Ciphers: []string{crypto.ChaChaCipher, crypto.AESCipher}})
+	parsed, _ = ParseMapping(mapping.String(), cfg)
+	if outgoing, incoming := parsed.CipherSuites(); outgoing != crypto.ChaChaCipher || incoming != crypto.AESCipher {
+		t.Fatal("ParseMapping did not pick the cipher preferred by the receiving node for each direction.")
+	}
+	c, _ := parsed.Cipher(local, remote.ID)
+	if _, ok := c.Outgoing.(*crypto.ChaCha20); !ok {
+		t.Fatal("Cipher did not use the negotiated cipher.")
+	}
+
+	psk := crypto.DeriveKey([]byte("pre-shared key"), nil, nil)
+	localKeys.SetPSK(psk)
+	pskCiphers, _ := localKeys.Ciphers(local, remote.PublicKey, remote.PublicSalt, HKDFCryptoVersion, crypto.AESCipher, crypto.AESCipher)
+	length, _ = remoteCiphers.Outgoing.Encrypt(buf, 16, nil)
+	if _, _, err := pskCiphers.Incoming.Decrypt(buf[:length], nil); err == nil {
+		t.Fatal("The pre-shared key was not mixed into the derived keys.")
+	}
+	remoteKeys.SetPSK(psk)
+	remoteCiphers, _ = remoteKeys.Ciphers(remote, local.PublicKey, local.PublicSalt, HKDFCryptoVersion, crypto.AESCipher, crypto.AESCipher)
+	length, _ = remoteCiphers.Outgoing.Encrypt(buf, 16, nil)
+	if _, _, err := pskCiphers.Incoming.Decrypt(buf[:length], nil); err != nil {
+		t.Fatal("Nodes holding the same pre-shared key did not derive the same keys.")
+	}
+	localKeys.SetPSK(nil)
+	remoteKeys.SetPSK(nil)
+
+	cfg.NetworkConfig = &NetworkConfig{Cipher: crypto.ChaChaCipher}
+	parsed, _ = ParseMapping(mapping.String(), cfg)
+	if outgoing, incoming := parsed.CipherSuites(); outgoing != crypto.ChaChaCipher || incoming != crypto.ChaChaCipher {
+		t.Fatal("ParseMapping did not use the cipher set for the whole network.")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	localKeys, remoteKeys := NewKeyring(NewKey(0)), NewKeyring(NewKey(0))
+	local := NewSessions(localKeys, time.Minute)
+	remote := NewSessions(remoteKeys, time.Minute)
+
+	localMapping := NewMapping(&Config{PrivateIP: net.ParseIP("10.99.0.1"), Keys: localKeys})
+	remoteMapping := NewMapping(&Config{PrivateIP: net.ParseIP("10.99.0.2"), Keys: remoteKeys})
+	localIP, remoteIP := IPtoInt(localMapping.PrivateIP), IPtoInt(remoteMapping.PrivateIP)
+
+	if _, ok := local.Sending(remoteIP); ok {
+		t.Fatal("Sending returned a session before any handshake.")
+	}
+	if ip := <-local.Requests(); ip != remoteIP {
+		t.Fatal("Sending did not request a handshake.")
+	}
+
+	now := time.Now()
+	init, ok := local.Initiate(now, remoteMapping)
+	if !ok || len(init) != HandshakeInitSize {
+		t.Fatal("Initiate did not start a handshake.")
+	}
+	if _, ok := local.Initiate(now, remoteMapping); ok {
+		t.Fatal("Initiate did not rate limit handshakes.")
+	}
+
+	if _, err := remote.Respond(now, remoteMapping, init); err == nil {
+		t.Fatal("Respond accepted a handshake authenticated with a key that doesn't belong to the sender.")
+	}
+	response, err := remote.Respond(now, localMapping, init)
+	if err != nil || len(response) != HandshakeResponseSize {
+		t.Fatalf("Respond failed to answer a handshake: %v", err)
+	}
+	if _, err := remote.Respond(now, localMapping, init); err == nil {
+		t.Fatal("Respond accepted a replayed handshake init.")
+	}
+
+	if err := local.Complete(now, remoteMapping, response); err != nil {
+		t.Fatalf("Complete failed to finish the handshake: %s", err)
+	}
+
+	sending, ok := local.Sending(remoteIP)
+	if !ok {
+		t.Fatal("Sending did not return the established session.")
+	}
+	receiving, ok := remote.Receiving(localIP, sending.Remote)
+	if !ok {
+		t.Fatal("Receiving did not return the session the initiator tags packets with.")
+	}
+	if _, ok := remote.Receiving(remoteIP, sending.Remote); ok {
+		t.Fatal("Receiving returned a session for the wrong remote node.")
+	}
+
+	buf := make([]byte, 64)
+	length, _ := sending.Outgoing.Encrypt(buf, 16, nil)
+	if _, _, err := receiving.Incoming.Decrypt(buf[:length], nil); err != nil {
+		t.Fatal("The session keys of both nodes did not match.")
+	}
+
+	if _, ok := remote.Sending(localIP); !ok {
+		t.Fatal("Sending did not fall back to an unconfirmed session.")
+	}
+	remote.Confirm(receiving)
+	if session, ok := remote.Sending(localIP); !ok || session != receiving {
+		t.Fatal("Confirm did not promote the session for sending.")
+	}
+
+	remote.Prune(now.Add(sessionLifetimes * time.Minute))
+	if _, ok := remote.Receiving(localIP, sending.Remote); ok {
+		t.Fatal("Prune did not drop an expired session.")
+	}
+	if _, err := remote.Respond(now, localMapping, init); err == nil {
+		t.Fatal("Respond accepted a replayed handshake init once the sessions were pruned.")
+	}
+}
+
+func TestOpenKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quantum")
+	if err != nil {
+		t.Fatalf("Unable to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, KeysFile)
+
+	keys, err := OpenKeyring(file, false)
+	if err != nil {
+		t.Fatalf("OpenKeyring returned an error for a missing key file: %s", err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("OpenKeyring did not persist the generated keys readable only by the owner.")
+	}
+
+	keys.Rotate(time.Now())
+	if err := keys.Save(); err != nil {
+		t.Fatalf("Save returned an error: %s", err)
+	}
+
+	reopened, err := OpenKeyring(file, false)
+	if err != nil {
+		t.Fatalf("OpenKeyring returned an error for an existing key file: %s", err)
+	}
+	if !testEq(reopened.Current().PrivateKey, keys.Current().PrivateKey) || reopened.Previous() == nil || !testEq(reopened.Previous().PrivateKey, keys.Previous().PrivateKey) {
+		t.Fatal("OpenKeyring did not reuse the persisted keys.")
+	}
+	if reopened.counter <= keys.counter {
+		t.Fatal("OpenKeyring did not persist a new high-water mark for the packet counters.")
+	}
+
+	regenerated, err := OpenKeyring(file, true)
+	if err != nil {
+		t.Fatalf("OpenKeyring returned an error when regenerating keys: %s", err)
+	}
+	if testEq(regenerated.Current().PrivateKey, keys.Current().PrivateKey) || regenerated.Current().ID != keys.Current().ID+1 || regenerated.Previous() != nil {
+		t.Fatal("OpenKeyring did not regenerate the keys.")
+	}
+
+	os.Chmod(file, 0644)
+	if _, err := OpenKeyring(file, false); err == nil {
+		t.Fatal("OpenKeyring accepted a key file readable by other users.")
+	}
+
+	pskFile := path.Join(dir, "psk")
+	ioutil.WriteFile(pskFile, []byte("a pre-shared key that is long enough\n"), 0600)
+	psk, err := LoadPSK(pskFile)
+	if err != nil || len(psk) != 32 {
+		t.Fatalf("LoadPSK failed to load a pre-shared key: %v", err)
+	}
+	if again, _ := LoadPSK(pskFile); !testEq(psk, again) {
+		t.Fatal("LoadPSK did not deterministically stretch the pre-shared key.")
+	}
+
+	ioutil.WriteFile(pskFile, []byte("too short"), 0600)
+	if _, err := LoadPSK(pskFile); err == nil {
+		t.Fatal("LoadPSK accepted a short pre-shared key.")
+	}
+	os.Chmod(pskFile, 0644)
+	if _, err := LoadPSK(pskFile); err == nil {
+		t.Fatal("LoadPSK accepted a pre-shared key file readable by other users.")
+	}
+}
+
 func TestParseNetworkConfig(t *testing.T) {
 	defaultLeaseTime, _ := time.ParseDuration("48h")
 	DefaultNetworkConfig := &NetworkConfig{
@@ -666,12 +1054,25 @@ func TestGenerateFloatingMapping(t *testing.T) {
 	}
 }
 
+type testReloader struct {
+	reloads int
+}
+
+func (reloader *testReloader) Reload() error {
+	reloader.reloads++
+	return errors.New("test reload error")
+}
+
 func TestSignaler(t *testing.T) {
 	log := NewLogger(NoopLogger)
 	cfg, err := NewConfig(log)
 	signaler := NewSignaler(log, cfg, []int{1}, map[string]string{"QUANTUM_TESTING": "woot"})
 
+	reloader := &testReloader{}
+	signaler.AddReloader(reloader)
+
 	go func() {
+		signaler.signals <- syscall.SIGUSR1
 		signaler.signals <- syscall.SIGHUP
 		signaler.signals <- syscall.SIGINT
 	}()
@@ -680,8 +1081,185 @@ func TestSignaler(t *testing.T) {
 	if err != nil {
 		t.Fatal("Wait returned an error: " + err.Error())
 	}
+	if reloader.reloads != 1 {
+		t.Fatalf("Wait called the reloader %d times on a refresh signal, instead of once.", reloader.reloads)
+	}
 	err = signaler.Wait(false)
 	if err != nil {
 		t.Fatal("Wait returned an error: " + err.Error())
 	}
 }
+
+func TestRevocations(t *testing.T) {
+	var missing *Revocations
+	if missing.Revoked("1") {
+		t.Fatal("A nil revocation set revoked a certificate.")
+	}
+
+	revocations := NewRevocations()
+	revocations.Set([]string{"0A:1B", "ff", "not-a-serial"})
+	if revocations.Len() != 2 || !revocations.Revoked("a1b") || !revocations.Revoked("ff") || revocations.Revoked("1") {
+		t.Fatal("Set did not normalize the revoked serial numbers.")
+	}
+
+	revocations.Set(nil)
+	if revocations.Revoked("ff") {
+		t.Fatal("Set did not replace the revoked serial numbers.")
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	machine, _ := url.Parse("quantum://0123456789abcdef")
+	cert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "192.168.1.1"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}
+
+	identity := NewPeerIdentity(cert)
+	if identity.MachineID != "" || len(identity.IPs) != 2 {
+		t.Fatal("NewPeerIdentity did not pick up the addresses of the certificate.")
+	}
+	if !identity.Matches(&Mapping{IPv4: net.ParseIP("192.168.1.1")}) || !identity.Matches(&Mapping{ReflexiveIP: net.ParseIP("10.0.0.1")}) || identity.Matches(&Mapping{IPv4: net.ParseIP("10.0.0.2")}) {
+		t.Fatal("Matches did not compare the addresses of the certificate with the public addresses of the mapping.")
+	}
+
+	cert.URIs = append(cert.URIs, machine)
+	identity = NewPeerIdentity(cert)
+	if identity.MachineID != "0123456789abcdef" || identity.String() != "quantum://0123456789abcdef" {
+		t.Fatal("NewPeerIdentity did not pick up the machine id of the certificate.")
+	}
+	if !identity.Matches(&Mapping{MachineID: "0123456789abcdef"}) || identity.Matches(&Mapping{MachineID: "other", IPv4: net.ParseIP("10.0.0.1")}) {
+		t.Fatal("Matches did not bind a certificate carrying a machine id to that machine.")
+	}
+
+	var missing *PeerIdentity
+	if !missing.Matches(&Mapping{}) {
+		t.Fatal("A nil identity did not match.")
+	}
+}
+
+func writeTestAuthority(t *testing.T, dir string) (string, string) {
+	key, err := GenerateCertificateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "quantum test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := path.Join(dir, "ca.crt"), path.Join(dir, "ca.key")
+	if err := WriteFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveCertificateKey(keyFile, key); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quantum-authority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestAuthority(t, dir)
+	if _, err := LoadAuthority(keyFile, keyFile); err == nil {
+		t.Fatal("LoadAuthority accepted a missing certificate.")
+	}
+
+	authority, err := LoadAuthority(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("SaveCertificateKey did not restrict the permissions of the key file.")
+	}
+
+	key, err := GenerateCertificateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM, err := NewCSR(key, "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := ParseCSR(csrPEM)
+	if err != nil || !PublicKeysEqual(csr.PublicKey, key.Public()) {
+		t.Fatal("ParseCSR did not return the key of the certificate signing request.")
+	}
+	if _, err := ParseCSR(authority.Certificate()); err == nil {
+		t.Fatal("ParseCSR accepted a certificate.")
+	}
+
+	now := time.Now()
+	certPEM, err := authority.Issue("0123456789abcdef", csr.PublicKey, now, 3*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := authority.Verify(certPEM, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NewPeerIdentity(cert).MachineID != "0123456789abcdef" || !PublicKeysEqual(cert.PublicKey, key.Public()) {
+		t.Fatal("Issue did not bind the certificate to the machine id and key.")
+	}
+	if _, err := authority.Verify(certPEM, now.Add(4*time.Hour)); err == nil {
+		t.Fatal("Verify accepted an expired certificate.")
+	}
+
+	long, err := authority.Issue("0123456789abcdef", csr.PublicKey, now, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, _ := ParseCertificatePEM(long); cert.NotAfter.After(now.Add(24 * time.Hour)) {
+		t.Fatal("Issue did not limit the certificate to the lifetime of the certificate authority.")
+	}
+
+	if RenewalDue(cert, now) || !RenewalDue(cert, now.Add(2*time.Hour)) {
+		t.Fatal("RenewalDue did not renew the certificate after two thirds of its lifetime.")
+	}
+
+	saved := path.Join(dir, "key.pem")
+	if err := SaveCertificateKey(saved, key); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCertificateKey(saved)
+	if err != nil || !PublicKeysEqual(loaded.Public(), key.Public()) {
+		t.Fatal("LoadCertificateKey did not load the saved key.")
+	}
+}
+
+func TestCertificateRequest(t *testing.T) {
+	request := &CertificateRequest{MachineID: "0123456789abcdef", CSR: []byte("csr"), Token: "token"}
+	parsed, err := ParseCertificateRequest(request.String())
+	if err != nil || parsed.MachineID != request.MachineID || string(parsed.CSR) != "csr" || parsed.Token != "token" || parsed.Certificate != nil {
+		t.Fatal("ParseCertificateRequest did not return the original request.")
+	}
+
+	issued := &IssuedCertificate{Certificate: []byte("cert"), CA: []byte("ca")}
+	parsedIssued, err := ParseIssuedCertificate(issued.String())
+	if err != nil || string(parsedIssued.Certificate) != "cert" || string(parsedIssued.CA) != "ca" {
+		t.Fatal("ParseIssuedCertificate did not return the original certificate.")
+	}
+
+	if _, err := ParseCertificateRequest("{"); err == nil {
+		t.Fatal("ParseCertificateRequest accepted invalid json.")
+	}
+}
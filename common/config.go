@@ -5,9 +5,11 @@ package common
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -16,6 +18,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -34,6 +37,22 @@ const (
 	defaultLeaseTime   time.Duration = 48 * time.Hour
 )
 
+const (
+	// OpenSSLDTLSProvider selects the openssl based implementation of the DTLS backend, which requires cgo.
+	OpenSSLDTLSProvider = "openssl"
+
+	// GoDTLSProvider selects the pure go implementation of the DTLS backend.
+	GoDTLSProvider = "go"
+)
+
+const (
+	// TUNDeviceType selects a TUN device, which carries ip packets between the nodes.
+	TUNDeviceType = "tun"
+
+	// TAPDeviceType selects a TAP device, which carries ethernet frames between the nodes in order to stretch a layer 2 segment across them.
+	TAPDeviceType = "tap"
+)
+
 var (
 	googleV4   = net.ParseIP("8.8.8.8")
 	googleV6   = net.ParseIP("2001:4860:4860::8888")
@@ -57,6 +76,8 @@ The only exceptions to the above are the two special cli argments '-h'|'--help'
 type Config struct {
 	ConfFile                 string                 `internal:"false"  type:"string"    short:"c"    long:"conf-file"                   default:""                      description:"The configuration file to use to configure quantum."`
 	DeviceName               string                 `internal:"false"  type:"string"    short:"i"    long:"device-name"                 default:"quantum%d"             description:"The name to give the TUN device quantum uses, append '%d' to have auto incrementing names."`
+	DeviceType               string                 `internal:"false"  type:"string"    short:"dt"   long:"device-type"                 default:"tun"                   description:"The type of device quantum uses, either 'tun' to carry ip packets or 'tap' to carry ethernet frames. Every node in a quantum network must use the same type."`
+	DeviceOffloads           bool                   `internal:"false"  type:"bool"      short:"do"   long:"device-offloads"             default:"false"                 description:"Whether or not to open the TUN device with IFF_VNET_HDR and enable the TSO/USO offloads, so that quantum reads large super packets to split for the underlay and merges received tcp segments before writing them to the device."`
 	NumWorkers               int                    `internal:"false"  type:"int"       short:"n"    long:"workers"                     default:"0"                     description:"The number of quantum workers to use, set to 0 for a worker per available cpu core."`
 	PrivateIP                net.IP                 `internal:"false"  type:"ip"        short:"ip"   long:"private-ip"                  default:""                      description:"The private ip address to assign this quantum instance."`
 	ListenIP                 net.IP                 `internal:"false"  type:"ip"        short:"lip"  long:"listen-ip"                   default:""                      description:"The local server ip to listen on, leave blank of automatic association."`
@@ -69,6 +90,9 @@ type Config struct {
 	DataDir                  string                 `internal:"false"  type:"string"    short:"d"    long:"data-dir"                    default:"/var/lib/quantum"      description:"The directory to store local quantum state to."`
 	PidFile                  string                 `internal:"false"  type:"string"    short:"pf"   long:"pid-file"                    default:"/var/run/quantum.pid"  description:"The pid file to use for tracking rolling restarts."`
 	Plugins                  []string               `internal:"false"  type:"list"      short:"x"    long:"plugins"                     default:""                      description:"The plugins supported by this node."`
+	PluginOptions            []string               `internal:"false"  type:"list"      short:"po"   long:"plugin-options"              default:""                      description:"A comma delimited list of plugin specific options in 'plugin.key=value' syntax, which override the options set in the 'plugin-config' section of the configuration file."`
+	CompressionCodecs        []string               `internal:"false"  type:"list"      short:"cc"   long:"compression-codecs"          default:"snappy"                description:"A comma delimited list of the codecs the compression plugin negotiates in order of preference, any of 'snappy', 'lz4' and 'zstd'. Packets are compressed with the first codec the receiving node supports as well."`
+	CompressionAdaptive      bool                   `internal:"false"  type:"bool"      short:"ca"   long:"compression-adaptive"        default:"true"                  description:"Whether or not the compression plugin sends packets uncompressed when compressing them would not make them smaller, for instance already compressed or encrypted traffic."`
 	DatastorePrefix          string                 `internal:"false"  type:"string"    short:"pr"   long:"datastore-prefix"            default:"quantum"               description:"The prefix to store quantum configuration data under in the key/value datastore."`
 	DatastoreSyncInterval    time.Duration          `internal:"false"  type:"duration"  short:"si"   long:"datastore-sync-interval"     default:"60s"                   description:"The interval of full datastore syncs."`
 	DatastoreRefreshInterval time.Duration          `internal:"false"  type:"duration"  short:"ri"   long:"datastore-refresh-interval"  default:"120s"                  description:"The interval of dhcp lease refreshes with the datastore."`
@@ -84,6 +108,13 @@ type Config struct {
 	DTLSCA                   string                 `internal:"false"  type:"string"    short:"dtca" long:"dtls-ca-cert"                default:""                      description:"The DTLS CA certificate to authenticate the DTLS certificates when using the DTLS backend."`
 	DTLSCert                 string                 `internal:"false"  type:"string"    short:"dtc"  long:"dtls-cert"                   default:""                      description:"The DTLS client certificate to use to authenticate when using the DTLS backend."`
 	DTLSKey                  string                 `internal:"false"  type:"string"    short:"dtk"  long:"dtls-key"                    default:""                      description:"The DTLS client key to use to authenticate when using the DTLS backend."`
+	DTLSCRL                  []string               `internal:"false"  type:"list"      short:"dtcr" long:"dtls-crl-files"              default:""                      description:"A comma delimited list of CRL files, signed by the DTLS CA, listing the DTLS certificates to reject when using the DTLS backend. Like the certificate, key and CA files they are reloaded when they change."`
+	DTLSProvider             string                 `internal:"false"  type:"string"    short:"dtp"  long:"dtls-provider"               default:"openssl"               description:"The DTLS implementation to use with the DTLS backend, either 'openssl' or 'go'. Both interoperate, so nodes can be switched over one at a time."`
+	DTLSIdleTimeout          time.Duration          `internal:"false"  type:"duration"  short:"dtit" long:"dtls-idle-timeout"           default:"5m"                    description:"The length of time a DTLS session can go unused before it is closed, set to 0 to keep idle sessions open."`
+	DTLSMaxSessions          int                    `internal:"false"  type:"int"       short:"dtms" long:"dtls-max-sessions"           default:"1024"                  description:"The maximum number of incoming and of outgoing DTLS sessions held by each queue, the least recently used session is closed to make room for new ones. Set to 0 for no limit."`
+	DTLSCAKey                string                 `internal:"false"  type:"string"    short:"dtck" long:"dtls-ca-key"                 default:""                      description:"The unencrypted key of the DTLS CA certificate. Setting it makes this node a signer of the built-in certificate authority, which issues DTLS certificates to the nodes enrolling through the datastore and to itself."`
+	DTLSJoinToken            string                 `internal:"false"  type:"string"    short:"dtjt" long:"dtls-join-token"             default:""                      description:"A one-time join token stored in the datastore, which this node uses to enroll with the built-in certificate authority when it doesn't hold a valid DTLS certificate. Enrolled nodes renew their certificate before it expires."`
+	DTLSCertTTL              time.Duration          `internal:"false"  type:"duration"  short:"dtct" long:"dtls-cert-ttl"               default:"24h"                   description:"The lifetime of the DTLS certificates issued by the built-in certificate authority, which are renewed once two thirds of it have passed."`
 	StatsRoute               string                 `internal:"false"  type:"string"    short:"sr"   long:"stats-route"                 default:"/stats"                description:"The api route to serve statistics data from."`
 	StatsAddress             string                 `internal:"false"  type:"string"    short:"sa"   long:"stats-address"               default:"0.0.0.0"               description:"The api server address."`
 	StatsPort                int                    `internal:"false"  type:"int"       short:"sp"   long:"stats-port"                  default:"1099"                  description:"The api server port."`
@@ -92,24 +123,152 @@ type Config struct {
 	NetworkFloatingRange     string                 `internal:"false"  type:"string"    short:"nfr"  long:"network-floating-range"      default:"10.99.2.0/23"          description:"The reserved subnet, in CIDR notation, within the network to use for floating ip address assignments."`
 	NetworkBackend           string                 `internal:"false"  type:"string"    short:"nb"   long:"network-backend"             default:"udp"                   description:"The network backend to set in the datastore, if nothing already exists in the network configuration."`
 	NetworkLeaseTime         time.Duration          `internal:"false"  type:"duration"  short:"nlt"  long:"network-lease-time"          default:"48h"                   description:"The lease time for DHCP assigned addresses within the quantum cluster."`
-	PublicKey                []byte                 `internal:"true"` // The public key to use with the encryption plugin.
-	PrivateKey               []byte                 `internal:"true"` // The private key to use with the encryption plugin.
-	PublicSalt               []byte                 `internal:"true"` // The public salt to use with the encryption plugin.
-	PrivateSalt              []byte                 `internal:"true"` // The private salt to use with the encryption plugin.
+	NetworkCipher            string                 `internal:"false"  type:"string"    short:"ncph" long:"network-cipher"              default:""                      description:"The cipher every node in the quantum cluster uses with the encryption plugin, set in the datastore if nothing already exists in the network configuration. Leave blank to negotiate ciphers per node."`
+	KeepaliveInterval        time.Duration          `internal:"false"  type:"duration"  short:"ki"   long:"keepalive-interval"          default:"10s"                   description:"The interval between keepalive probes sent to each remote peer, set to 0 to disable probing."`
+	KeepaliveTimeout         time.Duration          `internal:"false"  type:"duration"  short:"kt"   long:"keepalive-timeout"           default:"30s"                   description:"The length of time without hearing from a remote peer before it is considered down."`
+	PeersRoute               string                 `internal:"false"  type:"string"    short:"psr"  long:"peers-route"                 default:"/peers"                description:"The api route to serve peer liveness data from."`
+	Relay                    bool                   `internal:"false"  type:"bool"      short:"rl"   long:"relay"                       default:"false"                 description:"Whether or not to relay traffic between remote nodes that are unable to reach each other directly."`
+	DisableRelays            bool                   `internal:"false"  type:"bool"      short:"drl"  long:"disable-relays"              default:"false"                 description:"Whether or not to stop sending traffic through relay nodes to remote nodes that are unreachable directly. Relaying takes room off of the device MTU, which this gives back."`
+	DisableNATTraversal      bool                   `internal:"false"  type:"bool"      short:"dnat" long:"disable-nat-traversal"       default:"false"                 description:"Whether or not to disable reflexive endpoint discovery and hole punching. Use this if you know the server isn't behind a NAT."`
+	RekeyInterval            time.Duration          `internal:"false"  type:"duration"  short:"rki"  long:"rekey-interval"              default:"24h"                   description:"The length of time a key pair is used by the encryption plugin before it is rotated, set to 0 to disable time based rekeying."`
+	RekeyVolume              int                    `internal:"false"  type:"int"       short:"rkv"  long:"rekey-volume"                default:"1099511627776"         description:"The number of bytes encrypted with a key pair by the encryption plugin before it is rotated, set to 0 to disable volume based rekeying."`
+	RekeyGracePeriod         time.Duration          `internal:"false"  type:"duration"  short:"rkg"  long:"rekey-grace-period"          default:"180s"                  description:"The length of time the previous key pair stays in use after a rotation, which should be long enough for the new key pair to reach every node."`
+	RegenerateKeys           bool                   `internal:"false"  type:"bool"      short:"rgk"  long:"regenerate-keys"             default:"false"                 description:"Whether or not to discard the encryption key pair persisted in the data directory and generate a new one on start, which is ignored during rolling restarts."`
+	PSKFile                  string                 `internal:"false"  type:"string"    short:"psk"  long:"psk-file"                    default:""                      description:"The file containing the pre-shared key of the quantum network, which is mixed into the keys used by the encryption plugin so that only nodes holding it can take part. Leave blank to not use a pre-shared key."`
+	HandshakeInterval        time.Duration          `internal:"false"  type:"duration"  short:"hsi"  long:"handshake-interval"          default:"120s"                  description:"The length of time a session established through a handshake is used by the encryption plugin before the next handshake, set to 0 to disable handshakes and only use the published key pairs."`
+	Ciphers                  []string               `internal:"false"  type:"list"      short:"cph"  long:"ciphers"                     default:"aes-256-gcm,chacha20-poly1305" description:"The ciphers supported by this node for the encryption plugin in order of preference, remote nodes encrypt the packets they send to this node with the first one they also support."`
+	Keys                     *Keyring               `internal:"true"` // The keys to use with the encryption plugin.
+	Sessions                 *Sessions              `internal:"true"` // The sessions established through handshakes to use with the encryption plugin.
+	Revocations              *Revocations           `internal:"true"` // The serial numbers of the DTLS certificates revoked through the datastore.
 	Salt                     []byte                 `internal:"true"` // The salt to use with the encryption plugin.
+	Capabilities             []string               `internal:"true"` // The optional protocol features supported by this node
+	reflexive                atomic.Value           `internal:"true"` // The public ip address and port of this node as observed by remote nodes when they differ due to NAT, which are read and replaced together
+	MTU                      int                    `internal:"true"` // The max size packet to receive from the TUN device, which leaves room for the enabled plugins to grow it
 	RealDeviceName           string                 `internal:"true"` // Used when a rolling restart is triggered to find the correct tun interface
 	ReuseFDS                 bool                   `internal:"true"` // Used when a rolling restart is triggered which forces quantum to reuse the passed in socket/tun fds
 	MachineID                string                 `internal:"true"` // The generated machine id for this node
+	HardwareAddr             net.HardwareAddr       `internal:"true"` // The mac address of the TAP device derived from the machine id, which is only set when using a TAP device
 	AuthEnabled              bool                   `internal:"true"` // Whether or not datastore authentication is enabled (toggled by setting username/password)
 	TLSEnabled               bool                   `internal:"true"` // Whether or not tls with the datastore is enabled (toggled by setting the tls parameters at run time)
 	IsIPv4Enabled            bool                   `internal:"true"` // Whether or not quantum has determined that this node is ipv4 capable
 	IsIPv6Enabled            bool                   `internal:"true"` // Whether or not quantum has determined that this node is ipv6 capable
-	ListenAddr               syscall.Sockaddr       `internal:"true"` // The commputed Sockaddr object to bind the underlying udp sockets to
+	ListenAddrs              []syscall.Sockaddr     `internal:"true"` // The computed Sockaddr objects to bind the underlying udp sockets to, one per enabled address family
 	NetworkConfig            *NetworkConfig         `internal:"true"` // The network config detemined by existence of the object in etcd
 	Log                      *Logger                `internal:"true"` // The internal Logger to use
+	PluginConfig             PluginSections         `internal:"true"` // The configuration sections of the plugins keyed by plugin name, built from the configuration file and the plugin options
 	fileData                 map[string]interface{} `internal:"true"` // An internal map of data representing a passed in configuration file
 }
 
+// reflexiveEndpoint is the public ip address and port of this node as observed by remote nodes.
+type reflexiveEndpoint struct {
+	ip   net.IP
+	port int
+}
+
+// Reflexive returns the public ip address and port of this node as observed by remote nodes, the ip address is nil unless they differ due to NAT.
+func (cfg *Config) Reflexive() (net.IP, int) {
+	if endpoint, ok := cfg.reflexive.Load().(*reflexiveEndpoint); ok {
+		return endpoint.ip, endpoint.port
+	}
+	return nil, 0
+}
+
+// SetReflexive replaces the reflexive endpoint of this node, which is cleared by passing a nil ip address.
+func (cfg *Config) SetReflexive(ip net.IP, port int) {
+	cfg.reflexive.Store(&reflexiveEndpoint{ip: ip, port: port})
+}
+
+// mac returns the mac address published in the mappings of this node, which is empty unless it uses a TAP device.
+func (cfg *Config) mac() string {
+	if cfg.HardwareAddr == nil {
+		return ""
+	}
+	return cfg.HardwareAddr.String()
+}
+
+// supportedPlugins returns the plugins advertised in the mappings of this node, which are the enabled plugins followed by the compression codecs it negotiates when compression is enabled.
+func (cfg *Config) supportedPlugins() []string {
+	if !StringInSlice("compression", cfg.Plugins) || len(cfg.CompressionCodecs) == 0 {
+		return cfg.Plugins
+	}
+
+	plugins := make([]string, 0, len(cfg.Plugins)+len(cfg.CompressionCodecs))
+	plugins = append(plugins, cfg.Plugins...)
+	for i := 0; i < len(cfg.CompressionCodecs); i++ {
+		plugins = append(plugins, CompressionCodecPrefix+cfg.CompressionCodecs[i])
+	}
+	return plugins
+}
+
+// PluginSections holds the configuration sections of the plugins, keyed by plugin name and then by option.
+type PluginSections map[string]map[string]string
+
+// PluginOption returns the value of the option within the configuration section of the plugin, or the supplied default if it isn't set.
+func (cfg *Config) PluginOption(plugin, key, def string) string {
+	if value, ok := cfg.PluginConfig[plugin][key]; ok {
+		return value
+	}
+	return def
+}
+
+// stringMap converts a section of a json or yaml configuration file to a map keyed by string.
+func stringMap(section interface{}) (map[string]interface{}, bool) {
+	switch v := section.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		output := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			str, ok := key.(string)
+			if !ok {
+				return nil, false
+			}
+			output[str] = value
+		}
+		return output, true
+	}
+	return nil, false
+}
+
+// parsePluginConfig builds the configuration sections of the plugins from the 'plugin-config' section of the configuration file, overridden by the plugin options.
+func (cfg *Config) parsePluginConfig() error {
+	cfg.PluginConfig = make(PluginSections)
+	set := func(plugin, key, value string) {
+		if cfg.PluginConfig[plugin] == nil {
+			cfg.PluginConfig[plugin] = make(map[string]string)
+		}
+		cfg.PluginConfig[plugin][key] = value
+	}
+
+	if section, ok := cfg.fileData["plugin-config"]; ok {
+		plugins, ok := stringMap(section)
+		if !ok {
+			return errors.New("error parsing value for 'plugin-config', expected a map of plugin names to maps of options")
+		}
+
+		for plugin, options := range plugins {
+			values, ok := stringMap(options)
+			if !ok {
+				return errors.New("error parsing value for 'plugin-config', expected a map of options for the '" + plugin + "' plugin")
+			}
+
+			for key, value := range values {
+				set(plugin, key, fmt.Sprint(value))
+			}
+		}
+	}
+
+	for i := 0; i < len(cfg.PluginOptions); i++ {
+		option := cfg.PluginOptions[i]
+		dot, equals := strings.Index(option, "."), strings.Index(option, "=")
+		if dot < 1 || equals < dot+2 {
+			return errors.New("error parsing value for 'plugin-options' got, '" + option + "', expected 'plugin.key=value'")
+		}
+		set(option[:dot], option[dot+1:equals], option[equals+1:])
+	}
+	return nil
+}
+
 func (cfg *Config) cliArg(short, long string, isFlag bool) (string, bool) {
 	for i, arg := range os.Args {
 		if arg == "-"+short ||
@@ -350,19 +509,93 @@ func (cfg *Config) computeArgs() error {
 	}
 	cfg.MachineID = hex.EncodeToString(machineID)
 
+	switch cfg.DeviceType {
+	case TUNDeviceType:
+	case TAPDeviceType:
+		// A locally administered unicast address, which stays the same across restarts since the machine id does.
+		hash := sha256.Sum256(machineID)
+		cfg.HardwareAddr = net.HardwareAddr{0x02, hash[0], hash[1], hash[2], hash[3], hash[4]}
+	default:
+		return errors.New("the device type '" + cfg.DeviceType + "' is not supported, expected either 'tun' or 'tap'")
+	}
+
+	if cfg.DeviceOffloads && cfg.DeviceType != TUNDeviceType {
+		return errors.New("device offloads are only supported by TUN devices")
+	}
+
 	cfg.RealDeviceName = os.Getenv(RealDeviceNameEnv)
 	if cfg.RealDeviceName != "" {
 		cfg.ReuseFDS = true
 	}
 
+	cfg.Capabilities = []string{KeepaliveCapability}
+	if !cfg.DisableNATTraversal {
+		cfg.Capabilities = append(cfg.Capabilities, NATTraversalCapability)
+	}
+	if cfg.Relay {
+		cfg.Capabilities = append(cfg.Capabilities, RelayCapability)
+	}
+
 	if StringInSlice("encryption", cfg.Plugins) {
-		pub, priv := crypto.GenerateECKeyPair()
-		pubSalt, privSalt := crypto.GenerateECKeyPair()
+		// Rolling restarts re-exec with the same arguments, so only regenerate the keys on a fresh start.
+		keys, err := OpenKeyring(path.Join(cfg.DataDir, KeysFile), cfg.RegenerateKeys && !cfg.ReuseFDS)
+		if err != nil {
+			return errors.New("error loading the encryption keys: " + err.Error())
+		}
+		cfg.Keys = keys
 
-		cfg.PublicKey = pub
-		cfg.PrivateKey = priv
-		cfg.PublicSalt = pubSalt
-		cfg.PrivateSalt = privSalt
+		if cfg.PSKFile != "" {
+			psk, err := LoadPSK(cfg.PSKFile)
+			if err != nil {
+				return errors.New("error loading the pre-shared key: " + err.Error())
+			}
+			keys.SetPSK(psk)
+		}
+
+		for i := 0; i < len(cfg.Ciphers); i++ {
+			if !StringInSlice(cfg.Ciphers[i], crypto.SupportedCiphers) {
+				return errors.New("the cipher '" + cfg.Ciphers[i] + "' is not supported")
+			}
+		}
+
+		if cfg.HandshakeInterval > 0 {
+			cfg.Sessions = NewSessions(keys, cfg.HandshakeInterval)
+			cfg.Capabilities = append(cfg.Capabilities, HandshakeCapability)
+		}
+	}
+
+	if cfg.DTLSProvider != OpenSSLDTLSProvider && cfg.DTLSProvider != GoDTLSProvider {
+		return errors.New("the DTLS provider '" + cfg.DTLSProvider + "' is not supported")
+	}
+
+	if cfg.DTLSMaxSessions < 0 {
+		return errors.New("the maximum number of DTLS sessions can't be negative")
+	}
+
+	cfg.Revocations = NewRevocations()
+
+	if err := cfg.parsePluginConfig(); err != nil {
+		return err
+	}
+
+	if cfg.DTLSCAKey != "" || cfg.DTLSJoinToken != "" {
+		if cfg.DTLSCertTTL <= 0 {
+			return errors.New("the lifetime of the DTLS certificates issued by the built-in certificate authority must be positive")
+		}
+		if cfg.DTLSCAKey != "" && cfg.DTLSCA == "" {
+			return errors.New("the built-in certificate authority needs the DTLS CA certificate matching its key")
+		}
+
+		// Enrolled nodes keep the credentials they are issued in the data directory, unless told otherwise.
+		if cfg.DTLSCA == "" {
+			cfg.DTLSCA = path.Join(cfg.DataDir, EnrolledCAFile)
+		}
+		if cfg.DTLSCert == "" {
+			cfg.DTLSCert = path.Join(cfg.DataDir, EnrolledCertFile)
+		}
+		if cfg.DTLSKey == "" {
+			cfg.DTLSKey = path.Join(cfg.DataDir, EnrolledKeyFile)
+		}
 	}
 
 	DefaultNetworkConfig := &NetworkConfig{
@@ -371,6 +604,11 @@ func (cfg *Config) computeArgs() error {
 		StaticRange:   cfg.NetworkStaticRange,
 		FloatingRange: cfg.NetworkFloatingRange,
 		LeaseTime:     cfg.NetworkLeaseTime,
+		Cipher:        cfg.NetworkCipher,
+	}
+
+	if DefaultNetworkConfig.Cipher != "" && !StringInSlice(DefaultNetworkConfig.Cipher, crypto.SupportedCiphers) {
+		return errors.New("the network cipher '" + DefaultNetworkConfig.Cipher + "' is not supported")
 	}
 
 	if DefaultNetworkConfig.Backend == "" {
@@ -459,28 +697,28 @@ func (cfg *Config) computeArgs() error {
 	}
 
 	if cfg.ListenIP == nil {
-		switch {
-		case cfg.IsIPv4Enabled && cfg.IsIPv6Enabled:
-			fallthrough
-		case cfg.IsIPv6Enabled:
+		cfg.ListenAddrs = nil
+		if cfg.IsIPv6Enabled {
 			sa := &syscall.SockaddrInet6{Port: cfg.ListenPort}
 			copy(sa.Addr[:], allV6.To16()[:])
-			cfg.ListenAddr = sa
-		case cfg.IsIPv4Enabled:
+			cfg.ListenAddrs = append(cfg.ListenAddrs, sa)
+		}
+		if cfg.IsIPv4Enabled {
 			sa := &syscall.SockaddrInet4{Port: cfg.ListenPort}
 			copy(sa.Addr[:], allV4.To4()[:])
-			cfg.ListenAddr = sa
-		default:
+			cfg.ListenAddrs = append(cfg.ListenAddrs, sa)
+		}
+		if cfg.ListenAddrs == nil {
 			return errors.New("an impossible situation occurred, neither ipv4 or ipv6 is available, check your networking configuration you must have public internet access to use automatic configuration")
 		}
 	} else if addr := cfg.ListenIP.To4(); addr != nil {
 		sa := &syscall.SockaddrInet4{Port: cfg.ListenPort}
 		copy(sa.Addr[:], addr[:])
-		cfg.ListenAddr = sa
+		cfg.ListenAddrs = []syscall.Sockaddr{sa}
 	} else if addr := cfg.ListenIP.To16(); addr != nil {
 		sa := &syscall.SockaddrInet6{Port: cfg.ListenPort}
 		copy(sa.Addr[:], addr[:])
-		cfg.ListenAddr = sa
+		cfg.ListenAddrs = []syscall.Sockaddr{sa}
 	} else {
 		return errors.New("an impossible situation occurred, neither ipv4 or ipv6 is available, check your networking configuration you must have public internet access to use automatic configuration")
 	}
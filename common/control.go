@@ -0,0 +1,135 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	// ControlTypeStart - The control type position within a control packet.
+	ControlTypeStart = 0
+
+	// ControlBodyStart - The control body start position within a control packet.
+	ControlBodyStart = 1
+
+	// ControlHeaderSize - The size of the data prepended to the control body.
+	ControlHeaderSize = 1
+
+	// TimestampSize - The size of a timestamp written by PutTimestamp.
+	TimestampSize = 8
+
+	// PingPathStart - The position of the probed path index within the body of a ping or pong control packet.
+	PingPathStart = TimestampSize
+
+	// PingBodySize - The size of the body of a ping control packet, which is echoed at the start of the matching pong control packet.
+	PingBodySize = TimestampSize + 1
+
+	// RelayHeaderSize - The size of the data prepended to a quantum packet in order to send it through a relay node.
+	RelayHeaderSize = HeaderSize + ControlHeaderSize + IPLength
+
+	// MaxEndpointSize - The maximum size of an endpoint written by PutEndpoint.
+	MaxEndpointSize = 1 + net.IPv6len + 2
+
+	// KeepaliveCapability is advertised by nodes that answer ping control packets with pong control packets.
+	KeepaliveCapability = "keepalive"
+
+	// RelayCapability is advertised by nodes that forward relay control packets to their destination.
+	RelayCapability = "relay"
+
+	// NATTraversalCapability is advertised by nodes that report observed endpoints in pong control packets, and punch holes towards the nodes requesting it via the datastore.
+	NATTraversalCapability = "nat-traversal"
+
+	// HandshakeCapability is advertised by nodes that establish sessions through handshake control packets, and encrypt traffic to other nodes advertising it with the resulting session keys.
+	HandshakeCapability = "handshake"
+)
+
+// ControlType represents the type of a control packet exchanged directly between quantum peers.
+//
+// Control types are always less than 16 which guarantees that the first nibble of a control packet is never a valid ip version.
+type ControlType byte
+
+const (
+	// PingControl is sent periodically to every remote peer in order to verify that it is reachable.
+	PingControl ControlType = iota + 1
+
+	// PongControl is sent in response to a PingControl packet, it echoes the ping body followed by the endpoint the ping was received from when it is known.
+	PongControl
+
+	// RelayControl carries a quantum packet destined for the node assigned the private ip address at the start of its body. Relay nodes forward it as is, so the inner packet is never decrypted along the way.
+	RelayControl
+
+	// HandshakeInitControl starts a handshake with the remote node, its body is the first handshake message.
+	HandshakeInitControl
+
+	// HandshakeResponseControl is sent in response to a HandshakeInitControl packet, its body is the second handshake message.
+	HandshakeResponseControl
+)
+
+// IsHandshake returns true if the supplied packet is a handshake control packet.
+func IsHandshake(packet []byte) bool {
+	if !IsControl(packet) {
+		return false
+	}
+
+	controlType := ControlType(packet[ControlTypeStart])
+	return controlType == HandshakeInitControl || controlType == HandshakeResponseControl
+}
+
+// IsControl returns true if the supplied packet is a control packet rather than an ip packet destined for the device.
+func IsControl(packet []byte) bool {
+	return len(packet) >= ControlHeaderSize && packet[ControlTypeStart]>>4 == 0 && packet[ControlTypeStart] != 0
+}
+
+// NewControlPayload is used to generate a payload that carries a control packet of bodyLength bytes, the body itself is left for the caller to fill in.
+func NewControlPayload(raw []byte, controlType ControlType, bodyLength int) *Payload {
+	raw[PacketStart+ControlTypeStart] = byte(controlType)
+	return NewTunPayload(raw, ControlHeaderSize+bodyLength)
+}
+
+// ControlBody returns the body of the supplied control packet.
+func ControlBody(packet []byte) []byte {
+	return packet[ControlBodyStart:]
+}
+
+// PutTimestamp writes the supplied time into the first 8 bytes of buf.
+func PutTimestamp(buf []byte, t time.Time) {
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+}
+
+// Timestamp reads a time from the first 8 bytes of buf as written by PutTimestamp.
+func Timestamp(buf []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+}
+
+// PutEndpoint writes the supplied ip address and port into buf, and returns the number of bytes written.
+func PutEndpoint(buf []byte, ip net.IP, port int) int {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()
+	}
+
+	buf[0] = byte(len(ip))
+	copy(buf[1:], ip)
+	binary.BigEndian.PutUint16(buf[1+len(ip):], uint16(port))
+	return 1 + len(ip) + 2
+}
+
+// Endpoint reads an ip address and port from buf as written by PutEndpoint, and returns false if buf does not contain a valid endpoint.
+func Endpoint(buf []byte) (net.IP, int, bool) {
+	if len(buf) < 1 {
+		return nil, 0, false
+	}
+
+	length := int(buf[0])
+	if (length != net.IPv4len && length != net.IPv6len) || len(buf) < 1+length+2 {
+		return nil, 0, false
+	}
+
+	ip := net.IP(append([]byte{}, buf[1:1+length]...))
+	return ip, int(binary.BigEndian.Uint16(buf[1+length:])), true
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"net"
+)
+
+const (
+	// FrameMarker - The first byte of a quantum packet carrying an ethernet frame read off of a TAP device.
+	//
+	// The first nibble of the marker is neither a control type nor a valid ip version, so frames are never mistaken for control packets or ip packets, whatever mac address they start with.
+	FrameMarker = 0xee
+
+	// FrameHeaderSize - The size of the data prepended to an ethernet frame.
+	FrameHeaderSize = 1
+
+	// FrameStart - The ethernet frame start position within a quantum packet carrying one.
+	FrameStart = FrameHeaderSize
+
+	// EthernetHeaderSize - The size of an ethernet header, which is the destination and source mac addresses followed by the ethertype.
+	EthernetHeaderSize = 2*MACLength + 2
+
+	// VLANTagSize - The size of an 802.1Q tag that an ethernet header may carry.
+	VLANTagSize = 4
+
+	// MACLength - The length of a mac address.
+	MACLength = 6
+
+	// TAPOverhead - The room the TAP device MTU leaves below the MTU of the TUN device, for the frame marker and a tagged ethernet header.
+	TAPOverhead = FrameHeaderSize + EthernetHeaderSize + VLANTagSize
+)
+
+// IsFrame returns true if the supplied packet carries an ethernet frame read off of a TAP device.
+func IsFrame(packet []byte) bool {
+	return len(packet) >= FrameHeaderSize+EthernetHeaderSize && packet[0] == FrameMarker
+}
+
+// DestinationMAC returns the destination mac address of the ethernet frame carried by the supplied packet.
+func DestinationMAC(packet []byte) net.HardwareAddr {
+	return net.HardwareAddr(packet[FrameStart : FrameStart+MACLength])
+}
+
+// SourceMAC returns the source mac address of the ethernet frame carried by the supplied packet.
+func SourceMAC(packet []byte) net.HardwareAddr {
+	return net.HardwareAddr(packet[FrameStart+MACLength : FrameStart+2*MACLength])
+}
+
+// IsMulticastMAC returns true if the supplied mac address is a broadcast or multicast address, which frames are flooded to every node for.
+func IsMulticastMAC(mac net.HardwareAddr) bool {
+	return len(mac) > 0 && mac[0]&0x01 == 0x01
+}
+
+// MACtoInt takes a mac address and returns a uint64 that represents it.
+func MACtoInt(mac net.HardwareAddr) uint64 {
+	var key uint64
+	for i := 0; i < len(mac) && i < MACLength; i++ {
+		key = key<<8 | uint64(mac[i])
+	}
+	return key
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"crypto/x509"
+	"net"
+)
+
+// MachineIDScheme is the scheme of the URI subject alternative name which binds a certificate to a machine id, for instance 'quantum://0123456789abcdef'.
+const MachineIDScheme = "quantum"
+
+// PeerIdentity represents who a remote node authenticated as, based on the certificate it presented.
+type PeerIdentity struct {
+	// The machine id the certificate was issued to, which is only set if the certificate carries one.
+	MachineID string
+
+	// The ip addresses the certificate was issued to, taken from its subject alternative names and its common name.
+	IPs []net.IP
+}
+
+// Matches returns whether or not the node represented by the mapping is the authenticated remote node, a nil PeerIdentity matches every mapping.
+//
+// A certificate carrying a machine id only matches the mappings of that machine, otherwise one of its ip addresses has to be a public address of the mapping.
+func (identity *PeerIdentity) Matches(mapping *Mapping) bool {
+	if identity == nil {
+		return true
+	}
+
+	if identity.MachineID != "" {
+		return identity.MachineID == mapping.MachineID
+	}
+
+	addresses := []net.IP{mapping.IPv4, mapping.IPv6, mapping.ReflexiveIP, net.ParseIP(mapping.Address)}
+	for i := 0; i < len(identity.IPs); i++ {
+		for j := 0; j < len(addresses); j++ {
+			if addresses[j] != nil && identity.IPs[i].Equal(addresses[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String returns a human readable representation of the PeerIdentity, for logging.
+func (identity *PeerIdentity) String() string {
+	if identity.MachineID != "" {
+		return MachineIDScheme + "://" + identity.MachineID
+	}
+
+	str := ""
+	for i := 0; i < len(identity.IPs); i++ {
+		if i > 0 {
+			str += ", "
+		}
+		str += identity.IPs[i].String()
+	}
+	return str
+}
+
+// NewPeerIdentity generates the PeerIdentity a remote node authenticated as by presenting the supplied certificate.
+func NewPeerIdentity(cert *x509.Certificate) *PeerIdentity {
+	identity := &PeerIdentity{}
+
+	for i := 0; i < len(cert.URIs); i++ {
+		if cert.URIs[i].Scheme == MachineIDScheme && cert.URIs[i].Host != "" {
+			identity.MachineID = cert.URIs[i].Host
+			break
+		}
+	}
+
+	identity.IPs = append(identity.IPs, cert.IPAddresses...)
+	if ip := net.ParseIP(cert.Subject.CommonName); ip != nil {
+		identity.IPs = append(identity.IPs, ip)
+	}
+	return identity
+}
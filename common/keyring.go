@@ -0,0 +1,425 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supernomad/quantum/crypto"
+)
+
+const (
+	// KeysFile is the name of the file within the data directory that the local keys are persisted to.
+	KeysFile = "keys"
+
+	keysFileMode os.FileMode = 0600
+	cryptoLabel              = "quantum packet key"
+	pskLabel                 = "quantum pre-shared key"
+
+	// MinPSKLength is the minimum length of the contents of a pre-shared key file.
+	MinPSKLength = 32
+
+	// LegacyCryptoVersion derives a single AES key shared by both directions with PBKDF2, and is assumed for remote nodes that don't advertise a version.
+	LegacyCryptoVersion uint8 = 1
+
+	// HKDFCryptoVersion derives a separate key per direction with HKDF, for the ciphers negotiated through the mappings.
+	HKDFCryptoVersion uint8 = 2
+
+	// CryptoVersion is the newest key derivation version supported by this node, the version used with a remote node is the lowest of the two nodes' versions.
+	CryptoVersion = HKDFCryptoVersion
+
+	// KeyIDSize is the length of the key id tag appended to encrypted packets, which holds the id of the sender's key followed by the id of the receiver's key.
+	KeyIDSize = 2
+)
+
+// Key represents a single generation of the key pair and salt used with the encryption plugin.
+type Key struct {
+	// The id used to tag packets encrypted with this key.
+	ID uint8 `json:"id"`
+
+	// The public key to publish to remote nodes.
+	PublicKey []byte `json:"publicKey"`
+
+	// The private key used to derive the secrets shared with remote nodes.
+	PrivateKey []byte `json:"privateKey"`
+
+	// The public salt to publish to remote nodes.
+	PublicSalt []byte `json:"publicSalt"`
+
+	// The private salt used to derive the salts shared with remote nodes.
+	PrivateSalt []byte `json:"privateSalt"`
+}
+
+// NewKey generates a new key pair and salt tagged with the supplied id.
+func NewKey(id uint8) *Key {
+	pub, priv := crypto.GenerateECKeyPair()
+	pubSalt, privSalt := crypto.GenerateECKeyPair()
+
+	return &Key{
+		ID:          id,
+		PublicKey:   pub,
+		PrivateKey:  priv,
+		PublicSalt:  pubSalt,
+		PrivateSalt: privSalt,
+	}
+}
+
+// Ciphers holds the cipher objects shared with a remote node for a single pair of keys.
+type Ciphers struct {
+	// Outgoing is used to encrypt packets sent to the remote node.
+	Outgoing crypto.Cipher
+
+	// Incoming is used to decrypt packets received from the remote node.
+	Incoming crypto.Cipher
+}
+
+type cachedCiphers struct {
+	ciphers *Ciphers
+	used    time.Time
+}
+
+// Keyring holds the local keys used with the encryption plugin, and handles rotating them.
+//
+// After a rotation the previous key stays in use for sending, and valid for receiving, until the keyring is settled at the end of the grace period. This gives the new key time to propagate to the remote nodes before anything depends on it.
+type Keyring struct {
+	// used must stay the first field to keep it 64bit aligned for atomic operations.
+	used     uint64
+	mux      sync.RWMutex
+	current  *Key
+	previous *Key
+	rotated  time.Time
+	counter  uint64
+	file     string
+	psk      []byte
+	cache    map[string]*cachedCiphers
+}
+
+type keyringState struct {
+	Current  *Key      `json:"current"`
+	Previous *Key      `json:"previous,omitempty"`
+	Rotated  time.Time `json:"rotated"`
+	Counter  uint64    `json:"counter,omitempty"`
+}
+
+// Current returns the most recently generated key, which is the one published to remote nodes.
+func (keys *Keyring) Current() *Key {
+	keys.mux.RLock()
+	defer keys.mux.RUnlock()
+
+	return keys.current
+}
+
+// Previous returns the key that was replaced by the last rotation, or nil if the keyring has settled since.
+func (keys *Keyring) Previous() *Key {
+	keys.mux.RLock()
+	defer keys.mux.RUnlock()
+
+	return keys.previous
+}
+
+// Sending returns the key to encrypt outgoing packets with.
+func (keys *Keyring) Sending() *Key {
+	keys.mux.RLock()
+	defer keys.mux.RUnlock()
+
+	if keys.previous != nil {
+		return keys.previous
+	}
+	return keys.current
+}
+
+// Get returns the key with the supplied id if it is still valid for decrypting incoming packets.
+func (keys *Keyring) Get(id uint8) (*Key, bool) {
+	keys.mux.RLock()
+	defer keys.mux.RUnlock()
+
+	switch {
+	case keys.current.ID == id:
+		return keys.current, true
+	case keys.previous != nil && keys.previous.ID == id:
+		return keys.previous, true
+	}
+	return nil, false
+}
+
+// PSK returns the pre-shared key of the quantum network, or nil if there is none.
+func (keys *Keyring) PSK() []byte {
+	keys.mux.RLock()
+	defer keys.mux.RUnlock()
+
+	return keys.psk
+}
+
+// SetPSK sets the pre-shared key of the quantum network, which is mixed into every secret shared with remote nodes from then on.
+func (keys *Keyring) SetPSK(psk []byte) {
+	keys.mux.Lock()
+	defer keys.mux.Unlock()
+
+	keys.psk = psk
+	keys.cache = nil
+}
+
+// Used records that length bytes were encrypted with the sending key.
+func (keys *Keyring) Used(length int) {
+	atomic.AddUint64(&keys.used, uint64(length))
+}
+
+// Expired returns whether or not the current key has been in use for longer than interval, or has encrypted more than volume bytes. Either limit is ignored when set to 0, and a key is never expired while the keyring has yet to settle.
+func (keys *Keyring) Expired(now time.Time, interval time.Duration, volume uint64) bool {
+	keys.mux.RLock()
+	defer keys.mux.RUnlock()
+
+	if keys.previous != nil {
+		return false
+	}
+
+	return (interval > 0 && now.Sub(keys.rotated) >= interval) ||
+		(volume > 0 && atomic.LoadUint64(&keys.used) >= volume)
+}
+
+// Rotate generates a new current key, and keeps the replaced key around until the keyring settles.
+func (keys *Keyring) Rotate(now time.Time) *Key {
+	keys.mux.Lock()
+	defer keys.mux.Unlock()
+
+	keys.previous = keys.current
+	keys.current = NewKey(keys.current.ID + 1)
+	keys.rotated = now
+	return keys.current
+}
+
+// Settle drops the previous key once the grace period after the last rotation has passed, returning whether or not it did so.
+func (keys *Keyring) Settle(now time.Time, grace time.Duration) bool {
+	keys.mux.Lock()
+	defer keys.mux.Unlock()
+
+	if keys.previous == nil || now.Sub(keys.rotated) < grace {
+		return false
+	}
+
+	keys.previous = nil
+	atomic.StoreUint64(&keys.used, 0)
+	return true
+}
+
+// Ciphers returns the cipher objects shared with the remote node owning the supplied public key and salt, derived from the supplied local key using the supplied version, and of the supplied outgoing and incoming types. The cipher objects are cached by the keys they were derived from, so that refreshed mappings reuse them instead of deriving them again.
+func (keys *Keyring) Ciphers(local *Key, publicKey, publicSalt []byte, version uint8, outgoing, incoming string) (*Ciphers, error) {
+	index := string([]byte{version}) + outgoing + "/" + incoming + "/" + string(local.PublicKey) + string(publicKey) + string(publicSalt)
+	now := time.Now()
+
+	keys.mux.Lock()
+	cached, ok := keys.cache[index]
+	if ok {
+		cached.used = now
+	}
+	keys.mux.Unlock()
+
+	if ok {
+		return cached.ciphers, nil
+	}
+
+	ciphers, err := deriveCiphers(local, publicKey, publicSalt, keys.PSK(), version, outgoing, incoming)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.mux.Lock()
+	defer keys.mux.Unlock()
+
+	if cached, ok := keys.cache[index]; ok {
+		return cached.ciphers, nil
+	}
+
+	if keys.cache == nil {
+		keys.cache = make(map[string]*cachedCiphers)
+	}
+	keys.cache[index] = &cachedCiphers{ciphers: ciphers, used: now}
+	return ciphers, nil
+}
+
+// Prune drops the cached cipher objects that haven't been asked for since before the supplied time.
+func (keys *Keyring) Prune(before time.Time) {
+	keys.mux.Lock()
+	defer keys.mux.Unlock()
+
+	for index, cached := range keys.cache {
+		if cached.used.Before(before) {
+			delete(keys.cache, index)
+		}
+	}
+}
+
+func deriveCiphers(local *Key, publicKey, publicSalt, psk []byte, version uint8, outgoing, incoming string) (*Ciphers, error) {
+	secret := crypto.GenerateSharedSecret(publicKey, local.PrivateKey)
+	salt := crypto.GenerateSharedSecret(publicSalt, local.PrivateSalt)
+
+	// Mixing in the pre-shared key means that a node without it can't derive the keys, even with a mapping the other nodes accept.
+	secret = append(secret, psk...)
+
+	// Nodes that only support the legacy version predate the choice of ciphers, and always use AES.
+	if version < HKDFCryptoVersion {
+		aes, err := crypto.NewAES(secret, salt)
+		if err != nil {
+			return nil, err
+		}
+		return &Ciphers{Outgoing: aes, Incoming: aes}, nil
+	}
+
+	// Bind each key to its direction by the order of the public keys, so that the outgoing key of one node is the incoming key of the other.
+	outgoingCipher, err := crypto.NewCipher(outgoing, crypto.DeriveKey(secret, salt, cryptoInfo(version, local.PublicKey, publicKey)))
+	if err != nil {
+		return nil, err
+	}
+
+	incomingCipher, err := crypto.NewCipher(incoming, crypto.DeriveKey(secret, salt, cryptoInfo(version, publicKey, local.PublicKey)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ciphers{Outgoing: outgoingCipher, Incoming: incomingCipher}, nil
+}
+
+func cryptoInfo(version uint8, sender, receiver []byte) []byte {
+	info := make([]byte, 0, len(cryptoLabel)+1+len(sender)+len(receiver))
+	info = append(info, cryptoLabel...)
+	info = append(info, version)
+	info = append(info, sender...)
+	return append(info, receiver...)
+}
+
+// Save persists the keys to the file the keyring was opened from, readable only by the owner. Keyrings that were not opened from a file are not persisted.
+func (keys *Keyring) Save() error {
+	if keys.file == "" {
+		return nil
+	}
+
+	keys.mux.RLock()
+	data, err := json.Marshal(&keyringState{
+		Current:  keys.current,
+		Previous: keys.previous,
+		Rotated:  keys.rotated,
+		Counter:  keys.counter,
+	})
+	keys.mux.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first and swap it in, so that a crash never leaves a truncated key file behind.
+	tmp, err := ioutil.TempFile(path.Dir(keys.file), path.Base(keys.file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(keysFileMode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), keys.file)
+}
+
+// OpenKeyring loads the keys persisted to the supplied file, or generates and persists new keys if the file doesn't exist or regenerate is true.
+//
+// Regenerated keys are given the id following the replaced key, so that packets still tagged for the replaced key are not mistaken for the new one.
+func OpenKeyring(file string, regenerate bool) (*Keyring, error) {
+	keys := &Keyring{file: file}
+
+	info, err := os.Stat(file)
+	switch {
+	case os.IsNotExist(err):
+		keys.current = NewKey(0)
+		keys.rotated = time.Now()
+		return keys, crypto.ReserveCounters(0, keys.reserveCounters)
+	case err != nil:
+		return nil, err
+	case info.Mode().Perm()&^keysFileMode != 0:
+		return nil, errors.New("the key file '" + file + "' is accessible by users other than its owner, its permissions should be " + keysFileMode.String())
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var state keyringState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.New("error parsing the key file '" + file + "': " + err.Error())
+	}
+	if state.Current == nil {
+		return nil, errors.New("the key file '" + file + "' does not contain a current key")
+	}
+
+	keys.current = state.Current
+	keys.previous = state.Previous
+	keys.rotated = state.Rotated
+
+	if regenerate {
+		keys.current = NewKey(state.Current.ID + 1)
+		keys.previous = nil
+		keys.rotated = time.Now()
+	}
+	return keys, crypto.ReserveCounters(state.Counter, keys.reserveCounters)
+}
+
+// reserveCounters persists the high-water mark of the packet counters along with the keys, which is done before any counter past the previous mark is used.
+func (keys *Keyring) reserveCounters(mark uint64) error {
+	keys.mux.Lock()
+	keys.counter = mark
+	keys.mux.Unlock()
+
+	return keys.Save()
+}
+
+// LoadPSK reads the pre-shared key of the quantum network from the supplied file, which must only be accessible by its owner, and stretches it into a 32 byte key.
+func LoadPSK(file string) ([]byte, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&^keysFileMode != 0 {
+		return nil, errors.New("the pre-shared key file '" + file + "' is accessible by users other than its owner, its permissions should be " + keysFileMode.String())
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) < MinPSKLength {
+		return nil, errors.New("the pre-shared key file '" + file + "' must contain at least " + strconv.Itoa(MinPSKLength) + " bytes")
+	}
+	return crypto.DeriveKey(data, nil, []byte(pskLabel)), nil
+}
+
+// NewKeyring generates a Keyring using the supplied key as the current key.
+func NewKeyring(key *Key) *Keyring {
+	return &Keyring{
+		current: key,
+		rotated: time.Now(),
+	}
+}
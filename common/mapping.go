@@ -7,11 +7,16 @@ import (
 	"encoding/json"
 	"errors"
 	"net"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/supernomad/quantum/crypto"
 )
 
+// CompressionCodecPrefix prefixes the compression codecs that a node advertises alongside its supported plugins, for instance 'compression:lz4'. Nodes advertising codecs tag each packet they compress with the codec used, nodes advertising none only exchange untagged snappy compressed packets.
+const CompressionCodecPrefix = "compression:"
+
 // Mapping represents the relationship between a public/private address along with encryption metadata for a particular node in the quantum network.
 type Mapping struct {
 	// The unique machine id within the quantum network.
@@ -20,6 +25,9 @@ type Mapping struct {
 	// The private ip address within the quantum network.
 	PrivateIP net.IP `json:"privateIP"`
 
+	// The mac address of the TAP device of the node represented by this mapping, which is only set for nodes using a TAP device.
+	MAC string `json:"mac,omitempty"`
+
 	// The port where quantum is listening for remote packets.
 	Port int `json:"port"`
 
@@ -32,23 +40,67 @@ type Mapping struct {
 	// The public ipv6 address of the node represented by this mapping, which may or may not exist.
 	IPv6 net.IP `json:"ipv6,omitempty"`
 
+	// The public ip address of the node represented by this mapping as observed by remote nodes, which is only set when it differs from the ipv4/ipv6 address due to NAT.
+	ReflexiveIP net.IP `json:"reflexiveIP,omitempty"`
+
+	// The public port of the node represented by this mapping as observed by remote nodes, which is only set alongside the reflexive ip address.
+	ReflexivePort int `json:"reflexivePort,omitempty"`
+
 	// The plugins that the node represented by this mapping supports.
 	SupportedPlugins []string `json:"plugins,omitempty"`
 
+	// The optional protocol features that the node represented by this mapping supports.
+	Capabilities []string `json:"capabilities,omitempty"`
+
 	// The public key to use with the encryption plugin.
 	PublicKey []byte `json:"publicKey,omitempty"`
 
 	// The salt to use with the encryption plugin.
 	PublicSalt []byte `json:"salt,omitempty"`
 
+	// The id of the public key and salt, which remote nodes tag their packets with.
+	KeyID uint8 `json:"keyID,omitempty"`
+
+	// The public key replaced by the last rotation, which is only set while it is still in use.
+	PreviousPublicKey []byte `json:"previousPublicKey,omitempty"`
+
+	// The salt replaced by the last rotation, which is only set while it is still in use.
+	PreviousPublicSalt []byte `json:"previousSalt,omitempty"`
+
+	// The id of the previous public key and salt.
+	PreviousKeyID uint8 `json:"previousKeyID,omitempty"`
+
+	// The ciphers supported by the node represented by this mapping in order of preference, which is unset for nodes that only support AES.
+	SupportedCiphers []string `json:"ciphers,omitempty"`
+
+	// The newest key derivation version supported by the node represented by this mapping, which is unset for nodes that only support LegacyCryptoVersion.
+	CryptoVersion uint8 `json:"cryptoVersion,omitempty"`
+
 	// The resulting endpoint to send data to the node represented by this mapping.
 	Sockaddr syscall.Sockaddr `json:"-"`
 
 	// The resulting endpoint to send data to the node represented by this mapping.
 	Address string `json:"-"`
 
-	// The AES object to use for encrypting packets to/from the node represented by this mapping.
-	AES *crypto.AES `json:"-"`
+	// The endpoints the node represented by this mapping may be reachable at, in order of preference.
+	Candidates []syscall.Sockaddr `json:"-"`
+
+	// The cipher objects to use for encrypting packets to/from the node represented by this mapping, keyed by the local and remote key ids. The cache is shared by copies returned from Via.
+	ciphers *cipherCache
+}
+
+type cipherCache struct {
+	mux      sync.RWMutex
+	keys     *Keyring
+	version  uint8
+	outgoing string
+	incoming string
+	entries  map[uint16]*cipherEntry
+}
+
+type cipherEntry struct {
+	local   *Key
+	ciphers *Ciphers
 }
 
 // Bytes returns a byte slice representation of a Mapping object, if there is an error while marshalling data a nil slice is returned.
@@ -62,38 +114,173 @@ func (mapping *Mapping) String() string {
 	return string(mapping.Bytes())
 }
 
+// HasCodecs returns true if the node represented by this mapping negotiates compression codecs, and so tags the packets it compresses with the codec used.
+func (mapping *Mapping) HasCodecs() bool {
+	for i := 0; i < len(mapping.SupportedPlugins); i++ {
+		if strings.HasPrefix(mapping.SupportedPlugins[i], CompressionCodecPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCapability returns true if the node represented by this mapping supports the supplied capability.
+func (mapping *Mapping) HasCapability(capability string) bool {
+	return StringInSlice(capability, mapping.Capabilities)
+}
+
+// Via returns a copy of the mapping which sends data to the node represented by this mapping using the supplied endpoint.
+func (mapping *Mapping) Via(sa syscall.Sockaddr) *Mapping {
+	via := *mapping
+	ip, port := ParseSockaddr(sa)
+
+	via.Sockaddr = sa
+	via.Address = ip.String()
+	via.Port = port
+	return &via
+}
+
+// Key returns the public key and salt of the node represented by this mapping with the supplied id, along with whether or not the key is published.
+func (mapping *Mapping) Key(id uint8) ([]byte, []byte, bool) {
+	switch {
+	case mapping.PublicKey != nil && mapping.KeyID == id:
+		return mapping.PublicKey, mapping.PublicSalt, true
+	case mapping.PreviousPublicKey != nil && mapping.PreviousKeyID == id:
+		return mapping.PreviousPublicKey, mapping.PreviousPublicSalt, true
+	}
+	return nil, nil, false
+}
+
+// Cipher returns the cipher objects shared with the node represented by this mapping, based on the supplied local key and the remote key with the supplied id. The cipher objects are looked up on first use and cached for the lifetime of the mapping.
+func (mapping *Mapping) Cipher(local *Key, id uint8) (*Ciphers, bool) {
+	if mapping.ciphers == nil {
+		return nil, false
+	}
+
+	index := uint16(local.ID)<<8 | uint16(id)
+
+	mapping.ciphers.mux.RLock()
+	entry, ok := mapping.ciphers.entries[index]
+	mapping.ciphers.mux.RUnlock()
+
+	if ok && entry.local == local {
+		return entry.ciphers, true
+	}
+
+	pub, pubSalt, ok := mapping.Key(id)
+	if !ok {
+		return nil, false
+	}
+
+	ciphers, err := mapping.ciphers.keys.Ciphers(local, pub, pubSalt, mapping.ciphers.version, mapping.ciphers.outgoing, mapping.ciphers.incoming)
+	if err != nil {
+		return nil, false
+	}
+
+	mapping.ciphers.mux.Lock()
+	mapping.ciphers.entries[index] = &cipherEntry{local: local, ciphers: ciphers}
+	mapping.ciphers.mux.Unlock()
+	return ciphers, true
+}
+
+// CipherSuites returns the names of the ciphers used for packets sent to, and received from, the node represented by this mapping.
+func (mapping *Mapping) CipherSuites() (string, string) {
+	if mapping.ciphers == nil {
+		return crypto.AESCipher, crypto.AESCipher
+	}
+	return mapping.ciphers.outgoing, mapping.ciphers.incoming
+}
+
+// selectCipher returns the cipher for packets sent by a node supporting the sender ciphers to a node supporting the receiver ciphers, which is the first of the receiver ciphers also supported by the sender. Both nodes agree on it without any exchange, and each node picks the cipher it decrypts with.
+func selectCipher(cfg *Config, receiver, sender []string) string {
+	if cfg.NetworkConfig != nil && cfg.NetworkConfig.Cipher != "" {
+		return cfg.NetworkConfig.Cipher
+	}
+
+	for i := 0; i < len(receiver); i++ {
+		if StringInSlice(receiver[i], sender) {
+			return receiver[i]
+		}
+	}
+	return crypto.AESCipher
+}
+
+func (mapping *Mapping) setKeys(cfg *Config) {
+	if cfg.Keys == nil {
+		return
+	}
+
+	current := cfg.Keys.Current()
+	mapping.CryptoVersion = CryptoVersion
+	mapping.SupportedCiphers = cfg.Ciphers
+	mapping.PublicKey = current.PublicKey
+	mapping.PublicSalt = current.PublicSalt
+	mapping.KeyID = current.ID
+
+	if previous := cfg.Keys.Previous(); previous != nil {
+		mapping.PreviousPublicKey = previous.PublicKey
+		mapping.PreviousPublicSalt = previous.PublicSalt
+		mapping.PreviousKeyID = previous.ID
+	}
+}
+
+func (mapping *Mapping) hasCandidate(sa syscall.Sockaddr) bool {
+	for i := 0; i < len(mapping.Candidates); i++ {
+		if SockaddrEquals(mapping.Candidates[i], sa) {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseMapping creates a new mapping based on the output of a Mapping.Bytes call.
 func ParseMapping(str string, cfg *Config) (*Mapping, error) {
 	data := []byte(str)
 	var mapping Mapping
 	json.Unmarshal(data, &mapping)
 
+	// Both address families are kept in order of preference, so that traffic can fail over to ipv4 when the ipv6 path to a node is broken.
 	if cfg.IsIPv6Enabled && mapping.IPv6 != nil {
-		sa := &syscall.SockaddrInet6{Port: mapping.Port}
-		copy(sa.Addr[:], mapping.IPv6.To16())
-
-		mapping.Sockaddr = sa
-		mapping.Address = mapping.IPv6.String()
-	} else if cfg.IsIPv4Enabled && mapping.IPv4 != nil {
-		sa := &syscall.SockaddrInet4{Port: mapping.Port}
-		copy(sa.Addr[:], mapping.IPv4.To4())
-
-		mapping.Sockaddr = sa
-		mapping.Address = mapping.IPv4.String()
-	} else {
+		mapping.Candidates = append(mapping.Candidates, NewSockaddr(mapping.IPv6, mapping.Port))
+	}
+	if cfg.IsIPv4Enabled && mapping.IPv4 != nil {
+		mapping.Candidates = append(mapping.Candidates, NewSockaddr(mapping.IPv4, mapping.Port))
+	}
+	if mapping.ReflexiveIP != nil {
+		isIPv4 := mapping.ReflexiveIP.To4() != nil
+		sa := NewSockaddr(mapping.ReflexiveIP, mapping.ReflexivePort)
+
+		if ((isIPv4 && cfg.IsIPv4Enabled) || (!isIPv4 && cfg.IsIPv6Enabled)) && !mapping.hasCandidate(sa) {
+			mapping.Candidates = append(mapping.Candidates, sa)
+		}
+	}
+
+	if len(mapping.Candidates) == 0 {
 		return nil, errors.New("mapping not compatible with this node due to networking conflicts: " + mapping.String())
 	}
 
-	if mapping.PublicKey != nil && mapping.PublicSalt != nil {
-		secret := crypto.GenerateSharedSecret(mapping.PublicKey, cfg.PrivateKey)
-		salt := crypto.GenerateSharedSecret(mapping.PublicSalt, cfg.PrivateSalt)
+	ip, _ := ParseSockaddr(mapping.Candidates[0])
+	mapping.Sockaddr = mapping.Candidates[0]
+	mapping.Address = ip.String()
+
+	if mapping.PublicKey != nil && mapping.PublicSalt != nil && cfg.Keys != nil {
+		version := mapping.CryptoVersion
+		if version < LegacyCryptoVersion {
+			version = LegacyCryptoVersion
+		} else if version > CryptoVersion {
+			version = CryptoVersion
+		}
 
-		aes, err := crypto.NewAES(secret, salt)
-		if err != nil {
-			return nil, err
+		mapping.ciphers = &cipherCache{
+			keys:     cfg.Keys,
+			version:  version,
+			outgoing: selectCipher(cfg, mapping.SupportedCiphers, cfg.Ciphers),
+			incoming: selectCipher(cfg, cfg.Ciphers, mapping.SupportedCiphers),
+			entries:  make(map[uint16]*cipherEntry),
 		}
 
-		mapping.AES = aes
+		// Look up the cipher objects used for sending up front, so that the first packet to the node doesn't pay for deriving them.
+		mapping.Cipher(cfg.Keys.Sending(), mapping.KeyID)
 	}
 
 	return &mapping, nil
@@ -101,30 +288,36 @@ func ParseMapping(str string, cfg *Config) (*Mapping, error) {
 
 // NewMapping generates a new basic Mapping with no cryptographic metadata.
 func NewMapping(cfg *Config) *Mapping {
-	return &Mapping{
+	reflexiveIP, reflexivePort := cfg.Reflexive()
+	mapping := &Mapping{
 		MachineID:        cfg.MachineID,
 		IPv4:             cfg.PublicIPv4,
 		IPv6:             cfg.PublicIPv6,
 		Port:             cfg.ListenPort,
+		ReflexiveIP:      reflexiveIP,
+		ReflexivePort:    reflexivePort,
 		PrivateIP:        cfg.PrivateIP,
-		SupportedPlugins: cfg.Plugins,
-		PublicKey:        cfg.PublicKey,
-		PublicSalt:       cfg.PublicSalt,
+		MAC:              cfg.mac(),
+		SupportedPlugins: cfg.supportedPlugins(),
+		Capabilities:     cfg.Capabilities,
 		Floating:         false,
 	}
+	mapping.setKeys(cfg)
+	return mapping
 }
 
 // NewFloatingMapping generates a new basic Mapping with no cryptographic metadata.
 func NewFloatingMapping(cfg *Config, i int) *Mapping {
-	return &Mapping{
+	mapping := &Mapping{
 		MachineID:        cfg.MachineID,
 		IPv4:             cfg.PublicIPv4,
 		IPv6:             cfg.PublicIPv6,
 		Port:             cfg.ListenPort,
 		PrivateIP:        cfg.FloatingIPs[i],
-		SupportedPlugins: cfg.Plugins,
-		PublicKey:        cfg.PublicKey,
-		PublicSalt:       cfg.PublicSalt,
+		SupportedPlugins: cfg.supportedPlugins(),
+		Capabilities:     cfg.Capabilities,
 		Floating:         true,
 	}
+	mapping.setKeys(cfg)
+	return mapping
 }
@@ -8,6 +8,8 @@ import (
 	"errors"
 	"net"
 	"time"
+
+	"github.com/supernomad/quantum/crypto"
 )
 
 // NetworkConfig object to represent the current network setup.
@@ -27,6 +29,9 @@ type NetworkConfig struct {
 	// The length of time to hold the assigned DHCP lease.
 	LeaseTime time.Duration `json:"leaseTime"`
 
+	// The cipher every node uses with the encryption plugin, overriding the ciphers negotiated through the mappings.
+	Cipher string `json:"cipher,omitempty"`
+
 	// The base ip address of the quantum network.
 	BaseIP net.IP `json:"-"`
 
@@ -49,6 +54,10 @@ func ParseNetworkConfig(data []byte) (*NetworkConfig, error) {
 		networkCfg.LeaseTime = 48 * time.Hour
 	}
 
+	if networkCfg.Cipher != "" && !StringInSlice(networkCfg.Cipher, crypto.SupportedCiphers) {
+		return nil, errors.New("network configuration has cipher defined but this node does not support '" + networkCfg.Cipher + "'")
+	}
+
 	baseIP, ipnet, err := net.ParseCIDR(networkCfg.Network)
 	if err != nil {
 		return nil, err
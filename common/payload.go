@@ -3,6 +3,10 @@
 
 package common
 
+import (
+	"syscall"
+)
+
 // Payload represents a packet traversing the quantum network.
 type Payload struct {
 	// The raw byte array representing the payload, which includes all necessary metadata.
@@ -16,6 +20,52 @@ type Payload struct {
 
 	// The total length of the payload.
 	Length int
+
+	// The underlying network endpoint the payload was received from, which is only set by sockets that are able to determine it.
+	Sockaddr syscall.Sockaddr
+
+	// Whether or not the payload was verified to originate from the remote peer identified by its header, either by the socket or by a plugin.
+	Authenticated bool
+
+	// The identity the socket authenticated the remote peer as, which is only set by sockets that authenticate their peers by certificate.
+	Peer *PeerIdentity
+
+	// Why the payload was dropped, which is set by the stage rejecting it when the reason should be reported separately.
+	DropReason string
+}
+
+const (
+	// ReplayedDropReason is the drop reason for authenticated packets that were rejected as replays.
+	ReplayedDropReason = "replayed"
+
+	// UnauthenticatedDropReason is the drop reason for packets that failed to authenticate, for instance because they were encrypted with unknown keys.
+	UnauthenticatedDropReason = "unauthenticated"
+
+	// NoSessionDropReason is the drop reason for packets to remote nodes that there is no session with yet, while the handshake establishing one is in progress.
+	NoSessionDropReason = "no-session"
+
+	// IdentityMismatchDropReason is the drop reason for packets received over an authenticated session, whose private ip address belongs to a node other than the authenticated peer.
+	IdentityMismatchDropReason = "identity-mismatch"
+
+	// MalformedDropReason is the drop reason for packets that could not be decoded, for instance because their compressed contents are corrupt or use an unknown codec.
+	MalformedDropReason = "malformed"
+
+	// CoverDropReason is the drop reason for the cover packets injected by the obfuscation plugin of remote nodes, which only exist to hide the real traffic.
+	CoverDropReason = "cover"
+
+	// ParityDropReason marks the parity packets sent by the fec plugin of remote nodes, which are consumed by the plugin rather than delivered. The workers don't count them as dropped, the plugin reports them instead.
+	ParityDropReason = "parity"
+
+	// RecoveredDropReason is the drop reason for packets arriving after the fec plugin already rebuilt them from parity packets.
+	RecoveredDropReason = "recovered"
+
+	// OversizeDropReason is the drop reason for packets that would outgrow their buffer or the maximum packet size once transformed by a plugin.
+	OversizeDropReason = "oversize"
+)
+
+// Fits returns whether or not a packet of the supplied length fits within the payload buffer and the maximum packet size, which plugins check before growing the packet in place.
+func (payload *Payload) Fits(length int) bool {
+	return PacketStart+length <= len(payload.Raw) && HeaderSize+length <= MaxPacketLength
 }
 
 // NewTunPayload is used to generate a payload based on a received TUN packet.
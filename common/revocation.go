@@ -0,0 +1,72 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"crypto/x509"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// Revocations struct which holds the serial numbers of the DTLS certificates revoked through the datastore.
+type Revocations struct {
+	mux     sync.RWMutex
+	serials map[string]bool
+}
+
+// Set replaces the revoked serial numbers, any that can't be parsed are ignored.
+func (revocations *Revocations) Set(serials []string) {
+	set := make(map[string]bool)
+	for i := 0; i < len(serials); i++ {
+		if serial, ok := NormalizeSerial(serials[i]); ok {
+			set[serial] = true
+		}
+	}
+
+	revocations.mux.Lock()
+	revocations.serials = set
+	revocations.mux.Unlock()
+}
+
+// Revoked returns whether or not the certificate with the supplied normalized serial number has been revoked, a nil Revocations revokes nothing.
+func (revocations *Revocations) Revoked(serial string) bool {
+	if revocations == nil {
+		return false
+	}
+
+	revocations.mux.RLock()
+	defer revocations.mux.RUnlock()
+
+	return revocations.serials[serial]
+}
+
+// Len returns the number of revoked serial numbers.
+func (revocations *Revocations) Len() int {
+	revocations.mux.RLock()
+	defer revocations.mux.RUnlock()
+
+	return len(revocations.serials)
+}
+
+// NormalizeSerial parses a hexadecimal certificate serial number, optionally separated by colons as printed by openssl, and returns it in the form produced by CertificateSerial.
+func NormalizeSerial(serial string) (string, bool) {
+	n, ok := new(big.Int).SetString(strings.Replace(strings.TrimSpace(serial), ":", "", -1), 16)
+	if !ok || n.Sign() < 0 {
+		return "", false
+	}
+	return n.Text(16), true
+}
+
+// CertificateSerial returns the serial number of the certificate as lower case hexadecimal without leading zeros.
+func CertificateSerial(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// NewRevocations generates an empty Revocations set.
+func NewRevocations() *Revocations {
+	return &Revocations{
+		serials: make(map[string]bool),
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/supernomad/quantum/crypto"
+)
+
+const (
+	// SessionIndexSize is the length of the session index appended to packets encrypted with session keys, which identifies the session to the receiver.
+	SessionIndexSize = 4
+
+	// SessionKindSize is the length of the packet kind appended to every packet exchanged with nodes supporting handshakes.
+	SessionKindSize = 1
+
+	// TransportKind marks packets encrypted with session keys, followed by the session index of the receiver.
+	TransportKind byte = 1
+
+	// HandshakeKind marks handshake control packets, which bypass the plugins since the handshake messages protect themselves.
+	HandshakeKind byte = 2
+
+	// HandshakeInitSize is the length of the body of a handshake init control packet.
+	HandshakeInitSize = crypto.NoiseInitiationOverhead + TimestampSize + SessionIndexSize
+
+	// HandshakeResponseSize is the length of the body of a handshake response control packet.
+	HandshakeResponseSize = crypto.NoiseResponseOverhead + SessionIndexSize
+
+	// HandshakeRetryInterval is the minimum interval between handshakes initiated with the same remote node.
+	HandshakeRetryInterval = 5 * time.Second
+
+	// The number of handshake intervals a session stays valid for, which leaves time for the next handshake to complete.
+	sessionLifetimes = 3
+
+	handshakePrologue = "quantum handshake"
+)
+
+// Session holds the transport keys established by a single handshake with a remote node.
+type Session struct {
+	// Index identifies the session to the local node, remote nodes tag their packets with it.
+	Index uint32
+
+	// Remote identifies the session to the remote node, and is used to tag outgoing packets.
+	Remote uint32
+
+	// Outgoing is used to encrypt packets sent to the remote node.
+	Outgoing crypto.Cipher
+
+	// Incoming is used to decrypt packets received from the remote node.
+	Incoming crypto.Cipher
+
+	// Window filters replayed packets received from the remote node.
+	Window crypto.ReplayWindow
+
+	// When the handshake establishing the session completed.
+	Created time.Time
+
+	peer uint32
+}
+
+type sessionPeer struct {
+	current  *Session
+	previous *Session
+	next     *Session
+
+	handshake *crypto.Handshake
+	index     uint32
+	initiated time.Time
+	requested time.Time
+}
+
+// SealHandshake marks the handshake control packet carried by the supplied payload, which is sent without going through the plugins.
+func SealHandshake(payload *Payload) {
+	payload.Raw[PacketStart+len(payload.Packet)] = HandshakeKind
+	payload.Packet = payload.Raw[PacketStart : PacketStart+len(payload.Packet)+SessionKindSize]
+	payload.Length += SessionKindSize
+}
+
+// OpenHandshake strips the mark from the supplied payload if it carries a handshake control packet, returning false if it doesn't.
+func OpenHandshake(payload *Payload) bool {
+	end := len(payload.Packet) - SessionKindSize
+	if end < 0 || payload.Packet[end] != HandshakeKind || !IsHandshake(payload.Packet[:end]) {
+		return false
+	}
+
+	payload.Packet = payload.Packet[:end]
+	payload.Length -= SessionKindSize
+	return true
+}
+
+// Sessions tracks the sessions established with remote nodes through handshakes, and the handshakes in progress.
+//
+// Handshakes authenticate both sides with the static keys published in their mappings, while the transport keys only depend on ephemeral keys that are discarded once the handshake completes. So compromising the static keys later on does not expose recorded traffic.
+type Sessions struct {
+	mux      sync.RWMutex
+	keys     *Keyring
+	interval time.Duration
+	peers    map[uint32]*sessionPeer
+	indexes  map[uint32]*Session
+	requests chan uint32
+
+	// The timestamp of the last handshake init accepted from each remote node, which is kept after its sessions are pruned so that a recorded handshake init can never be replayed.
+	timestamps map[uint32]uint64
+}
+
+func (sessions *Sessions) expired(now time.Time, session *Session) bool {
+	return session == nil || now.Sub(session.Created) >= sessionLifetimes*sessions.interval
+}
+
+// Requests returns the channel that the private ip addresses of remote nodes needing a handshake are sent to.
+func (sessions *Sessions) Requests() <-chan uint32 {
+	return sessions.requests
+}
+
+// Sending returns the session to encrypt packets sent to the remote node with the supplied private ip address. A handshake is requested when there is no usable session, or when the session is due to be replaced.
+func (sessions *Sessions) Sending(ip uint32) (*Session, bool) {
+	now := time.Now()
+
+	sessions.mux.RLock()
+	peer, ok := sessions.peers[ip]
+	var session *Session
+	if ok {
+		session = peer.current
+		if session == nil {
+			session = peer.next
+		}
+	}
+	sessions.mux.RUnlock()
+
+	usable := !sessions.expired(now, session)
+	if !usable || now.Sub(session.Created) >= sessions.interval {
+		sessions.request(now, ip)
+	}
+	return session, usable
+}
+
+// Request asks for a handshake with the remote node with the supplied private ip address, unless one was already requested within HandshakeRetryInterval.
+func (sessions *Sessions) Request(ip uint32) {
+	sessions.request(time.Now(), ip)
+}
+
+func (sessions *Sessions) request(now time.Time, ip uint32) {
+	sessions.mux.Lock()
+	defer sessions.mux.Unlock()
+
+	peer := sessions.peer(ip)
+	if now.Sub(peer.requested) < HandshakeRetryInterval {
+		return
+	}
+
+	select {
+	case sessions.requests <- ip:
+		peer.requested = now
+	default:
+	}
+}
+
+// Receiving returns the session with the supplied index, as long as it belongs to the remote node with the supplied private ip address.
+func (sessions *Sessions) Receiving(ip uint32, index uint32) (*Session, bool) {
+	sessions.mux.RLock()
+	session, ok := sessions.indexes[index]
+	sessions.mux.RUnlock()
+
+	if !ok || session.peer != ip || sessions.expired(time.Now(), session) {
+		return nil, false
+	}
+	return session, true
+}
+
+// Confirm records that an authenticated packet was received for the supplied session, which is what promotes a session established by a remote node to the one used for sending.
+func (sessions *Sessions) Confirm(session *Session) {
+	sessions.mux.RLock()
+	peer := sessions.peers[session.peer]
+	pending := peer != nil && peer.next == session
+	sessions.mux.RUnlock()
+
+	if !pending {
+		return
+	}
+
+	sessions.mux.Lock()
+	defer sessions.mux.Unlock()
+
+	if peer.next == session {
+		sessions.install(peer, session)
+		peer.next = nil
+	}
+}
+
+// Initiate starts a handshake with the remote node represented by the mapping, returning the handshake init body to send it. Nothing is returned if a handshake was already initiated with the remote node within HandshakeRetryInterval.
+func (sessions *Sessions) Initiate(now time.Time, mapping *Mapping) ([]byte, bool) {
+	if mapping.PublicKey == nil {
+		return nil, false
+	}
+
+	local := sessions.keys.Sending()
+	ip := IPtoInt(mapping.PrivateIP)
+
+	sessions.mux.Lock()
+	defer sessions.mux.Unlock()
+
+	peer := sessions.peer(ip)
+	if now.Sub(peer.initiated) < HandshakeRetryInterval {
+		return nil, false
+	}
+
+	index, err := sessions.index()
+	if err != nil {
+		return nil, false
+	}
+
+	payload := make([]byte, TimestampSize+SessionIndexSize)
+	binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+	binary.BigEndian.PutUint32(payload[TimestampSize:], index)
+
+	handshake := crypto.NewInitiatorHandshake(local.PrivateKey, local.PublicKey, mapping.PublicKey, []byte(handshakePrologue), sessions.keys.PSK())
+	msg, err := handshake.WriteMessage(payload)
+	if err != nil {
+		return nil, false
+	}
+
+	peer.handshake = handshake
+	peer.index = index
+	peer.initiated = now
+	return msg, true
+}
+
+// Respond answers a handshake init body received from the remote node represented by the mapping, returning the handshake response body to send back. The remote node must have authenticated with one of the public keys published in its mapping.
+func (sessions *Sessions) Respond(now time.Time, mapping *Mapping, msg []byte) ([]byte, error) {
+	var handshake *crypto.Handshake
+	var payload []byte
+	var err error
+
+	psk := sessions.keys.PSK()
+	for _, local := range sessions.locals() {
+		handshake = crypto.NewResponderHandshake(local.PrivateKey, local.PublicKey, []byte(handshakePrologue), psk)
+		if payload, err = handshake.ReadMessage(msg); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	remote := handshake.RemoteStatic()
+	if !bytes.Equal(remote, mapping.PublicKey) && !bytes.Equal(remote, mapping.PreviousPublicKey) {
+		return nil, errors.New("handshake was authenticated with a key that does not belong to " + mapping.PrivateIP.String())
+	}
+	if len(payload) != TimestampSize+SessionIndexSize {
+		return nil, errors.New("handshake init has an invalid payload")
+	}
+
+	ip := IPtoInt(mapping.PrivateIP)
+	timestamp := binary.BigEndian.Uint64(payload)
+
+	sessions.mux.Lock()
+	defer sessions.mux.Unlock()
+
+	// Handshake init messages are only ever accepted once, and in order, so a recorded one can't be replayed to reset the session.
+	if timestamp <= sessions.timestamps[ip] {
+		return nil, errors.New("handshake init is replayed")
+	}
+
+	index, err := sessions.index()
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, SessionIndexSize)
+	binary.BigEndian.PutUint32(response, index)
+
+	reply, err := handshake.WriteMessage(response)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := newSession(handshake, mapping, now, index, binary.BigEndian.Uint32(payload[TimestampSize:]))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions.timestamps[ip] = timestamp
+
+	// The remote node only starts using the session once it gets the response, so keep sending with the current session until then.
+	peer := sessions.peer(ip)
+	if peer.next != nil {
+		delete(sessions.indexes, peer.next.Index)
+	}
+	peer.next = session
+	sessions.indexes[index] = session
+	return reply, nil
+}
+
+// Complete finishes the handshake initiated with the remote node represented by the mapping using the supplied handshake response body, after which the established session is used for sending.
+func (sessions *Sessions) Complete(now time.Time, mapping *Mapping, msg []byte) error {
+	ip := IPtoInt(mapping.PrivateIP)
+
+	sessions.mux.Lock()
+	defer sessions.mux.Unlock()
+
+	peer, ok := sessions.peers[ip]
+	if !ok || peer.handshake == nil {
+		return errors.New("no handshake is in progress with " + mapping.PrivateIP.String())
+	}
+
+	payload, err := peer.handshake.ReadMessage(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) != SessionIndexSize {
+		return errors.New("handshake response has an invalid payload")
+	}
+
+	session, err := newSession(peer.handshake, mapping, now, peer.index, binary.BigEndian.Uint32(payload))
+	if err != nil {
+		return err
+	}
+
+	peer.handshake = nil
+	sessions.indexes[session.Index] = session
+	sessions.install(peer, session)
+	return nil
+}
+
+// Prune drops the expired sessions, along with the remote nodes that have nothing left. The timestamps of the handshakes accepted from the remote nodes are kept.
+func (sessions *Sessions) Prune(now time.Time) {
+	sessions.mux.Lock()
+	defer sessions.mux.Unlock()
+
+	for ip, peer := range sessions.peers {
+		for _, session := range []**Session{&peer.current, &peer.previous, &peer.next} {
+			if *session != nil && sessions.expired(now, *session) {
+				delete(sessions.indexes, (*session).Index)
+				*session = nil
+			}
+		}
+
+		if peer.handshake != nil && now.Sub(peer.initiated) >= sessions.interval {
+			peer.handshake = nil
+		}
+
+		if peer.current == nil && peer.previous == nil && peer.next == nil && peer.handshake == nil {
+			delete(sessions.peers, ip)
+		}
+	}
+}
+
+func (sessions *Sessions) install(peer *sessionPeer, session *Session) {
+	if peer.previous != nil {
+		delete(sessions.indexes, peer.previous.Index)
+	}
+	peer.previous = peer.current
+	peer.current = session
+}
+
+func (sessions *Sessions) peer(ip uint32) *sessionPeer {
+	peer, ok := sessions.peers[ip]
+	if !ok {
+		peer = &sessionPeer{}
+		sessions.peers[ip] = peer
+	}
+	return peer
+}
+
+func (sessions *Sessions) index() (uint32, error) {
+	buf := make([]byte, SessionIndexSize)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return 0, err
+		}
+
+		index := binary.BigEndian.Uint32(buf)
+		if _, ok := sessions.indexes[index]; !ok {
+			return index, nil
+		}
+	}
+}
+
+func (sessions *Sessions) locals() []*Key {
+	sending, current := sessions.keys.Sending(), sessions.keys.Current()
+	if sending == current {
+		return []*Key{current}
+	}
+	return []*Key{sending, current}
+}
+
+func newSession(handshake *crypto.Handshake, mapping *Mapping, now time.Time, index, remote uint32) (*Session, error) {
+	send, recv, err := handshake.Split()
+	if err != nil {
+		return nil, err
+	}
+
+	outgoingName, incomingName := mapping.CipherSuites()
+	outgoing, err := crypto.NewCipher(outgoingName, send)
+	if err != nil {
+		return nil, err
+	}
+
+	incoming, err := crypto.NewCipher(incomingName, recv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		Index:    index,
+		Remote:   remote,
+		Outgoing: outgoing,
+		Incoming: incoming,
+		Created:  now,
+		peer:     IPtoInt(mapping.PrivateIP),
+	}, nil
+}
+
+// NewSessions generates a Sessions table which authenticates handshakes with the supplied keys, and replaces sessions after they have been in use for the supplied interval.
+func NewSessions(keys *Keyring, interval time.Duration) *Sessions {
+	return &Sessions{
+		keys:     keys,
+		interval: interval,
+		peers:    make(map[uint32]*sessionPeer),
+		indexes:  make(map[uint32]*Session),
+		requests: make(chan uint32, 64),
+
+		timestamps: make(map[uint32]uint64),
+	}
+}
@@ -12,14 +12,26 @@ import (
 	"syscall"
 )
 
+// Reloader is implemented by the parts of quantum that can reload the files they were configured with in place, without a rolling restart.
+type Reloader interface {
+	// Reload should reread the files in use, keeping the current ones if any of them can't be loaded.
+	Reload() error
+}
+
 // Signaler struct used to manage os and user signals to the quantum process.
 type Signaler struct {
 	log *Logger
 	cfg *Config
 
-	fds     []int
-	env     map[string]string
-	signals chan os.Signal
+	fds       []int
+	env       map[string]string
+	signals   chan os.Signal
+	reloaders []Reloader
+}
+
+// AddReloader registers a Reloader to call when the quantum process receives SIGUSR1.
+func (sig *Signaler) AddReloader(reloader Reloader) {
+	sig.reloaders = append(sig.reloaders, reloader)
 }
 
 func (sig *Signaler) fork(exec bool, files []uintptr) (int, error) {
@@ -57,28 +69,42 @@ func (sig *Signaler) reload(exec bool) error {
 	return nil
 }
 
+func (sig *Signaler) refresh() {
+	sig.log.Info.Println("[MAIN]", "Received refresh signal from user. Reloading configured files...")
+
+	for i := 0; i < len(sig.reloaders); i++ {
+		if err := sig.reloaders[i].Reload(); err != nil {
+			sig.log.Error.Println("[MAIN]", "Error reloading configured files:", err.Error())
+		}
+	}
+}
+
 func (sig *Signaler) terminate(exec bool) error {
 	sig.log.Info.Println("[MAIN]", "Received termination signal from user. Terminating process.")
 	return nil
 }
 
-// Wait for a configured os or user signal to be passed to the quantum process.
+// Wait for a configured os or user signal to be passed to the quantum process, refresh signals are handled in place and don't end the wait.
 func (sig *Signaler) Wait(exec bool) error {
-	s := <-sig.signals
-	switch s {
-	case syscall.SIGHUP:
-		return sig.reload(exec)
-	case syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT:
-		return sig.terminate(exec)
-	default:
-		return errors.New("build error received undefined signal")
+	for {
+		s := <-sig.signals
+		switch s {
+		case syscall.SIGUSR1:
+			sig.refresh()
+		case syscall.SIGHUP:
+			return sig.reload(exec)
+		case syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT:
+			return sig.terminate(exec)
+		default:
+			return errors.New("build error received undefined signal")
+		}
 	}
 }
 
 // NewSignaler generates a new Signaler object, which will watch for new os and user signals passed to the quantum process.
 func NewSignaler(log *Logger, cfg *Config, fds []int, env map[string]string) *Signaler {
-	signals := make(chan os.Signal)
-	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 
 	return &Signaler{
 		log:     log,
@@ -0,0 +1,29 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package crypto
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ChaCha20 represents a chacha20-poly1305 AEAD cipher object.
+type ChaCha20 struct {
+	packetCipher
+}
+
+// NewChaCha20Key returns a new chacha20-poly1305 cipher object using the passed in key as is, which must be 32 bytes long.
+func NewChaCha20Key(key []byte) (*ChaCha20, error) {
+	if len(key) != keyLength {
+		return nil, errors.New("chacha20 keys must be 32 bytes long")
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChaCha20{packetCipher: newPacketCipher(aead)}, nil
+}
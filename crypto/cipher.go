@@ -0,0 +1,193 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package crypto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// AESCipher is the name of the aes-256-gcm cipher, which is the fastest choice on processors with AES instructions.
+	AESCipher = "aes-256-gcm"
+
+	// ChaChaCipher is the name of the chacha20-poly1305 cipher, which is the fastest choice on processors without AES instructions.
+	ChaChaCipher = "chacha20-poly1305"
+)
+
+const (
+	// counterBlock is the number of packet counters a cipher takes from the shared counters at a time.
+	counterBlock = 1 << 24
+
+	// counterReservation is the number of packet counters reserved by each high-water mark, which must be a multiple of counterBlock.
+	counterReservation = 1 << 40
+)
+
+// SupportedCiphers lists the names of the ciphers NewCipher is able to generate.
+var SupportedCiphers = []string{AESCipher, ChaChaCipher}
+
+// Cipher represents an AEAD cipher object which encrypts packets in place, authenticating the sender and a per sender packet counter along with them.
+type Cipher interface {
+	// EncryptedSize returns the minimum size of the data buffer for encryption, which includes the tag size + counter size.
+	EncryptedSize(data []byte) int
+
+	// DecryptedSize returns the size of the data once decrypted, which excludes the tag size + counter size.
+	DecryptedSize(data []byte) int
+
+	// Encrypt takes the data buffer and encrypts up to length bytes in place, while injecting the tag and the next packet counter at the end.
+	Encrypt(data []byte, length int, sender []byte) (int, error)
+
+	// Decrypt takes the data buffer and decrypts it and verifies the sender and counter, returning the decrypted length and the authenticated counter.
+	Decrypt(data []byte, sender []byte) (int, uint64, error)
+}
+
+// NewCipher returns a new cipher object of the named type using the passed in key as is, which must be 32 bytes long.
+func NewCipher(name string, key []byte) (Cipher, error) {
+	switch name {
+	case AESCipher:
+		return NewAESKey(key)
+	case ChaChaCipher:
+		return NewChaCha20Key(key)
+	}
+	return nil, errors.New("unknown cipher '" + name + "'")
+}
+
+// counters hands out the blocks of packet counters used by every cipher, so that no two ciphers, even with the same key, ever use the same counter.
+var counters struct {
+	mux     sync.Mutex
+	next    uint64
+	mark    uint64
+	reserve func(mark uint64) error
+}
+
+// ReserveCounters makes every packet counter handed out from now on greater than the supplied high-water mark, and calls reserve with each new high-water mark before any counter past the previous one is used.
+//
+// Persisting the marks passed to reserve, and supplying the last one on startup, guarantees that a nonce is never reused with the same key across restarts, even if the clock steps backwards.
+func ReserveCounters(mark uint64, reserve func(mark uint64) error) error {
+	counters.mux.Lock()
+	defer counters.mux.Unlock()
+
+	if counters.next < mark {
+		counters.next = mark
+	}
+	counters.reserve = reserve
+	return reserveCounters()
+}
+
+func nextCounterBlock() (uint64, error) {
+	counters.mux.Lock()
+	defer counters.mux.Unlock()
+
+	// Without a persisted high-water mark the clock keeps the counters increasing across restarts.
+	if now := uint64(time.Now().UnixNano()); counters.next < now {
+		counters.next = now
+	}
+	if counters.next+counterBlock > counters.mark {
+		if err := reserveCounters(); err != nil {
+			return 0, err
+		}
+	}
+
+	start := counters.next
+	counters.next += counterBlock
+	return start, nil
+}
+
+func reserveCounters() error {
+	mark := counters.next + counterReservation
+	if counters.reserve != nil {
+		if err := counters.reserve(mark); err != nil {
+			return errors.New("error reserving packet counters: " + err.Error())
+		}
+	}
+	counters.mark = mark
+	return nil
+}
+
+// packetCipher implements Cipher on top of an AEAD with a 12 byte nonce, which is built from the sender and the packet counter.
+type packetCipher struct {
+	// counter and limit must stay the first fields to keep them 64bit aligned for atomic operations.
+	counter uint64
+	limit   uint64
+	aead    cipher.AEAD
+}
+
+// EncryptedSize returns the minimum size of the data buffer for encryption, which includes the tag size + counter size.
+func (crypt *packetCipher) EncryptedSize(data []byte) int {
+	return len(data) + crypt.aead.Overhead() + CounterSize
+}
+
+// DecryptedSize returns the size of the data once decrypted, which excludes the tag size + counter size.
+func (crypt *packetCipher) DecryptedSize(data []byte) int {
+	return len(data) - crypt.aead.Overhead() - CounterSize
+}
+
+// Encrypt takes the data buffer and encrypts up to length bytes in place, while injecting the tag and the next packet counter at the end.
+//
+// The nonce is built from the sender and the counter, which are both signed as additional data, so the sender must uniquely identify the local node for every key it is used with.
+func (crypt *packetCipher) Encrypt(data []byte, length int, sender []byte) (int, error) {
+	counter, err := crypt.next()
+	if err != nil {
+		return -1, err
+	}
+
+	nonce := crypt.nonce(sender, counter)
+	crypt.aead.Seal(data[:0], nonce, data[:length], nonce)
+	binary.BigEndian.PutUint64(data[length+crypt.aead.Overhead():], counter)
+	return crypt.EncryptedSize(data[:length]), nil
+}
+
+// Decrypt takes the data buffer and decrypts it and verifies the sender and counter, returning the decrypted length and the authenticated counter.
+//
+// sender and data must be the same buffers passed to Encrypt.
+func (crypt *packetCipher) Decrypt(data []byte, sender []byte) (int, uint64, error) {
+	if len(data) < crypt.aead.Overhead()+CounterSize {
+		return -1, 0, errors.New("encrypted packet is too short")
+	}
+
+	length := len(data) - CounterSize
+	counter := binary.BigEndian.Uint64(data[length:])
+
+	nonce := crypt.nonce(sender, counter)
+	_, err := crypt.aead.Open(data[:0], nonce, data[:length], nonce)
+	return crypt.DecryptedSize(data), counter, err
+}
+
+func (crypt *packetCipher) nonce(sender []byte, counter uint64) []byte {
+	nonce := make([]byte, crypt.aead.NonceSize())
+	copy(nonce[:senderSize], sender)
+	binary.BigEndian.PutUint64(nonce[senderSize:], counter)
+	return nonce
+}
+
+// next returns the next packet counter, taking a new block from the shared counters once the current one runs out.
+func (crypt *packetCipher) next() (uint64, error) {
+	for {
+		counter := atomic.LoadUint64(&crypt.counter)
+		if counter+1 < atomic.LoadUint64(&crypt.limit) {
+			if atomic.CompareAndSwapUint64(&crypt.counter, counter, counter+1) {
+				return counter + 1, nil
+			}
+			continue
+		}
+
+		start, err := nextCounterBlock()
+		if err != nil {
+			return 0, err
+		}
+		// Only swap in the new block if no other goroutine did in the meantime, the unused block is simply skipped.
+		if atomic.CompareAndSwapUint64(&crypt.counter, counter, start) {
+			atomic.StoreUint64(&crypt.limit, start+counterBlock)
+		}
+	}
+}
+
+func newPacketCipher(aead cipher.AEAD) packetCipher {
+	// The first packet takes the first block of counters.
+	return packetCipher{aead: aead}
+}
@@ -6,6 +6,7 @@ package crypto
 import (
 	"crypto/rand"
 	"net"
+	"strconv"
 	"sync"
 	"syscall"
 	"testing"
@@ -18,9 +19,9 @@ const (
 	clientCertFile = "../dist/ssl/certs/ec-client.crt"
 	clientKeyFile  = "../dist/ssl/keys/ec-client.key"
 	tagLen         = 16
-	nonceLen       = 12
+	counterLen     = 8
 	bufLen         = 1500
-	dataLen        = bufLen - tagLen - nonceLen
+	dataLen        = bufLen - tagLen - counterLen
 )
 
 func testEq(a, b []byte) bool {
@@ -71,7 +72,7 @@ func TestAES(t *testing.T) {
 	fillSlice(expected)
 
 	minSize := aes.EncryptedSize(buf)
-	if minSize != len(buf)+tagLen+nonceLen {
+	if minSize != len(buf)+tagLen+counterLen {
 		t.Fatalf("The AES minimum size is incorrect, got: %d", minSize)
 	}
 
@@ -87,7 +88,7 @@ func TestAES(t *testing.T) {
 		t.Fatal("Encrypted output matches plaintext.")
 	}
 
-	length, err = aes.Decrypt(buf, nil)
+	length, counter, err := aes.Decrypt(buf, nil)
 	if err != nil {
 		t.Fatalf("Errored trying to decrypt buffer: %s", err.Error())
 	}
@@ -98,6 +99,224 @@ func TestAES(t *testing.T) {
 	if !testEq(buf[:dataLen], expected) || dataLen != aes.DecryptedSize(buf) {
 		t.Fatal("Decrypted output does not match plaintext.")
 	}
+
+	sender := []byte{10, 99, 0, 1}
+	length, err = aes.Encrypt(buf, dataLen, sender)
+	if err != nil {
+		t.Fatalf("Errored trying to encrypt buffer: %s", err.Error())
+	}
+
+	_, next, err := aes.Decrypt(buf[:length], sender)
+	if err != nil || next <= counter {
+		t.Fatal("Encrypt did not use a monotonically increasing counter.")
+	}
+
+	length, err = aes.Encrypt(buf, dataLen, sender)
+	if err != nil {
+		t.Fatalf("Errored trying to encrypt buffer: %s", err.Error())
+	}
+	buf[length-1]++
+	if _, _, err := aes.Decrypt(buf[:length], sender); err == nil {
+		t.Fatal("Decrypt accepted a packet with a tampered counter.")
+	}
+
+	length, err = aes.Encrypt(buf, dataLen, sender)
+	if err != nil {
+		t.Fatalf("Errored trying to encrypt buffer: %s", err.Error())
+	}
+	if _, _, err := aes.Decrypt(buf[:length], []byte{10, 99, 0, 2}); err == nil {
+		t.Fatal("Decrypt accepted a packet from a different sender.")
+	}
+}
+
+func TestReserveCounters(t *testing.T) {
+	var marks []uint64
+	reserve := func(mark uint64) error {
+		marks = append(marks, mark)
+		return nil
+	}
+	defer ReserveCounters(0, nil)
+
+	// A high-water mark far ahead of the clock, as if the clock stepped backwards since it was persisted.
+	mark := uint64(1) << 62
+	if err := ReserveCounters(mark, reserve); err != nil || len(marks) != 1 || marks[0] <= mark {
+		t.Fatal("ReserveCounters did not reserve counters past the supplied high-water mark.")
+	}
+
+	chacha, err := NewChaCha20Key([]byte("ChaCha20Key-32Characters12345678"))
+	if err != nil {
+		t.Fatalf("Unable to create the chacha20 object: %s", err.Error())
+	}
+
+	buf := make([]byte, bufLen)
+	length, err := chacha.Encrypt(buf, dataLen, nil)
+	if err != nil {
+		t.Fatalf("Errored trying to encrypt buffer: %s", err.Error())
+	}
+	_, counter, err := chacha.Decrypt(buf[:length], nil)
+	if err != nil || counter <= mark || counter >= marks[len(marks)-1] {
+		t.Fatal("Encrypt used a counter outside of the reserved counters.")
+	}
+
+	// Exhaust the block of counters taken by the cipher.
+	chacha.counter = chacha.limit - 1
+	length, err = chacha.Encrypt(buf, dataLen, nil)
+	if err != nil {
+		t.Fatalf("Errored trying to encrypt buffer: %s", err.Error())
+	}
+	_, next, err := chacha.Decrypt(buf[:length], nil)
+	if err != nil || next <= counter+counterBlock-1 {
+		t.Fatal("Encrypt did not take a new block of counters once the previous one ran out.")
+	}
+
+	counters.mux.Lock()
+	counters.next = counters.mark
+	counters.mux.Unlock()
+	chacha.counter = chacha.limit - 1
+	if _, err := chacha.Encrypt(buf, dataLen, nil); err != nil || len(marks) != 2 || marks[1] <= next {
+		t.Fatal("Encrypt did not reserve more counters once the reserved ones ran out.")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	secret := []byte("AES256Key-32Characters1234567890")
+	salt := []byte("AES256Salt32Characters1234567890")
+
+	key := DeriveKey(secret, salt, []byte("outgoing"))
+	if len(key) != keyLength || !testEq(key, DeriveKey(secret, salt, []byte("outgoing"))) {
+		t.Fatal("DeriveKey did not deterministically derive a 32 byte key.")
+	}
+	if testEq(key, DeriveKey(secret, salt, []byte("incoming"))) {
+		t.Fatal("DeriveKey derived the same key for different info.")
+	}
+
+	if _, err := NewAESKey(key); err != nil {
+		t.Fatalf("NewAESKey failed to use a derived key: %s", err.Error())
+	}
+	if _, err := NewAESKey(key[:16]); err == nil {
+		t.Fatal("NewAESKey accepted a key of the wrong length.")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	window := &ReplayWindow{}
+	base := uint64(1000000)
+
+	if !window.Accept(base) {
+		t.Fatal("Accept rejected the first counter.")
+	}
+	if window.Accept(base) {
+		t.Fatal("Accept did not reject a replayed counter.")
+	}
+	if !window.Accept(base+10) || !window.Accept(base+5) {
+		t.Fatal("Accept rejected reordered counters within the window.")
+	}
+	if window.Accept(base + 5) {
+		t.Fatal("Accept did not reject a replayed reordered counter.")
+	}
+
+	if !window.Accept(base + 10 + ReplayWindowSize) {
+		t.Fatal("Accept rejected a counter advancing the window.")
+	}
+	if window.Accept(base + 9) {
+		t.Fatal("Accept did not reject a counter that fell behind the window.")
+	}
+	if !window.Accept(base + 11) {
+		t.Fatal("Accept rejected an unseen counter at the edge of the window.")
+	}
+
+	if !window.Accept(base + 100*ReplayWindowSize) {
+		t.Fatal("Accept rejected a counter far ahead of the window.")
+	}
+	if window.Accept(base + 100*ReplayWindowSize) {
+		t.Fatal("Accept did not reject a replayed counter after a large jump.")
+	}
+}
+
+func TestNoise(t *testing.T) {
+	initPub, initPriv := GenerateECKeyPair()
+	respPub, respPriv := GenerateECKeyPair()
+	prologue := []byte("prologue")
+
+	initiator := NewInitiatorHandshake(initPriv, initPub, respPub, prologue, nil)
+	responder := NewResponderHandshake(respPriv, respPub, prologue, nil)
+
+	msg, err := initiator.WriteMessage([]byte("hello"))
+	if err != nil || len(msg) != NoiseInitiationOverhead+5 {
+		t.Fatal("WriteMessage failed to write the first message.")
+	}
+
+	tampered := append([]byte(nil), msg...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := NewResponderHandshake(respPriv, respPub, prologue, nil).ReadMessage(tampered); err == nil {
+		t.Fatal("ReadMessage accepted a tampered first message.")
+	}
+	otherPub, otherPriv := GenerateECKeyPair()
+	if _, err := NewResponderHandshake(otherPriv, otherPub, prologue, nil).ReadMessage(msg); err == nil {
+		t.Fatal("ReadMessage accepted a first message meant for a different static key.")
+	}
+
+	payload, err := responder.ReadMessage(msg)
+	if err != nil || string(payload) != "hello" {
+		t.Fatal("ReadMessage failed to read the first message.")
+	}
+	if !testEq(responder.RemoteStatic(), initPub) {
+		t.Fatal("RemoteStatic did not return the static key of the initiator.")
+	}
+
+	msg, err = responder.WriteMessage([]byte("world"))
+	if err != nil || len(msg) != NoiseResponseOverhead+5 {
+		t.Fatal("WriteMessage failed to write the second message.")
+	}
+	if payload, err := initiator.ReadMessage(msg); err != nil || string(payload) != "world" {
+		t.Fatal("ReadMessage failed to read the second message.")
+	}
+
+	initSend, initRecv, err := initiator.Split()
+	if err != nil {
+		t.Fatal("Split failed after a completed handshake.")
+	}
+	respSend, respRecv, _ := responder.Split()
+	if !testEq(initSend, respRecv) || !testEq(initRecv, respSend) || testEq(initSend, initRecv) {
+		t.Fatal("Split did not produce matching transport keys for each direction.")
+	}
+	if _, _, err := initiator.Split(); err == nil {
+		t.Fatal("Split succeeded twice.")
+	}
+	if _, err := initiator.WriteMessage(nil); err == nil {
+		t.Fatal("WriteMessage succeeded after the handshake completed.")
+	}
+
+	psk := DeriveKey([]byte("pre-shared key"), nil, nil)
+	handshake := func(initiatorPSK, responderPSK []byte) ([]byte, error) {
+		initiator := NewInitiatorHandshake(initPriv, initPub, respPub, prologue, initiatorPSK)
+		responder := NewResponderHandshake(respPriv, respPub, prologue, responderPSK)
+
+		msg, _ := initiator.WriteMessage(nil)
+		if _, err := responder.ReadMessage(msg); err != nil {
+			return nil, err
+		}
+		msg, _ = responder.WriteMessage(nil)
+		if _, err := initiator.ReadMessage(msg); err != nil {
+			return nil, err
+		}
+		send, _, err := initiator.Split()
+		return send, err
+	}
+
+	pskSend, err := handshake(psk, psk)
+	if err != nil {
+		t.Fatalf("Failed to complete a handshake with a pre-shared key: %s", err.Error())
+	}
+	if testEq(pskSend, initSend) {
+		t.Fatal("The pre-shared key was not mixed into the transport keys.")
+	}
+	if _, err := handshake(psk, nil); err == nil {
+		t.Fatal("Completed a handshake with a responder that lacks the pre-shared key.")
+	}
+	if _, err := handshake(psk, DeriveKey([]byte("another key"), nil, nil)); err == nil {
+		t.Fatal("Completed a handshake with mismatched pre-shared keys.")
+	}
 }
 
 func BenchmarkAES(b *testing.B) {
@@ -123,13 +342,81 @@ func BenchmarkAES(b *testing.B) {
 			b.Fatalf("Errored trying to encrypt buffer: %s", err.Error())
 		}
 
-		_, err = aes.Decrypt(buf, nil)
+		_, _, err = aes.Decrypt(buf, nil)
 		if err != nil {
 			b.Fatalf("Errored trying to decrypt buffer: %s", err.Error())
 		}
 	}
 }
 
+func TestCiphers(t *testing.T) {
+	key := []byte("AES256Key-32Characters1234567890")
+	sender := []byte{10, 99, 0, 1}
+
+	for _, name := range SupportedCiphers {
+		crypt, err := NewCipher(name, key)
+		if err != nil {
+			t.Fatalf("NewCipher failed to create the %s cipher: %s", name, err.Error())
+		}
+
+		buf := make([]byte, bufLen)
+		expected := make([]byte, dataLen)
+		fillSlice(buf[:dataLen])
+		copy(expected, buf[:dataLen])
+
+		length, _ := crypt.Encrypt(buf, dataLen, sender)
+		if length != crypt.EncryptedSize(buf[:dataLen]) {
+			t.Fatalf("The %s cipher returned the wrong encrypted length.", name)
+		}
+
+		other := ChaChaCipher
+		if name == ChaChaCipher {
+			other = AESCipher
+		}
+		mismatched, _ := NewCipher(other, key)
+		encrypted := append([]byte(nil), buf[:length]...)
+		if _, _, err := mismatched.Decrypt(encrypted, sender); err == nil {
+			t.Fatalf("The %s cipher decrypted a packet encrypted with the %s cipher.", other, name)
+		}
+
+		decrypted, _, err := crypt.Decrypt(buf[:length], sender)
+		if err != nil || decrypted != dataLen || !testEq(buf[:decrypted], expected) {
+			t.Fatalf("The %s cipher failed to decrypt its own packet.", name)
+		}
+	}
+
+	if _, err := NewCipher("rot13", key); err == nil {
+		t.Fatal("NewCipher accepted an unknown cipher.")
+	}
+	if _, err := NewCipher(ChaChaCipher, key[:16]); err == nil {
+		t.Fatal("NewCipher accepted a key of the wrong length.")
+	}
+}
+
+// BenchmarkCiphers compares the ciphers on the packet sizes quantum handles, from bare tcp acks up to full packets at the default mtu of 1420 bytes.
+func BenchmarkCiphers(b *testing.B) {
+	key := []byte("AES256Key-32Characters1234567890")
+
+	for _, name := range SupportedCiphers {
+		for _, size := range []int{64, 512, 1420} {
+			b.Run(name+"/"+strconv.Itoa(size), func(b *testing.B) {
+				crypt, _ := NewCipher(name, key)
+				buf := make([]byte, size+tagLen+counterLen)
+				fillSlice(buf[:size])
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					length, _ := crypt.Encrypt(buf, size, nil)
+					if _, _, err := crypt.Decrypt(buf[:length], nil); err != nil {
+						b.Fatalf("Errored trying to decrypt buffer: %s", err.Error())
+					}
+				}
+			})
+		}
+	}
+}
+
 func TestEcdh(t *testing.T) {
 	pub, priv := GenerateECKeyPair()
 	if len(pub) != keyLength {
@@ -223,13 +223,7 @@ int _set_common_ssl_parameters(SSL_CTX* ssl_ctx, int verify_peer, char* error) {
     return 1;
 }
 
-int _set_ssl_certs(SSL_CTX* ssl_ctx, const char* ca, const char* cert, const char* key, char* error) {
-    // Load the ca certificate to use for verification.
-    if (!SSL_CTX_load_verify_locations(ssl_ctx, ca, NULL)) {
-        strcpy(error, "unable to load the specified CA certificate file");
-        return 0;
-    }
-
+int _set_ssl_key_pair(SSL_CTX* ssl_ctx, const char* cert, const char* key, char* error) {
     // Load the public certificate.
     if (!SSL_CTX_use_certificate_file(ssl_ctx, cert, SSL_FILETYPE_PEM)) {
         strcpy(error, "unable to load the specified public certificate file");
@@ -248,12 +242,44 @@ int _set_ssl_certs(SSL_CTX* ssl_ctx, const char* ca, const char* cert, const cha
         return 0;
     }
 
+    // Certificate and key set properly.
+    return 1;
+}
+
+int _set_ssl_certs(SSL_CTX* ssl_ctx, const char* ca, const char* cert, const char* key, char* error) {
+    // Load the ca certificate to use for verification.
+    if (!SSL_CTX_load_verify_locations(ssl_ctx, ca, NULL)) {
+        strcpy(error, "unable to load the specified CA certificate file");
+        return 0;
+    }
+
+    // Load the public certificate and its private key.
+    if (!_set_ssl_key_pair(ssl_ctx, cert, key, error)) {
+        return 0;
+    }
+
     // Certificates and keys set properly.
     return 1;
 }
 
+SSL* _new_ssl(Context* ctx) {
+    pthread_mutex_lock(&ctx->lock);
+
+    SSL* ssl = SSL_new(ctx->ssl_ctx);
+
+    // Hold on to the current CA certificate store, since reload_dtls_context may replace it before the handshake is verified against it.
+    if (ssl != NULL && !SSL_set1_verify_cert_store(ssl, SSL_CTX_get_cert_store(ctx->ssl_ctx))) {
+        SSL_free(ssl);
+        ssl = NULL;
+    }
+
+    pthread_mutex_unlock(&ctx->lock);
+    return ssl;
+}
+
 Context* init_server_dtls_context(int fd, const char* addr, int port, int use_v6, int verify_peer, const char* ca, const char* cert, const char* key, char* error) {
-    Context* ctx = (Context*)malloc(sizeof(Context));
+    Context* ctx = (Context*)calloc(1, sizeof(Context));
+    pthread_mutex_init(&ctx->lock, NULL);
 
     ctx->use_v6 = use_v6;
     ctx->fd = fd;
@@ -294,7 +320,8 @@ Context* init_server_dtls_context(int fd, const char* addr, int port, int use_v6
 }
 
 Context* init_client_dtls_context(const char* addr, int use_v6, int verify_peer, const char* ca, const char* cert, const char* key, char* error) {
-    Context* ctx = (Context*)malloc(sizeof(Context));
+    Context* ctx = (Context*)calloc(1, sizeof(Context));
+    pthread_mutex_init(&ctx->lock, NULL);
 
     ctx->use_v6 = use_v6;
     ctx->fd = -1;
@@ -331,6 +358,34 @@ Context* init_client_dtls_context(const char* addr, int use_v6, int verify_peer,
     return ctx;
 }
 
+void stop_dtls_context(Context* ctx) {
+    ctx->stopped = 1;
+}
+
+int reload_dtls_context(Context* ctx, const char* ca, const char* cert, const char* key, char* error) {
+    // Load the ca certificate into a new store, so that the current one stays in place if it can't be loaded.
+    X509_STORE* store = X509_STORE_new();
+    if (store == NULL) {
+        strcpy(error, "unable to create a new CA certificate store");
+        return 0;
+    }
+
+    if (!X509_STORE_load_locations(store, ca, NULL)) {
+        X509_STORE_free(store);
+        strcpy(error, "unable to load the specified CA certificate file");
+        return 0;
+    }
+
+    pthread_mutex_lock(&ctx->lock);
+
+    // The previous store is freed once the sessions holding on to it are done with it.
+    SSL_CTX_set_cert_store(ctx->ssl_ctx, store);
+    int ret = _set_ssl_key_pair(ctx->ssl_ctx, cert, key, error);
+
+    pthread_mutex_unlock(&ctx->lock);
+    return ret;
+}
+
 void free_dtls_context(Context* ctx) {
     if (ctx == NULL) {
         return;
@@ -348,7 +403,8 @@ void free_dtls_context(Context* ctx) {
 }
 
 Session* accept_dtls(Context* ctx, char* error) {
-    Session* session = (Session*)malloc(sizeof(Session));
+    Session* session = (Session*)calloc(1, sizeof(Session));
+    session->fd = -1;
 
     BIO* bio = BIO_new_dgram(ctx->fd, BIO_NOCLOSE);
     if (bio == NULL) {
@@ -357,7 +413,7 @@ Session* accept_dtls(Context* ctx, char* error) {
         return NULL;
     }
 
-    session->ssl = SSL_new(ctx->ssl_ctx);
+    session->ssl = _new_ssl(ctx);
     if (session->ssl == NULL) {
         strcpy(error, "unable to create the required SSL object for the new connection");
         free_dtls_session(session);
@@ -384,33 +440,25 @@ Session* accept_dtls(Context* ctx, char* error) {
     struct timeval timeout;
     timeout.tv_sec = 5;
     timeout.tv_usec = 0;
-    BIO_ctrl(SSL_get_rbio(session->ssl), BIO_CTRL_DGRAM_SET_RECV_TIMEOUT, 0, &timeout);
     BIO_ctrl(SSL_get_rbio(session->ssl), BIO_CTRL_DGRAM_SET_SEND_TIMEOUT, 0, &timeout);
 
+    // Wake up from listening periodically, so that a stopped context doesn't keep reading from the listening socket.
+    timeout.tv_sec = DTLS_LISTEN_TIMEOUT;
+    BIO_ctrl(SSL_get_rbio(session->ssl), BIO_CTRL_DGRAM_SET_RECV_TIMEOUT, 0, &timeout);
+
     int ret = 0;
     do { ret = DTLSv1_listen(session->ssl, peer_addr); }
-    while (ret == 0);
+    while (ret == 0 && !ctx->stopped);
 
-    if (ret < 0) {
-        strcpy(error, "unable to successfully preform CLIENT_HELLO/HELLO_VERIFY with the remote peer");
+    if (ret == 0) {
+        strcpy(error, "the context was stopped while listening for a new connection");
         BIO_ADDR_free(peer_addr);
         free_dtls_session(session);
         return NULL;
     }
 
-    ret = 0;
-    do { ret = SSL_accept(session->ssl); }
-    while (ret == 0);
-
     if (ret < 0) {
-        strcpy(error, "unable to successfully preform SSL_accept with the remote peer");
-        BIO_ADDR_free(peer_addr);
-        free_dtls_session(session);
-        return NULL;
-    }
-
-    if (SSL_get_verify_result(session->ssl) != X509_V_OK) {
-        strcpy(error, "unable to successfully verify the remote peer certificate");
+        strcpy(error, "unable to successfully preform CLIENT_HELLO/HELLO_VERIFY with the remote peer");
         BIO_ADDR_free(peer_addr);
         free_dtls_session(session);
         return NULL;
@@ -455,11 +503,29 @@ Session* accept_dtls(Context* ctx, char* error) {
 
     BIO_ADDR_free(peer_addr);
 
+    // Finish the handshake on the connection socket, so that nothing the peer sends once it completes ends up on the shared listening socket.
+    ret = 0;
+    do { ret = SSL_accept(session->ssl); }
+    while (ret == 0);
+
+    if (ret < 0) {
+        strcpy(error, "unable to successfully preform SSL_accept with the remote peer");
+        free_dtls_session(session);
+        return NULL;
+    }
+
+    if (SSL_get_verify_result(session->ssl) != X509_V_OK) {
+        strcpy(error, "unable to successfully verify the remote peer certificate");
+        free_dtls_session(session);
+        return NULL;
+    }
+
     return session;
 }
 
 Session* connect_dtls(Context* ctx, const char* addr, int port, char* error) {
-    Session* session = (Session*)malloc(sizeof(Session));
+    Session* session = (Session*)calloc(1, sizeof(Session));
+    session->fd = -1;
 
     if (ctx->use_v6) {
         session->remote_addr_len = sizeof(struct sockaddr_in6);
@@ -492,7 +558,14 @@ Session* connect_dtls(Context* ctx, const char* addr, int port, char* error) {
 
     BIO* bio = BIO_new_dgram(session->fd, BIO_NOCLOSE);
 
-    session->ssl = SSL_new(ctx->ssl_ctx);
+    session->ssl = _new_ssl(ctx);
+    if (session->ssl == NULL) {
+        strcpy(error, "unable to create the required SSL object for the new connection");
+        BIO_free(bio);
+        free_dtls_session(session);
+        return NULL;
+    }
+
     SSL_set_bio(session->ssl, bio, bio);
     SSL_set_connect_state(session->ssl);
 
@@ -554,12 +627,36 @@ void free_dtls_session(Session* session) {
         close(session->fd);
         session->fd = -1;
     }
+
+    if (session->remote_addr != NULL) {
+        free(session->remote_addr);
+        session->remote_addr = NULL;
+    }
+
+    free(session);
 }
 
 int get_dtls_fd(Session* session) {
     return session->fd;
 }
 
+int get_dtls_peer_certificate(Session* session, void* buf, int length) {
+    X509* cert = SSL_get_peer_certificate(session->ssl);
+    if (cert == NULL) {
+        return 0;
+    }
+
+    // Only write the DER encoded certificate out if it fits, the caller retries with a buffer of the returned length otherwise.
+    int needed = i2d_X509(cert, NULL);
+    if (needed > 0 && needed <= length) {
+        unsigned char* out = (unsigned char*)buf;
+        needed = i2d_X509(cert, &out);
+    }
+
+    X509_free(cert);
+    return needed;
+}
+
 int read_dtls(Session* session, void* buf, int length) {
     return SSL_read(session->ssl, buf, length);
 }
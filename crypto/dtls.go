@@ -5,7 +5,7 @@ package crypto
 
 /*
 // Need the openssl library binary blobs from the included submodule in 'quantum/vendor/openssl'.
-#cgo LDFLAGS: ${SRCDIR}/../vendor/openssl/libssl.a ${SRCDIR}/../vendor/openssl/libcrypto.a -ldl
+#cgo LDFLAGS: ${SRCDIR}/../vendor/openssl/libssl.a ${SRCDIR}/../vendor/openssl/libcrypto.a -ldl -lpthread
 #cgo CFLAGS: -g -Wno-deprecated -I${SRCDIR}/../vendor/openssl/include
 
 // Include the dtls glue for cgo <-> go
@@ -20,9 +20,10 @@ import (
 )
 
 const (
-	errorLen             = 120
-	initialized    int32 = 1
-	notInitialized int32 = 0
+	errorLen                 = 120
+	peerCertificateLen       = 4096
+	initialized        int32 = 1
+	notInitialized     int32 = 0
 )
 
 var state = notInitialized
@@ -103,6 +104,31 @@ func (dtls *DTLSContext) Connect(addr string, port int) (*DTLSSession, error) {
 	}, nil
 }
 
+// Stop makes a pending Accept return an error within a second, the context must not be closed until it has.
+func (dtls *DTLSContext) Stop() {
+	C.stop_dtls_context(dtls.ctx)
+}
+
+// Reload replaces the CA certificate, certificate and key of the context. Sessions opened afterwards use the new files, while the sessions already open are unaffected.
+func (dtls *DTLSContext) Reload(ca string, cert string, key string) error {
+	// Get the various converted strings.
+	err := generateErrorStr()
+	castr := C.CString(ca)
+	certstr := C.CString(cert)
+	keystr := C.CString(key)
+
+	// Ensure the C based strings get freed to mitigate any kind of memory leak.
+	defer C.free(unsafe.Pointer(err))
+	defer C.free(unsafe.Pointer(castr))
+	defer C.free(unsafe.Pointer(certstr))
+	defer C.free(unsafe.Pointer(keystr))
+
+	if C.reload_dtls_context(dtls.ctx, castr, certstr, keystr, err) == 0 {
+		return errors.New(C.GoString(err))
+	}
+	return nil
+}
+
 // Close destroys all traces of the DTLS struct.
 func (dtls *DTLSContext) Close() {
 	// Call into cgo to destroy the context using the openssl free/shutdown functions.
@@ -192,7 +218,23 @@ func (session *DTLSSession) Write(buf []byte) (int, bool) {
 	return int(wrote), true
 }
 
-// Close destroys all traces of the DTLSSession struct.
+// PeerCertificate returns the DER encoded certificate presented by the remote node during the handshake, or nil if it didn't present one.
+func (session *DTLSSession) PeerCertificate() []byte {
+	buf := make([]byte, peerCertificateLen)
+	length := int(C.get_dtls_peer_certificate(session.session, unsafe.Pointer(&buf[0]), C.int(len(buf))))
+
+	if length > len(buf) {
+		buf = make([]byte, length)
+		length = int(C.get_dtls_peer_certificate(session.session, unsafe.Pointer(&buf[0]), C.int(len(buf))))
+	}
+
+	if length <= 0 || length > len(buf) {
+		return nil
+	}
+	return buf[:length]
+}
+
+// Close destroys all traces of the DTLSSession struct, which must not be used or closed again afterwards.
 func (session *DTLSSession) Close() {
 	// Call into cgo to destroy the session using the openssl free/shutdown functions/
 	C.free_dtls_session(session.session)
@@ -14,17 +14,25 @@
 #include <openssl/engine.h>
 #include <sys/socket.h>
 #include <netdb.h>
+#include <pthread.h>
 
 #define COOKIE_SECRET_LENGTH 16
 #define SSL_CIPHER "ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384"
 #define CLIENT_CTX_PORT 0
 #define DTLS_MAX_MTU 1000
+#define DTLS_LISTEN_TIMEOUT 1
 
 typedef struct {
 	int fd;
     SSL_CTX* ssl_ctx;
     int use_v6;
 
+    // Set by stop_dtls_context to end a pending accept_dtls, which checks it between listening timeouts.
+    volatile int stopped;
+
+    // Guards the certificates of ssl_ctx, which reload_dtls_context replaces while sessions are being opened.
+    pthread_mutex_t lock;
+
     struct sockaddr* local_addr;
     unsigned int local_addr_len;
 } Context;
@@ -42,12 +50,15 @@ void destroy_dtls();
 
 Context* init_server_dtls_context(int fd, const char* addr, int port, int use_v6, int verify_peer, const char* ca, const char* cert, const char* key, char* error);
 Context* init_client_dtls_context(const char* addr, int use_v6, int verify_peer, const char* ca, const char* cert, const char* key, char* error);
+void stop_dtls_context(Context* ctx);
+int reload_dtls_context(Context* ctx, const char* ca, const char* cert, const char* key, char* error);
 void free_dtls_context(Context* ctx);
 
 Session* accept_dtls(Context* ctx, char* error);
 Session* connect_dtls(Context* ctx, const char* addr, int port, char* error);
 
 int get_dtls_fd(Session* session);
+int get_dtls_peer_certificate(Session* session, void* buf, int length);
 
 int read_dtls(Session* session, void* buf, int length);
 int write_dtls(Session* session, void* buf, int length);
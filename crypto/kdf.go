@@ -0,0 +1,18 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package crypto
+
+import (
+	"crypto/sha512"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// DeriveKey expands the supplied shared secret and salt into a 32 byte key using HKDF-SHA512. The info binds the key to a single purpose, so keys derived with different info are independent of each other.
+func DeriveKey(secret, salt, info []byte) []byte {
+	key := make([]byte, keyLength)
+	io.ReadFull(hkdf.New(sha512.New, secret, salt, info), key)
+	return key
+}
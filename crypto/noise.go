@@ -0,0 +1,357 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	noiseProtocol    = "Noise_IK_25519_AESGCM_SHA256"
+	noisePSKProtocol = "Noise_IKpsk2_25519_AESGCM_SHA256"
+	noiseTagSize     = 16
+
+	// NoiseInitiationOverhead is the size of the first handshake message, not counting its payload.
+	NoiseInitiationOverhead = keyLength + keyLength + noiseTagSize + noiseTagSize
+
+	// NoiseResponseOverhead is the size of the second handshake message, not counting its payload.
+	NoiseResponseOverhead = keyLength + noiseTagSize
+)
+
+// Handshake implements the initiator and responder sides of the Noise IK handshake pattern, using curve25519, AES-GCM and SHA256:
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
+//	<- e, ee, se
+//
+// The initiator must know the static public key of the responder up front, while the responder learns the static public key of the initiator from the first message. Both sides end up authenticated to each other, and the transport keys produced by Split only depend on ephemeral keys that are thrown away afterwards.
+//
+// When a pre-shared key is supplied the IKpsk2 variant is used instead, which mixes the pre-shared key in at the end of the second message so that the handshake only completes between holders of the pre-shared key.
+type Handshake struct {
+	initiator bool
+	step      int
+	psk       []byte
+
+	localPrivate  []byte
+	localPublic   []byte
+	remotePublic  []byte
+	ephemeralPriv []byte
+	ephemeralPub  []byte
+	remoteEphem   []byte
+
+	ck []byte
+	h  []byte
+	k  []byte
+	n  uint64
+}
+
+func (hs *Handshake) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(hs.h)
+	hash.Write(data)
+	hs.h = hash.Sum(nil)
+}
+
+func noiseHKDF(ck, ikm []byte, outputs int) [][]byte {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	out := make([][]byte, outputs)
+	var prev []byte
+	for i := 0; i < outputs; i++ {
+		mac = hmac.New(sha256.New, temp)
+		mac.Write(prev)
+		mac.Write([]byte{byte(i + 1)})
+		out[i] = mac.Sum(nil)
+		prev = out[i]
+	}
+	return out
+}
+
+func (hs *Handshake) mixKey(ikm []byte) {
+	out := noiseHKDF(hs.ck, ikm, 2)
+	hs.ck, hs.k = out[0], out[1]
+	hs.n = 0
+}
+
+func (hs *Handshake) mixKeyAndHash(ikm []byte) {
+	out := noiseHKDF(hs.ck, ikm, 3)
+	hs.ck = out[0]
+	hs.mixHash(out[1])
+	hs.k = out[2]
+	hs.n = 0
+}
+
+// mixEphemeral processes an ephemeral public key, which in psk handshakes is also mixed into the keys.
+func (hs *Handshake) mixEphemeral(pub []byte) {
+	hs.mixHash(pub)
+	if hs.psk != nil {
+		hs.mixKey(pub)
+	}
+}
+
+func (hs *Handshake) aead() (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(hs.k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[4:], hs.n)
+	hs.n++
+	return aead, nonce, nil
+}
+
+func (hs *Handshake) encryptAndHash(dst, plaintext []byte) ([]byte, error) {
+	aead, nonce, err := hs.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	start := len(dst)
+	dst = aead.Seal(dst, nonce, plaintext, hs.h)
+	hs.mixHash(dst[start:])
+	return dst, nil
+}
+
+func (hs *Handshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	aead, nonce, err := hs.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, hs.h)
+	if err != nil {
+		return nil, errors.New("handshake message failed to authenticate")
+	}
+
+	hs.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func dh(pub, priv []byte) ([]byte, error) {
+	secret := GenerateSharedSecret(pub, priv)
+
+	// Reject low order points, which would leave the output independent of the private key.
+	if subtle.ConstantTimeCompare(secret, make([]byte, keyLength)) == 1 {
+		return nil, errors.New("handshake public key is invalid")
+	}
+	return secret, nil
+}
+
+// WriteMessage returns the next handshake message carrying the supplied payload, which is encrypted and authenticated.
+func (hs *Handshake) WriteMessage(payload []byte) ([]byte, error) {
+	switch {
+	case hs.initiator && hs.step == 0:
+		msg := make([]byte, 0, NoiseInitiationOverhead+len(payload))
+
+		hs.ephemeralPub, hs.ephemeralPriv = GenerateECKeyPair()
+		hs.mixEphemeral(hs.ephemeralPub)
+		msg = append(msg, hs.ephemeralPub...)
+
+		es, err := dh(hs.remotePublic, hs.ephemeralPriv)
+		if err != nil {
+			return nil, err
+		}
+		hs.mixKey(es)
+
+		msg, err = hs.encryptAndHash(msg, hs.localPublic)
+		if err != nil {
+			return nil, err
+		}
+
+		ss, err := dh(hs.remotePublic, hs.localPrivate)
+		if err != nil {
+			return nil, err
+		}
+		hs.mixKey(ss)
+
+		msg, err = hs.encryptAndHash(msg, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		hs.step++
+		return msg, nil
+	case !hs.initiator && hs.step == 1:
+		msg := make([]byte, 0, NoiseResponseOverhead+len(payload))
+
+		hs.ephemeralPub, hs.ephemeralPriv = GenerateECKeyPair()
+		hs.mixEphemeral(hs.ephemeralPub)
+		msg = append(msg, hs.ephemeralPub...)
+
+		ee, err := dh(hs.remoteEphem, hs.ephemeralPriv)
+		if err != nil {
+			return nil, err
+		}
+		hs.mixKey(ee)
+
+		se, err := dh(hs.remotePublic, hs.ephemeralPriv)
+		if err != nil {
+			return nil, err
+		}
+		hs.mixKey(se)
+
+		if hs.psk != nil {
+			hs.mixKeyAndHash(hs.psk)
+		}
+
+		msg, err = hs.encryptAndHash(msg, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		hs.step++
+		return msg, nil
+	}
+
+	return nil, errors.New("handshake is not expecting to write a message")
+}
+
+// ReadMessage processes the next handshake message, returning its decrypted payload.
+func (hs *Handshake) ReadMessage(msg []byte) ([]byte, error) {
+	switch {
+	case !hs.initiator && hs.step == 0:
+		if len(msg) < NoiseInitiationOverhead {
+			return nil, errors.New("handshake message is too short")
+		}
+
+		hs.remoteEphem = append([]byte(nil), msg[:keyLength]...)
+		hs.mixEphemeral(hs.remoteEphem)
+
+		es, err := dh(hs.remoteEphem, hs.localPrivate)
+		if err != nil {
+			return nil, err
+		}
+		hs.mixKey(es)
+
+		remotePublic, err := hs.decryptAndHash(msg[keyLength : 2*keyLength+noiseTagSize])
+		if err != nil {
+			return nil, err
+		}
+		hs.remotePublic = remotePublic
+
+		ss, err := dh(hs.remotePublic, hs.localPrivate)
+		if err != nil {
+			return nil, err
+		}
+		hs.mixKey(ss)
+
+		payload, err := hs.decryptAndHash(msg[2*keyLength+noiseTagSize:])
+		if err != nil {
+			return nil, err
+		}
+
+		hs.step++
+		return payload, nil
+	case hs.initiator && hs.step == 1:
+		if len(msg) < NoiseResponseOverhead {
+			return nil, errors.New("handshake message is too short")
+		}
+
+		hs.remoteEphem = append([]byte(nil), msg[:keyLength]...)
+		hs.mixEphemeral(hs.remoteEphem)
+
+		ee, err := dh(hs.remoteEphem, hs.ephemeralPriv)
+		if err != nil {
+			return nil, err
+		}
+		hs.mixKey(ee)
+
+		se, err := dh(hs.remoteEphem, hs.localPrivate)
+		if err != nil {
+			return nil, err
+		}
+		hs.mixKey(se)
+
+		if hs.psk != nil {
+			hs.mixKeyAndHash(hs.psk)
+		}
+
+		payload, err := hs.decryptAndHash(msg[keyLength:])
+		if err != nil {
+			return nil, err
+		}
+
+		hs.step++
+		return payload, nil
+	}
+
+	return nil, errors.New("handshake is not expecting to read a message")
+}
+
+// RemoteStatic returns the static public key of the remote side, which for responders is only known after reading the first message.
+func (hs *Handshake) RemoteStatic() []byte {
+	return hs.remotePublic
+}
+
+// Split returns the transport keys for sending and receiving once the handshake has completed, after which the handshake state is wiped.
+func (hs *Handshake) Split() ([]byte, []byte, error) {
+	if hs.step != 2 {
+		return nil, nil, errors.New("handshake has not completed")
+	}
+
+	keys := noiseHKDF(hs.ck, nil, 2)
+	initiatorKey, responderKey := keys[0], keys[1]
+
+	hs.ephemeralPriv = nil
+	hs.ck, hs.k = nil, nil
+	hs.step++
+
+	if hs.initiator {
+		return initiatorKey, responderKey, nil
+	}
+	return responderKey, initiatorKey, nil
+}
+
+func newHandshake(initiator bool, localPrivate, localPublic, remotePublic, prologue, psk []byte) *Handshake {
+	hs := &Handshake{
+		initiator:    initiator,
+		psk:          psk,
+		localPrivate: localPrivate,
+		localPublic:  localPublic,
+		remotePublic: remotePublic,
+	}
+
+	protocol := noiseProtocol
+	if psk != nil {
+		protocol = noisePSKProtocol
+	}
+
+	hs.h = make([]byte, sha256.Size)
+	copy(hs.h, protocol)
+	hs.ck = append([]byte(nil), hs.h...)
+	hs.mixHash(prologue)
+
+	// The static public key of the responder is known to both sides ahead of time.
+	if initiator {
+		hs.mixHash(remotePublic)
+	} else {
+		hs.mixHash(localPublic)
+	}
+	return hs
+}
+
+// NewInitiatorHandshake starts a handshake towards the remote node owning the supplied static public key, the pre-shared key is optional and must be 32 bytes long when set.
+func NewInitiatorHandshake(localPrivate, localPublic, remotePublic, prologue, psk []byte) *Handshake {
+	return newHandshake(true, localPrivate, localPublic, remotePublic, prologue, psk)
+}
+
+// NewResponderHandshake prepares to answer a handshake started by a remote node, the pre-shared key is optional and must be 32 bytes long when set.
+func NewResponderHandshake(localPrivate, localPublic, prologue, psk []byte) *Handshake {
+	return newHandshake(false, localPrivate, localPublic, nil, prologue, psk)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package crypto
+
+import (
+	"sync"
+)
+
+const (
+	replayBlockBits = 64
+	replayBlocks    = 32
+
+	// ReplayWindowSize is the number of counters behind the highest accepted counter that are still tracked, anything older is rejected outright.
+	ReplayWindowSize = (replayBlocks - 1) * replayBlockBits
+)
+
+// ReplayWindow is a sliding window anti-replay filter for the packet counters of a single sender, modeled after RFC 6479.
+type ReplayWindow struct {
+	mux    sync.Mutex
+	last   uint64
+	blocks [replayBlocks]uint64
+}
+
+// Accept returns whether or not the counter has not been seen before and is still within the window, recording it as seen.
+//
+// Only counters of authenticated packets should be passed to Accept, otherwise forged counters could be used to advance the window.
+func (window *ReplayWindow) Accept(counter uint64) bool {
+	window.mux.Lock()
+	defer window.mux.Unlock()
+
+	if counter < window.last && window.last-counter > ReplayWindowSize {
+		return false
+	}
+
+	index := counter / replayBlockBits
+	if counter > window.last {
+		current := window.last / replayBlockBits
+		diff := index - current
+		if diff > replayBlocks {
+			diff = replayBlocks
+		}
+
+		for i := uint64(1); i <= diff; i++ {
+			window.blocks[(current+i)%replayBlocks] = 0
+		}
+		window.last = counter
+	}
+
+	block := &window.blocks[index%replayBlocks]
+	bit := uint64(1) << (counter % replayBlockBits)
+	if *block&bit != 0 {
+		return false
+	}
+
+	*block |= bit
+	return true
+}
@@ -5,6 +5,7 @@ package datastore
 
 import (
 	"errors"
+	"net"
 	"time"
 
 	"github.com/supernomad/quantum/common"
@@ -20,7 +21,9 @@ const (
 	// MOCKDatastore will tell quantum to use a moked out backend datastore for testing.
 	MOCKDatastore
 
-	lockTTL = 10 * time.Second
+	lockTTL    = 10 * time.Second
+	punchTTL   = 30 * time.Second
+	requestTTL = 5 * time.Minute
 )
 
 // Datastore interface for quantum to use for retrieving mapping data from the backend datastore.
@@ -31,6 +34,39 @@ type Datastore interface {
 	// Mapping should return the mapping and true if it exists, if not the mapping should be nil and false should be returned along with it.
 	Mapping(ip uint32) (*common.Mapping, bool)
 
+	// Mappings should return a snapshot of all of the mappings currently known to the datastore.
+	Mappings() []*common.Mapping
+
+	// Fetch should retrieve the current mapping for the supplied private ip address from the backend, replacing the one held locally.
+	Fetch(ip net.IP) error
+
+	// Publish should update the local mapping within the datastore to reflect changes made to the local configuration at runtime.
+	Publish() error
+
+	// Punch should ask the node assigned the supplied private ip address to punch a hole through its NAT towards the local node.
+	Punch(ip net.IP) error
+
+	// Punches should return a channel of the private ip addresses of the remote nodes asking the local node to punch a hole towards them.
+	Punches() <-chan net.IP
+
+	// Enroll should post the certificate request of the local node, for the signers of the built-in certificate authority to handle.
+	Enroll(request *common.CertificateRequest) error
+
+	// Issued should return the certificate last issued to the node with the supplied machine id by the built-in certificate authority, or nil if there is none.
+	Issued(machineID string) (*common.IssuedCertificate, error)
+
+	// Requests should return the pending certificate requests of the nodes enrolling with the built-in certificate authority.
+	Requests() ([]*common.CertificateRequest, error)
+
+	// Redeem should consume the supplied one-time join token, returning an error if it doesn't exist or has already been used.
+	Redeem(token string) error
+
+	// Issue should store the certificate issued in response to the request, and remove the request.
+	Issue(request *common.CertificateRequest, issued *common.IssuedCertificate) error
+
+	// Reject should remove the request without issuing a certificate.
+	Reject(request *common.CertificateRequest) error
+
 	// Start should kick off any routines that need to run in the background to groom the mappings and manage the datastore state.
 	Start()
 
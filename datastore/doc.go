@@ -25,5 +25,24 @@ The data structure itself is as follows:
 	  "ipv6": "fd00:dead:beef::2",
 	  "port": 1099
 	}
+
+Revoked DTLS certificates are stored alongside the mappings, keyed by their hexadecimal serial number with any value. Nodes using the DTLS backend reject handshakes with them and close the sessions already open with them.
+	Etcd Example:
+	quantum/revoked/1a2b
+
+The built-in certificate authority uses the datastore to exchange certificate requests and issued certificates between the nodes and the signers. Join tokens are created by the operator with any value and are deleted once used, pending requests are keyed by the machine id of the requesting node and expire after five minutes, and issued certificates are keyed by the machine id of the node they were issued to and expire along with the certificate.
+	Etcd Example:
+	quantum/tokens/4c1f0a6e2d
+	quantum/csrs/b8fc945e893cfd55dc6170b6a4f6471d5790fa279e020410f435759ba9e3f0c5
+	{
+	  "machineID": "b8fc945e893cfd55dc6170b6a4f6471d5790fa279e020410f435759ba9e3f0c5",
+	  "csr": "LS0tLS1CRUdJTi...",
+	  "token": "4c1f0a6e2d"
+	}
+	quantum/certs/b8fc945e893cfd55dc6170b6a4f6471d5790fa279e020410f435759ba9e3f0c5
+	{
+	  "certificate": "LS0tLS1CRUdJTi...",
+	  "ca": "LS0tLS1CRUdJTi..."
+	}
 */
 package datastore
@@ -8,8 +8,10 @@ import (
 	"crypto/x509"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/client"
@@ -20,6 +22,7 @@ import (
 // Etcd datastore struct for interacting with the coreos etcd key/value datastore.
 type Etcd struct {
 	cfg                 *common.Config
+	mux                 sync.RWMutex
 	mappings            map[uint32]*common.Mapping
 	ctx                 context.Context
 	cli                 client.Client
@@ -29,6 +32,16 @@ type Etcd struct {
 	stopRefreshingLock  chan struct{}
 	stopRefreshingLease chan struct{}
 	stopWatchingNodes   chan struct{}
+	stopWatchingPunches context.CancelFunc
+	stopWatchingRevoked context.CancelFunc
+	punches             chan net.IP
+	floatingMux         sync.Mutex
+	floating            map[string]*floatingLock
+}
+
+type floatingLock struct {
+	index int
+	value string
 }
 
 func isError(err error, codes ...int) bool {
@@ -76,7 +89,10 @@ func (etcd *Etcd) handleNetworkConfig() error {
 }
 
 func (etcd *Etcd) handleLocalMapping() error {
+	etcd.mux.RLock()
 	mapping, err := common.GenerateLocalMapping(etcd.cfg, etcd.mappings)
+	etcd.mux.RUnlock()
+
 	if err != nil {
 		return errors.New("error generating the local network mapping: " + err.Error())
 	}
@@ -96,7 +112,7 @@ func (etcd *Etcd) handleLocalMapping() error {
 	return nil
 }
 
-func (etcd *Etcd) lockFloatingIP(key, value string) {
+func (etcd *Etcd) lockFloatingIP(key string, i int) {
 	opts := &client.SetOptions{
 		PrevExist: client.PrevNoExist,
 		TTL:       etcd.cfg.DatastoreFloatingIPTTL,
@@ -104,7 +120,15 @@ func (etcd *Etcd) lockFloatingIP(key, value string) {
 
 	stop := make(chan struct{})
 	for {
+		// Regenerate the mapping on every attempt so that it carries the current keys.
+		value := common.NewFloatingMapping(etcd.cfg, i).String()
+
+		etcd.floatingMux.Lock()
 		_, err := etcd.kapi.Set(etcd.ctx, key, value, opts)
+		if err == nil {
+			etcd.floating[key] = &floatingLock{index: i, value: value}
+		}
+		etcd.floatingMux.Unlock()
 
 		if err != nil && !isError(err, client.ErrorCodeNodeExist) {
 			etcd.cfg.Log.Error.Println("[ETCD]", "Error attempting to set floating mapping in etcd: "+err.Error())
@@ -116,39 +140,53 @@ func (etcd *Etcd) lockFloatingIP(key, value string) {
 		}
 
 		etcd.refresh(key, value, etcd.cfg.DatastoreFloatingIPTTL, etcd.cfg.DatastoreFloatingIPTTL/2, stop)
+
+		etcd.floatingMux.Lock()
+		delete(etcd.floating, key)
+		etcd.floatingMux.Unlock()
 	}
 }
 
 func (etcd *Etcd) handleFloatingMappings() error {
+	etcd.mux.RLock()
+	defer etcd.mux.RUnlock()
+
 	for i := 0; i < len(etcd.cfg.FloatingIPs); i++ {
 		mapping, err := common.GenerateFloatingMapping(etcd.cfg, i, etcd.mappings)
 		if err != nil {
 			return err
 		}
 
-		go etcd.lockFloatingIP(etcd.key("nodes", mapping.PrivateIP.String()), mapping.String())
+		go etcd.lockFloatingIP(etcd.key("nodes", mapping.PrivateIP.String()), i)
 	}
 
 	return nil
 }
 
+// refresh keeps the supplied key alive as long as it still holds value, for held floating ip locks the value is the one last published by this node.
 func (etcd *Etcd) refresh(key, value string, ttl, refreshInterval time.Duration, stop chan struct{}) {
 	ticker := time.NewTicker(refreshInterval)
 
-	opts := &client.SetOptions{
-		PrevValue: value,
-		PrevExist: client.PrevExist,
-		TTL:       ttl,
-		Refresh:   true,
-	}
-
 	stopRefreshing := false
 	for !stopRefreshing {
 		select {
 		case <-stop:
 			stopRefreshing = true
 		case <-ticker.C:
+			opts := &client.SetOptions{
+				PrevValue: value,
+				PrevExist: client.PrevExist,
+				TTL:       ttl,
+				Refresh:   true,
+			}
+
+			etcd.floatingMux.Lock()
+			if lock, ok := etcd.floating[key]; ok {
+				opts.PrevValue = lock.value
+			}
 			_, err := etcd.kapi.Set(etcd.ctx, key, "", opts)
+			etcd.floatingMux.Unlock()
+
 			if err != nil {
 				etcd.cfg.Log.Error.Println("[ETCD]", "Error refreshing key in etcd: "+err.Error())
 				if isError(err, client.ErrorCodeKeyNotFound, client.ErrorCodePrevValueRequired, client.ErrorCodeTestFailed) {
@@ -223,7 +261,33 @@ func (etcd *Etcd) sync() error {
 		}
 		mappings[common.IPtoInt(mapping.PrivateIP)] = mapping
 	}
+
+	etcd.mux.Lock()
 	etcd.mappings = mappings
+	etcd.mux.Unlock()
+
+	return etcd.syncRevoked()
+}
+
+func (etcd *Etcd) syncRevoked() error {
+	var nodes client.Nodes
+	resp, err := etcd.kapi.Get(etcd.ctx, etcd.key("revoked"), &client.GetOptions{Recursive: true})
+
+	if err != nil {
+		if !isError(err, client.ErrorCodeKeyNotFound) {
+			return errors.New("error retrieving the revoked certificates from etcd: " + err.Error())
+		}
+		nodes = make(client.Nodes, 0)
+	} else {
+		nodes = resp.Node.Nodes
+	}
+
+	serials := make([]string, len(nodes))
+	for i := 0; i < len(nodes); i++ {
+		serials[i] = path.Base(nodes[i].Key)
+	}
+
+	etcd.cfg.Revocations.Set(serials)
 	return nil
 }
 
@@ -260,7 +324,9 @@ func (etcd *Etcd) watch() {
 						etcd.cfg.Log.Error.Println("[ETCD]", "Error parsing mapping: "+err.Error())
 						continue
 					}
+					etcd.mux.Lock()
 					etcd.mappings[common.IPtoInt(mapping.PrivateIP)] = mapping
+					etcd.mux.Unlock()
 				}
 			case "delete", "expire":
 				for _, node := range nodes {
@@ -269,19 +335,259 @@ func (etcd *Etcd) watch() {
 						etcd.cfg.Log.Error.Println("[ETCD]", "Error parsing mapping: "+err.Error())
 						continue
 					}
+					etcd.mux.Lock()
 					delete(etcd.mappings, common.IPtoInt(mapping.PrivateIP))
+					etcd.mux.Unlock()
 				}
 			}
 		}
 	}
 }
 
+func (etcd *Etcd) watchPunches(ctx context.Context) {
+	watcher := etcd.kapi.Watcher(etcd.key("punch", etcd.cfg.PrivateIP.String()), &client.WatcherOptions{Recursive: true})
+
+	for {
+		resp, err := watcher.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			etcd.cfg.Log.Error.Println("[ETCD]", "Error during punch watch on the etcd cluster: "+err.Error())
+			time.Sleep(5 * time.Second)
+
+			go etcd.watchPunches(ctx)
+			return
+		}
+
+		switch resp.Action {
+		case "set", "update", "create":
+			ip := net.ParseIP(path.Base(resp.Node.Key))
+			if ip == nil {
+				continue
+			}
+
+			select {
+			case etcd.punches <- ip:
+			default:
+			}
+		}
+	}
+}
+
+// watchRevoked resynchronizes the revoked certificates whenever they change, rather than waiting for the next full sync.
+func (etcd *Etcd) watchRevoked(ctx context.Context) {
+	watcher := etcd.kapi.Watcher(etcd.key("revoked"), &client.WatcherOptions{Recursive: true})
+
+	for {
+		_, err := watcher.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			etcd.cfg.Log.Error.Println("[ETCD]", "Error during revoked certificate watch on the etcd cluster: "+err.Error())
+			time.Sleep(5 * time.Second)
+
+			go etcd.watchRevoked(ctx)
+			return
+		}
+
+		if err := etcd.syncRevoked(); err != nil {
+			etcd.cfg.Log.Error.Println("[ETCD]", "Error synchronizing revoked certificates with the backend: "+err.Error())
+		}
+	}
+}
+
 // Mapping returns a mapping and true based on the supplied uint32 representation of an ipv4 address if it exists within the datastore, otherwise it returns nil for the mapping and false.
 func (etcd *Etcd) Mapping(ip uint32) (*common.Mapping, bool) {
+	etcd.mux.RLock()
+	defer etcd.mux.RUnlock()
+
 	mapping, exists := etcd.mappings[ip]
 	return mapping, exists
 }
 
+// Mappings returns a snapshot of all of the mappings currently known to the datastore.
+func (etcd *Etcd) Mappings() []*common.Mapping {
+	etcd.mux.RLock()
+	defer etcd.mux.RUnlock()
+
+	mappings := make([]*common.Mapping, 0, len(etcd.mappings))
+	for _, mapping := range etcd.mappings {
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// Fetch retrieves the current mapping for the supplied private ip address from etcd, replacing the one held locally or forgetting it if it no longer exists.
+func (etcd *Etcd) Fetch(ip net.IP) error {
+	resp, err := etcd.kapi.Get(etcd.ctx, etcd.key("nodes", ip.String()), nil)
+	if err != nil {
+		if isError(err, client.ErrorCodeKeyNotFound) {
+			etcd.mux.Lock()
+			delete(etcd.mappings, common.IPtoInt(ip))
+			etcd.mux.Unlock()
+			return nil
+		}
+		return errors.New("error retrieving a mapping from etcd: " + err.Error())
+	}
+
+	mapping, err := common.ParseMapping(resp.Node.Value, etcd.cfg)
+	if err != nil {
+		return errors.New("error parsing a mapping retrieved from etcd: " + err.Error())
+	}
+
+	etcd.mux.Lock()
+	etcd.mappings[common.IPtoInt(mapping.PrivateIP)] = mapping
+	etcd.mux.Unlock()
+	return nil
+}
+
+// Publish updates the local mapping within etcd to reflect changes made to the local configuration at runtime.
+func (etcd *Etcd) Publish() error {
+	key := etcd.key("nodes", etcd.cfg.PrivateIP.String())
+	opts := &client.SetOptions{
+		PrevExist: client.PrevExist,
+		TTL:       etcd.cfg.NetworkConfig.LeaseTime,
+	}
+
+	_, err := etcd.kapi.Set(etcd.ctx, key, common.NewMapping(etcd.cfg).String(), opts)
+	if err != nil {
+		return errors.New("error publishing the local network mapping in etcd: " + err.Error())
+	}
+
+	etcd.floatingMux.Lock()
+	defer etcd.floatingMux.Unlock()
+
+	for key, lock := range etcd.floating {
+		value := common.NewFloatingMapping(etcd.cfg, lock.index).String()
+		opts := &client.SetOptions{
+			PrevValue: lock.value,
+			PrevExist: client.PrevExist,
+			TTL:       etcd.cfg.DatastoreFloatingIPTTL,
+		}
+
+		_, err := etcd.kapi.Set(etcd.ctx, key, value, opts)
+		if err != nil {
+			return errors.New("error publishing a floating network mapping in etcd: " + err.Error())
+		}
+		lock.value = value
+	}
+	return nil
+}
+
+// Punch asks the node assigned the supplied private ip address to punch a hole through its NAT towards the local node.
+func (etcd *Etcd) Punch(ip net.IP) error {
+	key := etcd.key("punch", ip.String(), etcd.cfg.PrivateIP.String())
+	opts := &client.SetOptions{
+		TTL: punchTTL,
+	}
+
+	_, err := etcd.kapi.Set(etcd.ctx, key, etcd.cfg.MachineID, opts)
+	if err != nil {
+		return errors.New("error requesting a hole punch in etcd: " + err.Error())
+	}
+	return nil
+}
+
+// Punches returns a channel of the private ip addresses of the remote nodes asking the local node to punch a hole towards them.
+func (etcd *Etcd) Punches() <-chan net.IP {
+	return etcd.punches
+}
+
+// Enroll posts the certificate request of the local node in etcd, where it is kept until it is handled or expires.
+func (etcd *Etcd) Enroll(request *common.CertificateRequest) error {
+	key := etcd.key("csrs", request.MachineID)
+	opts := &client.SetOptions{
+		TTL: requestTTL,
+	}
+
+	_, err := etcd.kapi.Set(etcd.ctx, key, request.String(), opts)
+	if err != nil {
+		return errors.New("error posting the certificate request in etcd: " + err.Error())
+	}
+	return nil
+}
+
+// Issued returns the certificate last issued to the node with the supplied machine id, or nil if there is none or it has expired.
+func (etcd *Etcd) Issued(machineID string) (*common.IssuedCertificate, error) {
+	resp, err := etcd.kapi.Get(etcd.ctx, etcd.key("certs", machineID), nil)
+	if err != nil {
+		if isError(err, client.ErrorCodeKeyNotFound) {
+			return nil, nil
+		}
+		return nil, errors.New("error retrieving an issued certificate from etcd: " + err.Error())
+	}
+
+	issued, err := common.ParseIssuedCertificate(resp.Node.Value)
+	if err != nil {
+		return nil, errors.New("error parsing an issued certificate retrieved from etcd: " + err.Error())
+	}
+	return issued, nil
+}
+
+// Requests returns the pending certificate requests, skipping any that can't be parsed.
+func (etcd *Etcd) Requests() ([]*common.CertificateRequest, error) {
+	resp, err := etcd.kapi.Get(etcd.ctx, etcd.key("csrs"), &client.GetOptions{Recursive: true})
+	if err != nil {
+		if isError(err, client.ErrorCodeKeyNotFound) {
+			return nil, nil
+		}
+		return nil, errors.New("error retrieving the certificate requests from etcd: " + err.Error())
+	}
+
+	requests := make([]*common.CertificateRequest, 0, len(resp.Node.Nodes))
+	for _, node := range resp.Node.Nodes {
+		request, err := common.ParseCertificateRequest(node.Value)
+		if err != nil || request.MachineID != path.Base(node.Key) {
+			etcd.cfg.Log.Error.Println("[ETCD]", "Error parsing the certificate request", node.Key)
+			continue
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+// Redeem deletes the supplied join token from etcd, which only succeeds for the first node redeeming it.
+func (etcd *Etcd) Redeem(token string) error {
+	if token == "" || path.Base(token) != token {
+		return errors.New("the join token is invalid")
+	}
+
+	_, err := etcd.kapi.Delete(etcd.ctx, etcd.key("tokens", token), nil)
+	if err != nil {
+		if isError(err, client.ErrorCodeKeyNotFound) {
+			return errors.New("the join token doesn't exist or has already been used")
+		}
+		return errors.New("error redeeming the join token in etcd: " + err.Error())
+	}
+	return nil
+}
+
+// Issue stores the certificate issued in response to the request in etcd until it expires, and removes the request.
+func (etcd *Etcd) Issue(request *common.CertificateRequest, issued *common.IssuedCertificate) error {
+	opts := &client.SetOptions{
+		TTL: etcd.cfg.DTLSCertTTL,
+	}
+
+	_, err := etcd.kapi.Set(etcd.ctx, etcd.key("certs", request.MachineID), issued.String(), opts)
+	if err != nil {
+		return errors.New("error storing an issued certificate in etcd: " + err.Error())
+	}
+	return etcd.Reject(request)
+}
+
+// Reject removes the request from etcd.
+func (etcd *Etcd) Reject(request *common.CertificateRequest) error {
+	_, err := etcd.kapi.Delete(etcd.ctx, etcd.key("csrs", request.MachineID), nil)
+	if err != nil && !isError(err, client.ErrorCodeKeyNotFound) {
+		return errors.New("error removing a certificate request from etcd: " + err.Error())
+	}
+	return nil
+}
+
 // Init the Etcd datastore which will open any necessary connections, preform an initial sync of the datastore, and define the local mapping in the datastore.
 func (etcd *Etcd) Init() error {
 	err := etcd.lock()
@@ -320,6 +626,14 @@ func (etcd *Etcd) Init() error {
 func (etcd *Etcd) Start() {
 	go etcd.watch()
 
+	ctx, cancel := context.WithCancel(etcd.ctx)
+	etcd.stopWatchingPunches = cancel
+	go etcd.watchPunches(ctx)
+
+	ctx, cancel = context.WithCancel(etcd.ctx)
+	etcd.stopWatchingRevoked = cancel
+	go etcd.watchRevoked(ctx)
+
 	ticker := time.NewTicker(etcd.cfg.DatastoreSyncInterval)
 	go func() {
 	loop:
@@ -341,6 +655,8 @@ func (etcd *Etcd) Start() {
 
 // Stop synchronizing with the backend and shutdown open connections.
 func (etcd *Etcd) Stop() {
+	etcd.stopWatchingPunches()
+	etcd.stopWatchingRevoked()
 	etcd.stopSyncing <- struct{}{}
 	etcd.stopRefreshingLease <- struct{}{}
 	etcd.stopWatchingNodes <- struct{}{}
@@ -420,5 +736,7 @@ func newEtcd(cfg *common.Config) (Datastore, error) {
 		stopRefreshingLock:  make(chan struct{}),
 		stopRefreshingLease: make(chan struct{}),
 		stopWatchingNodes:   make(chan struct{}),
+		punches:             make(chan net.IP, 16),
+		floating:            make(map[string]*floatingLock),
 	}, nil
 }
@@ -4,12 +4,27 @@
 package datastore
 
 import (
+	"errors"
+	"net"
+	"sync"
+
 	"github.com/supernomad/quantum/common"
 )
 
 // Mock datastore struct for testing.
 type Mock struct {
 	InternalMapping *common.Mapping
+	Published       int
+	Punched         []net.IP
+	Fetched         []net.IP
+	Pending         []*common.CertificateRequest
+	Certificates    map[string]*common.IssuedCertificate
+	Tokens          map[string]bool
+
+	// Fetches receives the private ip supplied to Fetch when set, so that tests can wait on fetches made from other goroutines.
+	Fetches chan net.IP
+
+	mux sync.Mutex
 }
 
 // Mapping always returns the internal mapping and true.
@@ -17,6 +32,93 @@ func (mock *Mock) Mapping(ip uint32) (*common.Mapping, bool) {
 	return mock.InternalMapping, true
 }
 
+// Mappings always returns a slice containing only the internal mapping.
+func (mock *Mock) Mappings() []*common.Mapping {
+	return []*common.Mapping{mock.InternalMapping}
+}
+
+// Fetch which just records the supplied private ip, and sends it to the fetches channel when set.
+func (mock *Mock) Fetch(ip net.IP) error {
+	mock.mux.Lock()
+	mock.Fetched = append(mock.Fetched, ip)
+	fetches := mock.Fetches
+	mock.mux.Unlock()
+
+	if fetches != nil {
+		fetches <- ip
+	}
+	return nil
+}
+
+// Publish which just counts the number of times it was called.
+func (mock *Mock) Publish() error {
+	mock.Published++
+	return nil
+}
+
+// Punch which just records the supplied private ip.
+func (mock *Mock) Punch(ip net.IP) error {
+	mock.Punched = append(mock.Punched, ip)
+	return nil
+}
+
+// Punches which returns a nil channel that never delivers a request.
+func (mock *Mock) Punches() <-chan net.IP {
+	return nil
+}
+
+// Enroll which replaces any pending request of the same node with the supplied one.
+func (mock *Mock) Enroll(request *common.CertificateRequest) error {
+	mock.remove(request.MachineID)
+	mock.Pending = append(mock.Pending, request)
+	return nil
+}
+
+// Issued which returns the certificate recorded for the supplied machine id.
+func (mock *Mock) Issued(machineID string) (*common.IssuedCertificate, error) {
+	return mock.Certificates[machineID], nil
+}
+
+// Requests which returns the pending requests.
+func (mock *Mock) Requests() ([]*common.CertificateRequest, error) {
+	return mock.Pending, nil
+}
+
+// Redeem which consumes the supplied token if it is one of the recorded tokens.
+func (mock *Mock) Redeem(token string) error {
+	if !mock.Tokens[token] {
+		return errors.New("the join token doesn't exist or has already been used")
+	}
+	delete(mock.Tokens, token)
+	return nil
+}
+
+// Issue which records the issued certificate and removes the request.
+func (mock *Mock) Issue(request *common.CertificateRequest, issued *common.IssuedCertificate) error {
+	if mock.Certificates == nil {
+		mock.Certificates = make(map[string]*common.IssuedCertificate)
+	}
+	mock.Certificates[request.MachineID] = issued
+	mock.remove(request.MachineID)
+	return nil
+}
+
+// Reject which removes the request.
+func (mock *Mock) Reject(request *common.CertificateRequest) error {
+	mock.remove(request.MachineID)
+	return nil
+}
+
+func (mock *Mock) remove(machineID string) {
+	pending := mock.Pending[:0]
+	for i := 0; i < len(mock.Pending); i++ {
+		if mock.Pending[i].MachineID != machineID {
+			pending = append(pending, mock.Pending[i])
+		}
+	}
+	mock.Pending = pending
+}
+
 // Init which is a noop.
 func (mock *Mock) Init() error {
 	return nil
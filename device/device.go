@@ -13,6 +13,9 @@ const (
 	// TUNDevice creates and manages a TUN based network device.
 	TUNDevice = "tun"
 
+	// TAPDevice creates and manages a TAP based network device.
+	TAPDevice = "tap"
+
 	// MOCKDevice creates and manages a mocked out network device for testing.
 	MOCKDevice = "mock"
 )
@@ -20,8 +23,10 @@ const (
 const (
 	ifNameSize    = 16
 	iffTun        = 0x0001
+	iffTap        = 0x0002
 	iffNoPi       = 0x1000
 	iffMultiQueue = 0x0100
+	iffVnetHdr    = 0x4000
 )
 
 type ifReq struct {
@@ -47,11 +52,19 @@ type Device interface {
 	Queues() []int
 }
 
+// Flusher interface for devices which hold back the packets written to them in order to coalesce them, and so need to be told when no more packets are coming for now.
+type Flusher interface {
+	// Flush should write the packets held back on the specified device queue.
+	Flush(queue int) bool
+}
+
 // New will generate a new Device struct based on the supplied device deviceType and user configuration
 func New(deviceType string, cfg *common.Config) (Device, error) {
 	switch deviceType {
 	case TUNDevice:
 		return newTUN(cfg)
+	case TAPDevice:
+		return newTAP(cfg)
 	case MOCKDevice:
 		return newMock(cfg)
 	}
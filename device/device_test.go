@@ -4,12 +4,15 @@
 package device
 
 import (
+	"bytes"
+	"encoding/binary"
 	"net"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/supernomad/quantum/common"
+	"github.com/vishvananda/netlink"
 	"golang.org/x/net/ipv4"
 )
 
@@ -58,6 +61,7 @@ func TestTUN(t *testing.T) {
 	tun, err := New(TUNDevice, &common.Config{
 		NumWorkers:    1,
 		DeviceName:    "quantum%d",
+		MTU:           common.MaxMTU,
 		PrivateIP:     net.ParseIP("10.99.0.1"),
 		NetworkConfig: DefaultNetworkConfig,
 		ReuseFDS:      false,
@@ -111,3 +115,190 @@ func TestTUN(t *testing.T) {
 		t.Fatalf("Failed to close the TUN device: %s", err.Error())
 	}
 }
+
+func TestTAP(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.98.0.0/16")
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	tap, err := New(TAPDevice, &common.Config{
+		NumWorkers:    1,
+		DeviceName:    "quantumtap%d",
+		MTU:           1400,
+		PrivateIP:     net.ParseIP("10.98.0.1"),
+		HardwareAddr:  mac,
+		NetworkConfig: &common.NetworkConfig{IPNet: ipnet},
+		ReuseFDS:      false,
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to create TAP device: %s", err.Error())
+	}
+
+	link, err := netlink.LinkByName(tap.Name())
+	if err != nil {
+		t.Fatalf("Failed to find the TAP device: %s", err.Error())
+	}
+	if link.Attrs().HardwareAddr.String() != mac.String() || link.Attrs().MTU != 1400-common.TAPOverhead {
+		t.Fatal("Failed to properly set the TAP device mac address and MTU.")
+	}
+
+	buf := make([]byte, common.MaxBufferLength)
+	payload := common.NewTunPayload(buf, common.FrameHeaderSize+common.EthernetHeaderSize+28)
+	if tap.Write(0, payload) {
+		t.Fatal("The TAP device shouldn't write packets that don't carry a frame.")
+	}
+
+	payload.Packet[0] = common.FrameMarker
+	copy(payload.Packet[common.FrameStart:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0x02, 0x08, 0x06})
+	if !tap.Write(0, payload) {
+		t.Fatal("Failed to write the frame to the tap device")
+	}
+
+	if err := tap.Close(); err != nil {
+		t.Fatalf("Failed to close the TAP device: %s", err.Error())
+	}
+}
+
+func tcpSuperPacket(payloadLength int) []byte {
+	packet := make([]byte, 40+payloadLength)
+	iph := &ipv4.Header{
+		Version:  4,
+		Len:      20,
+		TotalLen: len(packet),
+		ID:       7,
+		TTL:      64,
+		Protocol: tcpProtocol,
+		Src:      net.ParseIP("10.99.0.2"),
+		Dst:      net.ParseIP("10.99.0.1"),
+	}
+	iphBuf, _ := iph.Marshal()
+	copy(packet, iphBuf)
+	ipv4Checksum(packet)
+
+	binary.BigEndian.PutUint16(packet[20:22], 1234)
+	binary.BigEndian.PutUint16(packet[22:24], 5678)
+	binary.BigEndian.PutUint32(packet[24:28], 1000)
+	binary.BigEndian.PutUint32(packet[28:32], 2000)
+	packet[32] = 5 << 4
+	packet[33] = tcpFlagACK | tcpFlagPSH
+	binary.BigEndian.PutUint16(packet[34:36], 512)
+	for i := 40; i < len(packet); i++ {
+		packet[i] = byte(i)
+	}
+	return packet
+}
+
+func validChecksums(packet []byte) bool {
+	return fold(checksum(0, packet[:20])) == 0xffff && fold(checksum(pseudoHeader(packet, tcpProtocol, len(packet)-20), packet[20:])) == 0xffff
+}
+
+func TestOffloads(t *testing.T) {
+	super := tcpSuperPacket(2500)
+	// The kernel leaves the pseudo header sum in the checksum field of the super packets it hands out.
+	binary.BigEndian.PutUint16(super[36:38], fold(pseudoHeader(super, tcpProtocol, len(super)-20)))
+
+	seg := &segmenter{raw: make([]byte, vnetHdrSize+maxSuperPacket), mtu: common.MaxMTU}
+	hdr := vnetHdr{flags: vnetHdrNeedsCsum, gsoType: gsoTCPv4, hdrLen: 40, gsoSize: 1000, csumStart: 20, csumOffset: 16}
+	hdr.encode(seg.raw)
+	n := copy(seg.raw[vnetHdrSize:], super)
+	if !seg.load(vnetHdrSize + n) {
+		t.Fatal("The segmenter refused a valid tcp super packet.")
+	}
+
+	var segments [][]byte
+	for seg.pending() {
+		buf := make([]byte, seg.mtu)
+		segments = append(segments, buf[:seg.segment(buf)])
+	}
+	if len(segments) != 3 || len(segments[0]) != 1040 || len(segments[2]) != 540 {
+		t.Fatal("The segmenter didn't split the super packet into segments of the gso size.")
+	}
+	for i := 0; i < len(segments); i++ {
+		if !validChecksums(segments[i]) || binary.BigEndian.Uint32(segments[i][24:28]) != uint32(1000+1000*i) || (segments[i][33]&tcpFlagPSH != 0) != (i == 2) {
+			t.Fatalf("The segmenter didn't fix up the headers of segment %d.", i)
+		}
+	}
+
+	short := &segmenter{raw: make([]byte, vnetHdrSize+maxSuperPacket), mtu: 1000}
+	hdr.encode(short.raw)
+	copy(short.raw[vnetHdrSize:], super)
+	if short.load(vnetHdrSize + n) {
+		t.Fatal("The segmenter accepted a super packet whose segments don't fit the MTU.")
+	}
+
+	fds := make([]int, 2)
+	if err := syscall.Pipe(fds); err != nil {
+		t.Fatalf("Failed to create a pipe: %s", err.Error())
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	co := &coalescer{fd: fds[1], raw: make([]byte, vnetHdrSize+maxSuperPacket)}
+	for i := 0; i < len(segments); i++ {
+		if held, err := co.add(segments[i]); !held || err != nil {
+			t.Fatal("The coalescer didn't hold back a tcp segment.")
+		}
+	}
+
+	buf := make([]byte, vnetHdrSize+maxSuperPacket)
+	n, err := syscall.Read(fds[0], buf)
+	if err != nil || n != vnetHdrSize+len(super) {
+		t.Fatal("The coalescer didn't merge the segments back into the super packet once the pushed segment arrived.")
+	}
+	hdr.decode(buf)
+	if hdr.gsoType != gsoTCPv4 || hdr.gsoSize != 1000 || hdr.flags != vnetHdrNeedsCsum || hdr.csumStart != 20 || hdr.csumOffset != 16 || !bytes.Equal(buf[vnetHdrSize+40:n], super[40:]) {
+		t.Fatal("The coalescer didn't describe the merged super packet properly.")
+	}
+
+	if held, err := co.add(super[:20]); held || err != nil {
+		t.Fatal("The coalescer held back a packet that isn't a tcp segment.")
+	}
+
+	segments[1][len(segments[1])-1]++
+	if held, err := co.add(segments[0]); !held || err != nil {
+		t.Fatal("The coalescer didn't hold back a tcp segment.")
+	}
+	if held, err := co.add(segments[1]); held || err != nil {
+		t.Fatal("The coalescer held back a tcp segment failing its checksum.")
+	}
+	if n, err := syscall.Read(fds[0], buf); err != nil || n != vnetHdrSize+len(segments[0]) {
+		t.Fatal("The coalescer didn't write out the segment held before the corrupted one on its own.")
+	}
+}
+
+func TestOffloadTUN(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.97.0.0/16")
+
+	tun, err := New(TUNDevice, &common.Config{
+		NumWorkers:     1,
+		DeviceName:     "quantumgso%d",
+		MTU:            common.MaxMTU,
+		DeviceOffloads: true,
+		PrivateIP:      net.ParseIP("10.97.0.1"),
+		NetworkConfig:  &common.NetworkConfig{IPNet: ipnet},
+		ReuseFDS:       false,
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to create TUN device with offloads: %s", err.Error())
+	}
+	if _, ok := tun.(Flusher); !ok || len(tun.Queues()) != 1 {
+		t.Fatal("Failed to properly create the TUN device with offloads.")
+	}
+
+	buf := make([]byte, common.MaxBufferLength)
+	segment := tcpSuperPacket(100)
+	copy(segment[12:20], net.ParseIP("10.97.0.2").To4())
+	copy(segment[16:20], net.ParseIP("10.97.0.1").To4())
+	ipv4Checksum(segment)
+	transportChecksum(segment, 20, tcpProtocol)
+	copy(buf[common.PacketStart:], segment)
+
+	if !tun.Write(0, common.NewTunPayload(buf, len(segment))) || !tun.(Flusher).Flush(0) {
+		t.Fatal("Failed to write the segment to the TUN device with offloads.")
+	}
+
+	if err := tun.Close(); err != nil {
+		t.Fatalf("Failed to close the TUN device: %s", err.Error())
+	}
+}
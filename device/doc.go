@@ -6,5 +6,6 @@ Package device contains the structs and logic to create, configure, and maintain
 
 Currently supported devices:
 	- TUN device
+	- TAP device
 */
 package device
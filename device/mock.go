@@ -18,7 +18,7 @@ func (mock *Mock) Name() string {
 
 // Read which just returns the supplied buffer in the form of a *common.Payload.
 func (mock *Mock) Read(queue int, buf []byte) (*common.Payload, bool) {
-	return common.NewTunPayload(buf, common.MTU), true
+	return common.NewTunPayload(buf, common.MaxMTU), true
 }
 
 // Write which is a noop.
@@ -0,0 +1,471 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"unsafe"
+
+	"github.com/supernomad/quantum/common"
+)
+
+const (
+	// The size of the virtio_net_hdr that prefixes every packet read from or written to a TUN device opened with IFF_VNET_HDR.
+	vnetHdrSize = 10
+
+	// The virtio_net_hdr flag marking a packet whose transport checksum is left for the receiver to complete.
+	vnetHdrNeedsCsum = 0x01
+
+	// The virtio_net_hdr gso types.
+	gsoNone   = 0x00
+	gsoTCPv4  = 0x01
+	gsoTCPv6  = 0x04
+	gsoUDPL4  = 0x05
+	gsoECNBit = 0x80
+
+	// The offloads requested from the kernel, USO is only supported by newer kernels so it is requested separately.
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+	tunFUSO4 = 0x20
+	tunFUSO6 = 0x40
+
+	// The size of the largest packet the kernel hands to or accepts from the TUN device when offloads are enabled.
+	maxSuperPacket = 65535
+
+	tcpProtocol = 6
+	udpProtocol = 17
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+)
+
+// vnetHdr is the virtio_net_hdr describing how the kernel offloaded a packet.
+type vnetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (hdr *vnetHdr) decode(buf []byte) {
+	hdr.flags = buf[0]
+	hdr.gsoType = buf[1]
+	hdr.hdrLen = binary.LittleEndian.Uint16(buf[2:4])
+	hdr.gsoSize = binary.LittleEndian.Uint16(buf[4:6])
+	hdr.csumStart = binary.LittleEndian.Uint16(buf[6:8])
+	hdr.csumOffset = binary.LittleEndian.Uint16(buf[8:10])
+}
+
+func (hdr *vnetHdr) encode(buf []byte) {
+	buf[0] = hdr.flags
+	buf[1] = hdr.gsoType
+	binary.LittleEndian.PutUint16(buf[2:4], hdr.hdrLen)
+	binary.LittleEndian.PutUint16(buf[4:6], hdr.gsoSize)
+	binary.LittleEndian.PutUint16(buf[6:8], hdr.csumStart)
+	binary.LittleEndian.PutUint16(buf[8:10], hdr.csumOffset)
+}
+
+// checksum adds the supplied data to the running ones' complement sum.
+func checksum(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// fold folds the running ones' complement sum into 16 bits.
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// pseudoHeader returns the running sum of the pseudo header that the transport checksum of the ip packet covers.
+func pseudoHeader(packet []byte, protocol byte, length int) uint32 {
+	var sum uint32
+	if packet[0]>>4 == 4 {
+		sum = checksum(0, packet[12:20])
+	} else {
+		sum = checksum(0, packet[8:40])
+	}
+	return sum + uint32(protocol) + uint32(length)
+}
+
+// ipv4Checksum recomputes the header checksum of the ipv4 packet.
+func ipv4Checksum(packet []byte) {
+	ihl := int(packet[0]&0x0f) * 4
+	packet[10], packet[11] = 0, 0
+	binary.BigEndian.PutUint16(packet[10:12], ^fold(checksum(0, packet[:ihl])))
+}
+
+// transportChecksum computes the transport checksum of the ip packet, whose transport header starts at the supplied offset.
+func transportChecksum(packet []byte, l4 int, protocol byte) {
+	field := l4 + 16
+	if protocol == udpProtocol {
+		field = l4 + 6
+	}
+	packet[field], packet[field+1] = 0, 0
+
+	csum := ^fold(checksum(pseudoHeader(packet, protocol, len(packet)-l4), packet[l4:]))
+	if csum == 0 && protocol == udpProtocol {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(packet[field:], csum)
+}
+
+// validTransportChecksum returns true if the transport checksum of the ip packet, whose transport header starts at the supplied offset, is correct.
+func validTransportChecksum(packet []byte, l4 int, protocol byte) bool {
+	return fold(checksum(pseudoHeader(packet, protocol, len(packet)-l4), packet[l4:])) == 0xffff
+}
+
+// segmenter splits the super packets read off of a TUN device queue into packets that fit the MTU, handing them out one at a time.
+type segmenter struct {
+	mtu      int
+	raw      []byte
+	packet   []byte
+	hdr      vnetHdr
+	protocol byte
+	l4       int
+	hl       int
+	next     int
+	count    int
+}
+
+// load decodes the super packet of the supplied length read into the raw buffer, and returns false if it can't be split.
+func (seg *segmenter) load(n int) bool {
+	seg.next, seg.count = 0, 0
+	if n < vnetHdrSize {
+		return false
+	}
+	seg.hdr.decode(seg.raw)
+	seg.packet = seg.raw[vnetHdrSize:n]
+	if len(seg.packet) == 0 {
+		return false
+	}
+
+	if seg.hdr.gsoType == gsoNone {
+		if seg.hdr.flags&vnetHdrNeedsCsum != 0 {
+			// The kernel left the pseudo header sum in the checksum field, so summing the rest of the packet completes it.
+			start, field := int(seg.hdr.csumStart), int(seg.hdr.csumStart+seg.hdr.csumOffset)
+			if field+2 > len(seg.packet) {
+				return false
+			}
+			csum := ^fold(checksum(0, seg.packet[start:]))
+			if csum == 0 && seg.hdr.csumOffset == 6 {
+				// A udp checksum of zero means that there is no checksum.
+				csum = 0xffff
+			}
+			binary.BigEndian.PutUint16(seg.packet[field:], csum)
+		}
+		seg.count = 1
+		return true
+	}
+
+	seg.l4 = int(seg.hdr.csumStart)
+	switch seg.hdr.gsoType &^ gsoECNBit {
+	case gsoTCPv4, gsoTCPv6:
+		if seg.l4+20 > len(seg.packet) {
+			return false
+		}
+		seg.protocol = tcpProtocol
+		seg.hl = seg.l4 + int(seg.packet[seg.l4+12]>>4)*4
+	case gsoUDPL4:
+		seg.protocol = udpProtocol
+		seg.hl = seg.l4 + 8
+	default:
+		return false
+	}
+
+	mss := int(seg.hdr.gsoSize)
+	if mss == 0 || seg.hl > len(seg.packet) || seg.hl+mss > seg.mtu {
+		return false
+	}
+	seg.count = (len(seg.packet) - seg.hl + mss - 1) / mss
+	return true
+}
+
+// pending returns true if there are packets left to hand out.
+func (seg *segmenter) pending() bool {
+	return seg.next < seg.count
+}
+
+// segment writes the next packet into the supplied buffer, and returns its length.
+func (seg *segmenter) segment(buf []byte) int {
+	i := seg.next
+	seg.next++
+
+	if seg.hdr.gsoType == gsoNone {
+		return copy(buf, seg.packet)
+	}
+
+	mss := int(seg.hdr.gsoSize)
+	offset := i * mss
+	size := len(seg.packet) - seg.hl - offset
+	if size > mss {
+		size = mss
+	}
+
+	packet := buf[:seg.hl+size]
+	copy(packet, seg.packet[:seg.hl])
+	copy(packet[seg.hl:], seg.packet[seg.hl+offset:seg.hl+offset+size])
+
+	if packet[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+		binary.BigEndian.PutUint16(packet[4:6], binary.BigEndian.Uint16(seg.packet[4:6])+uint16(i))
+		ipv4Checksum(packet)
+	} else {
+		binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)-40))
+	}
+
+	l4 := seg.l4
+	if seg.protocol == tcpProtocol {
+		binary.BigEndian.PutUint32(packet[l4+4:], binary.BigEndian.Uint32(seg.packet[l4+4:])+uint32(offset))
+		if i > 0 {
+			packet[l4+13] &^= tcpFlagCWR
+		}
+		if seg.next < seg.count {
+			packet[l4+13] &^= tcpFlagFIN | tcpFlagPSH
+		}
+	} else {
+		binary.BigEndian.PutUint16(packet[l4+4:], uint16(8+size))
+	}
+	transportChecksum(packet, l4, seg.protocol)
+
+	return len(packet)
+}
+
+// coalescer merges consecutive segments of a tcp flow written to a TUN device queue into a super packet, which the kernel processes in one go.
+type coalescer struct {
+	fd     int
+	raw    []byte
+	length int
+	count  int
+	mss    int
+	last   int
+	l4     int
+	hl     int
+	seq    uint32
+}
+
+// tcpHeaders returns the offset of the tcp header and the total length of the headers of the packet, and false if it isn't a plain tcp segment carrying data that can be coalesced.
+func tcpHeaders(packet []byte) (int, int, bool) {
+	var l4 int
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		l4 = int(packet[0]&0x0f) * 4
+		if packet[9] != tcpProtocol || binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 || int(binary.BigEndian.Uint16(packet[2:4])) != len(packet) {
+			return 0, 0, false
+		}
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		l4 = 40
+		if packet[6] != tcpProtocol || int(binary.BigEndian.Uint16(packet[4:6]))+40 != len(packet) {
+			return 0, 0, false
+		}
+	default:
+		return 0, 0, false
+	}
+
+	if l4+20 > len(packet) {
+		return 0, 0, false
+	}
+	hl := l4 + int(packet[l4+12]>>4)*4
+	flags := packet[l4+13]
+	if hl < l4+20 || hl >= len(packet) || flags&^(tcpFlagACK|tcpFlagPSH) != 0 || flags&tcpFlagACK == 0 {
+		return 0, 0, false
+	}
+	return l4, hl, true
+}
+
+// follows returns true if the packet continues the flow held by the coalescer.
+func (co *coalescer) follows(packet []byte, l4, hl int) bool {
+	held := co.raw[vnetHdrSize : vnetHdrSize+co.length]
+	if co.count == 0 || l4 != co.l4 || hl != co.hl || co.last != co.mss || len(packet)-hl > co.mss || co.length+len(packet)-hl > maxSuperPacket {
+		return false
+	}
+	if binary.BigEndian.Uint32(packet[l4+4:]) != co.seq {
+		return false
+	}
+
+	if packet[0]>>4 == 4 {
+		if !bytes.Equal(packet[0:2], held[0:2]) || !bytes.Equal(packet[6:10], held[6:10]) || !bytes.Equal(packet[12:l4], held[12:l4]) {
+			return false
+		}
+	} else if !bytes.Equal(packet[0:4], held[0:4]) || !bytes.Equal(packet[6:40], held[6:40]) {
+		return false
+	}
+
+	// The ports, the acknowledgment number, the data offset and the options all need to match, the window is taken from the latest segment.
+	return bytes.Equal(packet[l4:l4+4], held[l4:l4+4]) && bytes.Equal(packet[l4+8:l4+13], held[l4+8:l4+13]) && bytes.Equal(packet[l4+20:hl], held[l4+20:hl])
+}
+
+// add holds back the packet, merging it into the held super packet when it continues the same flow, and returns false if the packet needs to be written as is.
+func (co *coalescer) add(packet []byte) (bool, error) {
+	l4, hl, ok := tcpHeaders(packet)
+	if !ok || !validTransportChecksum(packet, l4, tcpProtocol) {
+		// Segments failing their checksum are written as is for the kernel to drop, rather than being merged into a super packet whose checksum the kernel completes.
+		return false, co.flush()
+	}
+
+	if !co.follows(packet, l4, hl) {
+		if err := co.flush(); err != nil {
+			return false, err
+		}
+		co.length = copy(co.raw[vnetHdrSize:], packet)
+		co.count = 1
+		co.l4, co.hl = l4, hl
+		co.mss = len(packet) - hl
+		co.last = co.mss
+	} else {
+		held := co.raw[vnetHdrSize:]
+		co.length += copy(held[co.length:], packet[hl:])
+		co.count++
+		co.last = len(packet) - hl
+		copy(held[l4+14:l4+16], packet[l4+14:l4+16])
+		held[l4+13] |= packet[l4+13]
+	}
+	co.seq = binary.BigEndian.Uint32(packet[l4+4:]) + uint32(len(packet)-hl)
+
+	if packet[l4+13]&tcpFlagPSH != 0 {
+		return true, co.flush()
+	}
+	return true, nil
+}
+
+// flush writes the held super packet to the TUN device queue, describing it as a gso packet whose tcp checksum is left for the kernel to complete when it holds more than one segment.
+func (co *coalescer) flush() error {
+	if co.count == 0 {
+		return nil
+	}
+
+	var hdr vnetHdr
+	packet := co.raw[vnetHdrSize : vnetHdrSize+co.length]
+	if co.count > 1 {
+		if packet[0]>>4 == 4 {
+			binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+			ipv4Checksum(packet)
+			hdr.gsoType = gsoTCPv4
+		} else {
+			binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)-40))
+			hdr.gsoType = gsoTCPv6
+		}
+		binary.BigEndian.PutUint16(packet[co.l4+16:], fold(pseudoHeader(packet, tcpProtocol, len(packet)-co.l4)))
+
+		hdr.flags = vnetHdrNeedsCsum
+		hdr.hdrLen = uint16(co.hl)
+		hdr.gsoSize = uint16(co.mss)
+		hdr.csumStart = uint16(co.l4)
+		hdr.csumOffset = 16
+	}
+	hdr.encode(co.raw)
+	co.count = 0
+
+	_, err := syscall.Write(co.fd, co.raw[:vnetHdrSize+co.length])
+	return err
+}
+
+// OffloadTun device struct for managing a multi-queue TUN networking device opened with IFF_VNET_HDR, which hands quantum large tcp and udp super packets to split before sending them, and accepts tcp segments merged into super packets.
+type OffloadTun struct {
+	Tun
+	segmenters []*segmenter
+	coalescers []*coalescer
+	hdr        [vnetHdrSize]byte
+}
+
+// Read the next packet split from the super packet read off the specified device queue, and return a *common.Payload representation of the packet.
+func (tun *OffloadTun) Read(queue int, buf []byte) (*common.Payload, bool) {
+	seg := tun.segmenters[queue]
+	if !seg.pending() {
+		n, err := syscall.Read(tun.queues[queue], seg.raw)
+		if err != nil || !seg.load(n) {
+			return nil, false
+		}
+	}
+	return common.NewTunPayload(buf, seg.segment(buf[common.PacketStart:])), true
+}
+
+// Write a *common.Payload to the specified device queue, tcp segments are held back to merge them with the segments that follow.
+func (tun *OffloadTun) Write(queue int, payload *common.Payload) bool {
+	if len(payload.Packet) == 0 {
+		return false
+	}
+	held, err := tun.coalescers[queue].add(payload.Packet)
+	if held || err != nil {
+		return err == nil
+	}
+
+	iovecs := []syscall.Iovec{{Base: &tun.hdr[0]}, {Base: &payload.Packet[0]}}
+	iovecs[0].SetLen(vnetHdrSize)
+	iovecs[1].SetLen(len(payload.Packet))
+	_, _, errNo := syscall.Syscall(syscall.SYS_WRITEV, uintptr(tun.queues[queue]), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	return errNo == 0
+}
+
+// Flush writes the tcp segments held back on the specified device queue.
+func (tun *OffloadTun) Flush(queue int) bool {
+	return tun.coalescers[queue].flush() == nil
+}
+
+func newOffloadTUN(cfg *common.Config) (Device, error) {
+	tun := &OffloadTun{Tun: Tun{name: cfg.DeviceName, cfg: cfg, queues: make([]int, cfg.NumWorkers)}}
+
+	for i := 0; i < cfg.NumWorkers; i++ {
+		if !cfg.ReuseFDS {
+			ifName, queue, err := createTUN(tun.name, iffTun|iffVnetHdr)
+			if err != nil {
+				return nil, err
+			}
+			tun.queues[i] = queue
+			tun.name = ifName
+		} else {
+			tun.queues[i] = 3 + i
+			tun.name = cfg.RealDeviceName
+		}
+
+		if err := setOffloads(tun.queues[i]); err != nil {
+			return nil, err
+		}
+		tun.segmenters = append(tun.segmenters, &segmenter{raw: make([]byte, vnetHdrSize+maxSuperPacket), mtu: cfg.MTU})
+		tun.coalescers = append(tun.coalescers, &coalescer{fd: tun.queues[i], raw: make([]byte, vnetHdrSize+maxSuperPacket)})
+	}
+
+	if !cfg.ReuseFDS {
+		err := initTun(tun.name, cfg.MTU, cfg.PrivateIP, cfg.FloatingIPs, cfg.NetworkConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tun, nil
+}
+
+func setOffloads(queue int) error {
+	size := int32(vnetHdrSize)
+	_, _, errNo := syscall.Syscall(syscall.SYS_IOCTL, uintptr(queue), uintptr(syscall.TUNSETVNETHDRSZ), uintptr(unsafe.Pointer(&size)))
+	if errNo != 0 {
+		return errors.New("error setting the TUN device virtio header size: " + errNo.Error())
+	}
+
+	_, _, errNo = syscall.Syscall(syscall.SYS_IOCTL, uintptr(queue), uintptr(syscall.TUNSETOFFLOAD), uintptr(tunFCsum|tunFTSO4|tunFTSO6|tunFUSO4|tunFUSO6))
+	if errNo == syscall.EINVAL {
+		// Kernels older than 6.2 don't support USO.
+		_, _, errNo = syscall.Syscall(syscall.SYS_IOCTL, uintptr(queue), uintptr(syscall.TUNSETOFFLOAD), uintptr(tunFCsum|tunFTSO4|tunFTSO6))
+	}
+	if errNo != 0 {
+		return errors.New("error setting the TUN device offloads: " + errNo.Error())
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package device
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/vishvananda/netlink"
+)
+
+// Tap device struct for managing a multi-queue TAP networking device, which carries ethernet frames rather than ip packets.
+type Tap struct {
+	Tun
+}
+
+// Read a frame off the specified device queue and return a *common.Payload representation of the frame, which is prefixed by the frame marker.
+func (tap *Tap) Read(queue int, buf []byte) (*common.Payload, bool) {
+	n, err := syscall.Read(tap.queues[queue], buf[common.PacketStart+common.FrameHeaderSize:])
+	if err != nil {
+		return nil, false
+	}
+	buf[common.PacketStart] = common.FrameMarker
+	return common.NewTunPayload(buf, common.FrameHeaderSize+n), true
+}
+
+// Write the frame carried by a *common.Payload to the specified device queue, payloads that don't carry a frame are refused.
+func (tap *Tap) Write(queue int, payload *common.Payload) bool {
+	if !common.IsFrame(payload.Packet) {
+		return false
+	}
+	_, err := syscall.Write(tap.queues[queue], payload.Packet[common.FrameStart:])
+	return err == nil
+}
+
+func newTAP(cfg *common.Config) (Device, error) {
+	tap := &Tap{Tun{name: cfg.DeviceName, cfg: cfg, queues: make([]int, cfg.NumWorkers)}}
+
+	for i := 0; i < cfg.NumWorkers; i++ {
+		if !cfg.ReuseFDS {
+			ifName, queue, err := createTUN(tap.name, iffTap)
+			if err != nil {
+				return nil, err
+			}
+			tap.queues[i] = queue
+			tap.name = ifName
+		} else {
+			tap.queues[i] = 3 + i
+			tap.name = cfg.RealDeviceName
+		}
+	}
+
+	if !cfg.ReuseFDS {
+		err := initTap(tap.name, cfg.HardwareAddr, cfg.MTU-common.TAPOverhead, cfg.PrivateIP, cfg.FloatingIPs, cfg.NetworkConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tap, nil
+}
+
+// initTap configures the TAP device with the network prefix rather than a single address, since the remote nodes are reached over the stretched segment by resolving their mac addresses.
+func initTap(name string, mac net.HardwareAddr, mtu int, src net.IP, additionalIPs []net.IP, networkCfg *common.NetworkConfig) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return errors.New("error getting the virtual network device from the kernel: " + err.Error())
+	}
+	if mac != nil {
+		err = netlink.LinkSetHardwareAddr(link, mac)
+		if err != nil {
+			return errors.New("error setting the virtual network device mac address: " + err.Error())
+		}
+	}
+	err = netlink.LinkSetMTU(link, mtu)
+	if err != nil {
+		return errors.New("error setting the virtual network device MTU: " + err.Error())
+	}
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		return errors.New("error upping the virtual network device: " + err.Error())
+	}
+	ones, _ := networkCfg.IPNet.Mask.Size()
+	addr, err := netlink.ParseAddr(src.String() + "/" + strconv.Itoa(ones))
+	if err != nil {
+		return errors.New("error parsing the virtual network device address: " + err.Error())
+	}
+	err = netlink.AddrAdd(link, addr)
+	if err != nil {
+		return errors.New("error setting the virtual network device address: " + err.Error())
+	}
+
+	for i := 0; i < len(additionalIPs); i++ {
+		additional, err := netlink.ParseAddr(additionalIPs[i].String() + "/32")
+		if err != nil {
+			return errors.New("error parsing the virtual network device address: " + err.Error())
+		}
+		err = netlink.AddrAdd(link, additional)
+		if err != nil {
+			return errors.New("error setting the virtual network device address: " + err.Error())
+		}
+	}
+
+	return nil
+}
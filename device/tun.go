@@ -57,13 +57,17 @@ func (tun *Tun) Write(queue int, payload *common.Payload) bool {
 }
 
 func newTUN(cfg *common.Config) (Device, error) {
+	if cfg.DeviceOffloads {
+		return newOffloadTUN(cfg)
+	}
+
 	queues := make([]int, cfg.NumWorkers)
 	name := cfg.DeviceName
 	tun := &Tun{name: name, cfg: cfg, queues: queues}
 
 	for i := 0; i < tun.cfg.NumWorkers; i++ {
 		if !tun.cfg.ReuseFDS {
-			ifName, queue, err := createTUN(tun.name)
+			ifName, queue, err := createTUN(tun.name, iffTun)
 			if err != nil {
 				return nil, err
 			}
@@ -76,7 +80,7 @@ func newTUN(cfg *common.Config) (Device, error) {
 	}
 
 	if !tun.cfg.ReuseFDS {
-		err := initTun(tun.name, tun.cfg.PrivateIP, tun.cfg.FloatingIPs, tun.cfg.NetworkConfig)
+		err := initTun(tun.name, tun.cfg.MTU, tun.cfg.PrivateIP, tun.cfg.FloatingIPs, tun.cfg.NetworkConfig)
 		if err != nil {
 			return nil, err
 		}
@@ -85,9 +89,9 @@ func newTUN(cfg *common.Config) (Device, error) {
 	return tun, nil
 }
 
-func createTUN(name string) (string, int, error) {
+func createTUN(name string, kind uint16) (string, int, error) {
 	var req ifReq
-	req.Flags = iffTun | iffNoPi | iffMultiQueue
+	req.Flags = kind | iffNoPi | iffMultiQueue
 
 	copy(req.Name[:15], name)
 
@@ -106,7 +110,7 @@ func createTUN(name string) (string, int, error) {
 	return string(req.Name[:strings.Index(string(req.Name[:]), "\000")]), queue, nil
 }
 
-func initTun(name string, src net.IP, additionalIPs []net.IP, networkCfg *common.NetworkConfig) error {
+func initTun(name string, mtu int, src net.IP, additionalIPs []net.IP, networkCfg *common.NetworkConfig) error {
 	link, err := netlink.LinkByName(name)
 	if err != nil {
 		return errors.New("error getting the virtual network device from the kernel: " + err.Error())
@@ -115,7 +119,7 @@ func initTun(name string, src net.IP, additionalIPs []net.IP, networkCfg *common
 	if err != nil {
 		return errors.New("error upping the virtual network device: " + err.Error())
 	}
-	err = netlink.LinkSetMTU(link, common.MTU)
+	err = netlink.LinkSetMTU(link, mtu)
 	if err != nil {
 		return errors.New("error setting the virtual network device MTU: " + err.Error())
 	}
@@ -19,6 +19,7 @@ pushd $GOPATH/src/github.com/supernomad/quantum/dist/ssl 2>&1 > /dev/null
 
 touch data/index.txt
 echo '01' > data/serial
+echo '01' > data/crlnumber
 
 export SAN="IP:127.0.0.1, IP:::1"
 
@@ -47,15 +48,26 @@ yes | openssl ca -config etcd-openssl.cnf -passin pass:quantum -extensions v3_cl
 export SAN="IP:127.0.0.1, IP:172.18.0.2, IP:172.18.0.3, IP:172.18.0.4, IP:172.18.0.5, IP:::1, IP:fd00:dead:beef::2, IP:fd00:dead:beef::3, IP:fd00:dead:beef::4, IP:fd00:dead:beef::5"
 
 # Create ec CA cert
-yes | openssl ecparam -out keys/ec-secp521r1.pem -name secp521r1
-yes | openssl req -config etcd-openssl.cnf -sha384 -passout pass:quantum -new -x509 -extensions v3_ca -newkey ec:keys/ec-secp521r1.pem -keyout keys/ec-ca.key -out certs/ec-ca.crt -subj "/C=US/ST=New York/L=New York City/O=quantum/OU=development/CN=ec-ca.quantum.dev"
+yes | openssl ecparam -out keys/ec-secp384r1.pem -name secp384r1
+yes | openssl req -config etcd-openssl.cnf -sha384 -passout pass:quantum -new -x509 -extensions v3_ca -newkey ec:keys/ec-secp384r1.pem -keyout keys/ec-ca.key -out certs/ec-ca.crt -subj "/C=US/ST=New York/L=New York City/O=quantum/OU=development/CN=ec-ca.quantum.dev"
 
 # Create ec server certificate
-yes | openssl req -config etcd-openssl.cnf -sha384 -new -nodes -newkey ec:keys/ec-secp521r1.pem -keyout keys/ec-server.key -out csrs/ec-server.csr -subj "/C=US/ST=New York/L=New York City/O=quantum/OU=development/CN=ec-server"
+yes | openssl req -config etcd-openssl.cnf -sha384 -new -nodes -newkey ec:keys/ec-secp384r1.pem -keyout keys/ec-server.key -out csrs/ec-server.csr -subj "/C=US/ST=New York/L=New York City/O=quantum/OU=development/CN=ec-server"
 yes | openssl ca -config etcd-openssl.cnf -passin pass:quantum -extensions v3_server -keyfile keys/ec-ca.key -cert certs/ec-ca.crt -out certs/ec-server.crt -infiles csrs/ec-server.csr
 
 # Create ec client certificate
-yes | openssl req -config etcd-openssl.cnf -sha384 -new -nodes -newkey ec:keys/ec-secp521r1.pem -keyout keys/ec-client.key -out csrs/ec-client.csr -subj "/C=US/ST=New York/L=New York City/O=quantum/OU=development/CN=ec-client"
+yes | openssl req -config etcd-openssl.cnf -sha384 -new -nodes -newkey ec:keys/ec-secp384r1.pem -keyout keys/ec-client.key -out csrs/ec-client.csr -subj "/C=US/ST=New York/L=New York City/O=quantum/OU=development/CN=ec-client"
 yes | openssl ca -config etcd-openssl.cnf -passin pass:quantum -extensions v3_client -keyfile keys/ec-ca.key -cert certs/ec-ca.crt -out certs/ec-client.crt -infiles csrs/ec-client.csr
 
+# Create an ec certificate bound to a machine id
+export SAN="URI:quantum://0123456789abcdef, IP:127.0.0.1, IP:::1"
+yes | openssl req -config etcd-openssl.cnf -sha384 -new -nodes -newkey ec:keys/ec-secp384r1.pem -keyout keys/ec-machine.key -out csrs/ec-machine.csr -subj "/C=US/ST=New York/L=New York City/O=quantum/OU=development/CN=ec-machine"
+yes | openssl ca -config etcd-openssl.cnf -passin pass:quantum -extensions v3_server -keyfile keys/ec-ca.key -cert certs/ec-ca.crt -out certs/ec-machine.crt -infiles csrs/ec-machine.csr
+
+# Create a revoked ec client certificate, and a CRL listing it
+yes | openssl req -config etcd-openssl.cnf -sha384 -new -nodes -newkey ec:keys/ec-secp384r1.pem -keyout keys/ec-revoked.key -out csrs/ec-revoked.csr -subj "/C=US/ST=New York/L=New York City/O=quantum/OU=development/CN=ec-revoked"
+yes | openssl ca -config etcd-openssl.cnf -passin pass:quantum -extensions v3_client -keyfile keys/ec-ca.key -cert certs/ec-ca.crt -out certs/ec-revoked.crt -infiles csrs/ec-revoked.csr
+openssl ca -config etcd-openssl.cnf -passin pass:quantum -keyfile keys/ec-ca.key -cert certs/ec-ca.crt -revoke certs/ec-revoked.crt
+openssl ca -config etcd-openssl.cnf -passin pass:quantum -keyfile keys/ec-ca.key -cert certs/ec-ca.crt -gencrl -out certs/ec-ca.crl
+
 popd 2>&1 > /dev/null
@@ -12,6 +12,7 @@ import (
 	"github.com/supernomad/quantum/datastore"
 	"github.com/supernomad/quantum/device"
 	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/peer"
 	"github.com/supernomad/quantum/plugin"
 	"github.com/supernomad/quantum/rest"
 	"github.com/supernomad/quantum/socket"
@@ -37,6 +38,10 @@ func main() {
 	err = store.Init()
 	handleError(log, err)
 
+	enrollment := worker.NewEnrollment(cfg, store)
+	err = enrollment.Init()
+	handleError(log, err)
+
 	incomingPlugins := make([]plugin.Plugin, len(cfg.Plugins))
 	outgoingPlugins := make([]plugin.Plugin, len(cfg.Plugins))
 	for i := 0; i < len(cfg.Plugins); i++ {
@@ -46,10 +51,16 @@ func main() {
 		incomingPlugins[i] = plugin
 	}
 
-	sort.Sort(plugin.Sorter{Plugins: outgoingPlugins})
-	sort.Sort(sort.Reverse(plugin.Sorter{Plugins: incomingPlugins}))
+	err = plugin.Check(cfg, outgoingPlugins)
+	handleError(log, err)
+
+	err = plugin.Init(outgoingPlugins, store)
+	handleError(log, err)
+
+	sort.Sort(plugin.Sorter{Plugins: outgoingPlugins, Config: cfg})
+	sort.Sort(sort.Reverse(plugin.Sorter{Plugins: incomingPlugins, Config: cfg}))
 
-	dev, err := device.New(device.TUNDevice, cfg)
+	dev, err := device.New(cfg.DeviceType, cfg)
 	handleError(log, err)
 
 	sock, err := socket.New(cfg.NetworkConfig.Backend, cfg)
@@ -57,27 +68,39 @@ func main() {
 
 	aggregator := metric.New(cfg)
 
-	api := rest.New(cfg, aggregator)
+	peers := peer.New()
 
-	outgoing := worker.NewOutgoing(cfg, aggregator, store, outgoingPlugins, dev, sock)
-	incoming := worker.NewIncoming(cfg, aggregator, store, incomingPlugins, dev, sock)
+	api := rest.New(cfg, aggregator, peers)
+
+	control := worker.NewControl(cfg, aggregator, store, outgoingPlugins, sock, peers)
+	outgoing := worker.NewOutgoing(cfg, aggregator, store, outgoingPlugins, dev, sock, control)
+	incoming := worker.NewIncoming(cfg, aggregator, store, incomingPlugins, dev, sock, control)
+	rekey := worker.NewRekey(cfg, store)
 
 	api.Start()
 	aggregator.Start()
 	store.Start()
+	control.Start()
+	rekey.Start()
+	enrollment.Start()
 
 	for i := 0; i < cfg.NumWorkers; i++ {
 		incoming.Start(i)
 		outgoing.Start(i)
 	}
 
-	fds := make([]int, cfg.NumWorkers*2)
-	copy(fds[0:cfg.NumWorkers], dev.Queues())
-	copy(fds[cfg.NumWorkers:cfg.NumWorkers*2], sock.Queues())
+	devQueues, sockQueues := dev.Queues(), sock.Queues()
+	fds := make([]int, len(devQueues)+len(sockQueues))
+	copy(fds[0:len(devQueues)], devQueues)
+	copy(fds[len(devQueues):], sockQueues)
 
 	signaler := common.NewSignaler(log, cfg, fds, map[string]string{common.RealDeviceNameEnv: dev.Name()})
+	if reloader, ok := sock.(common.Reloader); ok {
+		signaler.AddReloader(reloader)
+	}
 
 	log.Info.Printf("[MAIN] Listening on device:  %s", dev.Name())
+	log.Info.Printf("[MAIN] Device MTU:           %d", cfg.MTU)
 	log.Info.Printf("[MAIN] Network space:        %s", cfg.NetworkConfig.Network)
 	log.Info.Printf("[MAIN] Private IP address:   %s", cfg.PrivateIP)
 	log.Info.Printf("[MAIN] Public IPv4 address:  %s", cfg.PublicIPv4)
@@ -89,6 +112,9 @@ func main() {
 	err = signaler.Wait(true)
 	handleError(log, err)
 
+	control.Stop()
+	rekey.Stop()
+	enrollment.Stop()
 	api.Stop()
 	aggregator.Stop()
 	store.Stop()
@@ -25,12 +25,34 @@ func handleMetric(metrics *Metrics, metric *Metric) {
 	if metric.Dropped {
 		metrics.DroppedBytes += metric.Bytes
 		metrics.DroppedPackets++
+
+		if metric.Reason != "" {
+			if metrics.DropReasons == nil {
+				metrics.DropReasons = make(map[string]uint64)
+			}
+			metrics.DropReasons[metric.Reason]++
+		}
 	} else {
 		metrics.Bytes += metric.Bytes
 		metrics.Packets++
 	}
 }
 
+func (aggregator *Aggregator) handlePeer(metric *Metric) {
+	peerMetrics, ok := aggregator.metricsLog.PeerMetrics[metric.PrivateIP]
+	if !ok {
+		peerMetrics = &PeerMetrics{}
+		aggregator.metricsLog.PeerMetrics[metric.PrivateIP] = peerMetrics
+	}
+
+	if peerMetrics.State != "" && peerMetrics.State != metric.State {
+		peerMetrics.Transitions++
+	}
+
+	peerMetrics.State = metric.State
+	peerMetrics.RTT = metric.RTT
+}
+
 func (aggregator *Aggregator) pipeline(metric *Metric) {
 	aggregator.cfg.Log.Debug.Println("[AGGREGATOR]", "Metric data received:", metric)
 
@@ -40,6 +62,18 @@ func (aggregator *Aggregator) pipeline(metric *Metric) {
 		metrics = aggregator.metricsLog.RxMetrics
 	case Tx:
 		metrics = aggregator.metricsLog.TxMetrics
+	case Peer:
+		aggregator.handlePeer(metric)
+		return
+	case Session:
+		aggregator.metricsLog.SessionMetrics = metric.Sessions
+		return
+	case Compression:
+		aggregator.metricsLog.CompressionMetrics = metric.Compression
+		return
+	case FEC:
+		aggregator.metricsLog.FECMetrics = metric.FEC
+		return
 	}
 
 	handleMetric(metrics, metric)
@@ -11,6 +11,9 @@ The currently collected metrics are as follows:
     - Dropped Packets
     - Bytes
     - Dropped Bytes
+    - Peer liveness state and round trip time
+    - Per peer compression ratio
+    - Per peer packets recovered and lost despite forward error correction
 
 The metrics are split out based on the queue and the link that handled the transmission, as well as generally over all queues/links. Where a link represents the remote peer involved in the transmission, and a queue represents the internal packet queue.
 */
@@ -5,6 +5,7 @@ package metric
 
 import (
 	"encoding/json"
+	"time"
 )
 
 const (
@@ -13,6 +14,18 @@ const (
 
 	// Tx metric
 	Tx
+
+	// Peer metric, which reports the liveness of a remote peer rather than a single packet.
+	Peer
+
+	// Session metric, which reports the state of the sessions held by the socket rather than a single packet.
+	Session
+
+	// Compression metric, which reports the compression statistics of the traffic sent to each remote peer rather than a single packet.
+	Compression
+
+	// FEC metric, which reports the forward error correction statistics of the traffic exchanged with each remote peer rather than a single packet.
+	FEC
 )
 
 // Metric is used to represent a single incoming or outgoing packet's metric.
@@ -26,11 +39,29 @@ type Metric struct {
 	// The size of the packet in bytes.
 	Bytes uint64
 
-	// The type of the packet, either Rx or Tx.
+	// The type of the packet, either Rx or Tx, or Peer for liveness updates.
 	Type int
 
 	// Whether or not the packet was dropped.
 	Dropped bool
+
+	// Why the packet was dropped, which is only set for drops that are worth telling apart from the rest.
+	Reason string
+
+	// The liveness state of the remote peer, only used for Peer metrics.
+	State string
+
+	// The last measured round trip time to the remote peer, only used for Peer metrics.
+	RTT time.Duration
+
+	// The statistics of the sessions held by the socket, only used for Session metrics.
+	Sessions *SessionMetrics
+
+	// The compression statistics keyed by the private ip of the remote peer, only used for Compression metrics.
+	Compression map[string]*CompressionMetrics
+
+	// The forward error correction statistics keyed by the private ip of the remote peer, only used for FEC metrics.
+	FEC map[string]*FECMetrics
 }
 
 // Metrics struct for storing aggregated incoming or outgoing statistics.
@@ -47,6 +78,9 @@ type Metrics struct {
 	// The number of bytes successfully handled by quantum.
 	Bytes uint64 `json:"bytes"`
 
+	// The number of dropped packets keyed by the reason they were dropped for, only drops with a known reason are counted here.
+	DropReasons map[string]uint64 `json:"dropReasons,omitempty"`
+
 	// The stats for individual links that represent the network traffic of this node in relation to remote nodes.
 	Links map[string]*Metrics `json:"links,omitempty"`
 
@@ -54,6 +88,75 @@ type Metrics struct {
 	Queues []*Metrics `json:"queues,omitempty"`
 }
 
+// PeerMetrics struct for storing the liveness statistics of a remote peer.
+type PeerMetrics struct {
+	// The liveness state of the remote peer.
+	State string `json:"state"`
+
+	// The last measured round trip time to the remote peer in nanoseconds.
+	RTT time.Duration `json:"rtt"`
+
+	// The number of times the remote peer has transitioned between liveness states.
+	Transitions uint64 `json:"transitions"`
+}
+
+// SessionMetrics struct for storing the statistics of the sessions the socket holds with remote nodes, such as DTLS sessions.
+type SessionMetrics struct {
+	// The number of sessions currently open.
+	Sessions uint64 `json:"sessions"`
+
+	// The number of handshakes that have failed.
+	HandshakeFailures uint64 `json:"handshakeFailures"`
+
+	// The number of sessions closed after going idle.
+	Expired uint64 `json:"expired"`
+
+	// The number of sessions closed to make room for new ones.
+	Evicted uint64 `json:"evicted"`
+
+	// The number of sessions closed because the remote node left the network.
+	Removed uint64 `json:"removed"`
+
+	// The number of sessions closed because the certificate of the remote node was revoked.
+	Revoked uint64 `json:"revoked"`
+}
+
+// CompressionMetrics struct for storing the compression statistics of the packets sent to a remote peer.
+type CompressionMetrics struct {
+	// The codec last used to compress packets sent to the remote peer.
+	Codec string `json:"codec"`
+
+	// The number of packets handled.
+	Packets uint64 `json:"packets"`
+
+	// The number of packets sent uncompressed because compressing them would not have made them smaller.
+	Skipped uint64 `json:"skipped"`
+
+	// The number of bytes handled before compression.
+	Bytes uint64 `json:"bytes"`
+
+	// The number of bytes sent after compression.
+	CompressedBytes uint64 `json:"compressedBytes"`
+
+	// The ratio of the bytes sent after compression to the bytes handled before compression, lower is better.
+	Ratio float64 `json:"ratio"`
+}
+
+// FECMetrics struct for storing the forward error correction statistics of the packets exchanged with a remote peer.
+type FECMetrics struct {
+	// The number of parity packets sent to the remote peer.
+	ParityPackets uint64 `json:"parityPackets"`
+
+	// The number of parity packets received from the remote peer, which are consumed rather than delivered and so are not counted as dropped.
+	ParityReceived uint64 `json:"parityReceived"`
+
+	// The number of packets lost on the way from the remote peer that were rebuilt from the parity packets.
+	Recovered uint64 `json:"recovered"`
+
+	// The number of packets lost on the way from the remote peer that could not be rebuilt, because too many packets of their group were lost.
+	Unrecoverable uint64 `json:"unrecoverable"`
+}
+
 // MetricsLog struct which contains the packet and byte statistics information for quantum.
 type MetricsLog struct {
 	// TxMetrics holds the packet and byte counts for packet transmission.
@@ -61,6 +164,18 @@ type MetricsLog struct {
 
 	// RxMetrics holds the packet and byte counts for packet reception.
 	RxMetrics *Metrics
+
+	// PeerMetrics holds the liveness statistics for the remote peers keyed by private ip.
+	PeerMetrics map[string]*PeerMetrics
+
+	// SessionMetrics holds the statistics of the sessions held by the socket, if it holds any.
+	SessionMetrics *SessionMetrics `json:",omitempty"`
+
+	// CompressionMetrics holds the compression statistics for the remote peers keyed by private ip, if the compression plugin is enabled.
+	CompressionMetrics map[string]*CompressionMetrics `json:",omitempty"`
+
+	// FECMetrics holds the forward error correction statistics for the remote peers keyed by private ip, if the fec plugin is enabled.
+	FECMetrics map[string]*FECMetrics `json:",omitempty"`
 }
 
 // Bytes returns a byte slice json representation of the MetricsLog struct in either flat or prettified notation, if there is an error while marshalling data a nil slice is returned.
@@ -84,6 +199,7 @@ func newMetricsLog(numWorkers int) *MetricsLog {
 			Links:  make(map[string]*Metrics),
 			Queues: make([]*Metrics, numWorkers),
 		},
+		PeerMetrics: make(map[string]*PeerMetrics),
 	}
 
 	for i := 0; i < numWorkers; i++ {
@@ -43,9 +43,47 @@ func TestAggregator(t *testing.T) {
 		PrivateIP: "10.99.0.1",
 		Bytes:     20,
 	}
+	aggregator.Metrics <- &Metric{
+		Type:      Rx,
+		Dropped:   true,
+		Reason:    common.ReplayedDropReason,
+		PrivateIP: "10.99.0.1",
+		Bytes:     20,
+	}
+
+	aggregator.Metrics <- &Metric{
+		Type:     Session,
+		Sessions: &SessionMetrics{Sessions: 2, HandshakeFailures: 1, Revoked: 1},
+	}
+
+	aggregator.Metrics <- &Metric{
+		Type:        Compression,
+		Compression: map[string]*CompressionMetrics{"10.99.0.1": {Codec: "lz4", Packets: 2, Skipped: 1, Bytes: 200, CompressedBytes: 150, Ratio: 0.75}},
+	}
+
+	aggregator.Metrics <- &Metric{
+		Type: FEC,
+		FEC:  map[string]*FECMetrics{"10.99.0.1": {ParityPackets: 4, Recovered: 2, Unrecoverable: 1}},
+	}
 
 	time.Sleep(1 * time.Millisecond)
 
+	if aggregator.metricsLog.RxMetrics.DroppedPackets != 2 || aggregator.metricsLog.RxMetrics.DropReasons[common.ReplayedDropReason] != 1 {
+		t.Fatal("Aggregator did not count replayed packets separately.")
+	}
+
+	if aggregator.metricsLog.SessionMetrics == nil || aggregator.metricsLog.SessionMetrics.Sessions != 2 || aggregator.metricsLog.SessionMetrics.HandshakeFailures != 1 || aggregator.metricsLog.SessionMetrics.Revoked != 1 {
+		t.Fatal("Aggregator did not record the session statistics.")
+	}
+
+	if compression := aggregator.metricsLog.CompressionMetrics["10.99.0.1"]; compression == nil || compression.Codec != "lz4" || compression.Ratio != 0.75 {
+		t.Fatal("Aggregator did not record the compression statistics.")
+	}
+
+	if fec := aggregator.metricsLog.FECMetrics["10.99.0.1"]; fec == nil || fec.Recovered != 2 || fec.Unrecoverable != 1 {
+		t.Fatal("Aggregator did not record the forward error correction statistics.")
+	}
+
 	buf := aggregator.Bytes(true)
 	if buf == nil {
 		t.Fatal("Bytes returned a nil slice when asking for a prettified version.")
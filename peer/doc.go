@@ -0,0 +1,46 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package peer contains the structs and logic to track the reachability of the remote nodes participating in the quantum network.
+
+A remote node being listed in the datastore only means that it holds a valid lease, not that it is actually reachable over the underlying network. To determine the latter quantum periodically sends keepalive probes to each remote node, and treats any authenticated packet received from a node as proof of life.
+
+Each remote node is tracked in one of the following states:
+	- unknown, no keepalive data has been gathered yet
+	- up, the node has been heard from within the keepalive timeout
+	- down, the node has been probed but not heard from within the keepalive timeout
+
+A remote node may be reachable over more than one endpoint, for instance its public ipv6 and ipv4 addresses, and the reflexive address observed by other nodes when it sits behind a NAT. Every endpoint is probed, and data is routed over the most preferred endpoint that answered the last round of probes. Much like happy eyeballs, the first endpoint to answer is used right away and ipv6 takes over as soon as it answers as well, while a broken ipv6 path fails over to ipv4 within a round of probes. When an authenticated packet arrives from a new endpoint, the remote node is considered to have roamed and data follows it to that endpoint right away, without waiting for its mapping to change in the datastore.
+
+NAT traversal works as follows:
+	- each pong reports the endpoint the matching ping was received from
+	- once the remote nodes agree on an observed endpoint that differs from the published one, it is published in the local mapping as the reflexive endpoint
+	- when a remote node is down, it is asked via the datastore to punch a hole towards the local node, which it does by immediately probing all of the local node's endpoints while the local node keeps probing it
+
+Some remote nodes will never be reachable directly, for instance when both sides are behind a symmetric NAT. Nodes started with '--relay' advertise the 'relay' capability in their mapping, and traffic destined for a down remote node is encapsulated towards the reachable relay node with the lowest round trip time. The relay node only strips the hop between itself and the sender before forwarding, so the inner packet is never decrypted along the way. Probing of the direct paths continues, and traffic switches back as soon as one of them answers again.
+
+The peer table is exposed by default at 'http://127.0.0.1:1099/peers', the structure is keyed by the private ip of the remote node:
+	{
+	  "10.99.0.2": {
+	    "machineID": "b8fc945e893cfd55dc6170b6a4f6471d5790fa279e020410f435759ba9e3f0c5",
+	    "state": "up",
+	    "lastSeen": "2017-06-01T12:00:00.000000000Z",
+	    "rtt": 412000,
+	    "endpoint": "[2001:db8::7]:1099",
+	    "paths": [
+	      {
+	        "endpoint": "[2001:db8::7]:1099",
+	        "lastSeen": "2017-06-01T12:00:00.000000000Z",
+	        "rtt": 412000
+	      },
+	      {
+	        "endpoint": "203.0.113.7:1099",
+	        "lastSeen": "2017-06-01T12:00:00.000000000Z",
+	        "rtt": 398000
+	      }
+	    ]
+	  }
+	}
+*/
+package peer
@@ -0,0 +1,471 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package peer
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+)
+
+// State represents the reachability of a remote peer over the underlying network.
+type State int
+
+const (
+	// Unknown is the state of a peer that has not been probed or heard from yet.
+	Unknown State = iota
+
+	// Up is the state of a peer that has been heard from within the keepalive timeout.
+	Up
+
+	// Down is the state of a peer that has been probed but not heard from within the keepalive timeout.
+	Down
+)
+
+// String returns the human readable representation of the State.
+func (state State) String() string {
+	switch state {
+	case Up:
+		return "up"
+	case Down:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalJSON returns the json representation of the State.
+func (state State) MarshalJSON() ([]byte, error) {
+	return json.Marshal(state.String())
+}
+
+type path struct {
+	route    *common.Mapping
+	lastSeen time.Time
+	rtt      time.Duration
+	roamed   bool
+}
+
+// Peer represents the liveness data gathered for a single remote node.
+type Peer struct {
+	mux        sync.RWMutex
+	machineID  string
+	state      State
+	lastSeen   time.Time
+	lastProbe  time.Time
+	lastPunch  time.Time
+	unanswered time.Time
+	rtt        time.Duration
+	mapping    *common.Mapping
+	paths      []*path
+	active     int
+}
+
+func (peer *Peer) current() *path {
+	if peer.active < 0 || peer.active >= len(peer.paths) {
+		return nil
+	}
+	return peer.paths[peer.active]
+}
+
+func (peer *Peer) find(sa syscall.Sockaddr) int {
+	for i := 0; i < len(peer.paths); i++ {
+		if common.SockaddrEquals(peer.paths[i].route.Sockaddr, sa) {
+			return i
+		}
+	}
+	return -1
+}
+
+// roamed returns the index of the path to the endpoint the peer roamed to, of which there is at most one, or -1 if the peer hasn't roamed.
+func (peer *Peer) roamed() int {
+	for i := 0; i < len(peer.paths); i++ {
+		if peer.paths[i].roamed {
+			return i
+		}
+	}
+	return -1
+}
+
+// tracks returns true if the supplied mapping represents the same remote node as the mapping the peer was last updated with, even if it is a different copy of it.
+func (peer *Peer) tracks(mapping *common.Mapping) bool {
+	return peer.mapping != nil && peer.mapping.MachineID == mapping.MachineID && peer.mapping.PrivateIP.Equal(mapping.PrivateIP)
+}
+
+func (peer *Peer) update(mapping *common.Mapping) {
+	peer.mux.Lock()
+	defer peer.mux.Unlock()
+
+	if peer.mapping == mapping {
+		return
+	}
+
+	var active syscall.Sockaddr
+	if current := peer.current(); current != nil {
+		active = current.route.Sockaddr
+	}
+
+	paths := make([]*path, len(mapping.Candidates))
+	for i := 0; i < len(mapping.Candidates); i++ {
+		paths[i] = &path{route: mapping.Via(mapping.Candidates[i])}
+		if len(mapping.Candidates) == 1 {
+			// There is no alternative, so skip the copy and route straight over the mapping.
+			paths[i].route = mapping
+		}
+
+		if j := peer.find(mapping.Candidates[i]); j >= 0 {
+			paths[i].lastSeen, paths[i].rtt = peer.paths[j].lastSeen, peer.paths[j].rtt
+		}
+	}
+
+	if len(paths) == 0 {
+		paths = []*path{{route: mapping}}
+	}
+
+	// Keep following a peer that roamed until its new endpoint shows up in its mapping.
+	old, roamed := peer.paths, peer.roamed()
+	peer.paths = paths
+	if roamed >= 0 && peer.find(old[roamed].route.Sockaddr) < 0 {
+		peer.paths = append(peer.paths, &path{route: mapping.Via(old[roamed].route.Sockaddr), lastSeen: old[roamed].lastSeen, rtt: old[roamed].rtt, roamed: true})
+	}
+
+	peer.mapping = mapping
+	peer.active = -1
+	if active != nil {
+		peer.active = peer.find(active)
+	}
+}
+
+// State returns the current State of the peer.
+func (peer *Peer) State() State {
+	peer.mux.RLock()
+	defer peer.mux.RUnlock()
+
+	return peer.state
+}
+
+// RTT returns the last measured round trip time over the active path to the peer.
+func (peer *Peer) RTT() time.Duration {
+	peer.mux.RLock()
+	defer peer.mux.RUnlock()
+
+	if current := peer.current(); current != nil {
+		return current.rtt
+	}
+	return peer.rtt
+}
+
+// Paths returns a mapping per endpoint the peer may be reachable at, in order of preference.
+func (peer *Peer) Paths() []*common.Mapping {
+	peer.mux.RLock()
+	defer peer.mux.RUnlock()
+
+	routes := make([]*common.Mapping, len(peer.paths))
+	for i := 0; i < len(peer.paths); i++ {
+		routes[i] = peer.paths[i].route
+	}
+	return routes
+}
+
+// Route returns the mapping to use in order to reach the peer over the path that most recently answered a probe, or the supplied mapping if no path has answered yet.
+//
+// If the supplied mapping is a different copy of the mapping the peer was last updated with, the path is applied to the supplied mapping, since it may be the newer of the two.
+func (peer *Peer) Route(mapping *common.Mapping) *common.Mapping {
+	peer.mux.RLock()
+	defer peer.mux.RUnlock()
+
+	current := peer.current()
+	switch {
+	case current == nil || !peer.tracks(mapping):
+		return mapping
+	case peer.mapping == mapping:
+		return current.route
+	case common.SockaddrEquals(mapping.Sockaddr, current.route.Sockaddr):
+		return mapping
+	}
+	return mapping.Via(current.route.Sockaddr)
+}
+
+// Seen marks the peer as up, and returns true if this changed the state of the peer.
+func (peer *Peer) Seen(now time.Time) bool {
+	peer.mux.Lock()
+	defer peer.mux.Unlock()
+
+	peer.lastSeen = now
+	peer.unanswered = time.Time{}
+
+	if peer.state == Up {
+		return false
+	}
+
+	peer.state = Up
+	return true
+}
+
+// Probed records that a keepalive probe was sent to the peer.
+func (peer *Peer) Probed(now time.Time) {
+	peer.mux.Lock()
+	defer peer.mux.Unlock()
+
+	peer.lastProbe = now
+	if peer.unanswered.IsZero() {
+		peer.unanswered = now
+	}
+}
+
+// Roamed records that an authenticated packet from the peer represented by the supplied mapping was received from the supplied endpoint, and returns true if this moved the active path of the peer to that endpoint.
+//
+// The path to the endpoint replaces the path to any endpoint the peer roamed to before, and is dropped once it stops answering probes.
+func (peer *Peer) Roamed(now time.Time, mapping *common.Mapping, sa syscall.Sockaddr) bool {
+	peer.mux.RLock()
+	current := peer.current()
+	stale := !peer.tracks(mapping)
+	unchanged := current != nil && common.SockaddrEquals(current.route.Sockaddr, sa)
+	peer.mux.RUnlock()
+
+	if stale || unchanged {
+		return false
+	}
+
+	peer.mux.Lock()
+	defer peer.mux.Unlock()
+
+	if !peer.tracks(mapping) {
+		return false
+	}
+
+	// Only the latest endpoint the peer roamed to is followed, so a peer roaming repeatedly doesn't pile up paths.
+	i := peer.find(sa)
+	if i < 0 {
+		i = peer.roamed()
+		if i < 0 {
+			peer.paths = append(peer.paths, nil)
+			i = len(peer.paths) - 1
+		}
+		peer.paths[i] = &path{route: peer.mapping.Via(sa), roamed: true}
+	}
+
+	peer.paths[i].lastSeen = now
+	if i == peer.active {
+		return false
+	}
+
+	peer.active = i
+	return true
+}
+
+// Punched records that the peer was asked to punch a hole towards the local node, and returns false if it was already asked to within the supplied interval.
+func (peer *Peer) Punched(now time.Time, interval time.Duration) bool {
+	peer.mux.Lock()
+	defer peer.mux.Unlock()
+
+	if !peer.lastPunch.IsZero() && now.Sub(peer.lastPunch) < interval {
+		return false
+	}
+
+	peer.lastPunch = now
+	return true
+}
+
+// Answered records the reply to a keepalive probe that was sent at the supplied time over the supplied path, and returns true if this changed the state of the peer.
+func (peer *Peer) Answered(now, sent time.Time, path int) bool {
+	peer.mux.Lock()
+	rtt := now.Sub(sent)
+	if path >= 0 && path < len(peer.paths) {
+		peer.paths[path].lastSeen = now
+		peer.paths[path].rtt = rtt
+
+		// Happy eyeballs, the first path to answer is used right away and a more preferred path takes over as soon as it answers as well.
+		if peer.current() == nil || path < peer.active {
+			peer.active = path
+		}
+	}
+	peer.rtt = rtt
+	peer.mux.Unlock()
+
+	return peer.Seen(now)
+}
+
+// Check will mark the peer as down if it has not answered a probe within the supplied timeout, and returns true if this changed the state of the peer.
+//
+// Check also fails over to the most preferred path that answered the last round of probes, if the active path did not, and drops the path to an endpoint the peer roamed to if it did not answer.
+func (peer *Peer) Check(now time.Time, timeout time.Duration) bool {
+	peer.mux.Lock()
+	defer peer.mux.Unlock()
+
+	if current := peer.current(); current != nil && current.lastSeen.Before(peer.lastProbe) {
+		peer.active = -1
+		for i := 0; i < len(peer.paths); i++ {
+			if !peer.paths[i].lastSeen.Before(peer.lastProbe) {
+				peer.active = i
+				break
+			}
+		}
+	}
+
+	// The roamed path is always the last one, so dropping it doesn't move the other paths.
+	if i := peer.roamed(); i >= 0 && i != peer.active && peer.paths[i].lastSeen.Before(peer.lastProbe) {
+		peer.paths = peer.paths[:i]
+	}
+
+	if peer.state == Down || peer.unanswered.IsZero() || now.Sub(peer.unanswered) < timeout {
+		return false
+	}
+
+	peer.state = Down
+	return true
+}
+
+type snapshot struct {
+	MachineID string        `json:"machineID"`
+	State     State         `json:"state"`
+	LastSeen  *time.Time    `json:"lastSeen,omitempty"`
+	LastProbe *time.Time    `json:"lastProbe,omitempty"`
+	RTT       time.Duration `json:"rtt"`
+	Endpoint  string        `json:"endpoint,omitempty"`
+	Paths     []*pathSnap   `json:"paths,omitempty"`
+}
+
+type pathSnap struct {
+	Endpoint string        `json:"endpoint"`
+	LastSeen *time.Time    `json:"lastSeen,omitempty"`
+	RTT      time.Duration `json:"rtt"`
+}
+
+func endpoint(route *common.Mapping) string {
+	return net.JoinHostPort(route.Address, strconv.Itoa(route.Port))
+}
+
+func (peer *Peer) snapshot() *snapshot {
+	peer.mux.RLock()
+	defer peer.mux.RUnlock()
+
+	snap := &snapshot{
+		MachineID: peer.machineID,
+		State:     peer.state,
+		RTT:       peer.rtt,
+	}
+
+	if current := peer.current(); current != nil {
+		snap.RTT = current.rtt
+	}
+
+	if !peer.lastSeen.IsZero() {
+		lastSeen := peer.lastSeen
+		snap.LastSeen = &lastSeen
+	}
+
+	if !peer.lastProbe.IsZero() {
+		lastProbe := peer.lastProbe
+		snap.LastProbe = &lastProbe
+	}
+
+	if current := peer.current(); current != nil {
+		snap.Endpoint = endpoint(current.route)
+	}
+
+	for i := 0; i < len(peer.paths); i++ {
+		ps := &pathSnap{
+			Endpoint: endpoint(peer.paths[i].route),
+			RTT:      peer.paths[i].rtt,
+		}
+
+		if !peer.paths[i].lastSeen.IsZero() {
+			lastSeen := peer.paths[i].lastSeen
+			ps.LastSeen = &lastSeen
+		}
+
+		snap.Paths = append(snap.Paths, ps)
+	}
+
+	return snap
+}
+
+// Table is a thread safe collection of the peers being tracked by quantum keyed by their private ip address.
+type Table struct {
+	mux   sync.RWMutex
+	peers map[uint32]*Peer
+	ips   map[uint32]string
+}
+
+// Get returns the peer and true if the supplied uint32 representation of a private ip is being tracked, otherwise it returns nil and false.
+func (table *Table) Get(ip uint32) (*Peer, bool) {
+	table.mux.RLock()
+	defer table.mux.RUnlock()
+
+	peer, ok := table.peers[ip]
+	return peer, ok
+}
+
+// Track returns the peer for the supplied mapping, and starts tracking it if it isn't already. The paths of the peer are refreshed whenever the supplied mapping changes.
+func (table *Table) Track(mapping *common.Mapping) *Peer {
+	ip := common.IPtoInt(mapping.PrivateIP)
+	if peer, ok := table.Get(ip); ok && peer.machineID == mapping.MachineID {
+		peer.update(mapping)
+		return peer
+	}
+
+	table.mux.Lock()
+	defer table.mux.Unlock()
+
+	if peer, ok := table.peers[ip]; ok && peer.machineID == mapping.MachineID {
+		peer.update(mapping)
+		return peer
+	}
+
+	peer := &Peer{machineID: mapping.MachineID, active: -1}
+	peer.update(mapping)
+	table.peers[ip] = peer
+	table.ips[ip] = mapping.PrivateIP.String()
+	return peer
+}
+
+// Prune stops tracking any peer that isn't represented by one of the supplied mappings.
+func (table *Table) Prune(mappings []*common.Mapping) {
+	current := make(map[uint32]bool, len(mappings))
+	for i := 0; i < len(mappings); i++ {
+		current[common.IPtoInt(mappings[i].PrivateIP)] = true
+	}
+
+	table.mux.Lock()
+	defer table.mux.Unlock()
+
+	for ip := range table.peers {
+		if !current[ip] {
+			delete(table.peers, ip)
+			delete(table.ips, ip)
+		}
+	}
+}
+
+// Bytes returns a byte slice json representation of the tracked peers in either flat or prettified notation, if there is an error while marshalling data a nil slice is returned.
+func (table *Table) Bytes(pretty bool) []byte {
+	table.mux.RLock()
+	snaps := make(map[string]*snapshot, len(table.peers))
+	for ip, peer := range table.peers {
+		snaps[table.ips[ip]] = peer.snapshot()
+	}
+	table.mux.RUnlock()
+
+	var data []byte
+	if pretty {
+		data, _ = json.MarshalIndent(snaps, "", "    ")
+	} else {
+		data, _ = json.Marshal(snaps)
+	}
+	return data
+}
+
+// New generates a Table for tracking the liveness of the remote peers within the quantum network.
+func New() *Table {
+	return &Table{
+		peers: make(map[uint32]*Peer),
+		ips:   make(map[uint32]string),
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package peer
+
+import (
+	"encoding/json"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+)
+
+func TestPeer(t *testing.T) {
+	p := &Peer{}
+	now := time.Now()
+
+	if p.State() != Unknown {
+		t.Fatal("A new peer should be in the unknown state.")
+	}
+
+	p.Probed(now)
+	if p.Check(now.Add(time.Second), 2*time.Second) {
+		t.Fatal("Check marked a peer as down before the timeout expired.")
+	}
+	if !p.Check(now.Add(2*time.Second), 2*time.Second) || p.State() != Down {
+		t.Fatal("Check did not mark an unanswered peer as down.")
+	}
+	if p.Check(now.Add(3*time.Second), 2*time.Second) {
+		t.Fatal("Check reported a state change for a peer that was already down.")
+	}
+
+	if !p.Answered(now.Add(3*time.Second), now.Add(2*time.Second), 0) || p.State() != Up {
+		t.Fatal("Answered did not mark the peer as up.")
+	}
+	if p.RTT() != time.Second {
+		t.Fatalf("Answered did not record the right round trip time, got: %s", p.RTT())
+	}
+	if p.Seen(now.Add(4 * time.Second)) {
+		t.Fatal("Seen reported a state change for a peer that was already up.")
+	}
+	if p.Check(now.Add(10*time.Second), 2*time.Second) {
+		t.Fatal("Check marked a peer as down without any outstanding probes.")
+	}
+}
+
+func TestPeerPaths(t *testing.T) {
+	table := New()
+	now := time.Now()
+
+	direct := common.NewSockaddr(net.ParseIP("192.168.1.10"), 1099)
+	reflexive := common.NewSockaddr(net.ParseIP("1.2.3.4"), 40000)
+	mapping := &common.Mapping{MachineID: "remote", PrivateIP: net.ParseIP("10.99.0.1"), Sockaddr: direct, Candidates: []syscall.Sockaddr{direct, reflexive}}
+
+	p := table.Track(mapping)
+	if len(p.Paths()) != 2 {
+		t.Fatal("Track did not create a path per candidate endpoint.")
+	}
+	if p.Route(mapping) != mapping {
+		t.Fatal("Route did not return the supplied mapping before any path answered.")
+	}
+
+	p.Probed(now)
+	p.Answered(now.Add(time.Millisecond), now, 1)
+	if route := p.Route(mapping); !common.SockaddrEquals(route.Sockaddr, reflexive) || route.Address != "1.2.3.4" || route.Port != 40000 {
+		t.Fatal("Route did not use the only path that answered.")
+	}
+
+	p.Answered(now.Add(2*time.Millisecond), now, 0)
+	if !common.SockaddrEquals(p.Route(mapping).Sockaddr, direct) {
+		t.Fatal("Route did not prefer the direct path once it answered.")
+	}
+
+	p.Probed(now.Add(time.Second))
+	p.Answered(now.Add(time.Second+time.Millisecond), now.Add(time.Second), 1)
+	p.Check(now.Add(2*time.Second), time.Minute)
+	if !common.SockaddrEquals(p.Route(mapping).Sockaddr, reflexive) {
+		t.Fatal("Check did not fail over to the path that answered the last probe.")
+	}
+
+	updated := &common.Mapping{MachineID: "remote", PrivateIP: mapping.PrivateIP, Sockaddr: direct, Candidates: []syscall.Sockaddr{direct, reflexive}}
+	table.Track(updated)
+	if !common.SockaddrEquals(p.Route(updated).Sockaddr, reflexive) {
+		t.Fatal("Track did not keep the active path when the mapping was refreshed.")
+	}
+	if route := p.Route(mapping); route == mapping || !common.SockaddrEquals(route.Sockaddr, reflexive) {
+		t.Fatal("Route did not apply the active path to a different copy of the mapping.")
+	}
+	if other := (&common.Mapping{MachineID: "other", PrivateIP: mapping.PrivateIP, Sockaddr: direct}); p.Route(other) != other {
+		t.Fatal("Route returned a path for a mapping of a different machine.")
+	}
+
+	if p.Answered(now.Add(time.Second), now, 7) || p.RTT() != time.Millisecond {
+		t.Fatal("Answered recorded the round trip time of an unknown path.")
+	}
+
+	roamed := common.NewSockaddr(net.ParseIP("5.6.7.8"), 50000)
+	if p.Roamed(now, &common.Mapping{MachineID: "other", PrivateIP: mapping.PrivateIP}, roamed) {
+		t.Fatal("Roamed followed a packet for a mapping of a different machine.")
+	}
+	if !p.Roamed(now, updated, roamed) || !common.SockaddrEquals(p.Route(updated).Sockaddr, roamed) {
+		t.Fatal("Roamed did not move the active path to the new endpoint.")
+	}
+	if p.Roamed(now, updated, roamed) {
+		t.Fatal("Roamed reported a change for the endpoint that was already active.")
+	}
+
+	refreshed := &common.Mapping{MachineID: "remote", PrivateIP: mapping.PrivateIP, Sockaddr: direct, Candidates: []syscall.Sockaddr{direct, reflexive}}
+	table.Track(refreshed)
+	if len(p.Paths()) != 3 || !common.SockaddrEquals(p.Route(refreshed).Sockaddr, roamed) {
+		t.Fatal("Track dropped the roamed endpoint when the mapping was refreshed.")
+	}
+
+	for i := 0; i < 300; i++ {
+		p.Roamed(now, refreshed, common.NewSockaddr(net.ParseIP("5.6.7.8"), 50001+i))
+	}
+	if len(p.Paths()) != 3 || p.Route(refreshed).Port != 50300 {
+		t.Fatal("Roamed did not replace the previous roamed endpoint.")
+	}
+
+	p.Probed(now.Add(3 * time.Second))
+	p.Answered(now.Add(3*time.Second+time.Millisecond), now.Add(3*time.Second), 0)
+	p.Check(now.Add(4*time.Second), time.Minute)
+	if len(p.Paths()) != 2 || !common.SockaddrEquals(p.Route(refreshed).Sockaddr, direct) {
+		t.Fatal("Check did not drop the roamed endpoint once it stopped answering.")
+	}
+
+	if !p.Punched(now, time.Minute) || p.Punched(now.Add(time.Second), time.Minute) {
+		t.Fatal("Punched did not rate limit hole punch requests.")
+	}
+}
+
+func TestTable(t *testing.T) {
+	table := New()
+
+	first := &common.Mapping{MachineID: "first", PrivateIP: net.ParseIP("10.99.0.1")}
+	second := &common.Mapping{MachineID: "second", PrivateIP: net.ParseIP("10.99.0.2")}
+
+	p := table.Track(first)
+	if table.Track(first) != p {
+		t.Fatal("Track returned a different peer for the same mapping.")
+	}
+	table.Track(second)
+
+	if _, ok := table.Get(common.IPtoInt(second.PrivateIP)); !ok {
+		t.Fatal("Get did not return a tracked peer.")
+	}
+
+	replaced := &common.Mapping{MachineID: "replaced", PrivateIP: first.PrivateIP}
+	if table.Track(replaced) == p {
+		t.Fatal("Track returned the old peer for a private ip that moved to a different machine.")
+	}
+
+	table.Prune([]*common.Mapping{replaced})
+	if _, ok := table.Get(common.IPtoInt(second.PrivateIP)); ok {
+		t.Fatal("Prune did not stop tracking a peer without a mapping.")
+	}
+
+	snaps := make(map[string]map[string]interface{})
+	if err := json.Unmarshal(table.Bytes(false), &snaps); err != nil {
+		t.Fatalf("Bytes returned invalid json: %s", err)
+	}
+	if len(snaps) != 1 || snaps["10.99.0.1"] == nil || snaps["10.99.0.1"]["machineID"] != "replaced" || snaps["10.99.0.1"]["state"] != "unknown" {
+		t.Fatal("Bytes did not return the tracked peers.")
+	}
+
+	if table.Bytes(true) == nil {
+		t.Fatal("Bytes returned a nil slice when asking for a prettified version.")
+	}
+}
@@ -4,60 +4,327 @@
 package plugin
 
 import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
+)
+
+const (
+	// SnappyCodec compresses packets with snappy, which is the only codec understood by nodes that don't negotiate codecs.
+	SnappyCodec = "snappy"
+
+	// LZ4Codec compresses packets with the LZ4 block format.
+	LZ4Codec = "lz4"
+
+	// ZstdCodec compresses packets with zstd, which compresses the most at the highest cpu cost.
+	ZstdCodec = "zstd"
+)
+
+// The maximum number of bytes compression grows a packet by, which covers the codec tag as well as the framing snappy adds to incompressible packets exchanged untagged.
+const compressionExpansion = 6
+
+// The codec tags prepended to the packets exchanged with nodes that negotiate codecs.
+const (
+	uncompressedTag byte = iota
+	snappyTag
+	lz4Tag
+	zstdTag
 )
 
+// The size of the scratch buffers packets are compressed into or decompressed from, which fits the worst case expansion of every codec.
+var scratchLength = snappy.MaxEncodedLen(common.MaxBufferLength)
+
+// codec compresses and decompresses packets with one compression algorithm.
+type codec struct {
+	name   string
+	plugin string
+	tag    byte
+
+	// encode compresses the src packet into the dst buffer, and returns nil if it doesn't fit.
+	encode func(comp *Compression, scratch *scratch, dst, src []byte) []byte
+
+	// decode decompresses the src packet into the dst buffer, and returns nil if it is corrupt or doesn't fit.
+	decode func(comp *Compression, dst, src []byte) []byte
+}
+
+var codecs = []*codec{
+	{
+		name: SnappyCodec,
+		tag:  snappyTag,
+		encode: func(comp *Compression, scratch *scratch, dst, src []byte) []byte {
+			return snappy.Encode(dst, src)
+		},
+		decode: func(comp *Compression, dst, src []byte) []byte {
+			if length, err := snappy.DecodedLen(src); err != nil || length > len(dst) {
+				return nil
+			}
+			buf, err := snappy.Decode(dst, src)
+			if err != nil {
+				return nil
+			}
+			return buf
+		},
+	},
+	{
+		name: LZ4Codec,
+		tag:  lz4Tag,
+		encode: func(comp *Compression, scratch *scratch, dst, src []byte) []byte {
+			length, err := scratch.lz4.CompressBlock(src, dst)
+			if err != nil || length == 0 {
+				return nil
+			}
+			return dst[:length]
+		},
+		decode: func(comp *Compression, dst, src []byte) []byte {
+			length, err := lz4.UncompressBlock(src, dst)
+			if err != nil {
+				return nil
+			}
+			return dst[:length]
+		},
+	},
+	{
+		name: ZstdCodec,
+		tag:  zstdTag,
+		encode: func(comp *Compression, scratch *scratch, dst, src []byte) []byte {
+			return comp.encoder.EncodeAll(src, dst[:0])
+		},
+		decode: func(comp *Compression, dst, src []byte) []byte {
+			buf, err := comp.decoder.DecodeAll(src, dst[:0])
+			if err != nil {
+				return nil
+			}
+			return buf
+		},
+	},
+}
+
+func init() {
+	for i := 0; i < len(codecs); i++ {
+		codecs[i].plugin = common.CompressionCodecPrefix + codecs[i].name
+	}
+}
+
+// scratch holds the per packet state of the compression plugin, one of which is preallocated for each queue in each direction. The lock only contends when the control worker sends packets on the queue of another worker.
+type scratch struct {
+	mux sync.Mutex
+	buf []byte
+	lz4 lz4.Compressor
+}
+
+// compressionStats holds the compression statistics of the packets sent to a remote peer.
+type compressionStats struct {
+	privateIP       string
+	codec           atomic.Value
+	packets         uint64
+	skipped         uint64
+	bytes           uint64
+	compressedBytes uint64
+}
+
 // Compression plugin struct to use for compressing outgoing packets or decompressing incoming packets.
+//
+// Packets exchanged with nodes that negotiate codecs are compressed with the first configured codec the remote node advertises, and are prepended with a tag naming the codec. When adaptive compression is enabled packets that wouldn't get smaller are sent uncompressed and tagged as such. Packets exchanged with nodes that don't negotiate codecs are always compressed with snappy and untagged.
 type Compression struct {
-	cfg *common.Config
+	cfg     *common.Config
+	codecs  []*codec
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	scratch [2][]*scratch
+
+	statsLock sync.RWMutex
+	stats     map[uint32]*compressionStats
 }
 
-func compress(raw []byte) ([]byte, int) {
-	buf := snappy.Encode(nil, raw)
-	return buf, len(buf)
+// negotiate returns the first configured codec that the remote node supports, and nil if there is none.
+func (comp *Compression) negotiate(mapping *common.Mapping) *codec {
+	for i := 0; i < len(comp.codecs); i++ {
+		if common.StringInSlice(comp.codecs[i].plugin, mapping.SupportedPlugins) {
+			return comp.codecs[i]
+		}
+	}
+	return nil
 }
 
-func decompress(raw []byte) ([]byte, int) {
-	buf, err := snappy.Decode(nil, raw)
-	if err != nil {
-		return nil, -1
+func (comp *Compression) record(mapping *common.Mapping, codec *codec, skipped bool, bytes, compressedBytes int) {
+	ip := common.IPtoInt(mapping.PrivateIP)
+
+	comp.statsLock.RLock()
+	stats, ok := comp.stats[ip]
+	comp.statsLock.RUnlock()
+
+	if !ok {
+		comp.statsLock.Lock()
+		if stats, ok = comp.stats[ip]; !ok {
+			stats = &compressionStats{privateIP: mapping.PrivateIP.String()}
+			comp.stats[ip] = stats
+		}
+		comp.statsLock.Unlock()
+	}
+
+	if codec != nil {
+		stats.codec.Store(codec.name)
+	}
+	if skipped {
+		atomic.AddUint64(&stats.skipped, 1)
+	}
+	atomic.AddUint64(&stats.packets, 1)
+	atomic.AddUint64(&stats.bytes, uint64(bytes))
+	atomic.AddUint64(&stats.compressedBytes, uint64(compressedBytes))
+}
+
+// setPacket replaces the packet carried by the payload, and returns false if it doesn't fit.
+func setPacket(payload *common.Payload, packet []byte) bool {
+	if !payload.Fits(len(packet)) {
+		return false
+	}
+
+	copy(payload.Raw[common.PacketStart:], packet)
+	payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+len(packet)]
+	payload.Length = common.HeaderSize + len(payload.Packet)
+	return true
+}
+
+// setTaggedPacket replaces the packet carried by the payload with the supplied one prepended with the codec tag, and returns false if it doesn't fit.
+func setTaggedPacket(payload *common.Payload, tag byte, packet []byte) bool {
+	if !payload.Fits(1 + len(packet)) {
+		return false
+	}
+
+	copy(payload.Raw[common.PacketStart+1:], packet)
+	payload.Raw[common.PacketStart] = tag
+	payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+1+len(packet)]
+	payload.Length = common.HeaderSize + len(payload.Packet)
+	return true
+}
+
+func (comp *Compression) incoming(payload *common.Payload, mapping *common.Mapping, scratch *scratch) bool {
+	dst := scratch.buf[:len(payload.Raw)-common.PacketStart]
+
+	if !mapping.HasCodecs() {
+		buf := codecs[0].decode(comp, dst, payload.Packet)
+		return buf != nil && setPacket(payload, buf)
+	}
+
+	if len(payload.Packet) == 0 {
+		return false
 	}
-	return buf, len(buf)
+
+	tag, body := payload.Packet[0], payload.Packet[1:]
+	if tag == uncompressedTag {
+		return setPacket(payload, body)
+	}
+
+	for i := 0; i < len(codecs); i++ {
+		if codecs[i].tag == tag {
+			buf := codecs[i].decode(comp, dst, body)
+			return buf != nil && setPacket(payload, buf)
+		}
+	}
+	return false
+}
+
+func (comp *Compression) outgoing(payload *common.Payload, mapping *common.Mapping, scratch *scratch) bool {
+	length := len(payload.Packet)
+
+	if !mapping.HasCodecs() {
+		buf := codecs[0].encode(comp, scratch, scratch.buf, payload.Packet)
+		if buf == nil || len(buf) > length+compressionExpansion || !setPacket(payload, buf) {
+			return false
+		}
+		comp.record(mapping, codecs[0], false, length, len(buf))
+		return true
+	}
+
+	codec := comp.negotiate(mapping)
+
+	var buf []byte
+	if codec != nil {
+		buf = codec.encode(comp, scratch, scratch.buf, payload.Packet)
+	}
+
+	fits := buf != nil && 1+len(buf) <= length+compressionExpansion
+	if fits && (!comp.cfg.CompressionAdaptive || len(buf) < length) && setTaggedPacket(payload, codec.tag, buf) {
+		comp.record(mapping, codec, false, length, 1+len(buf))
+		return true
+	}
+
+	// Packets that couldn't be compressed, wouldn't get any smaller or wouldn't fit once compressed are sent as is.
+	if !setTaggedPacket(payload, uncompressedTag, payload.Packet) {
+		return false
+	}
+	comp.record(mapping, codec, codec != nil, length, 1+length)
+	return true
 }
 
 // Apply returns the payload/mapping compressed if the direction is Outgoing and decompressed if the direction is Incoming.
-func (comp *Compression) Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
+func (comp *Compression) Apply(direction Direction, queue int, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
 	if !common.StringInSlice(CompressionPlugin, mapping.SupportedPlugins) {
 		return payload, mapping, true
 	}
 
+	scratch := comp.scratch[direction][queue]
+	scratch.mux.Lock()
+	defer scratch.mux.Unlock()
+
 	switch direction {
 	case Incoming:
-		decompressed, length := decompress(payload.Packet)
-		if decompressed == nil {
+		if !comp.incoming(payload, mapping, scratch) {
+			payload.DropReason = common.MalformedDropReason
 			return payload, mapping, false
 		}
-
-		copy(payload.Raw[common.PacketStart:], decompressed)
-		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length]
-		payload.Length = common.HeaderSize + length
 	case Outgoing:
-		compressed, length := compress(payload.Packet)
-		if compressed == nil {
+		if !comp.outgoing(payload, mapping, scratch) {
+			payload.DropReason = common.OversizeDropReason
 			return payload, mapping, false
 		}
-
-		copy(payload.Raw[common.PacketStart:], compressed)
-		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length]
-		payload.Length = common.HeaderSize + length
 	}
 	return payload, mapping, true
 }
 
-// Close which is a noop.
+// Report returns the compression statistics of the packets sent to each remote peer.
+func (comp *Compression) Report() *metric.Metric {
+	comp.statsLock.RLock()
+	defer comp.statsLock.RUnlock()
+
+	compression := make(map[string]*metric.CompressionMetrics, len(comp.stats))
+	for _, stats := range comp.stats {
+		metrics := &metric.CompressionMetrics{
+			Packets:         atomic.LoadUint64(&stats.packets),
+			Skipped:         atomic.LoadUint64(&stats.skipped),
+			Bytes:           atomic.LoadUint64(&stats.bytes),
+			CompressedBytes: atomic.LoadUint64(&stats.compressedBytes),
+		}
+		if codec, ok := stats.codec.Load().(string); ok {
+			metrics.Codec = codec
+		}
+		if metrics.Bytes > 0 {
+			metrics.Ratio = float64(metrics.CompressedBytes) / float64(metrics.Bytes)
+		}
+		compression[stats.privateIP] = metrics
+	}
+
+	return &metric.Metric{
+		Type:        metric.Compression,
+		Compression: compression,
+	}
+}
+
+// Close releases the zstd encoder and decoder.
 func (comp *Compression) Close() error {
-	return nil
+	comp.decoder.Close()
+	return comp.encoder.Close()
+}
+
+// Expansion returns the maximum number of bytes compression grows a packet by.
+func (comp *Compression) Expansion() int {
+	return compressionExpansion
 }
 
 // Name returns 'compression'.
@@ -71,7 +338,45 @@ func (comp *Compression) Order() int {
 }
 
 func newCompression(cfg *common.Config) (Plugin, error) {
-	return &Compression{
-		cfg: cfg,
-	}, nil
+	comp := &Compression{
+		cfg:   cfg,
+		stats: make(map[uint32]*compressionStats),
+	}
+
+	for i := 0; i < len(cfg.CompressionCodecs); i++ {
+		found := false
+		for j := 0; j < len(codecs); j++ {
+			if codecs[j].name == cfg.CompressionCodecs[i] {
+				comp.codecs = append(comp.codecs, codecs[j])
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("specified compression codec is not supported: " + cfg.CompressionCodecs[i])
+		}
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderCRC(false), zstd.WithLowerEncoderMem(true))
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(common.MaxBufferLength), zstd.WithDecodeAllCapLimit(true))
+	if err != nil {
+		encoder.Close()
+		return nil, err
+	}
+
+	comp.encoder, comp.decoder = encoder, decoder
+	queues := cfg.NumWorkers
+	if queues < 1 {
+		queues = 1
+	}
+	for i := 0; i < len(comp.scratch); i++ {
+		comp.scratch[i] = make([]*scratch, queues)
+		for j := 0; j < queues; j++ {
+			comp.scratch[i][j] = &scratch{buf: make([]byte, scratchLength)}
+		}
+	}
+	return comp, nil
 }
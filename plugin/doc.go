@@ -7,5 +7,17 @@ Package plugin contains the structs and logic to handle arbitrary transforms or
 Currently supported plugin types:
     - Compression
     - Encryption
+    - FEC
+    - Obfuscation
+
+Plugins transform packets in place within the payload buffer. Each plugin declares the maximum number of bytes it grows a packet by, and the MTU of the TUN device is lowered by the room the enabled plugins need when quantum starts, so that a full sized packet never outgrows the maximum packet size. Packets that would still outgrow their buffer or the maximum packet size are dropped with the oversize drop reason instead of being written past the end of the buffer. Plugins needing scratch space preallocate it per queue, which they are handed along with each packet, so that every worker reuses the same buffers without allocating per packet.
+
+The compression plugin negotiates its codec with each remote node through the codecs advertised alongside the supported plugins, and supports snappy, LZ4 and zstd. Packets that wouldn't get smaller are sent uncompressed when adaptive compression is enabled, and the compression ratio achieved for each remote node is reported with the other metrics.
+
+The fec plugin protects the packets sent to remote nodes over lossy links with forward error correction. It groups outgoing packets and sends Reed-Solomon parity packets for each group, from which the remote node rebuilds up to as many lost packets of the group as there are parity packets. It runs between compression and encryption, so parity and rebuilt packets are authenticated like any other. Parity packets are produced through the Producer interface, which the workers drain right after each packet and which the control worker flushes once a group times out.
+
+The obfuscation plugin resists traffic analysis, it pads packets up to the configured size buckets, can inject cover traffic at a configured rate, and replaces the private ip in the header of packets with a tag that only nodes sharing its key can map back to the sending node. It runs after the encryption plugin, which keeps authenticating the private ip as it is restored by the receiving node before any plugins run. The handshake packets establishing encryption sessions bypass the other plugins, but are padded and tagged by the obfuscation plugin like any other packet. The trailer recording the real length of a packet is authenticated, along with the private ip of the sending node, with a key derived from the shared key.
+
+Plugins are looked up by name in a registry, which the built-in plugins add themselves to and which other packages compiled into quantum can extend through Register. The order each plugin declares decides where it sits in the pipeline, unless overridden by the order option of the plugin, outgoing packets pass through the plugins in ascending order and incoming packets in descending order, with plugins of the same order sorted by name. Plugins can optionally implement the Initializer interface to set themselves up against the datastore, the MappingWatcher interface to be told about remote nodes joining, changing, or leaving, and the Reporter interface to publish their own metrics, the Resolver interface to restore a private ip they hid, the Injector interface to send packets of their own, and the Producer interface to add packets to the traffic passing through the plugins.
 */
 package plugin
@@ -4,41 +4,193 @@
 package plugin
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/crypto"
 )
 
+// The maximum number of bytes encryption grows a packet by, which is the authentication tag and counter followed by the larger of the key id and session trailers.
+const encryptionExpansion = crypto.TagSize + crypto.CounterSize + common.SessionIndexSize + common.SessionKindSize
+
 // Encryption plugin struct to use for encrypting outgoing packets or decrypting incoming packets.
 type Encryption struct {
-	cfg *common.Config
+	cfg     *common.Config
+	mux     sync.RWMutex
+	windows map[uint64]*replayWindow
+}
+
+type replayWindow struct {
+	crypto.ReplayWindow
+	publicKey []byte
 }
 
 // Apply returns the payload/mapping encrypted if the direction is Outgoing and decrypted if the direction is Incoming.
-func (enc *Encryption) Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
+//
+// Packets exchanged with nodes that support handshakes are encrypted with the keys of the session established with them, otherwise they are encrypted with keys derived from the published key pairs. The latter are tagged with the id of the sender's key followed by the id of the receiver's key, so that both sides pick the right keys while a rotation propagates.
+func (enc *Encryption) Apply(direction Direction, queue int, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
 	if !common.StringInSlice(EncryptionPlugin, mapping.SupportedPlugins) {
 		return payload, mapping, true
 	}
 
+	if enc.cfg.Sessions != nil && mapping.HasCapability(common.HandshakeCapability) {
+		return enc.session(direction, payload, mapping)
+	}
+
+	switch direction {
+	case Incoming:
+		end := len(payload.Packet) - common.KeyIDSize
+		if end < 0 {
+			payload.DropReason = common.UnauthenticatedDropReason
+			return payload, mapping, false
+		}
+		remoteID, localID := payload.Packet[end], payload.Packet[end+1]
+
+		local, ok := enc.cfg.Keys.Get(localID)
+		if !ok {
+			payload.DropReason = common.UnauthenticatedDropReason
+			return payload, mapping, false
+		}
+
+		ciphers, ok := mapping.Cipher(local, remoteID)
+		if !ok {
+			payload.DropReason = common.UnauthenticatedDropReason
+			return payload, mapping, false
+		}
+
+		length, counter, err := ciphers.Incoming.Decrypt(payload.Packet[:end], payload.IPAddress)
+		if err != nil {
+			payload.DropReason = common.UnauthenticatedDropReason
+			return payload, mapping, false
+		}
+
+		if !enc.window(payload.IPAddress, local.ID, remoteID, mapping).Accept(counter) {
+			payload.DropReason = common.ReplayedDropReason
+			return payload, mapping, false
+		}
+
+		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length]
+		payload.Length = common.HeaderSize + length
+		payload.Authenticated = true
+	case Outgoing:
+		local := enc.cfg.Keys.Sending()
+
+		ciphers, ok := mapping.Cipher(local, mapping.KeyID)
+		if !ok {
+			return payload, mapping, false
+		}
+
+		if !payload.Fits(ciphers.Outgoing.EncryptedSize(payload.Packet) + common.KeyIDSize) {
+			payload.DropReason = common.OversizeDropReason
+			return payload, mapping, false
+		}
+
+		length, err := ciphers.Outgoing.Encrypt(payload.Raw[common.PacketStart:], len(payload.Packet), payload.IPAddress)
+		if err != nil {
+			return payload, mapping, false
+		}
+
+		payload.Raw[common.PacketStart+length] = local.ID
+		payload.Raw[common.PacketStart+length+1] = mapping.KeyID
+		length += common.KeyIDSize
+		enc.cfg.Keys.Used(length)
+
+		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length]
+		payload.Length = common.HeaderSize + length
+	}
+	return payload, mapping, true
+}
+
+// session encrypts or decrypts the payload with the keys of the session established with the remote node. Encrypted packets are tagged with the index the receiver assigned to the session, followed by the TransportKind mark.
+func (enc *Encryption) session(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
 	switch direction {
 	case Incoming:
-		length, err := mapping.AES.Decrypt(payload.Packet, payload.IPAddress)
+		end := len(payload.Packet) - common.SessionIndexSize - common.SessionKindSize
+		if end < 0 || payload.Packet[len(payload.Packet)-common.SessionKindSize] != common.TransportKind {
+			payload.DropReason = common.UnauthenticatedDropReason
+			return payload, mapping, false
+		}
+
+		ip := common.IPtoInt(mapping.PrivateIP)
+		session, ok := enc.cfg.Sessions.Receiving(ip, binary.BigEndian.Uint32(payload.Packet[end:]))
+		if !ok {
+			// The remote node is using a session the local node doesn't know about, most likely because the local node restarted, so a new one is needed.
+			enc.cfg.Sessions.Request(ip)
+			payload.DropReason = common.UnauthenticatedDropReason
+			return payload, mapping, false
+		}
+
+		length, counter, err := session.Incoming.Decrypt(payload.Packet[:end], payload.IPAddress)
 		if err != nil {
+			payload.DropReason = common.UnauthenticatedDropReason
 			return payload, mapping, false
 		}
 
+		if !session.Window.Accept(counter) {
+			payload.DropReason = common.ReplayedDropReason
+			return payload, mapping, false
+		}
+		enc.cfg.Sessions.Confirm(session)
+
 		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length]
 		payload.Length = common.HeaderSize + length
+		payload.Authenticated = true
 	case Outgoing:
-		length, err := mapping.AES.Encrypt(payload.Raw[common.PacketStart:], len(payload.Packet), payload.IPAddress)
+		session, ok := enc.cfg.Sessions.Sending(common.IPtoInt(mapping.PrivateIP))
+		if !ok {
+			payload.DropReason = common.NoSessionDropReason
+			return payload, mapping, false
+		}
+
+		if !payload.Fits(session.Outgoing.EncryptedSize(payload.Packet) + common.SessionIndexSize + common.SessionKindSize) {
+			payload.DropReason = common.OversizeDropReason
+			return payload, mapping, false
+		}
+
+		length, err := session.Outgoing.Encrypt(payload.Raw[common.PacketStart:], len(payload.Packet), payload.IPAddress)
 		if err != nil {
 			return payload, mapping, false
 		}
 
+		binary.BigEndian.PutUint32(payload.Raw[common.PacketStart+length:], session.Remote)
+		length += common.SessionIndexSize
+		payload.Raw[common.PacketStart+length] = common.TransportKind
+		length += common.SessionKindSize
+
 		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length]
 		payload.Length = common.HeaderSize + length
 	}
 	return payload, mapping, true
 }
 
+// window returns the anti-replay window for the sender and pair of keys, starting a fresh one whenever the sender shows up with a different public key for the same key id.
+func (enc *Encryption) window(sender []byte, localID, remoteID uint8, mapping *common.Mapping) *replayWindow {
+	key := uint64(common.IPtoInt(sender))<<16 | uint64(localID)<<8 | uint64(remoteID)
+	publicKey, _, _ := mapping.Key(remoteID)
+
+	enc.mux.RLock()
+	window, ok := enc.windows[key]
+	enc.mux.RUnlock()
+
+	if ok && bytes.Equal(window.publicKey, publicKey) {
+		return window
+	}
+
+	enc.mux.Lock()
+	defer enc.mux.Unlock()
+
+	if window, ok := enc.windows[key]; ok && bytes.Equal(window.publicKey, publicKey) {
+		return window
+	}
+
+	window = &replayWindow{publicKey: publicKey}
+	enc.windows[key] = window
+	return window
+}
+
 // Close which is a noop.
 func (enc *Encryption) Close() error {
 	return nil
@@ -49,13 +201,23 @@ func (enc *Encryption) Name() string {
 	return EncryptionPlugin
 }
 
+// Expansion returns the size of the authentication tag, counter and session trailer appended to encrypted packets.
+func (enc *Encryption) Expansion() int {
+	return encryptionExpansion
+}
+
 // Order returns the EncryptionPluginOrder value.
 func (enc *Encryption) Order() int {
 	return EncryptionPluginOrder
 }
 
 func newEncryption(cfg *common.Config) (Plugin, error) {
+	if cfg.Keys == nil {
+		return nil, errors.New("the encryption plugin requires the local keys to be generated")
+	}
+
 	return &Encryption{
-		cfg: cfg,
+		cfg:     cfg,
+		windows: make(map[uint64]*replayWindow),
 	}, nil
 }
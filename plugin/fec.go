@@ -0,0 +1,645 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package plugin
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
+)
+
+const (
+	// The trailers appended to packets exchanged with nodes supporting fec, which end in a byte telling them apart. Unprotected packets only carry that byte, packets protected as part of a group carry the group id and their index within it, and parity packets additionally carry the number of data and parity packets in their group.
+	fecUnprotectedSize = 1
+	fecDataSize        = 3
+	fecParitySize      = 5
+
+	fecUnprotected byte = 0xff
+	fecParityFlag  byte = 0x80
+
+	// The marker ending the data held in a shard, which keeps the data apart from the zero padding making every shard of a group the same size.
+	fecMarker byte = 0x80
+
+	// The maximum number of bytes fec grows a packet by, which leaves room for the parity packets of a group holding a full sized packet. These are as large as the largest packet of their group plus the marker and the parity trailer.
+	fecExpansion = 1 + fecParitySize
+
+	// The limits on the redundancy, which keep the data and parity indexes apart within the trailer byte.
+	fecMaxData   = 64
+	fecMaxParity = 32
+
+	// The number of groups per remote node held while waiting for the packets needed to rebuild the ones lost.
+	fecWindow = 16
+
+	defaultFECData    = "8"
+	defaultFECParity  = "2"
+	defaultFECTimeout = "10ms"
+)
+
+// FEC plugin struct to use for forward error correction, which sends parity packets computed with Reed-Solomon codes over groups of outgoing packets, so that the remote node can rebuild packets lost within a group without waiting on a retransmission.
+//
+// Groups are closed once they hold the configured number of packets or once the first of them waited for the configured timeout, in which case the parity packets cover the packets sent so far.
+type FEC struct {
+	cfg     *common.Config
+	data    int
+	parity  int
+	timeout time.Duration
+	peers   []string
+
+	mux      sync.RWMutex
+	encoders map[[2]int]reedsolomon.Encoder
+	remotes  map[uint32]*fecRemote
+
+	queueMux sync.Mutex
+	outgoing []*fecPacket
+	incoming []*fecPacket
+}
+
+// fecRemote holds the state kept for a single remote node, behind a lock of its own so that packets exchanged with different remote nodes are handled in parallel.
+type fecRemote struct {
+	mux      sync.Mutex
+	sender   fecSender
+	receiver fecReceiver
+	stats    fecStats
+}
+
+type fecPacket struct {
+	mapping *common.Mapping
+	data    []byte
+}
+
+type fecStats struct {
+	privateIP      string
+	parityPackets  uint64
+	parityReceived uint64
+	recovered      uint64
+	unrecoverable  uint64
+}
+
+type fecSender struct {
+	mapping *common.Mapping
+	group   uint16
+	count   int
+	started time.Time
+	shards  [][]byte
+}
+
+type fecReceiver struct {
+	groups [fecWindow]*fecGroup
+}
+
+type fecGroup struct {
+	id        uint16
+	used      bool
+	done      bool
+	data      int
+	parity    int
+	highest   int
+	received  [fecMaxData + fecMaxParity]bool
+	recovered [fecMaxData]bool
+	shards    [fecMaxData + fecMaxParity][]byte
+}
+
+// encoder returns the Reed-Solomon encoder for groups of the supplied size, which is safe for concurrent use.
+func (fec *FEC) encoder(data, parity int) (reedsolomon.Encoder, error) {
+	key := [2]int{data, parity}
+	fec.mux.RLock()
+	enc, ok := fec.encoders[key]
+	fec.mux.RUnlock()
+	if ok {
+		return enc, nil
+	}
+
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+
+	fec.mux.Lock()
+	defer fec.mux.Unlock()
+
+	fec.encoders[key] = enc
+	return enc, nil
+}
+
+// remote returns the state kept for the remote node, creating it on first use.
+func (fec *FEC) remote(mapping *common.Mapping) *fecRemote {
+	ip := common.IPtoInt(mapping.PrivateIP)
+	fec.mux.RLock()
+	remote, ok := fec.remotes[ip]
+	fec.mux.RUnlock()
+	if ok {
+		return remote
+	}
+
+	fec.mux.Lock()
+	defer fec.mux.Unlock()
+
+	if remote, ok := fec.remotes[ip]; ok {
+		return remote
+	}
+	remote = &fecRemote{
+		sender: fecSender{shards: make([][]byte, fec.data)},
+		stats:  fecStats{privateIP: mapping.PrivateIP.String()},
+	}
+	fec.remotes[ip] = remote
+	return remote
+}
+
+// snapshot returns the state kept for every remote node, so that their locks are taken without holding the lock of the plugin, which is taken in turn while holding theirs.
+func (fec *FEC) snapshot() []*fecRemote {
+	fec.mux.RLock()
+	defer fec.mux.RUnlock()
+
+	remotes := make([]*fecRemote, 0, len(fec.remotes))
+	for _, remote := range fec.remotes {
+		remotes = append(remotes, remote)
+	}
+	return remotes
+}
+
+// queue appends the packet to the supplied queue of packets waiting to be produced.
+func (fec *FEC) queue(queue *[]*fecPacket, packet *fecPacket) {
+	fec.queueMux.Lock()
+	*queue = append(*queue, packet)
+	fec.queueMux.Unlock()
+}
+
+// protects returns whether or not the packets sent to the remote node are protected, which is the case for every node unless specific nodes are configured.
+func (fec *FEC) protects(mapping *common.Mapping) bool {
+	if len(fec.peers) == 0 {
+		return true
+	}
+	return common.StringInSlice(mapping.PrivateIP.String(), fec.peers) || common.StringInSlice(mapping.MachineID, fec.peers)
+}
+
+// shard copies the data into the shard buffer followed by the marker, allocating the buffer on first use.
+func shard(buf []byte, data []byte) []byte {
+	if buf == nil {
+		buf = make([]byte, common.MaxPacketLength)
+	}
+	buf = buf[:len(data)+1]
+	copy(buf, data)
+	buf[len(data)] = fecMarker
+	return buf
+}
+
+// unshard returns the data held in the shard, and false if the shard doesn't end in the marker followed by zero padding.
+func unshard(buf []byte) ([]byte, bool) {
+	for i := len(buf) - 1; i >= 0; i-- {
+		switch buf[i] {
+		case 0:
+			continue
+		case fecMarker:
+			return buf[:i], true
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+// pad zero fills the shards up to the supplied size, leaving out the empty shards of the packets missing from a group.
+func pad(shards [][]byte, size int) {
+	for i := 0; i < len(shards); i++ {
+		length := len(shards[i])
+		if length == 0 {
+			continue
+		}
+		shards[i] = shards[i][:size]
+		for j := length; j < size; j++ {
+			shards[i][j] = 0
+		}
+	}
+}
+
+// close computes the parity packets of the group being sent to the remote node, queues them to be produced, and starts the next group, the caller must hold the lock of the remote node.
+func (fec *FEC) close(remote *fecRemote) {
+	sender := &remote.sender
+	if sender.count == 0 {
+		return
+	}
+	defer func() {
+		sender.group++
+		sender.count = 0
+	}()
+
+	enc, err := fec.encoder(sender.count, fec.parity)
+	if err != nil {
+		return
+	}
+
+	size := 0
+	shards := make([][]byte, sender.count+fec.parity)
+	for i := 0; i < sender.count; i++ {
+		shards[i] = sender.shards[i]
+		if len(shards[i]) > size {
+			size = len(shards[i])
+		}
+	}
+	pad(shards[:sender.count], size)
+	for i := sender.count; i < len(shards); i++ {
+		shards[i] = make([]byte, size, size+fecParitySize)
+	}
+
+	if err := enc.Encode(shards); err != nil {
+		return
+	}
+
+	for i := 0; i < fec.parity; i++ {
+		packet := shards[sender.count+i]
+		packet = append(packet, 0, 0, byte(sender.count), byte(fec.parity), fecParityFlag|byte(i))
+		binary.BigEndian.PutUint16(packet[size:], sender.group)
+		fec.queue(&fec.outgoing, &fecPacket{mapping: sender.mapping, data: packet})
+	}
+	remote.stats.parityPackets += uint64(fec.parity)
+}
+
+// send records the packet in the group being sent to the remote node and appends its trailer.
+func (fec *FEC) send(payload *common.Payload, mapping *common.Mapping) bool {
+	length := len(payload.Packet)
+	if !fec.protects(mapping) {
+		if !payload.Fits(length + fecUnprotectedSize) {
+			return false
+		}
+		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length+fecUnprotectedSize]
+		payload.Packet[length] = fecUnprotected
+		payload.Length += fecUnprotectedSize
+		return true
+	}
+
+	if !payload.Fits(length + fecExpansion) {
+		return false
+	}
+
+	now := time.Now()
+	remote := fec.remote(mapping)
+
+	remote.mux.Lock()
+	defer remote.mux.Unlock()
+
+	sender := &remote.sender
+	if sender.count > 0 && now.Sub(sender.started) >= fec.timeout {
+		fec.close(remote)
+	}
+	if sender.count == 0 {
+		sender.started = now
+	}
+
+	sender.mapping = mapping
+	sender.shards[sender.count] = shard(sender.shards[sender.count], payload.Packet)
+
+	payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length+fecDataSize]
+	binary.BigEndian.PutUint16(payload.Packet[length:], sender.group)
+	payload.Packet[length+2] = byte(sender.count)
+	payload.Length += fecDataSize
+
+	sender.count++
+	if sender.count == fec.data {
+		fec.close(remote)
+	}
+	return true
+}
+
+// group returns the group with the supplied id held for the remote node, and false if the group is older than the ones held, the caller must hold the lock of the remote node.
+func (fec *FEC) group(remote *fecRemote, id uint16) (*fecGroup, bool) {
+	receiver := &remote.receiver
+	group := receiver.groups[id%fecWindow]
+	if group == nil {
+		group = &fecGroup{}
+		receiver.groups[id%fecWindow] = group
+	}
+	if group.used && group.id == id {
+		return group, true
+	}
+	if group.used && int16(id-group.id) < 0 {
+		return nil, false
+	}
+
+	if group.used && !group.done {
+		expected := group.highest + 1
+		if group.data > 0 {
+			expected = group.data
+		}
+
+		for i := 0; i < expected; i++ {
+			if !group.received[i] {
+				remote.stats.unrecoverable++
+			}
+		}
+	}
+
+	group.id, group.used, group.done = id, true, false
+	group.data, group.parity, group.highest = 0, 0, 0
+	group.received = [fecMaxData + fecMaxParity]bool{}
+	group.recovered = [fecMaxData]bool{}
+	return group, true
+}
+
+// recover rebuilds the packets lost from the group once enough of its packets were received, and queues them to be produced, the caller must hold the lock of the remote node.
+func (fec *FEC) recover(remote *fecRemote, mapping *common.Mapping, group *fecGroup) {
+	if group.data == 0 || group.done {
+		return
+	}
+
+	received, missing := 0, 0
+	for i := 0; i < group.data+group.parity; i++ {
+		if group.received[i] {
+			received++
+		} else if i < group.data {
+			missing++
+		}
+	}
+
+	if missing == 0 {
+		group.done = true
+		return
+	}
+	if received < group.data {
+		return
+	}
+
+	enc, err := fec.encoder(group.data, group.parity)
+	if err != nil {
+		return
+	}
+
+	// Every parity shard is as large as the largest data shard, the data shards received are padded to match and the ones missing are rebuilt in place.
+	size := 0
+	for i := group.data; i < group.data+group.parity; i++ {
+		if group.received[i] {
+			size = len(group.shards[i])
+			break
+		}
+	}
+
+	shards := make([][]byte, group.data+group.parity)
+	for i := 0; i < len(shards); i++ {
+		switch {
+		case group.received[i] && len(group.shards[i]) > size:
+			group.done = true
+			remote.stats.unrecoverable += uint64(missing)
+			return
+		case group.received[i]:
+			shards[i] = group.shards[i]
+		case i < group.data:
+			if group.shards[i] == nil {
+				group.shards[i] = make([]byte, common.MaxPacketLength)
+			}
+			shards[i] = group.shards[i][:0]
+		}
+	}
+	pad(shards[:group.data], size)
+
+	group.done = true
+	if err := enc.ReconstructData(shards); err != nil {
+		remote.stats.unrecoverable += uint64(missing)
+		return
+	}
+
+	for i := 0; i < group.data; i++ {
+		if group.received[i] {
+			continue
+		}
+
+		data, ok := unshard(shards[i])
+		if !ok {
+			remote.stats.unrecoverable++
+			continue
+		}
+		group.recovered[i] = true
+		remote.stats.recovered++
+		fec.queue(&fec.incoming, &fecPacket{mapping: mapping, data: append([]byte(nil), data...)})
+	}
+}
+
+// receive strips the trailer from the packet received from the remote node, and records it in its group.
+func (fec *FEC) receive(payload *common.Payload, mapping *common.Mapping) bool {
+	end := len(payload.Packet) - 1
+	if end < 0 {
+		payload.DropReason = common.MalformedDropReason
+		return false
+	}
+
+	kind := payload.Packet[end]
+	if kind != fecUnprotected && len(payload.Packet) > common.MaxPacketLength-common.HeaderSize {
+		// No node sends protected packets this large, and their shards wouldn't fit the shard buffers.
+		payload.DropReason = common.MalformedDropReason
+		return false
+	}
+
+	switch {
+	case kind == fecUnprotected:
+		payload.Packet = payload.Packet[:end]
+		payload.Length -= fecUnprotectedSize
+		return true
+	case kind&fecParityFlag == 0:
+		length := len(payload.Packet) - fecDataSize
+		index := int(kind)
+		if length < 0 || index >= fecMaxData {
+			payload.DropReason = common.MalformedDropReason
+			return false
+		}
+		id := binary.BigEndian.Uint16(payload.Packet[length:])
+		payload.Packet = payload.Packet[:length]
+		payload.Length -= fecDataSize
+
+		remote := fec.remote(mapping)
+		remote.mux.Lock()
+		defer remote.mux.Unlock()
+
+		group, ok := fec.group(remote, id)
+		if !ok {
+			return true
+		}
+		if group.recovered[index] {
+			payload.DropReason = common.RecoveredDropReason
+			return false
+		}
+		if group.received[index] {
+			return true
+		}
+		if group.data > 0 && index >= group.data {
+			payload.DropReason = common.MalformedDropReason
+			return false
+		}
+
+		group.received[index] = true
+		group.shards[index] = shard(group.shards[index], payload.Packet)
+		if index > group.highest {
+			group.highest = index
+		}
+		fec.recover(remote, mapping, group)
+		return true
+	}
+
+	length := len(payload.Packet) - fecParitySize
+	if length < 0 {
+		payload.DropReason = common.MalformedDropReason
+		return false
+	}
+	trailer := payload.Packet[length:]
+	id, data, parity, index := binary.BigEndian.Uint16(trailer), int(trailer[2]), int(trailer[3]), int(kind&^fecParityFlag)
+	if data < 1 || data > fecMaxData || parity < 1 || parity > fecMaxParity || index >= parity {
+		payload.DropReason = common.MalformedDropReason
+		return false
+	}
+
+	remote := fec.remote(mapping)
+	remote.mux.Lock()
+	defer remote.mux.Unlock()
+
+	// Parity packets are consumed rather than delivered, which the workers don't count as a drop.
+	payload.DropReason = common.ParityDropReason
+	remote.stats.parityReceived++
+	group, ok := fec.group(remote, id)
+	if !ok || group.done || group.highest >= data || (group.data > 0 && (group.data != data || group.parity != parity)) {
+		return false
+	}
+
+	group.data, group.parity = data, parity
+	group.received[data+index] = true
+	if group.shards[data+index] == nil {
+		group.shards[data+index] = make([]byte, common.MaxPacketLength)
+	}
+	group.shards[data+index] = group.shards[data+index][:length]
+	copy(group.shards[data+index], payload.Packet[:length])
+
+	fec.recover(remote, mapping, group)
+	return false
+}
+
+// Apply returns the payload/mapping with the fec trailer appended if the direction is Outgoing, and stripped if the direction is Incoming, in which case parity packets are consumed rather than passed on.
+func (fec *FEC) Apply(direction Direction, queue int, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
+	if !common.StringInSlice(FECPlugin, mapping.SupportedPlugins) {
+		return payload, mapping, true
+	}
+
+	switch direction {
+	case Incoming:
+		return payload, mapping, fec.receive(payload, mapping)
+	case Outgoing:
+		if !fec.send(payload, mapping) {
+			payload.DropReason = common.OversizeDropReason
+			return payload, mapping, false
+		}
+	}
+
+	return payload, mapping, true
+}
+
+// Produce moves the next parity packet to send, or the next packet rebuilt from the packets received, into the buffer. Groups being sent that waited for the timeout are closed first.
+func (fec *FEC) Produce(direction Direction, buf []byte) (*common.Payload, *common.Mapping, bool) {
+	var queue *[]*fecPacket
+	switch direction {
+	case Incoming:
+		queue = &fec.incoming
+	case Outgoing:
+		now := time.Now()
+		for _, remote := range fec.snapshot() {
+			remote.mux.Lock()
+			if remote.sender.count > 0 && now.Sub(remote.sender.started) >= fec.timeout {
+				fec.close(remote)
+			}
+			remote.mux.Unlock()
+		}
+		queue = &fec.outgoing
+	}
+
+	fec.queueMux.Lock()
+	if len(*queue) == 0 {
+		fec.queueMux.Unlock()
+		return nil, nil, false
+	}
+	packet := (*queue)[0]
+	(*queue)[0] = nil
+	*queue = (*queue)[1:]
+	fec.queueMux.Unlock()
+
+	payload := common.NewTunPayload(buf, len(packet.data))
+	copy(payload.Packet, packet.data)
+	if direction == Incoming {
+		copy(payload.IPAddress, packet.mapping.PrivateIP.To4())
+	} else {
+		copy(payload.IPAddress, fec.cfg.PrivateIP.To4())
+	}
+	return payload, packet.mapping, true
+}
+
+// FlushInterval returns the timeout of the groups being sent.
+func (fec *FEC) FlushInterval() time.Duration {
+	return fec.timeout
+}
+
+// Report returns the forward error correction statistics of each remote node.
+func (fec *FEC) Report() *metric.Metric {
+	remotes := fec.snapshot()
+	stats := make(map[string]*metric.FECMetrics, len(remotes))
+	for _, remote := range remotes {
+		remote.mux.Lock()
+		stats[remote.stats.privateIP] = &metric.FECMetrics{
+			ParityPackets:  remote.stats.parityPackets,
+			ParityReceived: remote.stats.parityReceived,
+			Recovered:      remote.stats.recovered,
+			Unrecoverable:  remote.stats.unrecoverable,
+		}
+		remote.mux.Unlock()
+	}
+
+	return &metric.Metric{
+		Type: metric.FEC,
+		FEC:  stats,
+	}
+}
+
+// Close which is a noop.
+func (fec *FEC) Close() error {
+	return nil
+}
+
+// Expansion returns the maximum number of bytes fec grows a packet by.
+func (fec *FEC) Expansion() int {
+	return fecExpansion
+}
+
+// Name returns 'fec'.
+func (fec *FEC) Name() string {
+	return FECPlugin
+}
+
+// Order returns the FECPluginOrder value.
+func (fec *FEC) Order() int {
+	return FECPluginOrder
+}
+
+func newFEC(cfg *common.Config) (Plugin, error) {
+	fec := &FEC{
+		cfg:      cfg,
+		peers:    optionList(cfg, FECPlugin, "peers", ""),
+		encoders: make(map[[2]int]reedsolomon.Encoder),
+		remotes:  make(map[uint32]*fecRemote),
+	}
+
+	var err error
+	fec.data, err = strconv.Atoi(cfg.PluginOption(FECPlugin, "data", defaultFECData))
+	if err != nil || fec.data < 1 || fec.data > fecMaxData {
+		return nil, errors.New("the number of fec data packets per group must be between 1 and " + strconv.Itoa(fecMaxData))
+	}
+
+	fec.parity, err = strconv.Atoi(cfg.PluginOption(FECPlugin, "parity", defaultFECParity))
+	if err != nil || fec.parity < 1 || fec.parity > fecMaxParity {
+		return nil, errors.New("the number of fec parity packets per group must be between 1 and " + strconv.Itoa(fecMaxParity))
+	}
+
+	fec.timeout, err = time.ParseDuration(cfg.PluginOption(FECPlugin, "timeout", defaultFECTimeout))
+	if err != nil || fec.timeout <= 0 {
+		return nil, errors.New("the fec group timeout must be a positive duration")
+	}
+
+	return fec, nil
+}
@@ -5,14 +5,18 @@ package plugin
 
 import (
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
 )
 
 // Mock plugin struct to use for testing.
 type Mock struct {
+	Store   datastore.Datastore
+	Changed []*common.Mapping
+	Removed []*common.Mapping
 }
 
 // Apply returns the payload/mapping unchanged and always true.
-func (mock *Mock) Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
+func (mock *Mock) Apply(direction Direction, queue int, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
 	return payload, mapping, true
 }
 
@@ -26,11 +30,31 @@ func (mock *Mock) Name() string {
 	return MockPlugin
 }
 
+// Expansion returns 0 as the mock plugin leaves packets untouched.
+func (mock *Mock) Expansion() int {
+	return 0
+}
+
 // Order returns the MockPluginOrder value.
 func (mock *Mock) Order() int {
 	return MockPluginOrder
 }
 
+// Init which just records the supplied datastore.
+func (mock *Mock) Init(store datastore.Datastore) error {
+	mock.Store = store
+	return nil
+}
+
+// OnMappingChange which just records the supplied mapping as changed or removed.
+func (mock *Mock) OnMappingChange(mapping *common.Mapping, removed bool) {
+	if removed {
+		mock.Removed = append(mock.Removed, mapping)
+		return
+	}
+	mock.Changed = append(mock.Changed, mapping)
+}
+
 func newMock(cfg *common.Config) (Plugin, error) {
 	return &Mock{}, nil
 }
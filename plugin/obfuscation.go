@@ -0,0 +1,330 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package plugin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+)
+
+const (
+	// The size of the trailer appended to obfuscated packets, which is a random nonce followed by the length of the packet before padding masked with a key stream derived from the nonce, and a tag authenticating both along with the private ip of the sending node.
+	obfuscationNonceSize   = 4
+	obfuscationMACSize     = 8
+	obfuscationTrailerSize = obfuscationNonceSize + 2 + obfuscationMACSize
+
+	// The label the key authenticating the trailers is derived from the shared key with.
+	obfuscationMACLabel = "quantum obfuscation mac"
+
+	// The default sizes on the wire that packets are padded up to.
+	defaultObfuscationBuckets = "256,512,1024,1472"
+
+	// The default length of time the tags hiding the private ip of a node are used for, before they change.
+	defaultObfuscationEpoch = "1m"
+)
+
+// Obfuscation plugin struct to use for resisting traffic analysis, by padding packets to fixed size buckets, injecting cover traffic, and hiding the private ip carried in the header of packets.
+//
+// The private ip of the sending node is replaced by a tag derived from it, the current epoch and the key shared by the nodes, which the receiving node maps back to the private ip using the mappings it knows of. Tags of the previous and next epochs are accepted as well, to allow for clock skew between nodes.
+type Obfuscation struct {
+	cfg      *common.Config
+	block    cipher.Block
+	mac      cipher.Block
+	buckets  []int
+	interval time.Duration
+	epoch    time.Duration
+
+	mux   sync.Mutex
+	ips   map[uint32]bool
+	table atomic.Value
+}
+
+type obfuscationTable struct {
+	epoch int64
+	local [common.IPLength]byte
+	tags  map[uint32]uint32
+}
+
+// tag returns the tag hiding the private ip during the supplied epoch.
+func (obf *Obfuscation) tag(epoch int64, ip uint32) [common.IPLength]byte {
+	var in, out [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(in[:8], uint64(epoch))
+	binary.LittleEndian.PutUint32(in[8:12], ip)
+	copy(in[12:], []byte{0xff, 0xff, 0xff, 0xff})
+	obf.block.Encrypt(out[:], in[:])
+
+	var tag [common.IPLength]byte
+	copy(tag[:], out[:common.IPLength])
+	return tag
+}
+
+// mask returns the key stream masking the length of a packet carrying the supplied nonce.
+func (obf *Obfuscation) mask(nonce []byte) uint16 {
+	var in, out [aes.BlockSize]byte
+	copy(in[:], nonce)
+	obf.block.Encrypt(out[:], in[:])
+	return binary.BigEndian.Uint16(out[:2])
+}
+
+// authenticate returns the tag authenticating the nonce and masked length of a packet, along with the private ip of the node sending it.
+func (obf *Obfuscation) authenticate(ip, trailer []byte) []byte {
+	var in, out [aes.BlockSize]byte
+	copy(in[:common.IPLength], ip)
+	copy(in[common.IPLength:], trailer[:obfuscationNonceSize+2])
+	obf.mac.Encrypt(out[:], in[:])
+	return out[:obfuscationMACSize]
+}
+
+// build generates the tags of every known node for the supplied epoch and the ones around it, the caller must hold the lock.
+func (obf *Obfuscation) build(epoch int64) *obfuscationTable {
+	table := &obfuscationTable{
+		epoch: epoch,
+		local: obf.tag(epoch, common.IPtoInt(obf.cfg.PrivateIP)),
+		tags:  make(map[uint32]uint32, 3*len(obf.ips)),
+	}
+
+	for ip := range obf.ips {
+		for e := epoch - 1; e <= epoch+1; e++ {
+			tag := obf.tag(e, ip)
+			table.tags[binary.LittleEndian.Uint32(tag[:])] = ip
+		}
+	}
+	obf.table.Store(table)
+	return table
+}
+
+// current returns the tags of the current epoch, rebuilding them once the epoch changes.
+func (obf *Obfuscation) current() *obfuscationTable {
+	epoch := time.Now().UnixNano() / int64(obf.epoch)
+	if table, ok := obf.table.Load().(*obfuscationTable); ok && table.epoch == epoch {
+		return table
+	}
+
+	obf.mux.Lock()
+	defer obf.mux.Unlock()
+
+	if table, ok := obf.table.Load().(*obfuscationTable); ok && table.epoch == epoch {
+		return table
+	}
+	return obf.build(epoch)
+}
+
+// bucket returns the size on the wire a packet of the supplied size is padded up to.
+func (obf *Obfuscation) bucket(size int) int {
+	for i := 0; i < len(obf.buckets); i++ {
+		if obf.buckets[i] >= size {
+			return obf.buckets[i]
+		}
+	}
+	return size
+}
+
+// seal pads the packet held by the payload up to the supplied size on the wire, appends the trailer recording its real length, and hides the private ip in its header.
+func (obf *Obfuscation) seal(payload *common.Payload, size int) {
+	length := len(payload.Packet)
+	packet := payload.Raw[common.PacketStart : common.PacketStart+size-common.HeaderSize]
+	end := len(packet) - obfuscationMACSize - 2
+
+	rand.Read(packet[length:end])
+	binary.BigEndian.PutUint16(packet[end:], uint16(length)^obf.mask(packet[end-obfuscationNonceSize:end]))
+	copy(packet[end+2:], obf.authenticate(obf.cfg.PrivateIP.To4(), packet[end-obfuscationNonceSize:]))
+
+	table := obf.current()
+	copy(payload.IPAddress, table.local[:])
+
+	payload.Packet = packet
+	payload.Length = size
+}
+
+// Apply returns the payload/mapping padded with its private ip hidden if the direction is Outgoing, and stripped of its padding if the direction is Incoming, in which case cover packets are dropped.
+func (obf *Obfuscation) Apply(direction Direction, queue int, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
+	if !common.StringInSlice(ObfuscationPlugin, mapping.SupportedPlugins) {
+		return payload, mapping, true
+	}
+
+	switch direction {
+	case Incoming:
+		end := len(payload.Packet) - obfuscationMACSize - 2
+		if end < obfuscationNonceSize {
+			payload.DropReason = common.MalformedDropReason
+			return payload, mapping, false
+		}
+		if subtle.ConstantTimeCompare(payload.Packet[end+2:], obf.authenticate(payload.IPAddress, payload.Packet[end-obfuscationNonceSize:])) != 1 {
+			payload.DropReason = common.UnauthenticatedDropReason
+			return payload, mapping, false
+		}
+
+		length := int(binary.BigEndian.Uint16(payload.Packet[end:]) ^ obf.mask(payload.Packet[end-obfuscationNonceSize:end]))
+		if length == 0 {
+			payload.DropReason = common.CoverDropReason
+			return payload, mapping, false
+		}
+		if length > end-obfuscationNonceSize {
+			payload.DropReason = common.MalformedDropReason
+			return payload, mapping, false
+		}
+
+		payload.Packet = payload.Packet[:length]
+		payload.Length = common.HeaderSize + length
+	case Outgoing:
+		size := obf.bucket(common.HeaderSize + len(payload.Packet) + obfuscationTrailerSize)
+		if !payload.Fits(size - common.HeaderSize) {
+			payload.DropReason = common.OversizeDropReason
+			return payload, mapping, false
+		}
+
+		obf.seal(payload, size)
+	}
+
+	return payload, mapping, true
+}
+
+// Resolve restores the private ip of the sending node in the header of the payload, if the header holds the tag of a known node.
+func (obf *Obfuscation) Resolve(payload *common.Payload) bool {
+	ip, ok := obf.current().tags[binary.LittleEndian.Uint32(payload.IPAddress)]
+	if !ok {
+		return false
+	}
+
+	binary.LittleEndian.PutUint32(payload.IPAddress, ip)
+	return true
+}
+
+// Interval returns how often cover packets are sent to each remote node, which is zero when cover traffic is disabled.
+func (obf *Obfuscation) Interval() time.Duration {
+	return obf.interval
+}
+
+// Inject builds a cover packet for the remote node represented by the mapping, padded to one of the buckets picked at random, which the remote node drops once it has stripped the padding.
+func (obf *Obfuscation) Inject(buf []byte, mapping *common.Mapping) (*common.Payload, bool) {
+	if !common.StringInSlice(ObfuscationPlugin, mapping.SupportedPlugins) {
+		return nil, false
+	}
+
+	var pick [2]byte
+	rand.Read(pick[:])
+
+	size := common.HeaderSize + obfuscationTrailerSize + int(binary.BigEndian.Uint16(pick[:]))%(common.MaxPacketLength-common.HeaderSize-obfuscationTrailerSize)
+	if len(obf.buckets) > 0 {
+		size = obf.buckets[int(pick[0])%len(obf.buckets)]
+	}
+
+	payload := common.NewTunPayload(buf, 0)
+	obf.seal(payload, size)
+	return payload, true
+}
+
+// Init learns the private ips of the nodes already in the datastore, so that their packets can be resolved.
+func (obf *Obfuscation) Init(store datastore.Datastore) error {
+	mappings := store.Mappings()
+	for i := 0; i < len(mappings); i++ {
+		obf.OnMappingChange(mappings[i], false)
+	}
+	return nil
+}
+
+// OnMappingChange adds the private ip of a node joining the quantum network to the known nodes, or removes it once the node leaves.
+func (obf *Obfuscation) OnMappingChange(mapping *common.Mapping, removed bool) {
+	if mapping.MachineID == obf.cfg.MachineID || mapping.PrivateIP == nil {
+		return
+	}
+	ip := common.IPtoInt(mapping.PrivateIP)
+
+	obf.mux.Lock()
+	defer obf.mux.Unlock()
+
+	if removed == !obf.ips[ip] {
+		return
+	}
+	if removed {
+		delete(obf.ips, ip)
+	} else {
+		obf.ips[ip] = true
+	}
+
+	if table, ok := obf.table.Load().(*obfuscationTable); ok {
+		obf.build(table.epoch)
+	}
+}
+
+// Close which is a noop.
+func (obf *Obfuscation) Close() error {
+	return nil
+}
+
+// Expansion returns the size of the trailer, which is all that a full sized packet grows by since packets are never padded beyond the largest bucket.
+func (obf *Obfuscation) Expansion() int {
+	return obfuscationTrailerSize
+}
+
+// Name returns 'obfuscation'.
+func (obf *Obfuscation) Name() string {
+	return ObfuscationPlugin
+}
+
+// Order returns the ObfuscationPluginOrder value.
+func (obf *Obfuscation) Order() int {
+	return ObfuscationPluginOrder
+}
+
+func newObfuscation(cfg *common.Config) (Plugin, error) {
+	key := cfg.PluginOption(ObfuscationPlugin, "key", "")
+	if key == "" {
+		return nil, errors.New("the obfuscation plugin requires the key shared by the nodes to be set with the 'obfuscation.key' plugin option")
+	}
+	hash := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	hash = sha256.Sum256([]byte(obfuscationMACLabel + key))
+	mac, err := aes.NewCipher(hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	obf := &Obfuscation{
+		cfg:   cfg,
+		block: block,
+		mac:   mac,
+		ips:   make(map[uint32]bool),
+	}
+
+	for _, bucket := range optionList(cfg, ObfuscationPlugin, "buckets", defaultObfuscationBuckets) {
+		size, err := strconv.Atoi(bucket)
+		if err != nil || size < common.HeaderSize+obfuscationTrailerSize || size > common.MaxPacketLength {
+			return nil, errors.New("the obfuscation buckets must be sizes between " + strconv.Itoa(common.HeaderSize+obfuscationTrailerSize) + " and " + strconv.Itoa(common.MaxPacketLength) + " bytes, got: " + bucket)
+		}
+		obf.buckets = append(obf.buckets, size)
+	}
+	sort.Ints(obf.buckets)
+
+	rate, err := strconv.ParseFloat(cfg.PluginOption(ObfuscationPlugin, "cover-rate", "0"), 64)
+	if err != nil || rate < 0 {
+		return nil, errors.New("the obfuscation cover rate must be a number of packets per second, or 0 to disable cover traffic")
+	}
+	if rate > 0 {
+		obf.interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	obf.epoch, err = time.ParseDuration(cfg.PluginOption(ObfuscationPlugin, "epoch", defaultObfuscationEpoch))
+	if err != nil || obf.epoch <= 0 {
+		return nil, errors.New("the obfuscation epoch must be a positive duration")
+	}
+
+	return obf, nil
+}
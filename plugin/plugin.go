@@ -5,8 +5,16 @@ package plugin
 
 import (
 	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/metric"
 )
 
 const (
@@ -16,19 +24,35 @@ const (
 	// EncryptionPlugin configures and injects an encryption based plugin.
 	EncryptionPlugin = "encryption"
 
+	// FECPlugin configures and injects a forward error correction plugin.
+	FECPlugin = "fec"
+
+	// ObfuscationPlugin configures and injects a traffic analysis resistance plugin.
+	ObfuscationPlugin = "obfuscation"
+
 	// MockPlugin configures and injects a mock plugin for testing.
 	MockPlugin = "mock"
+
+	// OrderOption is the plugin option overriding the order a plugin declares, which places it elsewhere amongst the other plugins.
+	OrderOption = "order"
 )
 
+// The built-in plugins are spaced apart in the overall order, so that registered plugins can be placed before, between, or after them.
 const (
 	// CompressionPluginOrder is the location of the compression plugin in the overall plugins enabled within quantum.
-	CompressionPluginOrder = iota
+	CompressionPluginOrder = 100
+
+	// FECPluginOrder is the location of the fec plugin in the overall plugins enabled within quantum, it comes after compression so that parity covers the compressed packets, and before encryption so that parity and rebuilt packets are authenticated like any other.
+	FECPluginOrder = 150
 
 	// EncryptionPluginOrder is the location of the encryption plugin in the overall plugins enabled within quantum.
-	EncryptionPluginOrder
+	EncryptionPluginOrder = 200
+
+	// ObfuscationPluginOrder is the location of the obfuscation plugin in the overall plugins enabled within quantum, it comes after encryption so that the header it hides is still authenticated by the encryption plugin.
+	ObfuscationPluginOrder = 300
 
 	// MockPluginOrder is the location of the mock plugin in the overall plugins enabled within quantum.
-	MockPluginOrder
+	MockPluginOrder = 1000
 )
 
 // Direction of the packet when supplied to the plugin in question.
@@ -44,8 +68,8 @@ const (
 
 // Plugin interface for a generic multi-queue network device.
 type Plugin interface {
-	// Apply should apply the plugin to the specified payload and mapping.
-	Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool)
+	// Apply should apply the plugin to the specified payload and mapping on behalf of the worker handling the specified queue. Plugins may keep state per queue, which still needs guarding as the control worker sends packets on the queues of the other workers.
+	Apply(direction Direction, queue int, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool)
 
 	// Close should gracefully destroy the plugin.
 	Close() error
@@ -53,8 +77,110 @@ type Plugin interface {
 	// Name should return the name of the plugin.
 	Name() string
 
-	// Order returns the location of the specified plugin in the overall plugins enabled within quantum.
+	// Order returns the location of the specified plugin in the overall plugins enabled within quantum. Outgoing packets pass through the plugins from the lowest order to the highest, and incoming packets in reverse.
 	Order() int
+
+	// Expansion should return the maximum number of bytes the plugin grows an outgoing packet by. Apply must drop packets that would grow beyond it, or that would not fit within the payload buffer, with the oversize drop reason.
+	Expansion() int
+}
+
+// Reporter interface for plugins which keep statistics of their own, which the control worker periodically hands to the metric aggregator.
+type Reporter interface {
+	// Report should return the current statistics of the plugin.
+	Report() *metric.Metric
+}
+
+// Initializer interface for plugins which need to set themselves up against the datastore, once it has been initialized and before any packets are handled.
+type Initializer interface {
+	// Init should prepare the plugin using the supplied datastore.
+	Init(store datastore.Datastore) error
+}
+
+// MappingWatcher interface for plugins which keep state per remote node, which the control worker notifies whenever the mapping of a remote node is added, changed, or removed.
+type MappingWatcher interface {
+	// OnMappingChange should update the plugin state for the supplied mapping, which is no longer in the datastore when removed is true.
+	OnMappingChange(mapping *common.Mapping, removed bool)
+}
+
+// Resolver interface for plugins which hide the private ip carried in the header of the packets they send, which the incoming workers ask to restore it before looking up the sending node.
+//
+// As they hide packets on the wire, resolvers that are ordered after every other plugin are also applied to the handshake control packets that otherwise bypass the plugins.
+type Resolver interface {
+	// Resolve should restore the private ip of the sending node in the header of the payload, and return false if the header isn't one the plugin hid.
+	Resolve(payload *common.Payload) bool
+}
+
+// Injector interface for plugins which send packets of their own to the remote nodes, like cover traffic, which the control worker sends on their behalf without passing them through the other plugins.
+type Injector interface {
+	// Interval should return how often the control worker asks for packets, or zero to never ask.
+	Interval() time.Duration
+
+	// Inject should build a packet for the remote node represented by the mapping within the supplied buffer, and return false if there is nothing to send to it.
+	Inject(buf []byte, mapping *common.Mapping) (*common.Payload, bool)
+}
+
+// Producer interface for plugins which produce packets on top of the ones they are applied to, like the parity packets sent or the packets rebuilt by forward error correction. The workers ask for them right after handling a packet, and pass them through the plugins that come after the producing plugin.
+type Producer interface {
+	// Produce should move a pending packet for the supplied direction into the buffer, along with the mapping of the remote node it is sent to or was received from, and return false when there are none.
+	Produce(direction Direction, buf []byte) (*common.Payload, *common.Mapping, bool)
+
+	// FlushInterval should return how often the control worker asks for outgoing packets, so that packets waiting on a timeout are sent even when there is no traffic, or zero to never ask.
+	FlushInterval() time.Duration
+}
+
+// Factory generates a new Plugin based on the supplied user configuration. Plugin specific settings can be read with the PluginOption method of the configuration.
+type Factory func(cfg *common.Config) (Plugin, error)
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Factory)
+)
+
+func init() {
+	mustRegister(CompressionPlugin, newCompression)
+	mustRegister(EncryptionPlugin, newEncryption)
+	mustRegister(FECPlugin, newFEC)
+	mustRegister(ObfuscationPlugin, newObfuscation)
+	mustRegister(MockPlugin, newMock)
+}
+
+// mustRegister registers a built-in plugin, which can only fail due to a programming error.
+func mustRegister(name string, factory Factory) {
+	if err := Register(name, factory); err != nil {
+		panic(err)
+	}
+}
+
+// Register makes the plugin generated by the supplied factory available under the supplied name, so that it can be enabled with the plugins option. It is meant to be called from the init function of the package implementing the plugin, which is then compiled into a custom quantum binary.
+func Register(name string, factory Factory) error {
+	if name == "" {
+		return errors.New("plugins must be registered with a name")
+	}
+	if factory == nil {
+		return errors.New("the plugin " + name + " must be registered with a factory")
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[name]; ok {
+		return errors.New("a plugin named " + name + " is already registered")
+	}
+	registry[name] = factory
+	return nil
+}
+
+// Registered returns the sorted names of every registered plugin.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // Plugins is a collection of plugin structs for quantum to use.
@@ -73,22 +199,89 @@ func (plugins Plugins) Swap(i, j int) {
 // Sorter is used to sort the various enabled plugins within quantum.
 type Sorter struct {
 	Plugins
+
+	// The user configuration whose order plugin options override the order the plugins declare, which is optional.
+	Config *common.Config
 }
 
-// Less returns whether or not the plugin at index 'i' is less than the that of the plugin at index 'j'.
+// order returns the order of the plugin at index 'i', which is the one set through the order plugin option if there is one.
+func (sorter Sorter) order(i int) int {
+	if sorter.Config != nil {
+		if order, err := strconv.Atoi(sorter.Config.PluginOption(sorter.Plugins[i].Name(), OrderOption, "")); err == nil {
+			return order
+		}
+	}
+	return sorter.Plugins[i].Order()
+}
+
+// Less returns whether or not the plugin at index 'i' is less than the that of the plugin at index 'j', plugins sharing the same order are sorted by name so that every node applies them in the same order.
 func (sorter Sorter) Less(i, j int) bool {
-	return sorter.Plugins[i].Order() < sorter.Plugins[j].Order()
+	if sorter.order(i) == sorter.order(j) {
+		return sorter.Plugins[i].Name() < sorter.Plugins[j].Name()
+	}
+	return sorter.order(i) < sorter.order(j)
+}
+
+// MTU returns the max size packet to receive from the TUN device, which the supplied plugins together never grow beyond the maximum packet size.
+func MTU(plugins []Plugin) int {
+	mtu := common.MaxMTU
+	for i := 0; i < len(plugins); i++ {
+		mtu -= plugins[i].Expansion()
+	}
+	return mtu
+}
+
+// Check sets the MTU of the TUN device to leave room for the supplied plugins, and verifies that the plugins leave a usable MTU.
+//
+// Unless relays are disabled the MTU also leaves room for forwarding a full sized packet through a relay node, which wraps the packet already grown by the plugins in a relay header and passes it through the plugins again.
+func Check(cfg *common.Config, plugins []Plugin) error {
+	expansion := common.MaxMTU - MTU(plugins)
+	overhead := expansion
+	if !cfg.DisableRelays {
+		overhead += common.RelayHeaderSize + expansion
+	}
+
+	mtu := common.MaxMTU - overhead
+	if mtu < common.MinMTU {
+		return errors.New("the enabled plugins can grow packets by " + strconv.Itoa(overhead) + " bytes, which leaves an MTU below the minimum of " + strconv.Itoa(common.MinMTU) + " bytes")
+	}
+
+	cfg.MTU = mtu
+	return nil
 }
 
-// New will generate a new Plugin struct based on the supplied device pluginType and user configuration.
+// optionList returns the plugin option as a list, whose items are separated by commas or spaces.
+func optionList(cfg *common.Config, plugin, key, def string) []string {
+	return strings.FieldsFunc(cfg.PluginOption(plugin, key, def), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// Init hands the supplied datastore to each of the plugins implementing the Initializer interface.
+func Init(plugins []Plugin, store datastore.Datastore) error {
+	for i := 0; i < len(plugins); i++ {
+		if initializer, ok := plugins[i].(Initializer); ok {
+			if err := initializer.Init(store); err != nil {
+				return errors.New("error initializing the " + plugins[i].Name() + " plugin: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// New will generate a new Plugin struct based on the supplied registered pluginType and user configuration.
 func New(pluginType string, cfg *common.Config) (Plugin, error) {
-	switch pluginType {
-	case CompressionPlugin:
-		return newCompression(cfg)
-	case EncryptionPlugin:
-		return newEncryption(cfg)
-	case MockPlugin:
-		return newMock(cfg)
+	registryLock.RLock()
+	factory, ok := registry[pluginType]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, errors.New("specified plugin is not supported")
+	}
+	if order := cfg.PluginOption(pluginType, OrderOption, ""); order != "" {
+		if _, err := strconv.Atoi(order); err != nil {
+			return nil, errors.New("the order of the " + pluginType + " plugin must be an integer, got: " + order)
+		}
 	}
-	return nil, errors.New("specified plugin is not supported")
+	return factory(cfg)
 }
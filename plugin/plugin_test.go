@@ -5,26 +5,31 @@ package plugin
 
 import (
 	"math/rand"
+	"net"
 	"sort"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/supernomad/quantum/common"
-	"github.com/supernomad/quantum/crypto"
+	"github.com/supernomad/quantum/datastore"
 )
 
-var mapping *common.Mapping
+var (
+	cfg     *common.Config
+	mapping *common.Mapping
+)
 
 func init() {
-	mapping = &common.Mapping{
-		SupportedPlugins: []string{"compression", "encryption"},
+	cfg = &common.Config{
+		PrivateIP:     net.ParseIP("10.99.0.1"),
+		PublicIPv4:    net.ParseIP("1.1.1.1"),
+		IsIPv4Enabled: true,
+		Plugins:       []string{"compression", "encryption"},
+		Keys:          common.NewKeyring(common.NewKey(0)),
 	}
-	key := []byte("AES256Key-32Characters1234567890")
-	salt := make([]byte, crypto.SaltLength)
-
-	rand.Read(salt)
 
-	aes, _ := crypto.NewAES(key, salt)
-	mapping.AES = aes
+	mapping, _ = common.ParseMapping(common.NewMapping(cfg).String(), cfg)
 }
 
 func testEq(a, b []byte) bool {
@@ -56,7 +61,7 @@ func fillSlice(buf []byte) error {
 }
 
 func TestSorter(t *testing.T) {
-	encryption, err := New(EncryptionPlugin, &common.Config{})
+	encryption, err := New(EncryptionPlugin, cfg)
 	if err != nil {
 		t.Fatal("Failed to create new encryption plugin.")
 	}
@@ -86,11 +91,88 @@ func TestSorter(t *testing.T) {
 	}
 }
 
+type custom struct {
+	Mock
+	name  string
+	order int
+}
+
+func (c *custom) Name() string {
+	return c.name
+}
+
+func (c *custom) Order() int {
+	return c.order
+}
+
+func TestRegister(t *testing.T) {
+	factory := func(cfg *common.Config) (Plugin, error) {
+		return &custom{name: "custom", order: CompressionPluginOrder + 50}, nil
+	}
+
+	if err := Register("", factory); err == nil {
+		t.Fatal("Register accepted a plugin without a name.")
+	}
+	if err := Register("custom", nil); err == nil {
+		t.Fatal("Register accepted a plugin without a factory.")
+	}
+	if err := Register(CompressionPlugin, factory); err == nil {
+		t.Fatal("Register accepted a plugin replacing a builtin plugin.")
+	}
+	if err := Register("custom", factory); err != nil {
+		t.Fatal("Register rejected a new plugin:", err)
+	}
+	if err := Register("custom", factory); err == nil {
+		t.Fatal("Register accepted the same plugin twice.")
+	}
+
+	registered := Registered()
+	if !common.StringInSlice("custom", registered) || !common.StringInSlice(MockPlugin, registered) || !sort.StringsAreSorted(registered) {
+		t.Fatal("Registered returned the wrong plugins:", registered)
+	}
+
+	if _, err := New("unknown", cfg); err == nil {
+		t.Fatal("New created a plugin that isn't registered.")
+	}
+
+	c, err := New("custom", cfg)
+	if err != nil {
+		t.Fatal("New failed to create a registered plugin:", err)
+	}
+	encryption, _ := New(EncryptionPlugin, cfg)
+	compression, _ := New(CompressionPlugin, &common.Config{})
+	tied := &custom{name: "a-tied", order: EncryptionPluginOrder}
+
+	plugins := []Plugin{encryption, c, tied, compression}
+	sort.Sort(Sorter{Plugins: plugins})
+
+	if plugins[0] != compression || plugins[1] != c || plugins[2] != tied || plugins[3] != encryption {
+		t.Fatal("Failed to sort a registered plugin amongst the builtin plugins.")
+	}
+
+	ordered := &common.Config{PluginConfig: common.PluginSections{"custom": {OrderOption: strconv.Itoa(EncryptionPluginOrder + 50)}}}
+	sort.Sort(Sorter{Plugins: plugins, Config: ordered})
+	if plugins[0] != compression || plugins[1] != tied || plugins[2] != encryption || plugins[3] != c {
+		t.Fatal("Failed to sort a plugin by the order set through its plugin options.")
+	}
+	if _, err := New("custom", &common.Config{PluginConfig: common.PluginSections{"custom": {OrderOption: "last"}}}); err == nil {
+		t.Fatal("New accepted a plugin order that isn't an integer.")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("mustRegister did not panic when registering the same plugin twice.")
+		}
+	}()
+	mustRegister("custom", factory)
+}
+
 func TestEncryption(t *testing.T) {
-	encryption, err := New(EncryptionPlugin, &common.Config{})
+	encryption, err := New(EncryptionPlugin, cfg)
 	if err != nil {
 		t.Fatal("Failed to create new compression plugin.")
 	}
+	mtu := MTU([]Plugin{encryption})
 
 	buf := make([]byte, common.MaxPacketLength)
 	expected := make([]byte, common.MaxPacketLength)
@@ -102,32 +184,181 @@ func TestEncryption(t *testing.T) {
 
 	copy(expected, buf)
 
-	out := common.NewTunPayload(buf, common.MTU)
+	out := common.NewTunPayload(buf, mtu)
 
-	encrypted, _, ok := encryption.Apply(Outgoing, out, mapping)
+	encrypted, _, ok := encryption.Apply(Outgoing, 0, out, mapping)
 	if !ok {
 		t.Fatal("Failed to encrypt the outgoing payload.")
 	}
 
 	in := common.NewSockPayload(encrypted.Raw, encrypted.Length)
 
-	_, _, ok = encryption.Apply(Incoming, in, mapping)
+	_, _, ok = encryption.Apply(Incoming, 0, in, mapping)
 	if !ok {
 		t.Fatal("Failed to decrypt the incoming payload.")
 	}
 
-	if !testEq(expected[:common.MTU], buf[:common.MTU]) {
+	if !in.Authenticated {
+		t.Fatal("Decrypting the incoming payload did not mark it as authenticated.")
+	}
+
+	out = common.NewTunPayload(buf, mtu)
+	encrypted, _, _ = encryption.Apply(Outgoing, 0, out, mapping)
+	replayed := make([]byte, encrypted.Length)
+	copy(replayed, encrypted.Raw)
+
+	if _, _, ok = encryption.Apply(Incoming, 0, common.NewSockPayload(encrypted.Raw, encrypted.Length), mapping); !ok {
+		t.Fatal("Failed to decrypt the incoming payload.")
+	}
+
+	in = common.NewSockPayload(replayed, len(replayed))
+	if _, _, ok = encryption.Apply(Incoming, 0, in, mapping); ok || in.DropReason != common.ReplayedDropReason {
+		t.Fatal("Failed to reject a replayed incoming payload.")
+	}
+
+	if !testEq(expected[:mtu], buf[:mtu]) {
 		t.Fatal("The outgoing and incoming payloads don't match after encryption/decryption.")
 	}
 
+	out = common.NewTunPayload(buf, mtu)
+	encrypted, _, _ = encryption.Apply(Outgoing, 0, out, mapping)
+	encrypted.Raw[common.PacketStart]++
+
+	in = common.NewSockPayload(encrypted.Raw, encrypted.Length)
+	if _, _, ok = encryption.Apply(Incoming, 0, in, mapping); ok || in.DropReason != common.UnauthenticatedDropReason {
+		t.Fatal("Failed to reject a tampered incoming payload.")
+	}
+
+	out = common.NewTunPayload(buf, common.MaxPacketLength-common.HeaderSize)
+	if _, _, ok = encryption.Apply(Outgoing, 0, out, mapping); ok || out.DropReason != common.OversizeDropReason {
+		t.Fatal("Failed to drop an outgoing payload that would not fit once encrypted.")
+	}
+
 	encryption.Close()
 }
 
+func TestEncryptionRekey(t *testing.T) {
+	keys := common.NewKeyring(common.NewKey(0))
+	rekeyCfg := &common.Config{
+		PrivateIP:     net.ParseIP("10.99.0.2"),
+		PublicIPv4:    net.ParseIP("1.1.1.2"),
+		IsIPv4Enabled: true,
+		Plugins:       []string{"encryption"},
+		Keys:          keys,
+	}
+
+	encryption, err := New(EncryptionPlugin, rekeyCfg)
+	if err != nil {
+		t.Fatal("Failed to create new encryption plugin.")
+	}
+	mtu := MTU([]Plugin{encryption})
+
+	roundTrip := func(sender, receiver *common.Mapping) bool {
+		buf := make([]byte, common.MaxPacketLength)
+		fillSlice(buf)
+
+		out := common.NewTunPayload(buf, mtu)
+		encrypted, _, ok := encryption.Apply(Outgoing, 0, out, receiver)
+		if !ok {
+			return false
+		}
+
+		in := common.NewSockPayload(encrypted.Raw, encrypted.Length)
+		_, _, ok = encryption.Apply(Incoming, 0, in, sender)
+		return ok
+	}
+
+	stale, _ := common.ParseMapping(common.NewMapping(rekeyCfg).String(), rekeyCfg)
+
+	now := time.Now()
+	keys.Rotate(now)
+	if !roundTrip(stale, stale) {
+		t.Fatal("Failed to exchange packets using the previous key during the grace period.")
+	}
+
+	fresh, _ := common.ParseMapping(common.NewMapping(rekeyCfg).String(), rekeyCfg)
+	if !roundTrip(fresh, stale) || !roundTrip(stale, fresh) {
+		t.Fatal("Failed to exchange packets while the rotated key propagates.")
+	}
+
+	keys.Settle(now.Add(time.Minute), time.Minute)
+	if !roundTrip(fresh, fresh) {
+		t.Fatal("Failed to exchange packets using the rotated key.")
+	}
+	if roundTrip(stale, stale) {
+		t.Fatal("Exchanged packets using a retired key.")
+	}
+
+	encryption.Close()
+}
+
+func TestEncryptionSession(t *testing.T) {
+	newCfg := func(ip string) *common.Config {
+		keys := common.NewKeyring(common.NewKey(0))
+		return &common.Config{
+			PrivateIP:     net.ParseIP(ip),
+			PublicIPv4:    net.ParseIP("1.1.1.1"),
+			IsIPv4Enabled: true,
+			Plugins:       []string{"encryption"},
+			Capabilities:  []string{common.HandshakeCapability},
+			Keys:          keys,
+			Sessions:      common.NewSessions(keys, time.Minute),
+		}
+	}
+	senderCfg, receiverCfg := newCfg("10.99.0.3"), newCfg("10.99.0.4")
+
+	sender, _ := common.ParseMapping(common.NewMapping(senderCfg).String(), receiverCfg)
+	receiver, _ := common.ParseMapping(common.NewMapping(receiverCfg).String(), senderCfg)
+
+	outgoing, _ := New(EncryptionPlugin, senderCfg)
+	incoming, _ := New(EncryptionPlugin, receiverCfg)
+	mtu := MTU([]Plugin{outgoing})
+
+	buf := make([]byte, common.MaxBufferLength)
+	fillSlice(buf[:common.MaxPacketLength])
+	copy(buf[common.IPStart:], senderCfg.PrivateIP.To4())
+	expected := make([]byte, mtu)
+	copy(expected, buf[common.PacketStart:])
+
+	payload, _, ok := outgoing.Apply(Outgoing, 0, common.NewTunPayload(buf, mtu), receiver)
+	if ok || payload.DropReason != common.NoSessionDropReason {
+		t.Fatal("Failed to hold back an outgoing payload until a session is established.")
+	}
+
+	now := time.Now()
+	init, _ := senderCfg.Sessions.Initiate(now, receiver)
+	response, err := receiverCfg.Sessions.Respond(now, sender, init)
+	if err != nil || senderCfg.Sessions.Complete(now, receiver, response) != nil {
+		t.Fatal("Failed to establish a session.")
+	}
+
+	payload, _, ok = outgoing.Apply(Outgoing, 0, common.NewTunPayload(buf, mtu), receiver)
+	if !ok || payload.Packet[len(payload.Packet)-common.SessionKindSize] != common.TransportKind {
+		t.Fatal("Failed to encrypt an outgoing payload with the session keys.")
+	}
+	encrypted := append([]byte(nil), payload.Raw[:payload.Length]...)
+
+	payload, _, ok = incoming.Apply(Incoming, 0, common.NewSockPayload(payload.Raw, payload.Length), sender)
+	if !ok || !payload.Authenticated || !testEq(payload.Packet, expected) {
+		t.Fatal("Failed to decrypt an incoming payload with the session keys.")
+	}
+
+	payload, _, ok = incoming.Apply(Incoming, 0, common.NewSockPayload(encrypted, len(encrypted)), sender)
+	if ok || payload.DropReason != common.ReplayedDropReason {
+		t.Fatal("Failed to reject a replayed incoming payload.")
+	}
+
+	if _, _, ok := incoming.Apply(Incoming, 0, common.NewSockPayload(encrypted, len(encrypted)), receiver); ok {
+		t.Fatal("Accepted an incoming payload tagged with a session belonging to another node.")
+	}
+}
+
 func TestCompression(t *testing.T) {
 	compression, err := New(CompressionPlugin, &common.Config{})
 	if err != nil {
 		t.Fatal("Failed to create new compression plugin.")
 	}
+	mtu := MTU([]Plugin{compression})
 
 	buf := make([]byte, common.MaxPacketLength)
 	expected := make([]byte, common.MaxPacketLength)
@@ -139,29 +370,168 @@ func TestCompression(t *testing.T) {
 
 	copy(expected, buf)
 
-	out := common.NewTunPayload(buf, common.MTU)
+	out := common.NewTunPayload(buf, mtu)
 
-	compressed, _, ok := compression.Apply(Outgoing, out, mapping)
+	compressed, _, ok := compression.Apply(Outgoing, 0, out, mapping)
 	if !ok {
 		t.Fatal("Failed to compress the outgoing payload.")
 	}
 
 	in := common.NewSockPayload(compressed.Raw, compressed.Length)
 
-	_, _, ok = compression.Apply(Incoming, in, mapping)
+	_, _, ok = compression.Apply(Incoming, 0, in, mapping)
 	if !ok {
 		t.Fatal("Failed to decompress the incoming payload.")
 	}
 
-	if !testEq(expected[:common.MTU], buf[:common.MTU]) {
+	if !testEq(expected[:mtu], buf[:mtu]) {
 		t.Fatal("The outgoing and incoming payloads don't match after compression/decompression.")
 	}
 
 	compression.Close()
 }
 
+func TestCheck(t *testing.T) {
+	checkCfg := &common.Config{
+		PrivateIP:     net.ParseIP("10.99.0.5"),
+		PublicIPv4:    net.ParseIP("1.1.1.5"),
+		IsIPv4Enabled: true,
+		MachineID:     "check",
+		Plugins:       []string{CompressionPlugin, FECPlugin, EncryptionPlugin, ObfuscationPlugin, MockPlugin},
+		Keys:          common.NewKeyring(common.NewKey(0)),
+		PluginConfig:  common.PluginSections{FECPlugin: {"peers": "check"}, ObfuscationPlugin: {"key": "secret"}},
+	}
+	remote, _ := common.ParseMapping(common.NewMapping(checkCfg).String(), checkCfg)
+
+	builtins := make([]Plugin, len(checkCfg.Plugins))
+	for i := 0; i < len(builtins); i++ {
+		plugin, err := New(checkCfg.Plugins[i], checkCfg)
+		if err != nil {
+			t.Fatalf("Failed to create new %s plugin: %s", checkCfg.Plugins[i], err)
+		}
+		defer plugin.Close()
+		builtins[i] = plugin
+	}
+
+	// Every combination of the builtin plugins leaves a usable MTU, and a full sized packet still fits once grown by all of them.
+	for combination := 0; combination < 1<<uint(len(builtins)); combination++ {
+		var plugins []Plugin
+		expansion := 0
+		for i := 0; i < len(builtins); i++ {
+			if combination&(1<<uint(i)) != 0 {
+				plugins = append(plugins, builtins[i])
+				expansion += builtins[i].Expansion()
+			}
+		}
+
+		checkCfg.DisableRelays = false
+		if err := Check(checkCfg, plugins); err != nil || checkCfg.MTU != common.MaxMTU-2*expansion-common.RelayHeaderSize {
+			t.Fatalf("Check didn't leave room for relaying in the MTU of plugin combination %d: %v", combination, err)
+		}
+
+		checkCfg.DisableRelays = true
+		if err := Check(checkCfg, plugins); err != nil || checkCfg.MTU != common.MaxMTU-expansion {
+			t.Fatalf("Check didn't size the MTU of plugin combination %d: %v", combination, err)
+		}
+
+		sort.Sort(Sorter{Plugins: plugins})
+
+		buf := make([]byte, common.MaxBufferLength)
+		fillSlice(buf)
+		payload := common.NewTunPayload(buf, checkCfg.MTU)
+		copy(payload.IPAddress, checkCfg.PrivateIP.To4())
+
+		var ok bool
+		for i := 0; i < len(plugins); i++ {
+			if payload, _, ok = plugins[i].Apply(Outgoing, 0, payload, remote); !ok {
+				t.Fatalf("The %s plugin dropped a full sized packet in plugin combination %d.", plugins[i].Name(), combination)
+			}
+		}
+		if payload.Length > common.MaxPacketLength {
+			t.Fatalf("Plugin combination %d grew a full sized packet beyond the maximum packet size.", combination)
+		}
+	}
+
+	encryption := builtins[2]
+	if err := Check(checkCfg, []Plugin{encryption, encryption, encryption, encryption, encryption, encryption, encryption}); err == nil {
+		t.Fatal("Check accepted plugins leaving an MTU below the minimum.")
+	}
+}
+
+func TestCompressionCodecs(t *testing.T) {
+	if _, err := New(CompressionPlugin, &common.Config{CompressionCodecs: []string{"gzip"}}); err == nil {
+		t.Fatal("New accepted an unsupported compression codec.")
+	}
+	mtu := common.MaxMTU - compressionExpansion
+
+	compressible := make([]byte, mtu)
+	for i := range compressible {
+		compressible[i] = byte(i % 16)
+	}
+	random := make([]byte, mtu)
+	fillSlice(random)
+
+	for _, codec := range []string{SnappyCodec, LZ4Codec, ZstdCodec} {
+		compression, err := New(CompressionPlugin, &common.Config{CompressionCodecs: []string{"zstd", codec}, CompressionAdaptive: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote := &common.Mapping{
+			PrivateIP:        net.ParseIP("10.99.0.2"),
+			SupportedPlugins: []string{CompressionPlugin, common.CompressionCodecPrefix + codec},
+		}
+
+		for _, data := range [][]byte{compressible, random} {
+			buf := make([]byte, common.MaxBufferLength)
+			copy(buf[common.PacketStart:], data)
+
+			payload, _, ok := compression.Apply(Outgoing, 0, common.NewTunPayload(buf, len(data)), remote)
+			if !ok {
+				t.Fatalf("Failed to compress the outgoing payload with %s.", codec)
+			}
+			if len(payload.Packet) > len(data)+1 {
+				t.Fatalf("Adaptive compression with %s made the payload larger than tagging it as uncompressed.", codec)
+			}
+
+			payload, _, ok = compression.Apply(Incoming, 0, common.NewSockPayload(payload.Raw, payload.Length), remote)
+			if !ok || !testEq(payload.Packet, data) {
+				t.Fatalf("The outgoing and incoming payloads don't match after compression/decompression with %s.", codec)
+			}
+		}
+
+		metrics := compression.(Reporter).Report().Compression["10.99.0.2"]
+		if metrics == nil || metrics.Codec != codec || metrics.Packets != 2 || metrics.Skipped != 1 || metrics.Ratio >= 1 {
+			t.Fatalf("Report did not return the compression statistics for %s.", codec)
+		}
+
+		buf := make([]byte, common.MaxBufferLength)
+		buf[common.PacketStart] = 0xff
+		payload, _, ok := compression.Apply(Incoming, 0, common.NewSockPayload(buf, common.HeaderSize+8), remote)
+		if ok || payload.DropReason != common.MalformedDropReason {
+			t.Fatal("A packet tagged with an unknown codec was not dropped as malformed.")
+		}
+
+		compression.Close()
+	}
+
+	// Nodes that share no codec still understand uncompressed tagged packets.
+	compression, _ := New(CompressionPlugin, &common.Config{CompressionCodecs: []string{LZ4Codec}})
+	remote := &common.Mapping{PrivateIP: net.ParseIP("10.99.0.3"), SupportedPlugins: []string{CompressionPlugin, common.CompressionCodecPrefix + ZstdCodec}}
+	buf := make([]byte, common.MaxBufferLength)
+	copy(buf[common.PacketStart:], compressible)
+	payload, _, ok := compression.Apply(Outgoing, 0, common.NewTunPayload(buf, mtu), remote)
+	if !ok || payload.Packet[0] != 0 || !testEq(payload.Packet[1:], compressible) {
+		t.Fatal("A packet to a node sharing no codec was not sent uncompressed.")
+	}
+
+	payload = common.NewTunPayload(make([]byte, common.MaxPacketLength), common.MaxPacketLength-common.PacketStart)
+	if _, _, ok = compression.Apply(Outgoing, 0, payload, remote); ok || payload.DropReason != common.OversizeDropReason {
+		t.Fatal("A packet that would not fit once tagged was not dropped as oversize.")
+	}
+}
+
 func TestMulti(t *testing.T) {
-	encryption, err := New(EncryptionPlugin, &common.Config{})
+	encryption, err := New(EncryptionPlugin, cfg)
 	if err != nil {
 		t.Fatal("Failed to create new encryption plugin.")
 	}
@@ -174,6 +544,7 @@ func TestMulti(t *testing.T) {
 	plugins := []Plugin{encryption, compression}
 
 	sort.Sort(Sorter{Plugins: plugins})
+	mtu := MTU(plugins)
 
 	buf := make([]byte, common.MaxPacketLength)
 	expected := make([]byte, common.MaxPacketLength)
@@ -185,11 +556,11 @@ func TestMulti(t *testing.T) {
 
 	copy(expected, buf)
 
-	payload := common.NewTunPayload(buf, common.MTU)
+	payload := common.NewTunPayload(buf, mtu)
 
 	var ok bool
 	for i := 0; i < len(plugins); i++ {
-		payload, mapping, ok = plugins[i].Apply(Outgoing, payload, mapping)
+		payload, mapping, ok = plugins[i].Apply(Outgoing, 0, payload, mapping)
 		if !ok {
 			t.Fatalf("Failed to apply outgoing plugin: %s", plugins[i].Name())
 		}
@@ -200,25 +571,258 @@ func TestMulti(t *testing.T) {
 	payload = common.NewSockPayload(payload.Raw, payload.Length)
 
 	for i := 0; i < len(plugins); i++ {
-		payload, mapping, ok = plugins[i].Apply(Incoming, payload, mapping)
+		payload, mapping, ok = plugins[i].Apply(Incoming, 0, payload, mapping)
 		if !ok {
 			t.Fatalf("Failed to apply incoming plugin: %s", plugins[i].Name())
 		}
 	}
 
-	if payload.Length-common.HeaderSize != common.MTU {
+	if payload.Length-common.HeaderSize != mtu {
 		t.Fatal("The outgoing and incoming payloads have different lengths after applying all plugins.")
 	}
 
-	if !testEq(expected[:common.MTU], payload.Raw[:payload.Length-common.HeaderSize]) {
+	if !testEq(expected[:mtu], payload.Raw[:payload.Length-common.HeaderSize]) {
 		t.Fatal("The outgoing and incoming payloads don't match after applying all plugins.")
 	}
 }
 
+func TestObfuscation(t *testing.T) {
+	if _, err := New(ObfuscationPlugin, &common.Config{}); err == nil {
+		t.Fatal("New created an obfuscation plugin without a key.")
+	}
+	if _, err := New(ObfuscationPlugin, &common.Config{PluginConfig: common.PluginSections{ObfuscationPlugin: {"key": "secret", "buckets": "8,2048"}}}); err == nil {
+		t.Fatal("New created an obfuscation plugin with buckets that can't hold a packet.")
+	}
+
+	newCfg := func(ip, machineID string) *common.Config {
+		return &common.Config{
+			PrivateIP:    net.ParseIP(ip),
+			MachineID:    machineID,
+			Plugins:      []string{ObfuscationPlugin},
+			PluginConfig: common.PluginSections{ObfuscationPlugin: {"key": "secret", "buckets": "1472,256,512", "cover-rate": "4"}},
+		}
+	}
+	localCfg, remoteCfg := newCfg("10.99.0.1", "local"), newCfg("10.99.0.2", "remote")
+
+	local, err := New(ObfuscationPlugin, localCfg)
+	if err != nil {
+		t.Fatal("Failed to create new obfuscation plugin:", err)
+	}
+	remote, _ := New(ObfuscationPlugin, remoteCfg)
+	localMapping, remoteMapping := common.NewMapping(localCfg), common.NewMapping(remoteCfg)
+	remote.(MappingWatcher).OnMappingChange(localMapping, false)
+
+	if local.(Injector).Interval() != 250*time.Millisecond {
+		t.Fatal("The obfuscation plugin didn't pick up the cover traffic rate.")
+	}
+
+	buf := make([]byte, common.MaxBufferLength)
+	expected := make([]byte, 100)
+	fillSlice(expected)
+
+	payload := common.NewTunPayload(buf, len(expected))
+	copy(payload.Packet, expected)
+	copy(payload.IPAddress, localCfg.PrivateIP.To4())
+
+	payload, _, ok := local.Apply(Outgoing, 0, payload, remoteMapping)
+	if !ok || payload.Length != 256 {
+		t.Fatal("The obfuscation plugin didn't pad the packet to the smallest bucket holding it.")
+	}
+	if net.IP(payload.IPAddress).Equal(localCfg.PrivateIP) {
+		t.Fatal("The obfuscation plugin didn't hide the private ip in the header.")
+	}
+
+	payload = common.NewSockPayload(payload.Raw, payload.Length)
+	if !remote.(Resolver).Resolve(payload) || !net.IP(payload.IPAddress).Equal(localCfg.PrivateIP) {
+		t.Fatal("The obfuscation plugin didn't restore the private ip of a known node.")
+	}
+	payload, _, ok = remote.Apply(Incoming, 0, payload, localMapping)
+	if !ok || payload.Length != common.HeaderSize+len(expected) || !testEq(expected, payload.Packet) {
+		t.Fatal("The obfuscation plugin didn't strip the padding from the packet.")
+	}
+
+	payload = common.NewTunPayload(buf, common.MaxPacketLength-common.HeaderSize-obfuscationTrailerSize)
+	copy(payload.IPAddress, localCfg.PrivateIP.To4())
+	if payload, _, ok = local.Apply(Outgoing, 0, payload, remoteMapping); !ok || payload.Length != common.MaxPacketLength {
+		t.Fatal("The obfuscation plugin failed to send a full sized packet.")
+	}
+	payload = common.NewTunPayload(buf, common.MaxPacketLength-common.HeaderSize)
+	if payload, _, ok = local.Apply(Outgoing, 0, payload, remoteMapping); ok || payload.DropReason != common.OversizeDropReason {
+		t.Fatal("The obfuscation plugin didn't drop a packet outgrowing the maximum packet size.")
+	}
+
+	payload = common.NewTunPayload(buf, len(expected))
+	copy(payload.IPAddress, localCfg.PrivateIP.To4())
+	payload, _, _ = local.Apply(Outgoing, 0, payload, remoteMapping)
+	payload.Packet[len(payload.Packet)-obfuscationMACSize-1] ^= 0x01
+	payload = common.NewSockPayload(payload.Raw, payload.Length)
+	remote.(Resolver).Resolve(payload)
+	if payload, _, ok = remote.Apply(Incoming, 0, payload, localMapping); ok || payload.DropReason != common.UnauthenticatedDropReason {
+		t.Fatal("The obfuscation plugin accepted a packet with a tampered trailer.")
+	}
+
+	cover, ok := local.(Injector).Inject(buf, remoteMapping)
+	if !ok || (cover.Length != 256 && cover.Length != 512 && cover.Length != 1472) {
+		t.Fatal("The obfuscation plugin didn't pad a cover packet to one of the buckets.")
+	}
+	cover = common.NewSockPayload(cover.Raw, cover.Length)
+	if !remote.(Resolver).Resolve(cover) {
+		t.Fatal("The obfuscation plugin didn't restore the private ip of a cover packet.")
+	}
+	if cover, _, ok = remote.Apply(Incoming, 0, cover, localMapping); ok || cover.DropReason != common.CoverDropReason {
+		t.Fatal("The obfuscation plugin didn't drop a cover packet.")
+	}
+
+	remote.(MappingWatcher).OnMappingChange(localMapping, true)
+	payload = common.NewTunPayload(buf, len(expected))
+	copy(payload.IPAddress, localCfg.PrivateIP.To4())
+	payload, _, _ = local.Apply(Outgoing, 0, payload, remoteMapping)
+	if remote.(Resolver).Resolve(common.NewSockPayload(payload.Raw, payload.Length)) {
+		t.Fatal("The obfuscation plugin restored the private ip of a node that left.")
+	}
+}
+
+func TestFEC(t *testing.T) {
+	if _, err := New(FECPlugin, &common.Config{PluginConfig: common.PluginSections{FECPlugin: {"parity": "0"}}}); err == nil {
+		t.Fatal("New created a fec plugin without parity packets.")
+	}
+
+	newCfg := func(ip, machineID string, options map[string]string) *common.Config {
+		return &common.Config{
+			PrivateIP:    net.ParseIP(ip),
+			MachineID:    machineID,
+			Plugins:      []string{FECPlugin},
+			PluginConfig: common.PluginSections{FECPlugin: options},
+		}
+	}
+	localCfg := newCfg("10.99.0.1", "local", map[string]string{"data": "4", "parity": "2", "timeout": "1h", "peers": "remote"})
+	remoteCfg := newCfg("10.99.0.2", "remote", map[string]string{})
+	otherCfg := newCfg("10.99.0.3", "other", map[string]string{})
+
+	local, err := New(FECPlugin, localCfg)
+	if err != nil {
+		t.Fatal("Failed to create new fec plugin:", err)
+	}
+	remote, _ := New(FECPlugin, remoteCfg)
+	mtu := MTU([]Plugin{local})
+	localMapping, remoteMapping, otherMapping := common.NewMapping(localCfg), common.NewMapping(remoteCfg), common.NewMapping(otherCfg)
+
+	buf := make([]byte, common.MaxBufferLength)
+	send := func(length int, mapping *common.Mapping) ([]byte, []byte) {
+		payload := common.NewTunPayload(buf, length)
+		fillSlice(payload.Packet)
+		expected := append([]byte(nil), payload.Packet...)
+
+		payload, _, ok := local.Apply(Outgoing, 0, payload, mapping)
+		if !ok {
+			t.Fatal("The fec plugin failed to send a packet.")
+		}
+		return expected, append([]byte(nil), payload.Raw[:payload.Length]...)
+	}
+	receive := func(raw []byte) (*common.Payload, bool) {
+		payload := common.NewSockPayload(buf, len(raw))
+		copy(buf, raw)
+		payload, _, ok := remote.Apply(Incoming, 0, payload, localMapping)
+		return payload, ok
+	}
+
+	expected, raw := send(100, otherMapping)
+	if payload, ok := receive(raw); !ok || !testEq(expected, payload.Packet) {
+		t.Fatal("The fec plugin didn't pass an unprotected packet through.")
+	}
+	if _, _, ok := local.(Producer).Produce(Outgoing, buf); ok {
+		t.Fatal("The fec plugin produced parity packets for a node it doesn't protect.")
+	}
+
+	var sent, packets [][]byte
+	for _, length := range []int{100, 1200, 40, mtu} {
+		expected, raw := send(length, remoteMapping)
+		sent, packets = append(sent, expected), append(packets, raw)
+	}
+	for payload, _, ok := local.(Producer).Produce(Outgoing, buf); ok; payload, _, ok = local.(Producer).Produce(Outgoing, buf) {
+		if payload.Length > common.MaxPacketLength {
+			t.Fatal("The fec plugin produced a parity packet larger than the maximum packet size.")
+		}
+		packets = append(packets, append([]byte(nil), payload.Raw[:payload.Length]...))
+	}
+	if len(packets) != 6 {
+		t.Fatal("The fec plugin didn't produce the parity packets of a full group.")
+	}
+
+	// Lose the second and the fourth packet of the group.
+	for _, i := range []int{0, 2} {
+		if payload, ok := receive(packets[i]); !ok || !testEq(sent[i], payload.Packet) {
+			t.Fatal("The fec plugin didn't strip the trailer of a protected packet.")
+		}
+	}
+	for _, i := range []int{4, 5} {
+		if payload, ok := receive(packets[i]); ok || payload.DropReason != common.ParityDropReason {
+			t.Fatal("The fec plugin passed a parity packet through.")
+		}
+	}
+
+	for _, i := range []int{1, 3} {
+		payload, mapping, ok := remote.(Producer).Produce(Incoming, buf)
+		if !ok || mapping != localMapping || !net.IP(payload.IPAddress).Equal(localCfg.PrivateIP) || !testEq(sent[i], payload.Packet) {
+			t.Fatal("The fec plugin didn't rebuild a lost packet.")
+		}
+	}
+	if payload, ok := receive(packets[3]); ok || payload.DropReason != common.RecoveredDropReason {
+		t.Fatal("The fec plugin passed a packet through after rebuilding it.")
+	}
+
+	// Lose three packets of the next group, which is more than its parity packets can make up for.
+	packets = packets[:0]
+	for i := 0; i < 4; i++ {
+		_, raw := send(64, remoteMapping)
+		packets = append(packets, raw)
+	}
+	for payload, _, ok := local.(Producer).Produce(Outgoing, buf); ok; payload, _, ok = local.(Producer).Produce(Outgoing, buf) {
+		packets = append(packets, append([]byte(nil), payload.Raw[:payload.Length]...))
+	}
+	for _, i := range []int{0, 4, 5} {
+		receive(packets[i])
+	}
+	if _, _, ok := remote.(Producer).Produce(Incoming, buf); ok {
+		t.Fatal("The fec plugin rebuilt packets from too few packets.")
+	}
+
+	// Move past the groups held, which gives up on the incomplete group.
+	for i := 0; i < fecWindow*4; i++ {
+		_, raw := send(64, remoteMapping)
+		receive(raw)
+	}
+
+	stats := remote.(Reporter).Report().FEC[localCfg.PrivateIP.String()]
+	if stats == nil || stats.Recovered != 2 || stats.Unrecoverable != 3 || stats.ParityReceived != 4 {
+		t.Fatal("The fec plugin didn't report the parity packets received, and the recovered and unrecoverable packets:", stats)
+	}
+	if stats := local.(Reporter).Report().FEC[remoteCfg.PrivateIP.String()]; stats == nil || stats.ParityPackets < 4 {
+		t.Fatal("The fec plugin didn't report the parity packets sent.")
+	}
+
+	// Shards larger than any node sends are dropped, rather than overflowing the shard buffers.
+	oversize := make([]byte, common.MaxBufferLength)
+	for _, trailer := range [][]byte{{0x40, 0, 0}, {0x40, 1, 4, 2, fecParityFlag}} {
+		copy(oversize[len(oversize)-len(trailer):], trailer)
+		if payload, ok := receive(oversize); ok || payload.DropReason != common.MalformedDropReason {
+			t.Fatal("The fec plugin accepted a shard larger than the maximum packet size.")
+		}
+	}
+
+	flushing, _ := New(FECPlugin, newCfg("10.99.0.1", "local", map[string]string{"timeout": "1ms"}))
+	payload := common.NewTunPayload(buf, 100)
+	flushing.Apply(Outgoing, 0, payload, remoteMapping)
+	time.Sleep(2 * time.Millisecond)
+	if payload, _, ok := flushing.(Producer).Produce(Outgoing, buf); !ok || payload.Packet[len(payload.Packet)-3] != 1 {
+		t.Fatal("The fec plugin didn't close a group once it timed out.")
+	}
+}
+
 func TestMock(t *testing.T) {
 	mock, _ := New(MockPlugin, &common.Config{})
 
-	if payload, mapping, ok := mock.Apply(Outgoing, nil, nil); !ok || payload != nil || mapping != nil {
+	if payload, mapping, ok := mock.Apply(Outgoing, 0, nil, nil); !ok || payload != nil || mapping != nil {
 		t.Fatal("Mock Apply should always return ok.")
 	}
 
@@ -229,4 +833,15 @@ func TestMock(t *testing.T) {
 	if mock.Order() != MockPluginOrder {
 		t.Fatal("Mock Order should always return MockPluginOrder.")
 	}
+
+	store := &datastore.Mock{}
+	if err := Init([]Plugin{mock}, store); err != nil || mock.(*Mock).Store != store {
+		t.Fatal("Init did not hand the datastore to the mock plugin.")
+	}
+
+	mock.(MappingWatcher).OnMappingChange(mapping, false)
+	mock.(MappingWatcher).OnMappingChange(mapping, true)
+	if len(mock.(*Mock).Changed) != 1 || len(mock.(*Mock).Removed) != 1 {
+		t.Fatal("Mock OnMappingChange did not record the mapping changes.")
+	}
 }
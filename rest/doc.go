@@ -6,6 +6,8 @@ Package rest contains the structs and logic to handle exposing internal metrics
 
 The rest api is exposed by default at 'http://127.0.0.1:1099/metrics', but the ip, port, and uri are configurable at run time.
 
+The liveness of the remote peers is exposed by default at 'http://127.0.0.1:1099/peers', for details on its structure see the peer package.
+
 The statistics structure that is exposed is the following with both the links and queues objects being variable based on usage:
 	{
 	  "TxMetrics": {
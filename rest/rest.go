@@ -11,6 +11,7 @@ import (
 
 	"github.com/supernomad/quantum/common"
 	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/peer"
 	"github.com/supernomad/quantum/version"
 )
 
@@ -19,6 +20,7 @@ type Rest struct {
 	cfg        *common.Config
 	server     *http.Server
 	aggregator *metric.Aggregator
+	peers      *peer.Table
 }
 
 func (rest *Rest) returnStats(w http.ResponseWriter, r *http.Request) {
@@ -34,8 +36,24 @@ func (rest *Rest) returnStats(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (rest *Rest) returnPeers(w http.ResponseWriter, r *http.Request) {
+	rest.cfg.Log.Debug.Println("[REST]", "Received an api request:", r)
+
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Server", "quantum v"+version.Version())
+
+	_, err := w.Write(rest.peers.Bytes(strings.Contains(r.RequestURI, "pretty")))
+	if err != nil {
+		rest.cfg.Log.Error.Println("[REST]", "Error writing peers api response:", err.Error())
+	}
+}
+
 func (rest *Rest) run() {
 	http.HandleFunc(rest.cfg.StatsRoute, rest.returnStats)
+	if rest.cfg.PeersRoute != "" && rest.peers != nil {
+		http.HandleFunc(rest.cfg.PeersRoute, rest.returnPeers)
+	}
 
 	for {
 		if err := rest.server.ListenAndServe(); err != nil {
@@ -56,11 +74,12 @@ func (rest *Rest) Stop() error {
 	return rest.server.Close()
 }
 
-// New generates an Rest instance exposing metrics and general purpose routes via a REST api interface.
-func New(cfg *common.Config, aggregator *metric.Aggregator) *Rest {
+// New generates an Rest instance exposing metrics, peer liveness, and general purpose routes via a REST api interface.
+func New(cfg *common.Config, aggregator *metric.Aggregator, peers *peer.Table) *Rest {
 	return &Rest{
 		cfg:        cfg,
 		server:     &http.Server{Addr: fmt.Sprintf("%s:%d", cfg.StatsAddress, cfg.StatsPort)},
 		aggregator: aggregator,
+		peers:      peers,
 	}
 }
@@ -4,25 +4,38 @@
 package rest
 
 import (
+	"encoding/json"
+	"net"
 	"net/http"
 	"testing"
 	"time"
 
 	"github.com/supernomad/quantum/common"
 	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/peer"
 )
 
 func TestRest(t *testing.T) {
 	cfg := &common.Config{
 		Log:          common.NewLogger(common.NoopLogger),
 		StatsRoute:   "/metrics",
+		PeersRoute:   "/peers",
 		StatsPort:    1099,
 		StatsAddress: "127.0.0.1",
 		NumWorkers:   1,
 	}
 
+	mappings := []*common.Mapping{
+		{MachineID: "first", PrivateIP: net.ParseIP("10.99.0.1")},
+		{MachineID: "second", PrivateIP: net.ParseIP("10.99.0.2")},
+	}
+	peers := peer.New()
+	for _, mapping := range mappings {
+		peers.Track(mapping)
+	}
+
 	aggregator := metric.New(cfg)
-	api := New(cfg, aggregator)
+	api := New(cfg, aggregator, peers)
 
 	api.Start()
 	aggregator.Start()
@@ -58,6 +71,30 @@ func TestRest(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	resp, err := http.Get("http://127.0.0.1:1099/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("The peers api returned status %d.", resp.StatusCode)
+	}
+
+	snaps := make(map[string]map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&snaps); err != nil {
+		t.Fatalf("The peers api returned invalid json: %s", err)
+	}
+	if len(snaps) != len(mappings) {
+		t.Fatalf("The peers api returned %d peers instead of %d.", len(snaps), len(mappings))
+	}
+	for _, mapping := range mappings {
+		snap := snaps[mapping.PrivateIP.String()]
+		if snap == nil || snap["machineID"] != mapping.MachineID || snap["state"] != "unknown" {
+			t.Fatalf("The peers api did not return the tracked peer %s.", mapping.PrivateIP)
+		}
+	}
+
 	aggregator.Stop()
 	api.Stop()
 }
@@ -0,0 +1,221 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package socket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+)
+
+var (
+	errRevokedCertificate = errors.New("the remote certificate has been revoked")
+	errIdentityMismatch   = errors.New("the remote certificate was not issued to the remote node")
+)
+
+// credentials hold the material loaded from the DTLS certificate, key, CA and CRL files, which is reloaded in place so that new sessions use the new material.
+//
+// Certificates are revoked by serial number, either through the CRL files or through the datastore, and the serial number of each session's remote certificate is kept so that sessions with revoked remote nodes can be closed.
+//
+// Each session also keeps the identity of its remote certificate, which has to match the mapping of the remote node the session was opened with, or the mappings of the packets received over it.
+type credentials struct {
+	cfg *common.Config
+
+	mux      sync.RWMutex
+	cert     tls.Certificate
+	roots    *x509.CertPool
+	crl      map[string]bool
+	modified map[string]time.Time
+}
+
+func (creds *credentials) files() []string {
+	files := []string{creds.cfg.DTLSCert, creds.cfg.DTLSKey}
+	if creds.cfg.DTLSCA != "" {
+		files = append(files, creds.cfg.DTLSCA)
+	}
+	return append(files, creds.cfg.DTLSCRL...)
+}
+
+// load reads the files, keeping the current material unless every one of them is valid.
+func (creds *credentials) load() error {
+	// The modification times are taken before reading, so that a file replaced while it is read is picked up by the next reload.
+	files := creds.files()
+	modified := make(map[string]time.Time, len(files))
+	for i := 0; i < len(files); i++ {
+		if info, err := os.Stat(files[i]); err == nil {
+			modified[files[i]] = info.ModTime()
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(creds.cfg.DTLSCert, creds.cfg.DTLSKey)
+	if err != nil {
+		return errors.New("error loading the DTLS certificate and key: " + err.Error())
+	}
+
+	roots := x509.NewCertPool()
+	var cas []*x509.Certificate
+	if creds.cfg.DTLSCA != "" {
+		data, err := ioutil.ReadFile(creds.cfg.DTLSCA)
+		if err != nil {
+			return errors.New("error reading the DTLS CA certificate: " + err.Error())
+		}
+
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			ca, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return errors.New("error parsing the DTLS CA certificate: " + err.Error())
+			}
+			roots.AddCert(ca)
+			cas = append(cas, ca)
+		}
+
+		if len(cas) == 0 {
+			return errors.New("error parsing the DTLS CA certificate")
+		}
+	}
+
+	crl := make(map[string]bool)
+	for i := 0; i < len(creds.cfg.DTLSCRL); i++ {
+		if err := loadCRL(creds.cfg.DTLSCRL[i], cas, crl); err != nil {
+			return err
+		}
+	}
+
+	creds.mux.Lock()
+	defer creds.mux.Unlock()
+
+	creds.cert, creds.roots, creds.crl, creds.modified = cert, roots, crl, modified
+	return nil
+}
+
+// changed returns whether or not any of the files has been modified since it was last loaded. Files that can't be found are skipped, since they are most likely in the middle of being replaced.
+func (creds *credentials) changed() bool {
+	creds.mux.RLock()
+	defer creds.mux.RUnlock()
+
+	files := creds.files()
+	for i := 0; i < len(files); i++ {
+		if info, err := os.Stat(files[i]); err == nil && !info.ModTime().Equal(creds.modified[files[i]]) {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh calls reload if any of the files has changed.
+func (creds *credentials) refresh(reload func() error) {
+	if !creds.changed() {
+		return
+	}
+
+	if err := reload(); err != nil {
+		creds.cfg.Log.Error.Println("[DTLS]", "Error reloading the changed DTLS certificates:", err.Error())
+		return
+	}
+	creds.cfg.Log.Info.Println("[DTLS]", "Reloaded the changed DTLS certificates")
+}
+
+func (creds *credentials) snapshot() (tls.Certificate, *x509.CertPool) {
+	creds.mux.RLock()
+	defer creds.mux.RUnlock()
+
+	return creds.cert, creds.roots
+}
+
+// revoked returns whether or not the certificate with the supplied serial number has been revoked, either by the CRL files or through the datastore.
+func (creds *credentials) revoked(serial string) bool {
+	creds.mux.RLock()
+	revoked := creds.crl[serial]
+	creds.mux.RUnlock()
+
+	return revoked || creds.cfg.Revocations.Revoked(serial)
+}
+
+// check returns the serial number and identity of the DER encoded certificate a remote node presented, and false if it has been revoked or can't be parsed. Remote nodes that didn't present a certificate pass without an identity, since it is up to verification whether or not they need one, and so do unverified certificates.
+func (creds *credentials) check(der []byte) (string, *common.PeerIdentity, bool) {
+	if len(der) == 0 {
+		return "", nil, true
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", nil, false
+	}
+
+	var identity *common.PeerIdentity
+	if !creds.cfg.DTLSSkipVerify {
+		identity = common.NewPeerIdentity(cert)
+	}
+
+	serial := common.CertificateSerial(cert)
+	return serial, identity, !creds.revoked(serial)
+}
+
+// verifyPeer rejects revoked remote certificates during handshakes, after the certificate chain has been verified.
+func (creds *credentials) verifyPeer(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+
+	if _, _, ok := creds.check(rawCerts[0]); !ok {
+		return errRevokedCertificate
+	}
+	return nil
+}
+
+// loadCRL adds the serial numbers listed by the PEM or DER encoded CRL file to crl, the CRL must be signed by one of the supplied CA certificates unless there are none.
+func loadCRL(file string, cas []*x509.Certificate, crl map[string]bool) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.New("error reading the DTLS CRL file '" + file + "': " + err.Error())
+	}
+
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+
+	for i := 0; i < len(ders); i++ {
+		list, err := x509.ParseRevocationList(ders[i])
+		if err != nil {
+			return errors.New("error parsing the DTLS CRL file '" + file + "': " + err.Error())
+		}
+
+		signed := len(cas) == 0
+		for j := 0; j < len(cas) && !signed; j++ {
+			signed = list.CheckSignatureFrom(cas[j]) == nil
+		}
+		if !signed {
+			return errors.New("the DTLS CRL file '" + file + "' is not signed by the DTLS CA certificate")
+		}
+
+		for j := 0; j < len(list.RevokedCertificateEntries); j++ {
+			crl[list.RevokedCertificateEntries[j].SerialNumber.Text(16)] = true
+		}
+	}
+	return nil
+}
+
+func newCredentials(cfg *common.Config) (*credentials, error) {
+	creds := &credentials{cfg: cfg}
+	if err := creds.load(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
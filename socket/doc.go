@@ -6,6 +6,12 @@ Package socket contains the structs and logic to create, configure, and maintain
 
 Currently supported sockets:
 	- UDP socket
-	- DTLS socket
+	- DTLS socket, backed by either openssl or a pure go implementation
+
+Each queue is bound once per enabled address family, so that ipv4 and ipv6 traffic are both handled natively. Writes are sent over the socket matching the address family of the destination endpoint.
+
+The DTLS certificate, key, CA and CRL files are reloaded when they change or when quantum receives SIGUSR1, sessions opened afterwards use the new files. Certificates revoked by the CRL files or through the datastore are rejected during handshakes, and the sessions already open with them are closed.
+
+The identity of each verified remote certificate, its machine id URI or its ip addresses, has to match the mapping of the remote node a session is opened with. Packets read off a session carry that identity, so that the workers can drop the ones whose private ip belongs to another node.
 */
 package socket
@@ -1,39 +1,69 @@
 // Copyright (c) 2016-2017 Christian Saide <supernomad>
 // Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
 
+//go:build cgo
+// +build cgo
+
 package socket
 
 import (
 	"errors"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/supernomad/quantum/common"
 	"github.com/supernomad/quantum/crypto"
+	"github.com/supernomad/quantum/metric"
+)
+
+const (
+	// The backoff between failed accepts doubles with each consecutive failure within these bounds, so that a broken server context doesn't spin.
+	minAcceptBackoff = 10 * time.Millisecond
+	maxAcceptBackoff = time.Second
 )
 
 // DTLS socket struct for managing a multi-queue openssl based DTLS socket.
 type DTLS struct {
 	cfg     *common.Config
-	stop    bool
+	creds   *credentials
+	stop    chan struct{}
 	queues  []int
 	pollFds []int
 	events  [][]syscall.EpollEvent
-	servers []*crypto.DTLSContext
-	clients []*crypto.DTLSContext
+	servers [][]*crypto.DTLSContext
+	clients [][]*crypto.DTLSContext
 	mux     sync.Mutex
-	writers []map[string]*crypto.DTLSSession
-	readers []map[int32]*crypto.DTLSSession
+	accepts sync.WaitGroup
+	stats   sessionStats
+	writers []*sessionTable
+	readers []*sessionTable
 }
 
 // Close the DTLS socket and removes associated network configuration.
 func (dtls *DTLS) Close() error {
-	dtls.stop = true
+	close(dtls.stop)
 
-	// Close the DTLS servers.
+	// Close the DTLS servers, once nothing is listening on their sockets anymore so that their file descriptors can't be reused from under a pending accept.
 	if dtls.servers != nil {
 		for i := 0; i < dtls.cfg.NumWorkers; i++ {
-			dtls.servers[i].Close()
+			for j := 0; j < len(dtls.servers[i]); j++ {
+				if dtls.servers[i][j] != nil {
+					dtls.servers[i][j].Stop()
+				}
+			}
+		}
+		dtls.accepts.Wait()
+
+		for i := 0; i < dtls.cfg.NumWorkers; i++ {
+			for j := 0; j < len(dtls.servers[i]); j++ {
+				if dtls.servers[i][j] != nil {
+					dtls.servers[i][j].Close()
+				}
+			}
 		}
 		dtls.servers = nil
 	}
@@ -41,11 +71,23 @@ func (dtls *DTLS) Close() error {
 	// Close the DTLS clients.
 	if dtls.clients != nil {
 		for i := 0; i < dtls.cfg.NumWorkers; i++ {
-			dtls.clients[i].Close()
+			for j := 0; j < len(dtls.clients[i]); j++ {
+				if dtls.clients[i][j] != nil {
+					dtls.clients[i][j].Close()
+				}
+			}
 		}
 		dtls.clients = nil
 	}
 
+	// Close the DTLS writer and reader sessions, the readers deregister themselves from the pollFds.
+	for i := 0; i < len(dtls.writers); i++ {
+		dtls.writers[i].close()
+	}
+	for i := 0; i < len(dtls.readers); i++ {
+		dtls.readers[i].close()
+	}
+
 	// Close the pollFds.
 	if dtls.pollFds != nil {
 		for i := 0; i < dtls.cfg.NumWorkers; i++ {
@@ -59,26 +101,6 @@ func (dtls *DTLS) Close() error {
 		dtls.events = nil
 	}
 
-	// Close the DTLS writer sessions.
-	if dtls.writers != nil {
-		for i := 0; i < dtls.cfg.NumWorkers; i++ {
-			for _, session := range dtls.writers[i] {
-				session.Close()
-			}
-		}
-		dtls.writers = nil
-	}
-
-	// Close the DTLS reader sessions.
-	if dtls.readers != nil {
-		for i := 0; i < dtls.cfg.NumWorkers; i++ {
-			for _, session := range dtls.readers[i] {
-				session.Close()
-			}
-		}
-		dtls.readers = nil
-	}
-
 	return nil
 }
 
@@ -90,80 +112,206 @@ func (dtls *DTLS) Queues() []int {
 // Read a packet off the specified DTLS socket queue and return a *common.Payload representation of the packet.
 func (dtls *DTLS) Read(queue int, buf []byte) (*common.Payload, bool) {
 	n, err := syscall.EpollWait(dtls.pollFds[queue], dtls.events[queue], -1)
-	if err != nil || n < 0 {
+	if err != nil || n < 1 {
 		return nil, false
 	}
 
-	session, ok := dtls.readers[queue][dtls.events[queue][0].Fd]
-	if !ok {
+	s, ok := dtls.readers[queue].getFd(dtls.events[queue][0].Fd)
+	if !ok || !s.lock() {
 		return nil, false
 	}
 
-	read, ok := session.Read(buf)
+	read, ok := s.conn.(*crypto.DTLSSession).Read(buf)
+	s.unlock(time.Now())
+
 	if !ok {
-		delete(dtls.readers[queue], dtls.events[queue][0].Fd)
+		dtls.readers[queue].remove(s)
 		return nil, false
 	}
 
-	return common.NewSockPayload(buf, read), true
+	// DTLS sessions are bound to the address they were established with, so there is no source address to report alongside the payload.
+	payload := common.NewSockPayload(buf, read)
+	payload.Authenticated = true
+	payload.Peer = s.peer
+	return payload, true
 }
 
 // Write a *common.Payload to the specified DTLS socket queue.
 func (dtls *DTLS) Write(queue int, payload *common.Payload, mapping *common.Mapping) bool {
-	session, ok := dtls.getWriter(queue, mapping)
-	if !ok {
+	s, ok := dtls.getWriter(queue, mapping)
+	if !ok || !s.lock() {
 		return false
 	}
 
-	wrote, ok := session.Write(payload.Raw[:payload.Length])
+	wrote, ok := s.conn.(*crypto.DTLSSession).Write(payload.Raw[:payload.Length])
+	s.unlock(time.Now())
+
 	if !ok || wrote != payload.Length {
-		delete(dtls.writers[queue], mapping.Address)
+		dtls.writers[queue].remove(s)
 		return false
 	}
 
 	return true
 }
 
+// Groom reloads the DTLS certificates if they have changed, and closes the DTLS sessions with remote nodes whose certificate has been revoked, those that have gone idle, and those with remote nodes that have left the network.
+func (dtls *DTLS) Groom(now time.Time, mappings []*common.Mapping) *metric.SessionMetrics {
+	dtls.creds.refresh(dtls.Reload)
+	return groomTables(now, dtls.cfg.DTLSIdleTimeout, mappingAddresses(mappings), dtls.creds.revoked, &dtls.stats, dtls.readers, dtls.writers)
+}
+
+// Reload the DTLS certificate, key, CA and CRL files, which are used by the sessions opened afterwards.
+func (dtls *DTLS) Reload() error {
+	// The files are validated up front, so that the contexts are only touched once they are known to load.
+	if err := dtls.creds.load(); err != nil {
+		return err
+	}
+
+	contexts := [][][]*crypto.DTLSContext{dtls.servers, dtls.clients}
+	for i := 0; i < len(contexts); i++ {
+		for j := 0; j < len(contexts[i]); j++ {
+			for k := 0; k < len(contexts[i][j]); k++ {
+				if err := contexts[i][j][k].Reload(dtls.cfg.DTLSCA, dtls.cfg.DTLSCert, dtls.cfg.DTLSKey); err != nil {
+					return errors.New("error reloading the DTLS certificates: " + err.Error())
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (dtls *DTLS) handleReader(queue int, session *crypto.DTLSSession) {
-	var event syscall.EpollEvent
+	// The revocations are checked once the handshake is done, the remote node only ever sees its session closed.
+	serial, peer, ok := dtls.creds.check(session.PeerCertificate())
+	if !ok {
+		atomic.AddUint64(&dtls.stats.handshakeFailures, 1)
+		session.Close()
+		return
+	}
 
-	event.Events = syscall.EPOLLIN
-	event.Fd = int32(session.Fd)
+	fd := int32(session.Fd)
+	key := strconv.Itoa(session.Fd)
 
-	syscall.EpollCtl(dtls.pollFds[queue], syscall.EPOLL_CTL_ADD, session.Fd, &event)
+	var remote net.IP
+	if sa, err := syscall.Getpeername(session.Fd); err == nil {
+		ip, port := common.ParseSockaddr(sa)
+		remote, key = ip, net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+
+	s := newSession(key, fd, remote, session, func() {
+		syscall.EpollCtl(dtls.pollFds[queue], syscall.EPOLL_CTL_DEL, session.Fd, &syscall.EpollEvent{})
+		session.Close()
+	}, time.Now())
+	s.serial, s.peer = serial, peer
+
+	// The session is added before it is registered, so that the worker never sees an event for a session it can't find.
+	dtls.readers[queue].add(s)
 
-	dtls.readers[queue][event.Fd] = session
+	event := syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     fd,
+	}
+	if err := syscall.EpollCtl(dtls.pollFds[queue], syscall.EPOLL_CTL_ADD, session.Fd, &event); err != nil {
+		dtls.readers[queue].remove(s)
+	}
 }
 
-func (dtls *DTLS) getWriter(queue int, mapping *common.Mapping) (*crypto.DTLSSession, bool) {
-	if session, ok := dtls.writers[queue][mapping.Address]; ok {
-		return session, ok
+func (dtls *DTLS) getWriter(queue int, mapping *common.Mapping) (*session, bool) {
+	table := dtls.writers[queue]
+	if s, ok := table.get(mapping.Address); ok {
+		return s, ok
 	}
 
 	dtls.mux.Lock()
 	defer dtls.mux.Unlock()
 
-	if session, ok := dtls.writers[queue][mapping.Address]; ok {
-		return session, ok
+	if s, ok := table.get(mapping.Address); ok {
+		return s, ok
 	}
 
-	session, err := dtls.clients[queue].Connect(mapping.Address, mapping.Port)
+	now := time.Now()
+	if !table.ready(mapping.Address, now) {
+		return nil, false
+	}
+
+	remote := net.ParseIP(mapping.Address)
+	addrFamily := syscall.AF_INET6
+	if remote.To4() != nil {
+		addrFamily = syscall.AF_INET
+	}
+
+	var client *crypto.DTLSContext
+	for i := 0; i < len(dtls.cfg.ListenAddrs); i++ {
+		if family(dtls.cfg.ListenAddrs[i]) == addrFamily {
+			client = dtls.clients[queue][i]
+		}
+	}
+	if client == nil {
+		return nil, false
+	}
+
+	session, err := client.Connect(mapping.Address, mapping.Port)
 	if err != nil {
+		dtls.cfg.Log.Debug.Println("[DTLS]", "Error connecting to", mapping.Address+":", err.Error())
+		table.failed(mapping.Address, now)
 		return nil, false
 	}
 
-	dtls.writers[queue][mapping.Address] = session
-	return session, true
+	serial, peer, ok := dtls.creds.check(session.PeerCertificate())
+	if !ok || !peer.Matches(mapping) {
+		err = errRevokedCertificate
+		if ok {
+			err = errIdentityMismatch
+		}
+		dtls.cfg.Log.Debug.Println("[DTLS]", "Error connecting to", mapping.Address+":", err.Error())
+		session.Close()
+		table.failed(mapping.Address, now)
+		return nil, false
+	}
+	table.succeeded(mapping.Address)
+
+	s := newSession(mapping.Address, -1, remote, session, session.Close, now)
+	s.serial, s.peer = serial, peer
+	table.add(s)
+	return s, true
 }
 
-func (dtls *DTLS) accept(queue int) {
-	for !dtls.stop {
-		session, err := dtls.servers[queue].Accept()
-		if err != nil {
+func (dtls *DTLS) accept(queue int, server *crypto.DTLSContext) {
+	defer dtls.accepts.Done()
+
+	var backoff time.Duration
+	for {
+		session, err := server.Accept()
+
+		select {
+		case <-dtls.stop:
+			if err == nil {
+				session.Close()
+			}
+			return
+		default:
+		}
+
+		if err == nil {
+			backoff = 0
+			dtls.handleReader(queue, session)
 			continue
 		}
 
-		dtls.handleReader(queue, session)
+		atomic.AddUint64(&dtls.stats.handshakeFailures, 1)
+
+		switch {
+		case backoff == 0:
+			backoff = minAcceptBackoff
+		case backoff < maxAcceptBackoff:
+			backoff *= 2
+		}
+
+		select {
+		case <-dtls.stop:
+			return
+		case <-time.After(backoff):
+		}
 	}
 }
 
@@ -172,45 +320,56 @@ func newDTLS(cfg *common.Config) (*DTLS, error) {
 
 	dtls := &DTLS{
 		cfg:     cfg,
-		stop:    false,
-		queues:  make([]int, cfg.NumWorkers),
+		stop:    make(chan struct{}),
 		pollFds: make([]int, cfg.NumWorkers),
 		events:  make([][]syscall.EpollEvent, cfg.NumWorkers),
-		servers: make([]*crypto.DTLSContext, cfg.NumWorkers),
-		clients: make([]*crypto.DTLSContext, cfg.NumWorkers),
-		writers: make([]map[string]*crypto.DTLSSession, cfg.NumWorkers),
-		readers: make([]map[int32]*crypto.DTLSSession, cfg.NumWorkers),
+		servers: make([][]*crypto.DTLSContext, cfg.NumWorkers),
+		clients: make([][]*crypto.DTLSContext, cfg.NumWorkers),
+		writers: make([]*sessionTable, cfg.NumWorkers),
+		readers: make([]*sessionTable, cfg.NumWorkers),
+	}
+
+	for i := 0; i < cfg.NumWorkers; i++ {
+		dtls.writers[i] = newSessionTable(cfg.DTLSMaxSessions, &dtls.stats)
+		dtls.readers[i] = newSessionTable(cfg.DTLSMaxSessions, &dtls.stats)
 	}
 
+	creds, err := newCredentials(cfg)
+	if err != nil {
+		return dtls, err
+	}
+	dtls.creds = creds
+
+	sockets, err := createUDPSockets(cfg)
+	if err != nil {
+		return dtls, errors.New("error creating the DTLS socket: " + err.Error())
+	}
+
+	dtls.queues = flatten(sockets)
+
 	for i := 0; i < dtls.cfg.NumWorkers; i++ {
-		var queue int
-		var err error
+		dtls.servers[i] = make([]*crypto.DTLSContext, len(cfg.ListenAddrs))
+		dtls.clients[i] = make([]*crypto.DTLSContext, len(cfg.ListenAddrs))
 
-		if !dtls.cfg.ReuseFDS {
-			queue, err = createUDPSocket(dtls.cfg.IsIPv6Enabled, dtls.cfg.ListenAddr)
+		for j := 0; j < len(cfg.ListenAddrs); j++ {
+			ip, port := common.ParseSockaddr(cfg.ListenAddrs[j])
+			useV6 := family(cfg.ListenAddrs[j]) == syscall.AF_INET6
+
+			server, err := crypto.NewServerDTLSContext(sockets[i][j], ip.String(), port, useV6, !cfg.DTLSSkipVerify, cfg.DTLSCA, cfg.DTLSCert, cfg.DTLSKey)
 			if err != nil {
-				return dtls, errors.New("error creating the DTLS socket: " + err.Error())
+				return dtls, err
 			}
-		} else {
-			queue = 3 + dtls.cfg.NumWorkers + i
-		}
-
-		dtls.queues[i] = queue
 
-		server, err := crypto.NewServerDTLSContext(queue, cfg.ListenIP.String(), cfg.ListenPort, cfg.IsIPv6Enabled, !cfg.DTLSSkipVerify, cfg.DTLSCA, cfg.DTLSCert, cfg.DTLSKey)
-		if err != nil {
-			return dtls, err
-		}
+			dtls.servers[i][j] = server
 
-		dtls.servers[i] = server
+			client, err := crypto.NewClientDTLSContext(ip.String(), useV6, !cfg.DTLSSkipVerify, cfg.DTLSCA, cfg.DTLSCert, cfg.DTLSKey)
+			if err != nil {
+				return dtls, err
+			}
 
-		client, err := crypto.NewClientDTLSContext(cfg.ListenIP.String(), cfg.IsIPv6Enabled, !cfg.DTLSSkipVerify, cfg.DTLSCA, cfg.DTLSCert, cfg.DTLSKey)
-		if err != nil {
-			return dtls, err
+			dtls.clients[i][j] = client
 		}
 
-		dtls.clients[i] = client
-
 		pollFd, err := syscall.EpollCreate1(0)
 		if err != nil {
 			return dtls, errors.New("Error creating epoll file descriptor: " + err.Error())
@@ -219,10 +378,10 @@ func newDTLS(cfg *common.Config) (*DTLS, error) {
 		dtls.pollFds[i] = pollFd
 		dtls.events[i] = make([]syscall.EpollEvent, 1)
 
-		dtls.writers[i] = make(map[string]*crypto.DTLSSession)
-		dtls.readers[i] = make(map[int32]*crypto.DTLSSession)
-
-		go dtls.accept(i)
+		for j := 0; j < len(dtls.servers[i]); j++ {
+			dtls.accepts.Add(1)
+			go dtls.accept(i, dtls.servers[i][j])
+		}
 	}
 
 	return dtls, nil
@@ -0,0 +1,17 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+//go:build !cgo
+// +build !cgo
+
+package socket
+
+import (
+	"errors"
+
+	"github.com/supernomad/quantum/common"
+)
+
+func newDTLS(cfg *common.Config) (Socket, error) {
+	return nil, errors.New("the openssl DTLS provider requires cgo, use the '" + common.GoDTLSProvider + "' DTLS provider instead")
+}
@@ -0,0 +1,553 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package socket
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
+)
+
+const (
+	goDTLSReceiveBuffer = 8192
+	goDTLSQueueLength   = 1024
+)
+
+// goDTLSCipherSuites are the cipher suites offered and accepted by the pure go DTLS socket, the first one matches the suite preferred by the openssl based DTLS socket.
+var goDTLSCipherSuites = []dtls.CipherSuiteID{
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+}
+
+// goDTLSDatagram is a packet received over a server session, along with the identity of the remote node that sent it.
+type goDTLSDatagram struct {
+	data []byte
+	peer *common.PeerIdentity
+}
+
+// GoDTLS socket struct for managing a multi-queue DTLS socket implemented in pure go, which interoperates with the openssl based DTLS socket.
+//
+// Just like the openssl based socket, sessions are one directional. Datagrams arriving on the queue sockets are handed to a server session per remote address, while packets are written over client sessions dialed from an ephemeral port.
+type GoDTLS struct {
+	cfg       *common.Config
+	queues    []int
+	files     [][]*os.File
+	listeners [][]*goDTLSListener
+	creds     *credentials
+	configMux sync.RWMutex
+	server    *dtls.Config
+	client    *dtls.Config
+	stop      chan struct{}
+	buffers   sync.Pool
+	received  []chan goDTLSDatagram
+	mux       sync.Mutex
+	stats     sessionStats
+	writers   []*sessionTable
+	readers   []*sessionTable
+}
+
+// Close the GoDTLS socket and removes associated network configuration.
+func (gd *GoDTLS) Close() error {
+	close(gd.stop)
+
+	for i := 0; i < len(gd.listeners); i++ {
+		for j := 0; j < len(gd.listeners[i]); j++ {
+			gd.listeners[i][j].close()
+		}
+	}
+
+	for i := 0; i < len(gd.writers); i++ {
+		gd.writers[i].close()
+	}
+	for i := 0; i < len(gd.readers); i++ {
+		gd.readers[i].close()
+	}
+
+	for i := 0; i < len(gd.files); i++ {
+		for j := 0; j < len(gd.files[i]); j++ {
+			if err := gd.files[i][j].Close(); err != nil {
+				return errors.New("error closing the socket queues: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Queues will return the underlying GoDTLS socket file descriptors.
+func (gd *GoDTLS) Queues() []int {
+	return gd.queues
+}
+
+// Read a packet off the specified GoDTLS socket queue and return a *common.Payload representation of the packet.
+func (gd *GoDTLS) Read(queue int, buf []byte) (*common.Payload, bool) {
+	var datagram goDTLSDatagram
+	select {
+	case <-gd.stop:
+		return nil, false
+	case datagram = <-gd.received[queue]:
+	}
+
+	read := copy(buf, datagram.data)
+	gd.buffers.Put(datagram.data[:cap(datagram.data)])
+
+	// DTLS sessions are bound to the address they were established with, so there is no source address to report alongside the payload.
+	payload := common.NewSockPayload(buf, read)
+	payload.Authenticated = true
+	payload.Peer = datagram.peer
+	return payload, true
+}
+
+// Write a *common.Payload to the specified GoDTLS socket queue.
+func (gd *GoDTLS) Write(queue int, payload *common.Payload, mapping *common.Mapping) bool {
+	s, ok := gd.getWriter(queue, mapping)
+	if !ok || !s.lock() {
+		return false
+	}
+
+	wrote, err := s.conn.(*dtls.Conn).Write(payload.Raw[:payload.Length])
+	s.unlock(time.Now())
+
+	if err != nil || wrote != payload.Length {
+		gd.writers[queue].remove(s)
+		return false
+	}
+
+	return true
+}
+
+// Groom reloads the DTLS certificates if they have changed, and closes the DTLS sessions with remote nodes whose certificate has been revoked, those that have gone idle, and those with remote nodes that have left the network.
+func (gd *GoDTLS) Groom(now time.Time, mappings []*common.Mapping) *metric.SessionMetrics {
+	gd.creds.refresh(gd.Reload)
+	return groomTables(now, gd.cfg.DTLSIdleTimeout, mappingAddresses(mappings), gd.creds.revoked, &gd.stats, gd.readers, gd.writers)
+}
+
+// Reload the DTLS certificate, key, CA and CRL files, which are used by the sessions opened afterwards.
+func (gd *GoDTLS) Reload() error {
+	if err := gd.creds.load(); err != nil {
+		return err
+	}
+
+	server, client := newGoDTLSConfigs(gd.cfg, gd.creds)
+
+	gd.configMux.Lock()
+	gd.server, gd.client = server, client
+	gd.configMux.Unlock()
+	return nil
+}
+
+func (gd *GoDTLS) configs() (*dtls.Config, *dtls.Config) {
+	gd.configMux.RLock()
+	defer gd.configMux.RUnlock()
+
+	return gd.server, gd.client
+}
+
+// identify returns the serial number and identity of the certificate presented by the remote node, the certificate itself was already checked during the handshake.
+func (gd *GoDTLS) identify(session *dtls.Conn) (string, *common.PeerIdentity) {
+	certs := session.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", nil
+	}
+
+	serial, peer, _ := gd.creds.check(certs[0])
+	return serial, peer
+}
+
+func (gd *GoDTLS) getWriter(queue int, mapping *common.Mapping) (*session, bool) {
+	table := gd.writers[queue]
+	if s, ok := table.get(mapping.Address); ok {
+		return s, ok
+	}
+
+	gd.mux.Lock()
+	defer gd.mux.Unlock()
+
+	if s, ok := table.get(mapping.Address); ok {
+		return s, ok
+	}
+
+	now := time.Now()
+	if !table.ready(mapping.Address, now) {
+		return nil, false
+	}
+
+	remote := net.ParseIP(mapping.Address)
+	if remote == nil {
+		return nil, false
+	}
+
+	var local net.IP
+	for i := 0; i < len(gd.cfg.ListenAddrs); i++ {
+		ip, _ := common.ParseSockaddr(gd.cfg.ListenAddrs[i])
+		if (ip.To4() != nil) == (remote.To4() != nil) {
+			local = ip
+		}
+	}
+	if local == nil {
+		return nil, false
+	}
+
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: local}, &net.UDPAddr{IP: remote, Port: mapping.Port})
+	if err != nil {
+		return nil, false
+	}
+
+	_, client := gd.configs()
+	session, err := dtls.Client(conn, client)
+	if err != nil {
+		gd.cfg.Log.Debug.Println("[DTLS]", "Error connecting to", mapping.Address+":", err.Error())
+		conn.Close()
+		table.failed(mapping.Address, now)
+		return nil, false
+	}
+
+	serial, peer := gd.identify(session)
+	if !peer.Matches(mapping) {
+		gd.cfg.Log.Debug.Println("[DTLS]", "Error connecting to", mapping.Address+":", errIdentityMismatch.Error())
+		session.Close()
+		table.failed(mapping.Address, now)
+		return nil, false
+	}
+	table.succeeded(mapping.Address)
+
+	s := newSession(mapping.Address, -1, remote, session, func() { session.Close() }, now)
+	s.serial, s.peer = serial, peer
+	table.add(s)
+	return s, true
+}
+
+// serve runs the server side of the handshake with a remote client, and then hands the packets it sends over to the queue.
+func (gd *GoDTLS) serve(queue int, peer *goDTLSPeer) {
+	server, _ := gd.configs()
+	session, err := dtls.Server(peer, server)
+	if err != nil {
+		atomic.AddUint64(&gd.stats.handshakeFailures, 1)
+		peer.Close()
+		return
+	}
+
+	s := newSession(peer.addr.String(), -1, peer.addr.IP, session, func() { session.Close() }, time.Now())
+	s.serial, s.peer = gd.identify(session)
+	gd.readers[queue].add(s)
+	defer gd.readers[queue].remove(s)
+
+	for {
+		buf := gd.buffers.Get().([]byte)
+		read, err := session.Read(buf)
+		if err != nil {
+			gd.buffers.Put(buf)
+			return
+		}
+		s.touch(time.Now())
+
+		select {
+		case <-gd.stop:
+			gd.buffers.Put(buf)
+			return
+		case gd.received[queue] <- goDTLSDatagram{data: buf[:read], peer: s.peer}:
+		}
+	}
+}
+
+// goDTLSListener demultiplexes the datagrams arriving on a queue socket into a goDTLSPeer per remote address.
+type goDTLSListener struct {
+	conn  *net.UDPConn
+	max   int
+	mux   sync.Mutex
+	peers map[string]*goDTLSPeer
+}
+
+func (listener *goDTLSListener) listen(accept func(peer *goDTLSPeer)) {
+	buf := make([]byte, goDTLSReceiveBuffer)
+	for {
+		read, addr, err := listener.conn.ReadFromUDP(buf)
+		if err != nil {
+			// There are no deadlines on the queue sockets, so this only happens once the socket is closed.
+			return
+		}
+
+		key := addr.String()
+
+		listener.mux.Lock()
+		peer, ok := listener.peers[key]
+		if !ok && listener.max > 0 && len(listener.peers) >= listener.max {
+			// Ignore new remote addresses until room frees up, just like a full socket buffer would.
+			listener.mux.Unlock()
+			continue
+		}
+		if !ok {
+			peer = newGoDTLSPeer(listener, addr)
+			listener.peers[key] = peer
+		}
+		listener.mux.Unlock()
+
+		if !ok {
+			go accept(peer)
+		}
+
+		data := make([]byte, read)
+		copy(data, buf[:read])
+		peer.deliver(data)
+	}
+}
+
+func (listener *goDTLSListener) remove(peer *goDTLSPeer) {
+	listener.mux.Lock()
+	defer listener.mux.Unlock()
+
+	key := peer.addr.String()
+	if listener.peers[key] == peer {
+		delete(listener.peers, key)
+	}
+}
+
+func (listener *goDTLSListener) close() {
+	listener.conn.Close()
+
+	listener.mux.Lock()
+	peers := make([]*goDTLSPeer, 0, len(listener.peers))
+	for _, peer := range listener.peers {
+		peers = append(peers, peer)
+	}
+	listener.mux.Unlock()
+
+	for i := 0; i < len(peers); i++ {
+		peers[i].Close()
+	}
+}
+
+// goDTLSPeer is a net.Conn carrying the datagrams exchanged with a single remote address over a shared queue socket.
+type goDTLSPeer struct {
+	listener *goDTLSListener
+	addr     *net.UDPAddr
+	incoming chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	mux      sync.Mutex
+	deadline time.Time
+	changed  chan struct{}
+}
+
+type goDTLSTimeout struct{}
+
+func (goDTLSTimeout) Error() string   { return "i/o timeout" }
+func (goDTLSTimeout) Timeout() bool   { return true }
+func (goDTLSTimeout) Temporary() bool { return true }
+
+func (peer *goDTLSPeer) deliver(data []byte) {
+	select {
+	case peer.incoming <- data:
+	case <-peer.closed:
+	default:
+		// The session isn't keeping up, so drop the datagram just like a full socket buffer would.
+	}
+}
+
+// Read the next datagram sent by the remote address, honoring the read deadline.
+func (peer *goDTLSPeer) Read(b []byte) (int, error) {
+	for {
+		peer.mux.Lock()
+		deadline, changed := peer.deadline, peer.changed
+		peer.mux.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, goDTLSTimeout{}
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		read, err, done := 0, error(nil), true
+		select {
+		case data := <-peer.incoming:
+			read = copy(b, data)
+		case <-peer.closed:
+			err = io.EOF
+		case <-timeout:
+			err = goDTLSTimeout{}
+		case <-changed:
+			done = false
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return read, err
+		}
+	}
+}
+
+// Write a datagram to the remote address over the shared queue socket.
+func (peer *goDTLSPeer) Write(b []byte) (int, error) {
+	select {
+	case <-peer.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return peer.listener.conn.WriteToUDP(b, peer.addr)
+}
+
+// Close the peer, which leaves the shared queue socket open.
+func (peer *goDTLSPeer) Close() error {
+	peer.once.Do(func() {
+		close(peer.closed)
+		peer.listener.remove(peer)
+	})
+	return nil
+}
+
+// LocalAddr returns the address of the shared queue socket.
+func (peer *goDTLSPeer) LocalAddr() net.Addr {
+	return peer.listener.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the remote client.
+func (peer *goDTLSPeer) RemoteAddr() net.Addr {
+	return peer.addr
+}
+
+// SetDeadline sets the read deadline, writes never block.
+func (peer *goDTLSPeer) SetDeadline(t time.Time) error {
+	return peer.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for pending and future reads.
+func (peer *goDTLSPeer) SetReadDeadline(t time.Time) error {
+	peer.mux.Lock()
+	defer peer.mux.Unlock()
+
+	peer.deadline = t
+	close(peer.changed)
+	peer.changed = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a noop, writes never block.
+func (peer *goDTLSPeer) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func newGoDTLSPeer(listener *goDTLSListener, addr *net.UDPAddr) *goDTLSPeer {
+	return &goDTLSPeer{
+		listener: listener,
+		addr:     addr,
+		incoming: make(chan []byte, goDTLSQueueLength),
+		closed:   make(chan struct{}),
+		changed:  make(chan struct{}),
+	}
+}
+
+// newGoDTLSConfigs returns the server and client configurations built from the loaded credentials, using the same verification settings as the openssl based DTLS socket. Certificates must use ECDSA keys on the P-256 or P-384 curves, openssl refuses to use certificates on other curves with clients that can't advertise them.
+func newGoDTLSConfigs(cfg *common.Config, creds *credentials) (*dtls.Config, *dtls.Config) {
+	cert, pool := creds.snapshot()
+
+	server := &dtls.Config{
+		Certificates:          []tls.Certificate{cert},
+		CipherSuites:          goDTLSCipherSuites,
+		ExtendedMasterSecret:  dtls.RequestExtendedMasterSecret,
+		ClientAuth:            dtls.RequireAndVerifyClientCert,
+		ClientCAs:             pool,
+		VerifyPeerCertificate: creds.verifyPeer,
+	}
+	if cfg.DTLSSkipVerify {
+		server.ClientAuth = dtls.NoClientCert
+	}
+
+	// Only the certificate chain is verified, matching the openssl based socket which connects by address rather than host name.
+	client := &dtls.Config{
+		Certificates:          []tls.Certificate{cert},
+		CipherSuites:          goDTLSCipherSuites,
+		ExtendedMasterSecret:  dtls.RequestExtendedMasterSecret,
+		RootCAs:               pool,
+		InsecureSkipVerify:    cfg.DTLSSkipVerify,
+		VerifyPeerCertificate: creds.verifyPeer,
+	}
+
+	return server, client
+}
+
+func newGoDTLS(cfg *common.Config) (*GoDTLS, error) {
+	gd := &GoDTLS{
+		cfg:       cfg,
+		stop:      make(chan struct{}),
+		files:     make([][]*os.File, cfg.NumWorkers),
+		listeners: make([][]*goDTLSListener, cfg.NumWorkers),
+		received:  make([]chan goDTLSDatagram, cfg.NumWorkers),
+		writers:   make([]*sessionTable, cfg.NumWorkers),
+		readers:   make([]*sessionTable, cfg.NumWorkers),
+		buffers: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, goDTLSReceiveBuffer)
+			},
+		},
+	}
+
+	creds, err := newCredentials(cfg)
+	if err != nil {
+		return gd, err
+	}
+	gd.creds = creds
+	gd.server, gd.client = newGoDTLSConfigs(cfg, creds)
+
+	sockets, err := createUDPSockets(cfg)
+	if err != nil {
+		return gd, errors.New("error creating the DTLS socket: " + err.Error())
+	}
+
+	gd.queues = flatten(sockets)
+
+	for i := 0; i < cfg.NumWorkers; i++ {
+		gd.files[i] = make([]*os.File, len(cfg.ListenAddrs))
+		gd.listeners[i] = make([]*goDTLSListener, len(cfg.ListenAddrs))
+		gd.received[i] = make(chan goDTLSDatagram, goDTLSQueueLength)
+		gd.writers[i] = newSessionTable(cfg.DTLSMaxSessions, &gd.stats)
+		gd.readers[i] = newSessionTable(cfg.DTLSMaxSessions, &gd.stats)
+
+		for j := 0; j < len(cfg.ListenAddrs); j++ {
+			// The file keeps the queue socket itself open for rolling restarts, while the packet conn works on a duplicate of it.
+			gd.files[i][j] = os.NewFile(uintptr(sockets[i][j]), "dtls")
+
+			conn, err := net.FilePacketConn(gd.files[i][j])
+			if err != nil {
+				return gd, errors.New("error creating the DTLS socket: " + err.Error())
+			}
+
+			udpConn, ok := conn.(*net.UDPConn)
+			if !ok {
+				conn.Close()
+				return gd, errors.New("error creating the DTLS socket: the queue socket is not a udp socket")
+			}
+
+			// Each listener holds at most one peer per session and pending handshake, so it is bounded at twice the session limit.
+			gd.listeners[i][j] = &goDTLSListener{
+				conn:  udpConn,
+				max:   2 * cfg.DTLSMaxSessions,
+				peers: make(map[string]*goDTLSPeer),
+			}
+		}
+	}
+
+	for i := 0; i < cfg.NumWorkers; i++ {
+		queue := i
+		for j := 0; j < len(gd.listeners[i]); j++ {
+			go gd.listeners[i][j].listen(func(peer *goDTLSPeer) { gd.serve(queue, peer) })
+		}
+	}
+
+	return gd, nil
+}
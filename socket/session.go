@@ -0,0 +1,317 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package socket
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
+)
+
+const (
+	// The backoff between handshake attempts with a remote address doubles with each consecutive failure, within these bounds.
+	minSessionBackoff = time.Second
+	maxSessionBackoff = time.Minute
+)
+
+// session is a single DTLS session held by a sessionTable, which is closed at most once and never while it is being used.
+type session struct {
+	key    string
+	fd     int32
+	remote net.IP
+	conn   interface{}
+	close  func()
+	used   int64
+
+	// The serial number of the certificate presented by the remote node, if it presented one.
+	serial string
+
+	// The identity the remote node authenticated as, if it presented a verified certificate.
+	peer *common.PeerIdentity
+
+	mux    sync.Mutex
+	closed bool
+}
+
+// lock the session for use, returning false if it has already been closed.
+func (s *session) lock() bool {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return false
+	}
+	return true
+}
+
+// unlock the session, marking it as used.
+func (s *session) unlock(now time.Time) {
+	s.touch(now)
+	s.mux.Unlock()
+}
+
+// touch marks the session as used.
+func (s *session) touch(now time.Time) {
+	atomic.StoreInt64(&s.used, now.UnixNano())
+}
+
+// shutdown closes the session once any pending use of it is done.
+func (s *session) shutdown() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		s.close()
+	}
+}
+
+func newSession(key string, fd int32, remote net.IP, conn interface{}, close func(), now time.Time) *session {
+	return &session{
+		key:    key,
+		fd:     fd,
+		remote: remote,
+		conn:   conn,
+		close:  close,
+		used:   now.UnixNano(),
+	}
+}
+
+type sessionBackoff struct {
+	failures uint
+	next     time.Time
+}
+
+// sessionStats are the counters shared by the session tables of a socket.
+type sessionStats struct {
+	handshakeFailures uint64
+	expired           uint64
+	evicted           uint64
+	removed           uint64
+	revoked           uint64
+}
+
+// sessionTable is a bounded table of the DTLS sessions of a single queue, keyed by remote address and optionally indexed by file descriptor. It also tracks the backoff between handshake attempts with each remote address.
+type sessionTable struct {
+	mux      sync.Mutex
+	max      int
+	stats    *sessionStats
+	sessions map[string]*session
+	fds      map[int32]*session
+	backoffs map[string]*sessionBackoff
+}
+
+func (table *sessionTable) get(key string) (*session, bool) {
+	table.mux.Lock()
+	defer table.mux.Unlock()
+
+	s, ok := table.sessions[key]
+	return s, ok
+}
+
+func (table *sessionTable) getFd(fd int32) (*session, bool) {
+	table.mux.Lock()
+	defer table.mux.Unlock()
+
+	s, ok := table.fds[fd]
+	return s, ok
+}
+
+func (table *sessionTable) len() int {
+	table.mux.Lock()
+	defer table.mux.Unlock()
+
+	return len(table.sessions)
+}
+
+// add the session to the table, replacing any existing session with the same key and evicting the least recently used session when the table is full. The sessions pushed out of the table are shut down.
+func (table *sessionTable) add(s *session) {
+	var closing []*session
+
+	table.mux.Lock()
+	if existing, ok := table.sessions[s.key]; ok {
+		table.delete(existing)
+		closing = append(closing, existing)
+	}
+
+	if table.max > 0 && len(table.sessions) >= table.max {
+		var oldest *session
+		for _, candidate := range table.sessions {
+			if oldest == nil || atomic.LoadInt64(&candidate.used) < atomic.LoadInt64(&oldest.used) {
+				oldest = candidate
+			}
+		}
+		table.delete(oldest)
+		closing = append(closing, oldest)
+		atomic.AddUint64(&table.stats.evicted, 1)
+	}
+
+	table.sessions[s.key] = s
+	if s.fd >= 0 {
+		table.fds[s.fd] = s
+	}
+	table.mux.Unlock()
+
+	for i := 0; i < len(closing); i++ {
+		closing[i].shutdown()
+	}
+}
+
+// remove the session from the table and shut it down.
+func (table *sessionTable) remove(s *session) {
+	table.mux.Lock()
+	if table.sessions[s.key] == s {
+		table.delete(s)
+	}
+	table.mux.Unlock()
+
+	s.shutdown()
+}
+
+// delete must be called with the table locked.
+func (table *sessionTable) delete(s *session) {
+	delete(table.sessions, s.key)
+	if s.fd >= 0 && table.fds[s.fd] == s {
+		delete(table.fds, s.fd)
+	}
+}
+
+// groom shuts down the sessions with remote nodes whose certificate has been revoked, unless revoked is nil, those that have been idle since before the cutoff, and those whose remote address isn't one of the supplied addresses, unless addresses is nil. Backoffs are forgotten once they have long passed.
+func (table *sessionTable) groom(now, cutoff time.Time, addresses map[string]bool, revoked func(serial string) bool) {
+	var closing []*session
+
+	table.mux.Lock()
+	for _, s := range table.sessions {
+		switch {
+		case revoked != nil && s.serial != "" && revoked(s.serial):
+			atomic.AddUint64(&table.stats.revoked, 1)
+		case !cutoff.IsZero() && atomic.LoadInt64(&s.used) < cutoff.UnixNano():
+			atomic.AddUint64(&table.stats.expired, 1)
+		case addresses != nil && !addresses[s.remote.String()]:
+			atomic.AddUint64(&table.stats.removed, 1)
+		default:
+			continue
+		}
+		table.delete(s)
+		closing = append(closing, s)
+	}
+
+	for key, backoff := range table.backoffs {
+		if addresses != nil && !addresses[key] || backoff.next.Before(now.Add(-maxSessionBackoff)) {
+			delete(table.backoffs, key)
+		}
+	}
+	table.mux.Unlock()
+
+	for i := 0; i < len(closing); i++ {
+		closing[i].shutdown()
+	}
+}
+
+// ready returns whether or not a handshake with the remote address may be attempted.
+func (table *sessionTable) ready(key string, now time.Time) bool {
+	table.mux.Lock()
+	defer table.mux.Unlock()
+
+	backoff, ok := table.backoffs[key]
+	return !ok || !now.Before(backoff.next)
+}
+
+// failed records a failed handshake with the remote address, doubling the time before the next attempt.
+func (table *sessionTable) failed(key string, now time.Time) {
+	atomic.AddUint64(&table.stats.handshakeFailures, 1)
+
+	table.mux.Lock()
+	defer table.mux.Unlock()
+
+	backoff, ok := table.backoffs[key]
+	if !ok {
+		backoff = &sessionBackoff{}
+		table.backoffs[key] = backoff
+	}
+
+	wait := maxSessionBackoff
+	if backoff.failures < 6 {
+		wait = minSessionBackoff << backoff.failures
+	}
+	backoff.failures++
+	backoff.next = now.Add(wait)
+}
+
+// succeeded clears the backoff of the remote address after a successful handshake.
+func (table *sessionTable) succeeded(key string) {
+	table.mux.Lock()
+	defer table.mux.Unlock()
+
+	delete(table.backoffs, key)
+}
+
+// close shuts down every session in the table.
+func (table *sessionTable) close() {
+	table.mux.Lock()
+	closing := make([]*session, 0, len(table.sessions))
+	for _, s := range table.sessions {
+		closing = append(closing, s)
+	}
+	table.sessions = make(map[string]*session)
+	table.fds = make(map[int32]*session)
+	table.mux.Unlock()
+
+	for i := 0; i < len(closing); i++ {
+		closing[i].shutdown()
+	}
+}
+
+func newSessionTable(max int, stats *sessionStats) *sessionTable {
+	return &sessionTable{
+		max:      max,
+		stats:    stats,
+		sessions: make(map[string]*session),
+		fds:      make(map[int32]*session),
+		backoffs: make(map[string]*sessionBackoff),
+	}
+}
+
+// mappingAddresses returns the set of addresses the supplied mappings can be reached at, as written in the mappings and in canonical form.
+func mappingAddresses(mappings []*common.Mapping) map[string]bool {
+	addresses := make(map[string]bool)
+	for i := 0; i < len(mappings); i++ {
+		ips := []net.IP{mappings[i].IPv4, mappings[i].IPv6, mappings[i].ReflexiveIP, net.ParseIP(mappings[i].Address)}
+		for j := 0; j < len(ips); j++ {
+			if ips[j] != nil {
+				addresses[ips[j].String()] = true
+			}
+		}
+		if mappings[i].Address != "" {
+			addresses[mappings[i].Address] = true
+		}
+	}
+	return addresses
+}
+
+// groomTables grooms the supplied tables and returns the resulting session statistics.
+func groomTables(now time.Time, idle time.Duration, addresses map[string]bool, revoked func(serial string) bool, stats *sessionStats, tables ...[]*sessionTable) *metric.SessionMetrics {
+	var cutoff time.Time
+	if idle > 0 {
+		cutoff = now.Add(-idle)
+	}
+
+	metrics := &metric.SessionMetrics{}
+	for i := 0; i < len(tables); i++ {
+		for j := 0; j < len(tables[i]); j++ {
+			tables[i][j].groom(now, cutoff, addresses, revoked)
+			metrics.Sessions += uint64(tables[i][j].len())
+		}
+	}
+
+	metrics.HandshakeFailures = atomic.LoadUint64(&stats.handshakeFailures)
+	metrics.Expired = atomic.LoadUint64(&stats.expired)
+	metrics.Evicted = atomic.LoadUint64(&stats.evicted)
+	metrics.Removed = atomic.LoadUint64(&stats.removed)
+	metrics.Revoked = atomic.LoadUint64(&stats.revoked)
+	return metrics
+}
@@ -6,8 +6,10 @@ package socket
 import (
 	"errors"
 	"syscall"
+	"time"
 
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
 )
 
 const (
@@ -36,12 +38,27 @@ type Socket interface {
 	Queues() []int
 }
 
+// Groomer interface for sockets which hold sessions with remote nodes, that need to be cleaned up periodically.
+type Groomer interface {
+	// Groom should close the sessions that have gone idle and those with remote nodes that are no longer part of the supplied mappings, and return the current statistics of the sessions.
+	Groom(now time.Time, mappings []*common.Mapping) *metric.SessionMetrics
+}
+
+// Backlogger interface for sockets which can tell whether packets are waiting to be read, which lets devices coalescing the packets written to them hold packets back for the rest of a burst.
+type Backlogger interface {
+	// Backlogged should return true if packets are waiting to be read off the specified socket queue.
+	Backlogged(queue int) bool
+}
+
 // New generates a socket based on the supplied type and configuration.
 func New(socketType string, cfg *common.Config) (Socket, error) {
 	switch socketType {
 	case UDPSocket:
 		return newUDP(cfg)
 	case DTLSSocket:
+		if cfg.DTLSProvider == common.GoDTLSProvider {
+			return newGoDTLS(cfg)
+		}
 		return newDTLS(cfg)
 	case MOCKSocket:
 		return newMock(cfg)
@@ -49,12 +66,16 @@ func New(socketType string, cfg *common.Config) (Socket, error) {
 	return nil, errors.New("build error socket type undefined")
 }
 
-func createUDPSocket(ipv6Enabled bool, sa syscall.Sockaddr) (int, error) {
-	// Grab the correct socket family.
-	family := syscall.AF_INET
-	if ipv6Enabled {
-		family = syscall.AF_INET6
+func family(sa syscall.Sockaddr) int {
+	if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		return syscall.AF_INET6
 	}
+	return syscall.AF_INET
+}
+
+func createUDPSocket(sa syscall.Sockaddr) (int, error) {
+	// Grab the correct socket family.
+	family := family(sa)
 
 	// Create the socket.
 	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, 0)
@@ -68,6 +89,14 @@ func createUDPSocket(ipv6Enabled bool, sa syscall.Sockaddr) (int, error) {
 		return -1, errors.New("error setting the UDP socket parameters: " + err.Error())
 	}
 
+	// Keep ipv6 sockets to ipv6 traffic only, so that an ipv4 socket can be bound to the same port alongside it.
+	if family == syscall.AF_INET6 {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+		if err != nil {
+			return -1, errors.New("error setting the UDP socket parameters: " + err.Error())
+		}
+	}
+
 	// Bind the newly created and configured socket.
 	err = syscall.Bind(fd, sa)
 	if err != nil {
@@ -76,3 +105,36 @@ func createUDPSocket(ipv6Enabled bool, sa syscall.Sockaddr) (int, error) {
 
 	return fd, nil
 }
+
+// createUDPSockets returns a udp socket per configured listen address for each queue, indexed by queue and then by listen address.
+func createUDPSockets(cfg *common.Config) ([][]int, error) {
+	sockets := make([][]int, cfg.NumWorkers)
+	for i := 0; i < cfg.NumWorkers; i++ {
+		sockets[i] = make([]int, len(cfg.ListenAddrs))
+		for j := 0; j < len(cfg.ListenAddrs); j++ {
+			if cfg.ReuseFDS {
+				// During a rolling restart the tun queues are passed in first, followed by the sockets of each listen address in turn.
+				sockets[i][j] = 3 + cfg.NumWorkers*(j+1) + i
+				continue
+			}
+
+			fd, err := createUDPSocket(cfg.ListenAddrs[j])
+			if err != nil {
+				return sockets, err
+			}
+			sockets[i][j] = fd
+		}
+	}
+	return sockets, nil
+}
+
+// flatten returns the sockets in the order they are passed along during a rolling restart.
+func flatten(sockets [][]int) []int {
+	var queues []int
+	for j := 0; len(sockets) > 0 && j < len(sockets[0]); j++ {
+		for i := 0; i < len(sockets); i++ {
+			queues = append(queues, sockets[i][j])
+		}
+	}
+	return queues
+}
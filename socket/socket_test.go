@@ -4,9 +4,15 @@
 package socket
 
 import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/supernomad/quantum/common"
 )
@@ -17,8 +23,34 @@ const (
 	serverKeyFile  = "../dist/ssl/keys/ec-server.key"
 	clientCertFile = "../dist/ssl/certs/ec-client.crt"
 	clientKeyFile  = "../dist/ssl/keys/ec-client.key"
+
+	revokedCertFile = "../dist/ssl/certs/ec-revoked.crt"
+	revokedKeyFile  = "../dist/ssl/keys/ec-revoked.key"
+	crlFile         = "../dist/ssl/certs/ec-ca.crl"
+
+	machineCertFile = "../dist/ssl/certs/ec-machine.crt"
+	machineKeyFile  = "../dist/ssl/keys/ec-machine.key"
+	machineID       = "0123456789abcdef"
 )
 
+func testCertificate(t *testing.T, file string) *x509.Certificate {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read the certificate: %s", err.Error())
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("Failed to decode the certificate.")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse the certificate: %s", err.Error())
+	}
+	return cert
+}
+
 func TestMock(t *testing.T) {
 	mock, _ := New(MOCKSocket, &common.Config{})
 	buf := make([]byte, common.MaxPacketLength)
@@ -55,7 +87,7 @@ func testUDPEndToEndV4(t *testing.T) {
 		NumWorkers:    1,
 		ReuseFDS:      false,
 		IsIPv6Enabled: false,
-		ListenAddr:    clientSa,
+		ListenAddrs:   []syscall.Sockaddr{clientSa},
 	})
 	if err != nil {
 		t.Fatalf("Failed to generate client UDP socket: %s", err.Error())
@@ -78,7 +110,7 @@ func testUDPEndToEndV4(t *testing.T) {
 		NumWorkers:    1,
 		ReuseFDS:      false,
 		IsIPv6Enabled: false,
-		ListenAddr:    serverSa,
+		ListenAddrs:   []syscall.Sockaddr{serverSa},
 	})
 	if err != nil {
 		t.Fatalf("Failed to generate server UDP socket: %s", err.Error())
@@ -176,7 +208,7 @@ func testUDPEndToEndV6(t *testing.T) {
 		NumWorkers:    1,
 		ReuseFDS:      false,
 		IsIPv6Enabled: true,
-		ListenAddr:    clientSa,
+		ListenAddrs:   []syscall.Sockaddr{clientSa},
 	})
 	if err != nil {
 		t.Fatalf("Failed to generate client UDP socket: %s", err.Error())
@@ -199,7 +231,7 @@ func testUDPEndToEndV6(t *testing.T) {
 		NumWorkers:    1,
 		ReuseFDS:      false,
 		IsIPv6Enabled: true,
-		ListenAddr:    serverSa,
+		ListenAddrs:   []syscall.Sockaddr{serverSa},
 	})
 	if err != nil {
 		t.Fatalf("Failed to generate server UDP socket: %s", err.Error())
@@ -283,294 +315,676 @@ func testUDPEndToEndV6(t *testing.T) {
 	server.Close()
 }
 
+func testUDPDualStack(t *testing.T) {
+	v4Sa := &syscall.SockaddrInet4{Port: 9997}
+	copy(v4Sa.Addr[:], net.ParseIP("127.0.0.1").To4())
+
+	v6Sa := &syscall.SockaddrInet6{Port: 9997}
+	copy(v6Sa.Addr[:], net.ParseIP("::1").To16())
+
+	server, err := New(UDPSocket, &common.Config{
+		NumWorkers:  1,
+		ListenAddrs: []syscall.Sockaddr{v6Sa, v4Sa},
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate dual stack UDP socket: %s", err.Error())
+	}
+	defer server.Close()
+
+	if len(server.Queues()) != 2 {
+		t.Fatal("Failed to generate dual stack UDP socket: a socket per address family was not created")
+	}
+
+	for _, sa := range []syscall.Sockaddr{v4Sa, v6Sa} {
+		sendbuf := []byte("hello")
+		if !server.Write(0, &common.Payload{Raw: sendbuf, Length: len(sendbuf)}, &common.Mapping{Sockaddr: sa}) {
+			t.Fatal("Failed to write the payload to the dual stack UDP socket.")
+		}
+
+		readbuf := make([]byte, len(sendbuf))
+		payload, ok := server.Read(0, readbuf)
+		if !ok || string(payload.Raw[:payload.Length]) != "hello" {
+			t.Fatal("Failed to read the payload from the dual stack UDP socket.")
+		}
+		if !common.SockaddrEquals(payload.Sockaddr, sa) {
+			t.Fatal("The dual stack UDP socket did not report the right source address.")
+		}
+	}
+}
+
 func TestUDP(t *testing.T) {
 	t.Run("end-to-end", func(t *testing.T) {
 		t.Run("IPv4", testUDPEndToEndV4)
 		t.Run("IPv6", testUDPEndToEndV6)
 	})
+	t.Run("dual-stack", testUDPDualStack)
+	t.Run("backlog", testUDPBacklog)
 }
 
-func testDTLSEndToEndV4(t *testing.T) {
-	done := make(chan bool)
-
-	lip := net.ParseIP("127.0.0.1").To4()
-
-	clientSa := &syscall.SockaddrInet4{Port: 9999}
-	copy(clientSa.Addr[:], lip[:])
-
-	clientMapping := &common.Mapping{
-		Address: "127.0.0.1",
-		Port:    9999,
-	}
+func testUDPBacklog(t *testing.T) {
+	sa := &syscall.SockaddrInet4{Port: 9990}
+	copy(sa.Addr[:], net.ParseIP("127.0.0.1").To4()[:])
 
-	client, err := New(DTLSSocket, &common.Config{
-		NumWorkers:     1,
-		ReuseFDS:       false,
-		DTLSCA:         caFile,
-		DTLSCert:       clientCertFile,
-		DTLSKey:        clientKeyFile,
-		DTLSSkipVerify: false,
-		IsIPv6Enabled:  false,
-		ListenIP:       lip,
-		ListenPort:     9999,
-		ListenAddr:     clientSa,
-		Log:            common.NewLogger(common.DebugLogger),
+	sock, err := New(UDPSocket, &common.Config{
+		NumWorkers:    1,
+		ReuseFDS:      false,
+		IsIPv6Enabled: false,
+		ListenAddrs:   []syscall.Sockaddr{sa},
 	})
 	if err != nil {
-		t.Fatalf("Failed to generate client UDP socket: %s", err.Error())
-	}
-	if client == nil {
-		t.Fatal("Failed to generate client UDP socket: unhandled error")
-	}
-	if len(client.Queues()) != 1 {
-		t.Fatal("Failed to generate client UDP socket: invalid socket queue generation")
+		t.Fatalf("Failed to generate UDP socket: %s", err.Error())
 	}
+	defer sock.Close()
 
-	serverSa := &syscall.SockaddrInet4{Port: 9998}
-	copy(serverSa.Addr[:], lip[:])
-
-	serverMapping := &common.Mapping{
-		Address: "127.0.0.1",
-		Port:    9998,
+	backlogger, ok := sock.(Backlogger)
+	if !ok || backlogger.Backlogged(0) {
+		t.Fatal("The UDP socket reported a backlog before anything was sent.")
 	}
 
-	server, err := New(DTLSSocket, &common.Config{
-		NumWorkers:     1,
-		ReuseFDS:       false,
-		DTLSCA:         caFile,
-		DTLSCert:       serverCertFile,
-		DTLSKey:        serverKeyFile,
-		DTLSSkipVerify: false,
-		IsIPv6Enabled:  false,
-		ListenIP:       lip,
-		ListenPort:     9998,
-		ListenAddr:     serverSa,
-		Log:            common.NewLogger(common.DebugLogger),
-	})
-	if err != nil {
-		t.Fatalf("Failed to generate server UDP socket: %s", err.Error())
+	buf := []byte("hello")
+	if !sock.Write(0, common.NewSockPayload(buf, len(buf)), &common.Mapping{Sockaddr: sa}) {
+		t.Fatal("Failed to write to the UDP socket.")
 	}
-	if server == nil {
-		t.Fatal("Failed to generate server UDP socket: unhandled error")
+	for i := 0; i < 100 && !backlogger.Backlogged(0); i++ {
+		time.Sleep(time.Millisecond)
 	}
-	if len(server.Queues()) != 1 {
-		t.Fatal("Failed to generate server UDP socket: invalid socket queue generation")
+	if !backlogger.Backlogged(0) {
+		t.Fatal("The UDP socket didn't report the packet waiting to be read.")
 	}
 
-	sendstr := "hello"
-	sendbuf := []byte(sendstr)
-	sendbufLen := len(sendbuf)
-	readbuf := make([]byte, sendbufLen)
+	if _, ok := sock.Read(0, make([]byte, common.MaxBufferLength)); !ok || backlogger.Backlogged(0) {
+		t.Fatal("The UDP socket still reported a backlog once the packet was read.")
+	}
+}
 
-	errorstr := ""
-	go func() {
-		payload, ok := server.Read(0, readbuf)
-		if !ok {
-			errorstr = "Server failed to read the payload correctly."
-			done <- true
-			return
-		}
+func testDTLSEndToEndV4(clientProvider, serverProvider string) func(t *testing.T) {
+	return func(t *testing.T) {
+		done := make(chan bool)
+
+		lip := net.ParseIP("127.0.0.1").To4()
+
+		clientSa := &syscall.SockaddrInet4{Port: 9999}
+		copy(clientSa.Addr[:], lip[:])
+
+		clientMapping := &common.Mapping{
+			Address: "127.0.0.1",
+			Port:    9999,
+		}
+
+		client, err := New(DTLSSocket, &common.Config{
+			NumWorkers:     1,
+			ReuseFDS:       false,
+			DTLSCA:         caFile,
+			DTLSCert:       clientCertFile,
+			DTLSKey:        clientKeyFile,
+			DTLSSkipVerify: false,
+			DTLSProvider:   clientProvider,
+			IsIPv6Enabled:  false,
+			ListenIP:       lip,
+			ListenPort:     9999,
+			ListenAddrs:    []syscall.Sockaddr{clientSa},
+			Log:            common.NewLogger(common.DebugLogger),
+		})
+		if err != nil {
+			t.Fatalf("Failed to generate client UDP socket: %s", err.Error())
+		}
+		if client == nil {
+			t.Fatal("Failed to generate client UDP socket: unhandled error")
+		}
+		if len(client.Queues()) != 1 {
+			t.Fatal("Failed to generate client UDP socket: invalid socket queue generation")
+		}
+
+		serverSa := &syscall.SockaddrInet4{Port: 9998}
+		copy(serverSa.Addr[:], lip[:])
+
+		serverMapping := &common.Mapping{
+			Address: "127.0.0.1",
+			Port:    9998,
+		}
+
+		server, err := New(DTLSSocket, &common.Config{
+			NumWorkers:     1,
+			ReuseFDS:       false,
+			DTLSCA:         caFile,
+			DTLSCert:       serverCertFile,
+			DTLSKey:        serverKeyFile,
+			DTLSSkipVerify: false,
+			DTLSProvider:   serverProvider,
+			IsIPv6Enabled:  false,
+			ListenIP:       lip,
+			ListenPort:     9998,
+			ListenAddrs:    []syscall.Sockaddr{serverSa},
+			Log:            common.NewLogger(common.DebugLogger),
+		})
+		if err != nil {
+			t.Fatalf("Failed to generate server UDP socket: %s", err.Error())
+		}
+		if server == nil {
+			t.Fatal("Failed to generate server UDP socket: unhandled error")
+		}
+		if len(server.Queues()) != 1 {
+			t.Fatal("Failed to generate server UDP socket: invalid socket queue generation")
+		}
+
+		sendstr := "hello"
+		sendbuf := []byte(sendstr)
+		sendbufLen := len(sendbuf)
+		readbuf := make([]byte, sendbufLen)
+
+		errorstr := ""
+		go func() {
+			payload, ok := server.Read(0, readbuf)
+			if !ok {
+				errorstr = "Server failed to read the payload correctly."
+				done <- true
+				return
+			}
 
-		if payload.Length != sendbufLen || sendstr != string(payload.Raw[:payload.Length]) {
-			errorstr = "Server failed to read the sent payload properly."
-			done <- true
-			return
-		}
+			if payload.Length != sendbufLen || sendstr != string(payload.Raw[:payload.Length]) {
+				errorstr = "Server failed to read the sent payload properly."
+				done <- true
+				return
+			}
 
-		ok = server.Write(0, payload, clientMapping)
-		if !ok {
-			errorstr = "Server failed to write the payload correctly."
-			done <- true
-			return
-		}
+			if payload.Peer == nil || !payload.Peer.Matches(clientMapping) {
+				errorstr = "Server failed to authenticate the client as the node at its address."
+				done <- true
+				return
+			}
 
-		done <- false
-	}()
+			ok = server.Write(0, payload, clientMapping)
+			if !ok {
+				errorstr = "Server failed to write the payload correctly."
+				done <- true
+				return
+			}
 
-	go func() {
-		payload := &common.Payload{
-			Raw:    sendbuf,
-			Length: sendbufLen,
-		}
+			done <- false
+		}()
 
-		ok := client.Write(0, payload, serverMapping)
-		if !ok {
-			errorstr = "Client failed to write the payload correctly."
-			done <- true
-			return
-		}
+		go func() {
+			payload := &common.Payload{
+				Raw:    sendbuf,
+				Length: sendbufLen,
+			}
 
-		recvPayload, ok := client.Read(0, readbuf)
-		if !ok {
-			errorstr = "Client failed to read the payload correctly."
-			done <- true
-			return
+			ok := client.Write(0, payload, serverMapping)
+			if !ok {
+				errorstr = "Client failed to write the payload correctly."
+				done <- true
+				return
+			}
+
+			recvPayload, ok := client.Read(0, readbuf)
+			if !ok {
+				errorstr = "Client failed to read the payload correctly."
+				done <- true
+				return
+			}
+
+			if recvPayload.Length != sendbufLen || sendstr != string(recvPayload.Raw[:recvPayload.Length]) {
+				errorstr = "Client failed to read the sent payload properly."
+				done <- true
+				return
+			}
+
+			done <- false
+		}()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case failed := <-done:
+				if failed {
+					t.Fatal(errorstr)
+				}
+			}
 		}
 
-		if recvPayload.Length != sendbufLen || sendstr != string(recvPayload.Raw[:recvPayload.Length]) {
-			errorstr = "Client failed to read the sent payload properly."
-			done <- true
-			return
+		// Once the remote node has left the network its sessions are closed.
+		stats := client.(Groomer).Groom(time.Now(), nil)
+		if stats.Sessions != 0 || stats.Removed != 2 {
+			t.Fatalf("Grooming left %d sessions open and removed %d, instead of removing both.", stats.Sessions, stats.Removed)
 		}
 
-		done <- false
-	}()
+		client.Close()
+		server.Close()
+	}
+}
 
-	for i := 0; i < 2; i++ {
-		select {
-		case failed := <-done:
-			if failed {
-				t.Fatal(errorstr)
+func testDTLSEndToEndV6(clientProvider, serverProvider string) func(t *testing.T) {
+	return func(t *testing.T) {
+		done := make(chan bool)
+
+		lip := net.ParseIP("::1").To16()
+
+		clientSa := &syscall.SockaddrInet6{Port: 9999}
+		copy(clientSa.Addr[:], lip[:])
+
+		clientMapping := &common.Mapping{
+			Address: "::1",
+			Port:    9999,
+		}
+
+		revocations := common.NewRevocations()
+		client, err := New(DTLSSocket, &common.Config{
+			NumWorkers:     1,
+			Revocations:    revocations,
+			ReuseFDS:       false,
+			DTLSCA:         caFile,
+			DTLSCert:       clientCertFile,
+			DTLSKey:        clientKeyFile,
+			DTLSSkipVerify: false,
+			DTLSProvider:   clientProvider,
+			IsIPv6Enabled:  true,
+			ListenIP:       lip,
+			ListenPort:     9999,
+			ListenAddrs:    []syscall.Sockaddr{clientSa},
+			Log:            common.NewLogger(common.DebugLogger),
+		})
+		if err != nil {
+			t.Fatalf("Failed to generate client UDP socket: %s", err.Error())
+		}
+		if client == nil {
+			t.Fatal("Failed to generate client UDP socket: unhandled error")
+		}
+		if len(client.Queues()) != 1 {
+			t.Fatal("Failed to generate client UDP socket: invalid socket queue generation")
+		}
+
+		serverSa := &syscall.SockaddrInet6{Port: 9998}
+		copy(serverSa.Addr[:], lip[:])
+
+		serverMapping := &common.Mapping{
+			Address: "::1",
+			Port:    9998,
+		}
+
+		server, err := New(DTLSSocket, &common.Config{
+			NumWorkers:     1,
+			ReuseFDS:       false,
+			DTLSCA:         caFile,
+			DTLSCert:       serverCertFile,
+			DTLSKey:        serverKeyFile,
+			DTLSSkipVerify: false,
+			DTLSProvider:   serverProvider,
+			IsIPv6Enabled:  true,
+			ListenIP:       lip,
+			ListenPort:     9998,
+			ListenAddrs:    []syscall.Sockaddr{serverSa},
+			Log:            common.NewLogger(common.DebugLogger),
+		})
+		if err != nil {
+			t.Fatalf("Failed to generate server UDP socket: %s", err.Error())
+		}
+		if server == nil {
+			t.Fatal("Failed to generate server UDP socket: unhandled error")
+		}
+		if len(server.Queues()) != 1 {
+			t.Fatal("Failed to generate server UDP socket: invalid socket queue generation")
+		}
+
+		sendstr := "hello"
+		sendbuf := []byte(sendstr)
+		sendbufLen := len(sendbuf)
+		readbuf := make([]byte, sendbufLen)
+
+		errorstr := ""
+		go func() {
+			payload, ok := server.Read(0, readbuf)
+			if !ok {
+				errorstr = "Server failed to read the payload correctly."
+				done <- true
+				return
+			}
+
+			if payload.Length != sendbufLen || sendstr != string(payload.Raw[:payload.Length]) {
+				errorstr = "Server failed to read the sent payload properly."
+				done <- true
+				return
+			}
+
+			if payload.Peer == nil || !payload.Peer.Matches(clientMapping) {
+				errorstr = "Server failed to authenticate the client as the node at its address."
+				done <- true
+				return
+			}
+
+			ok = server.Write(0, payload, clientMapping)
+			if !ok {
+				errorstr = "Server failed to write the payload correctly."
+				done <- true
+				return
+			}
+
+			done <- false
+		}()
+
+		go func() {
+			payload := &common.Payload{
+				Raw:    sendbuf,
+				Length: sendbufLen,
+			}
+
+			ok := client.Write(0, payload, serverMapping)
+			if !ok {
+				errorstr = "Client failed to write the payload correctly."
+				done <- true
+				return
+			}
+
+			recvPayload, ok := client.Read(0, readbuf)
+			if !ok {
+				errorstr = "Client failed to read the payload correctly."
+				done <- true
+				return
+			}
+
+			if recvPayload.Length != sendbufLen || sendstr != string(recvPayload.Raw[:recvPayload.Length]) {
+				errorstr = "Client failed to read the sent payload properly."
+				done <- true
+				return
+			}
+
+			done <- false
+		}()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case failed := <-done:
+				if failed {
+					t.Fatal(errorstr)
+				}
 			}
 		}
+
+		// Revoking the certificate of the remote node through the datastore closes its sessions.
+		revocations.Set([]string{common.CertificateSerial(testCertificate(t, serverCertFile))})
+		stats := client.(Groomer).Groom(time.Now(), []*common.Mapping{serverMapping})
+		if stats.Sessions != 0 || stats.Revoked != 2 {
+			t.Fatalf("Grooming left %d sessions open and closed %d as revoked, instead of closing both.", stats.Sessions, stats.Revoked)
+		}
+
+		client.Close()
+		server.Close()
 	}
+}
 
-	client.Close()
-	server.Close()
+func TestDTLS(t *testing.T) {
+	t.Run("end-to-end", func(t *testing.T) {
+		t.Run("IPv4", testDTLSEndToEndV4(common.OpenSSLDTLSProvider, common.OpenSSLDTLSProvider))
+		t.Run("IPv6", testDTLSEndToEndV6(common.OpenSSLDTLSProvider, common.OpenSSLDTLSProvider))
+	})
+	t.Run("interop", func(t *testing.T) {
+		t.Run("openssl-client", testDTLSEndToEndV4(common.OpenSSLDTLSProvider, common.GoDTLSProvider))
+		t.Run("go-client", testDTLSEndToEndV4(common.GoDTLSProvider, common.OpenSSLDTLSProvider))
+	})
 }
 
-func testDTLSEndToEndV6(t *testing.T) {
-	done := make(chan bool)
+func TestGoDTLS(t *testing.T) {
+	t.Run("end-to-end", func(t *testing.T) {
+		t.Run("IPv4", testDTLSEndToEndV4(common.GoDTLSProvider, common.GoDTLSProvider))
+		t.Run("IPv6", testDTLSEndToEndV6(common.GoDTLSProvider, common.GoDTLSProvider))
+	})
+	t.Run("revoked", testGoDTLSRevoked)
+	t.Run("identity", testGoDTLSIdentity)
+}
 
-	lip := net.ParseIP("::1").To16()
+func testGoDTLSRevoked(t *testing.T) {
+	lip := net.ParseIP("127.0.0.1").To4()
 
-	clientSa := &syscall.SockaddrInet6{Port: 9999}
+	clientSa := &syscall.SockaddrInet4{Port: 9999}
 	copy(clientSa.Addr[:], lip[:])
 
-	clientMapping := &common.Mapping{
-		Address: "::1",
-		Port:    9999,
-	}
-
 	client, err := New(DTLSSocket, &common.Config{
-		NumWorkers:     1,
-		ReuseFDS:       false,
-		DTLSCA:         caFile,
-		DTLSCert:       clientCertFile,
-		DTLSKey:        clientKeyFile,
-		DTLSSkipVerify: false,
-		IsIPv6Enabled:  true,
-		ListenIP:       lip,
-		ListenPort:     9999,
-		ListenAddr:     clientSa,
-		Log:            common.NewLogger(common.DebugLogger),
+		NumWorkers:   1,
+		DTLSCA:       caFile,
+		DTLSCert:     revokedCertFile,
+		DTLSKey:      revokedKeyFile,
+		DTLSProvider: common.GoDTLSProvider,
+		ListenIP:     lip,
+		ListenPort:   9999,
+		ListenAddrs:  []syscall.Sockaddr{clientSa},
+		Log:          common.NewLogger(common.NoopLogger),
 	})
 	if err != nil {
-		t.Fatalf("Failed to generate client UDP socket: %s", err.Error())
-	}
-	if client == nil {
-		t.Fatal("Failed to generate client UDP socket: unhandled error")
-	}
-	if len(client.Queues()) != 1 {
-		t.Fatal("Failed to generate client UDP socket: invalid socket queue generation")
+		t.Fatalf("Failed to generate client DTLS socket: %s", err.Error())
 	}
+	defer client.Close()
 
-	serverSa := &syscall.SockaddrInet6{Port: 9998}
+	serverSa := &syscall.SockaddrInet4{Port: 9998}
 	copy(serverSa.Addr[:], lip[:])
 
-	serverMapping := &common.Mapping{
-		Address: "::1",
-		Port:    9998,
-	}
-
 	server, err := New(DTLSSocket, &common.Config{
-		NumWorkers:     1,
-		ReuseFDS:       false,
-		DTLSCA:         caFile,
-		DTLSCert:       serverCertFile,
-		DTLSKey:        serverKeyFile,
-		DTLSSkipVerify: false,
-		IsIPv6Enabled:  true,
-		ListenIP:       lip,
-		ListenPort:     9998,
-		ListenAddr:     serverSa,
-		Log:            common.NewLogger(common.DebugLogger),
+		NumWorkers:   1,
+		DTLSCA:       caFile,
+		DTLSCert:     serverCertFile,
+		DTLSKey:      serverKeyFile,
+		DTLSCRL:      []string{crlFile},
+		DTLSProvider: common.GoDTLSProvider,
+		ListenIP:     lip,
+		ListenPort:   9998,
+		ListenAddrs:  []syscall.Sockaddr{serverSa},
+		Log:          common.NewLogger(common.NoopLogger),
 	})
 	if err != nil {
-		t.Fatalf("Failed to generate server UDP socket: %s", err.Error())
+		t.Fatalf("Failed to generate server DTLS socket: %s", err.Error())
 	}
-	if server == nil {
-		t.Fatal("Failed to generate server UDP socket: unhandled error")
+	defer server.Close()
+
+	sendbuf := []byte("hello")
+	payload := &common.Payload{
+		Raw:    sendbuf,
+		Length: len(sendbuf),
 	}
-	if len(server.Queues()) != 1 {
-		t.Fatal("Failed to generate server UDP socket: invalid socket queue generation")
+
+	if client.Write(0, payload, &common.Mapping{Address: "127.0.0.1", Port: 9998}) {
+		t.Fatal("Client with a revoked certificate completed a handshake.")
 	}
 
-	sendstr := "hello"
-	sendbuf := []byte(sendstr)
-	sendbufLen := len(sendbuf)
-	readbuf := make([]byte, sendbufLen)
+	stats := server.(Groomer).Groom(time.Now(), nil)
+	if stats.HandshakeFailures == 0 {
+		t.Fatal("Server did not count the handshake with the revoked certificate as failed.")
+	}
+}
 
-	errorstr := ""
-	go func() {
-		payload, ok := server.Read(0, readbuf)
-		if !ok {
-			errorstr = "Server failed to read the payload correctly."
-			done <- true
-			return
-		}
+func testGoDTLSIdentity(t *testing.T) {
+	lip := net.ParseIP("127.0.0.1").To4()
 
-		if payload.Length != sendbufLen || sendstr != string(payload.Raw[:payload.Length]) {
-			errorstr = "Server failed to read the sent payload properly."
-			done <- true
-			return
-		}
+	newSocket := func(port int, cert, key string) Socket {
+		sa := &syscall.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], lip[:])
 
-		ok = server.Write(0, payload, clientMapping)
-		if !ok {
-			errorstr = "Server failed to write the payload correctly."
-			done <- true
-			return
+		sock, err := New(DTLSSocket, &common.Config{
+			NumWorkers:   1,
+			DTLSCA:       caFile,
+			DTLSCert:     cert,
+			DTLSKey:      key,
+			DTLSProvider: common.GoDTLSProvider,
+			ListenIP:     lip,
+			ListenPort:   port,
+			ListenAddrs:  []syscall.Sockaddr{sa},
+			Log:          common.NewLogger(common.NoopLogger),
+		})
+		if err != nil {
+			t.Fatalf("Failed to generate DTLS socket: %s", err.Error())
 		}
+		return sock
+	}
 
-		done <- false
-	}()
+	server := newSocket(9998, machineCertFile, machineKeyFile)
+	defer server.Close()
 
-	go func() {
-		payload := &common.Payload{
-			Raw:    sendbuf,
-			Length: sendbufLen,
-		}
+	sendbuf := []byte("hello")
+	payload := &common.Payload{
+		Raw:    sendbuf,
+		Length: len(sendbuf),
+	}
 
-		ok := client.Write(0, payload, serverMapping)
-		if !ok {
-			errorstr = "Client failed to write the payload correctly."
-			done <- true
-			return
-		}
+	// The certificate of the server is bound to its machine id, so its address alone doesn't identify it.
+	mismatched := newSocket(9999, clientCertFile, clientKeyFile)
+	defer mismatched.Close()
+	if mismatched.Write(0, payload, &common.Mapping{MachineID: "fedcba9876543210", Address: "127.0.0.1", Port: 9998}) {
+		t.Fatal("Client opened a session with a remote node whose certificate was issued to another machine.")
+	}
 
-		recvPayload, ok := client.Read(0, readbuf)
-		if !ok {
-			errorstr = "Client failed to read the payload correctly."
-			done <- true
-			return
-		}
+	client := newSocket(9997, clientCertFile, clientKeyFile)
+	defer client.Close()
+	if !client.Write(0, payload, &common.Mapping{MachineID: machineID, Address: "127.0.0.1", Port: 9998}) {
+		t.Fatal("Client failed to open a session with a remote node whose certificate was issued to its machine.")
+	}
+}
 
-		if recvPayload.Length != sendbufLen || sendstr != string(recvPayload.Raw[:recvPayload.Length]) {
-			errorstr = "Client failed to read the sent payload properly."
-			done <- true
-			return
-		}
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quantum-credentials")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
 
-		done <- false
-	}()
+	crl := path.Join(dir, "ca.crl")
+	data, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		t.Fatalf("Failed to read the CRL: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(crl, data, 0644); err != nil {
+		t.Fatalf("Failed to write the CRL: %s", err.Error())
+	}
 
-	for i := 0; i < 2; i++ {
-		select {
-		case failed := <-done:
-			if failed {
-				t.Fatal(errorstr)
-			}
-		}
+	cfg := &common.Config{
+		DTLSCA:   caFile,
+		DTLSCert: serverCertFile,
+		DTLSKey:  serverKeyFile,
+		DTLSCRL:  []string{crl},
+		Log:      common.NewLogger(common.NoopLogger),
 	}
 
-	client.Close()
-	server.Close()
-}
+	creds, err := newCredentials(cfg)
+	if err != nil {
+		t.Fatalf("Failed to load the credentials: %s", err.Error())
+	}
 
-func TestDTLS(t *testing.T) {
-	t.Run("end-to-end", func(t *testing.T) {
-		t.Run("IPv4", testDTLSEndToEndV4)
-		t.Run("IPv6", testDTLSEndToEndV6)
+	if _, _, ok := creds.check(testCertificate(t, revokedCertFile).Raw); ok {
+		t.Fatal("A certificate listed in the CRL passed the check.")
+	}
+	serial, peer, ok := creds.check(testCertificate(t, clientCertFile).Raw)
+	if !ok || serial != common.CertificateSerial(testCertificate(t, clientCertFile)) {
+		t.Fatal("A certificate missing from the CRL failed the check.")
+	}
+	if !peer.Matches(&common.Mapping{Address: "127.0.0.1"}) || !peer.Matches(&common.Mapping{IPv6: net.ParseIP("::1")}) || peer.Matches(&common.Mapping{Address: "10.0.0.1"}) {
+		t.Fatal("The identity of a certificate did not match exactly the addresses it was issued to.")
+	}
+	if _, peer, ok := creds.check(nil); !ok || peer != nil {
+		t.Fatal("A remote node without a certificate failed the check.")
+	}
+
+	cfg.Revocations = common.NewRevocations()
+	cfg.Revocations.Set([]string{common.CertificateSerial(testCertificate(t, clientCertFile))})
+	if _, _, ok := creds.check(testCertificate(t, clientCertFile).Raw); ok {
+		t.Fatal("A certificate revoked through the datastore passed the check.")
+	}
+
+	if creds.changed() {
+		t.Fatal("Unmodified files were reported as changed.")
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(crl, later, later); err != nil {
+		t.Fatalf("Failed to modify the CRL: %s", err.Error())
+	}
+	if !creds.changed() {
+		t.Fatal("A modified file was not reported as changed.")
+	}
+
+	reloads := 0
+	creds.refresh(func() error {
+		reloads++
+		return creds.load()
 	})
+	if reloads != 1 || creds.changed() {
+		t.Fatal("Refreshing did not reload the modified files.")
+	}
+
+	// A CRL that isn't signed by the CA is rejected, leaving the loaded one in place.
+	cfg.DTLSCA = "../dist/ssl/certs/ca.crt"
+	if err := creds.load(); err == nil {
+		t.Fatal("Loading a CRL that isn't signed by the CA succeeded.")
+	}
+	if _, _, ok := creds.check(testCertificate(t, revokedCertFile).Raw); ok {
+		t.Fatal("A failed reload replaced the loaded CRL.")
+	}
+}
+
+func TestSessionTable(t *testing.T) {
+	now := time.Now()
+	stats := &sessionStats{}
+	table := newSessionTable(2, stats)
+
+	closed := make(map[string]bool)
+	add := func(key string, used time.Time) *session {
+		s := newSession(key, -1, net.ParseIP(key), nil, func() { closed[key] = true }, used)
+		table.add(s)
+		return s
+	}
+
+	add("10.0.0.1", now.Add(-time.Minute))
+	add("10.0.0.2", now)
+	add("10.0.0.3", now)
+	if !closed["10.0.0.1"] || table.len() != 2 || stats.evicted != 1 {
+		t.Fatal("Adding a session to a full table did not evict the least recently used session.")
+	}
+
+	s, ok := table.get("10.0.0.2")
+	if !ok || !s.lock() {
+		t.Fatal("Failed to get a session from the table.")
+	}
+	s.unlock(now.Add(time.Minute))
+
+	table.groom(now.Add(time.Minute), now.Add(time.Second), nil, nil)
+	if !closed["10.0.0.3"] || closed["10.0.0.2"] || stats.expired != 1 {
+		t.Fatal("Grooming did not close exactly the idle session.")
+	}
+
+	table.groom(now, time.Time{}, map[string]bool{"10.0.0.3": true}, nil)
+	if !closed["10.0.0.2"] || table.len() != 0 || stats.removed != 1 {
+		t.Fatal("Grooming did not close the session of the remote node that left.")
+	}
+
+	revoked := add("10.0.0.5", now)
+	revoked.serial = "1a"
+	add("10.0.0.6", now)
+	table.groom(now, time.Time{}, nil, func(serial string) bool { return serial == "1a" })
+	if !closed["10.0.0.5"] || closed["10.0.0.6"] || stats.revoked != 1 {
+		t.Fatal("Grooming did not close exactly the session with the revoked certificate.")
+	}
+
+	if s.lock() {
+		t.Fatal("Locking a closed session succeeded.")
+	}
+
+	if !table.ready("10.0.0.4", now) {
+		t.Fatal("A remote address without failures should be ready for a handshake.")
+	}
+
+	table.failed("10.0.0.4", now)
+	if table.ready("10.0.0.4", now.Add(minSessionBackoff/2)) || !table.ready("10.0.0.4", now.Add(minSessionBackoff)) {
+		t.Fatal("A failed handshake did not back off for the minimum backoff.")
+	}
+
+	table.failed("10.0.0.4", now)
+	if table.ready("10.0.0.4", now.Add(minSessionBackoff)) || !table.ready("10.0.0.4", now.Add(2*minSessionBackoff)) {
+		t.Fatal("Consecutive failed handshakes did not double the backoff.")
+	}
+
+	for i := 0; i < 10; i++ {
+		table.failed("10.0.0.4", now)
+	}
+	if !table.ready("10.0.0.4", now.Add(maxSessionBackoff)) || stats.handshakeFailures != 12 {
+		t.Fatal("The backoff grew past the maximum backoff.")
+	}
+
+	table.succeeded("10.0.0.4")
+	if !table.ready("10.0.0.4", now) {
+		t.Fatal("A successful handshake did not clear the backoff.")
+	}
 }
@@ -6,14 +6,18 @@ package socket
 import (
 	"errors"
 	"syscall"
+	"unsafe"
 
 	"github.com/supernomad/quantum/common"
 )
 
-// UDP socket struct for managing a multi-queue udp socket.
+// UDP socket struct for managing a multi-queue udp socket, which is bound to each enabled address family.
 type UDP struct {
-	cfg    *common.Config
-	queues []int
+	cfg     *common.Config
+	queues  []int
+	sockets [][]int
+	pollFds []int
+	events  [][]syscall.EpollEvent
 }
 
 // Close the UDP socket and removes associated network configuration.
@@ -23,6 +27,9 @@ func (udp *UDP) Close() error {
 			return errors.New("error closing the socket queues: " + err.Error())
 		}
 	}
+	for i := 0; i < len(udp.pollFds); i++ {
+		syscall.Close(udp.pollFds[i])
+	}
 	return nil
 }
 
@@ -33,38 +40,83 @@ func (udp *UDP) Queues() []int {
 
 // Read a packet off the specified UDP socket queue and return a *common.Payload representation of the packet.
 func (udp *UDP) Read(queue int, buf []byte) (*common.Payload, bool) {
-	n, _, err := syscall.Recvfrom(udp.queues[queue], buf, 0)
+	fd := udp.sockets[queue][0]
+	if udp.pollFds != nil {
+		n, err := syscall.EpollWait(udp.pollFds[queue], udp.events[queue], -1)
+		if err != nil || n < 1 {
+			return nil, false
+		}
+		fd = int(udp.events[queue][0].Fd)
+	}
+
+	n, from, err := syscall.Recvfrom(fd, buf, 0)
 	if err != nil {
 		return nil, false
 	}
-	return common.NewSockPayload(buf, n), true
+	payload := common.NewSockPayload(buf, n)
+	payload.Sockaddr = from
+	return payload, true
+}
+
+// Backlogged returns true if packets are waiting to be read off of any of the sockets of the specified UDP socket queue.
+func (udp *UDP) Backlogged(queue int) bool {
+	for i := 0; i < len(udp.sockets[queue]); i++ {
+		var n int32
+		_, _, errNo := syscall.Syscall(syscall.SYS_IOCTL, uintptr(udp.sockets[queue][i]), uintptr(syscall.TIOCINQ), uintptr(unsafe.Pointer(&n)))
+		if errNo == 0 && n > 0 {
+			return true
+		}
+	}
+	return false
 }
 
-// Write a *common.Payload to the specified UDP socket queue.
+// Write a *common.Payload to the specified UDP socket queue, using the socket bound to the address family of the mapping.
 func (udp *UDP) Write(queue int, payload *common.Payload, mapping *common.Mapping) bool {
-	err := syscall.Sendto(udp.queues[queue], payload.Raw[:payload.Length], 0, mapping.Sockaddr)
-	return err == nil
+	for i := 0; i < len(udp.cfg.ListenAddrs); i++ {
+		if family(udp.cfg.ListenAddrs[i]) == family(mapping.Sockaddr) {
+			err := syscall.Sendto(udp.sockets[queue][i], payload.Raw[:payload.Length], 0, mapping.Sockaddr)
+			return err == nil
+		}
+	}
+	return false
 }
 
 func newUDP(cfg *common.Config) (*UDP, error) {
 	udp := &UDP{
-		cfg:    cfg,
-		queues: make([]int, cfg.NumWorkers),
+		cfg: cfg,
 	}
 
-	for i := 0; i < udp.cfg.NumWorkers; i++ {
-		var queue int
-		var err error
+	sockets, err := createUDPSockets(cfg)
+	if err != nil {
+		return udp, errors.New("error creating the UDP socket: " + err.Error())
+	}
+
+	udp.sockets = sockets
+	udp.queues = flatten(sockets)
+
+	if len(cfg.ListenAddrs) < 2 {
+		return udp, nil
+	}
 
-		if !udp.cfg.ReuseFDS {
-			queue, err = createUDPSocket(udp.cfg.IsIPv6Enabled, udp.cfg.ListenAddr)
-			if err != nil {
-				return udp, errors.New("error creating the UDP socket: " + err.Error())
+	// Each queue is bound to more than one address family, so wait on all of its sockets at once.
+	udp.pollFds = make([]int, cfg.NumWorkers)
+	udp.events = make([][]syscall.EpollEvent, cfg.NumWorkers)
+	for i := 0; i < cfg.NumWorkers; i++ {
+		pollFd, err := syscall.EpollCreate1(0)
+		if err != nil {
+			return udp, errors.New("error creating epoll file descriptor: " + err.Error())
+		}
+
+		for j := 0; j < len(sockets[i]); j++ {
+			event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(sockets[i][j])}
+			if err := syscall.EpollCtl(pollFd, syscall.EPOLL_CTL_ADD, sockets[i][j], &event); err != nil {
+				return udp, errors.New("error adding the UDP socket to epoll: " + err.Error())
 			}
-		} else {
-			queue = 3 + udp.cfg.NumWorkers + i
 		}
-		udp.queues[i] = queue
+
+		udp.pollFds[i] = pollFd
+		udp.events[i] = make([]syscall.EpollEvent, 1)
 	}
+
 	return udp, nil
 }
@@ -0,0 +1,886 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package worker
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/peer"
+	"github.com/supernomad/quantum/plugin"
+	"github.com/supernomad/quantum/socket"
+)
+
+const (
+	controlQueue = 0
+
+	// The number of authentication failures within rejectWindow that triggers fetching the mapping of the remote node, and the minimum interval between fetches for the same remote node.
+	rejectThreshold = 3
+	rejectWindow    = time.Second
+	fetchInterval   = 5 * time.Second
+
+	// The interval between grooming the sessions held by the socket.
+	groomInterval = 10 * time.Second
+
+	// The interval between reporting the statistics kept by the plugins.
+	reportInterval = 10 * time.Second
+
+	// The interval between checking the datastore for mappings that changed, on behalf of the plugins watching them.
+	watchInterval = 5 * time.Second
+
+	// The length of time a mac address learned from the frames of a remote node is forwarded to it without being seen again, and the maximum number of mac addresses learned.
+	stationAge  = 5 * time.Minute
+	maxStations = 4096
+)
+
+type observation struct {
+	ip   net.IP
+	port int
+	seen time.Time
+}
+
+type watched struct {
+	mapping *common.Mapping
+	str     string
+}
+
+type station struct {
+	ip   uint32
+	seen time.Time
+}
+
+type rejection struct {
+	first   time.Time
+	count   int
+	fetched time.Time
+}
+
+// Control packet struct for probing the liveness of remote nodes and handling the control packets they send to the local node.
+type Control struct {
+	cfg        *common.Config
+	aggregator *metric.Aggregator
+	plugins    []plugin.Plugin
+	wrapped    int
+	sock       socket.Socket
+	store      datastore.Datastore
+	peers      *peer.Table
+	stop       chan struct{}
+
+	mux          sync.RWMutex
+	observations map[uint32]*observation
+	rejections   map[uint32]*rejection
+	relay        *common.Mapping
+	stations     map[uint64]*station
+
+	watched map[uint32]*watched
+}
+
+func (control *Control) stats(dropped bool, queue int, payload *common.Payload, mapping *common.Mapping) {
+	control.aggregator.Metrics <- &metric.Metric{
+		Queue:     queue,
+		Type:      metric.Tx,
+		Dropped:   dropped,
+		Bytes:     uint64(payload.Length),
+		Reason:    payload.DropReason,
+		PrivateIP: mapping.PrivateIP.String(),
+	}
+}
+
+func (control *Control) report(mapping *common.Mapping, p *peer.Peer) {
+	control.aggregator.Metrics <- &metric.Metric{
+		Type:      metric.Peer,
+		PrivateIP: mapping.PrivateIP.String(),
+		State:     p.State().String(),
+		RTT:       p.RTT(),
+	}
+}
+
+func (control *Control) transition(mapping *common.Mapping, p *peer.Peer) {
+	control.cfg.Log.Info.Println("[CONTROL]", "Peer", mapping.PrivateIP, "is now", p.State())
+	control.report(mapping, p)
+}
+
+func (control *Control) transmit(queue int, payload *common.Payload, mapping *common.Mapping) (*common.Payload, bool) {
+	copy(payload.IPAddress, control.cfg.PrivateIP.To4())
+
+	payload, ok := control.apply(queue, 0, payload, mapping)
+	if !ok {
+		return payload, ok
+	}
+	return payload, control.sock.Write(queue, payload, mapping)
+}
+
+// apply passes the payload through the plugins starting at the supplied index.
+func (control *Control) apply(queue, start int, payload *common.Payload, mapping *common.Mapping) (*common.Payload, bool) {
+	var ok bool
+	for i := start; i < len(control.plugins); i++ {
+		payload, mapping, ok = control.plugins[i].Apply(plugin.Outgoing, queue, payload, mapping)
+		if !ok {
+			return payload, ok
+		}
+	}
+	return payload, true
+}
+
+func (control *Control) send(queue int, payload *common.Payload, mapping *common.Mapping) bool {
+	payload, ok := control.transmit(queue, payload, mapping)
+	control.stats(!ok, queue, payload, mapping)
+	return ok
+}
+
+// handshake sends a handshake control packet to the remote node represented by the mapping, through the relay node when the remote node is unreachable. Handshake control packets bypass the plugins, since they are needed before the encryption plugin can send anything and the handshake messages protect themselves, except for the plugins hiding packets on the wire so that handshakes look like any other packet.
+func (control *Control) handshake(queue int, payload *common.Payload, mapping *common.Mapping) bool {
+	copy(payload.IPAddress, control.cfg.PrivateIP.To4())
+	common.SealHandshake(payload)
+
+	payload, ok := control.apply(queue, control.wrapped, payload, mapping)
+	if !ok {
+		control.stats(true, queue, payload, mapping)
+		return false
+	}
+
+	route, direct := control.Route(mapping)
+	if direct {
+		ok = control.sock.Write(queue, payload, route)
+	} else if relay, found := control.Relay(route); found {
+		ok = control.Forward(queue, payload, route, relay)
+	}
+
+	control.stats(!ok, queue, payload, route)
+	return ok
+}
+
+func (control *Control) initiate(buf []byte, ip uint32) {
+	mapping, ok := control.store.Mapping(ip)
+	if !ok || mapping.MachineID == control.cfg.MachineID || !mapping.HasCapability(common.HandshakeCapability) {
+		return
+	}
+
+	msg, ok := control.cfg.Sessions.Initiate(time.Now(), mapping)
+	if !ok {
+		return
+	}
+
+	payload := common.NewControlPayload(buf, common.HandshakeInitControl, len(msg))
+	copy(common.ControlBody(payload.Packet), msg)
+	control.handshake(controlQueue, payload, mapping)
+}
+
+func (control *Control) ping(buf []byte, now time.Time, p *peer.Peer) {
+	paths := p.Paths()
+
+	p.Probed(now)
+	for i := 0; i < len(paths); i++ {
+		payload := common.NewControlPayload(buf, common.PingControl, common.PingBodySize)
+		body := common.ControlBody(payload.Packet)
+
+		common.PutTimestamp(body, now)
+		body[common.PingPathStart] = byte(i)
+
+		control.send(controlQueue, payload, paths[i])
+	}
+}
+
+func (control *Control) probe(buf []byte) {
+	now := time.Now()
+	mappings := control.store.Mappings()
+	probed := make([]*common.Mapping, 0, len(mappings))
+
+	control.discover(now)
+
+	for i := 0; i < len(mappings); i++ {
+		mapping := mappings[i]
+		if mapping.MachineID == control.cfg.MachineID || mapping.Floating || !mapping.HasCapability(common.KeepaliveCapability) {
+			continue
+		}
+		probed = append(probed, mapping)
+
+		p := control.peers.Track(mapping)
+		if p.Check(now, control.cfg.KeepaliveTimeout) {
+			control.transition(mapping, p)
+		}
+
+		if p.State() == peer.Down && !control.cfg.DisableNATTraversal && mapping.HasCapability(common.NATTraversalCapability) && p.Punched(now, control.cfg.KeepaliveTimeout) {
+			if err := control.store.Punch(mapping.PrivateIP); err != nil {
+				control.cfg.Log.Error.Println("[CONTROL]", "Error requesting a hole punch from", mapping.PrivateIP.String()+":", err.Error())
+			}
+		}
+
+		control.ping(buf, now, p)
+	}
+
+	control.peers.Prune(probed)
+	control.elect(probed)
+}
+
+// elect picks the reachable relay node with the lowest round trip time to forward traffic for the remote nodes that are unreachable.
+func (control *Control) elect(mappings []*common.Mapping) {
+	if control.cfg.DisableRelays {
+		return
+	}
+
+	var relay *common.Mapping
+	var rtt time.Duration
+	for i := 0; i < len(mappings); i++ {
+		if !mappings[i].HasCapability(common.RelayCapability) {
+			continue
+		}
+
+		p, ok := control.peers.Get(common.IPtoInt(mappings[i].PrivateIP))
+		if !ok || p.State() != peer.Up {
+			continue
+		}
+
+		if relay == nil || p.RTT() < rtt {
+			relay, rtt = mappings[i], p.RTT()
+		}
+	}
+
+	control.mux.Lock()
+	changed := (relay == nil) != (control.relay == nil) || (relay != nil && !relay.PrivateIP.Equal(control.relay.PrivateIP))
+	control.relay = relay
+	control.mux.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if relay == nil {
+		control.cfg.Log.Info.Println("[CONTROL]", "No relay is available for unreachable peers")
+	} else {
+		control.cfg.Log.Info.Println("[CONTROL]", "Relaying traffic for unreachable peers via", relay.PrivateIP)
+	}
+}
+
+func (control *Control) punch(buf []byte, ip net.IP) {
+	mapping, ok := control.store.Mapping(common.IPtoInt(ip))
+	if !ok || mapping.MachineID == control.cfg.MachineID || mapping.Floating {
+		return
+	}
+
+	control.ping(buf, time.Now(), control.peers.Track(mapping))
+}
+
+func (control *Control) observe(mapping *common.Mapping, ip net.IP, port int) {
+	control.mux.Lock()
+	defer control.mux.Unlock()
+
+	control.observations[common.IPtoInt(mapping.PrivateIP)] = &observation{ip: ip, port: port, seen: time.Now()}
+}
+
+// discover determines the reflexive endpoint of the local node from the endpoints observed by the remote nodes, and publishes it when it changes.
+//
+// Observations of the published public endpoint, like those made by remote nodes on the same local network, are ignored. A reflexive endpoint is only published if it was observed by more than one remote node, or if a single remote node is observing the local node from behind a NAT.
+// This means nodes behind a symmetric NAT, which get a different endpoint per remote node, will never publish a reflexive endpoint.
+func (control *Control) discover(now time.Time) {
+	if control.cfg.DisableNATTraversal {
+		return
+	}
+
+	control.mux.Lock()
+
+	votes := make(map[string]int)
+	endpoints := make(map[string]*observation)
+	for ip, obs := range control.observations {
+		if now.Sub(obs.seen) > control.cfg.KeepaliveTimeout {
+			delete(control.observations, ip)
+			continue
+		}
+
+		if (obs.ip.Equal(control.cfg.PublicIPv4) || obs.ip.Equal(control.cfg.PublicIPv6)) && obs.port == control.cfg.ListenPort {
+			continue
+		}
+
+		endpoint := net.JoinHostPort(obs.ip.String(), strconv.Itoa(obs.port))
+		votes[endpoint]++
+		endpoints[endpoint] = obs
+	}
+
+	control.mux.Unlock()
+
+	var best *observation
+	var max int
+	for endpoint, count := range votes {
+		if count > max {
+			best, max = endpoints[endpoint], count
+		}
+	}
+
+	if max < 2 && len(votes) > 1 {
+		best = nil
+	}
+
+	ip, port := control.cfg.Reflexive()
+	if best == nil {
+		if ip == nil {
+			return
+		}
+		ip, port = nil, 0
+	} else {
+		if best.ip.Equal(ip) && best.port == port {
+			return
+		}
+		ip, port = best.ip, best.port
+	}
+	control.cfg.SetReflexive(ip, port)
+
+	control.cfg.Log.Info.Println("[CONTROL]", "Reflexive endpoint is now", ip, port)
+	if err := control.store.Publish(); err != nil {
+		control.cfg.Log.Error.Println("[CONTROL]", "Error publishing the reflexive endpoint:", err.Error())
+	}
+}
+
+// Handle a control packet received from a remote node, the payload buffer is reused for any response that needs to be sent.
+func (control *Control) Handle(queue int, payload *common.Payload, mapping *common.Mapping) bool {
+	body := common.ControlBody(payload.Packet)
+
+	switch common.ControlType(payload.Packet[common.ControlTypeStart]) {
+	case common.PingControl:
+		if len(body) < common.PingBodySize {
+			return false
+		}
+
+		length := common.PingBodySize
+		if payload.Sockaddr != nil {
+			// Reply to the endpoint the ping was received from, which is the only one known to be reachable through any NAT along the way.
+			ip, port := common.ParseSockaddr(payload.Sockaddr)
+			length += common.PutEndpoint(payload.Raw[common.PacketStart+common.ControlBodyStart+common.PingBodySize:], ip, port)
+			mapping = mapping.Via(payload.Sockaddr)
+		}
+
+		pong := common.NewControlPayload(payload.Raw, common.PongControl, length)
+		return control.send(queue, pong, mapping)
+	case common.PongControl:
+		if len(body) < common.PingBodySize {
+			return false
+		}
+
+		p, ok := control.peers.Get(common.IPtoInt(mapping.PrivateIP))
+		if !ok {
+			return false
+		}
+
+		if ip, port, ok := common.Endpoint(body[common.PingBodySize:]); ok {
+			control.observe(mapping, ip, port)
+		}
+
+		if p.Answered(time.Now(), common.Timestamp(body), int(body[common.PingPathStart])) {
+			control.transition(mapping, p)
+		} else {
+			control.report(mapping, p)
+		}
+		return true
+	case common.RelayControl:
+		if !control.cfg.Relay || len(body) < common.IPLength+common.HeaderSize {
+			return false
+		}
+
+		dst, ok := control.store.Mapping(common.IPtoInt(net.IP(body[:common.IPLength])))
+		if !ok || dst.MachineID == control.cfg.MachineID {
+			return false
+		}
+
+		route, ok := control.Route(dst)
+		if !ok {
+			return false
+		}
+
+		// Forward the inner packet untouched, only the hop between this node and the destination is re-processed by the plugins.
+		return control.send(queue, payload, route)
+	case common.HandshakeInitControl:
+		if control.cfg.Sessions == nil || len(body) != common.HandshakeInitSize {
+			return false
+		}
+
+		msg, err := control.cfg.Sessions.Respond(time.Now(), mapping, body)
+		if err != nil {
+			control.Rejected(mapping)
+			return false
+		}
+
+		response := common.NewControlPayload(payload.Raw, common.HandshakeResponseControl, len(msg))
+		copy(common.ControlBody(response.Packet), msg)
+		return control.handshake(queue, response, mapping)
+	case common.HandshakeResponseControl:
+		if control.cfg.Sessions == nil || len(body) != common.HandshakeResponseSize {
+			return false
+		}
+
+		return control.cfg.Sessions.Complete(time.Now(), mapping, body) == nil
+	}
+
+	return false
+}
+
+// Handshake returns true if the supplied payload carries a handshake control packet from a remote node that supports handshakes, stripping the mark added by the remote node. Such payloads go straight to Handle without passing through the plugins, other than the plugins hiding packets on the wire which must be undone beforehand.
+func (control *Control) Handshake(payload *common.Payload, mapping *common.Mapping) bool {
+	if control.cfg.Sessions == nil || !mapping.HasCapability(common.HandshakeCapability) {
+		return false
+	}
+	return common.OpenHandshake(payload)
+}
+
+// Seen marks the remote node represented by the mapping as alive, due to the supplied packet being received from it.
+//
+// If the packet was authenticated and arrived from an endpoint other than the one currently used to reach the remote node, the remote node is considered to have roamed and traffic follows it to the new endpoint right away.
+func (control *Control) Seen(mapping *common.Mapping, payload *common.Payload) {
+	p, ok := control.peers.Get(common.IPtoInt(mapping.PrivateIP))
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if payload.Authenticated && payload.Sockaddr != nil && p.Roamed(now, mapping, payload.Sockaddr) {
+		ip, port := common.ParseSockaddr(payload.Sockaddr)
+		control.cfg.Log.Info.Println("[CONTROL]", "Peer", mapping.PrivateIP, "roamed to", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+
+	if p.Seen(now) {
+		control.transition(mapping, p)
+	}
+}
+
+// Rejected records that a packet from the remote node represented by the mapping failed to authenticate. Repeated failures are often the first sign of the remote node having new keys, so they trigger a rate limited fetch of its mapping rather than waiting for the next datastore sync.
+func (control *Control) Rejected(mapping *common.Mapping) {
+	ip := common.IPtoInt(mapping.PrivateIP)
+	now := time.Now()
+
+	control.mux.Lock()
+	r, ok := control.rejections[ip]
+	if !ok {
+		r = &rejection{}
+		control.rejections[ip] = r
+	}
+
+	if now.Sub(r.first) > rejectWindow {
+		r.first = now
+		r.count = 0
+	}
+	r.count++
+
+	fetch := r.count >= rejectThreshold && now.Sub(r.fetched) >= fetchInterval
+	if fetch {
+		r.fetched = now
+		r.count = 0
+	}
+	control.mux.Unlock()
+
+	if !fetch {
+		return
+	}
+
+	go func() {
+		if err := control.store.Fetch(mapping.PrivateIP); err != nil {
+			control.cfg.Log.Error.Println("[CONTROL]", "Error fetching the mapping of", mapping.PrivateIP.String()+":", err.Error())
+		}
+	}()
+}
+
+// owner returns the mapping of the remote node that publishes the mac address as the one of its TAP device.
+func (control *Control) owner(mac net.HardwareAddr) (*common.Mapping, bool) {
+	str := mac.String()
+	mappings := control.store.Mappings()
+	for i := 0; i < len(mappings); i++ {
+		if mappings[i].MAC == str && !mappings[i].Floating && mappings[i].MachineID != control.cfg.MachineID {
+			return mappings[i], true
+		}
+	}
+	return nil, false
+}
+
+// Learn records that the station with the supplied mac address sits behind the TAP device of the remote node represented by the mapping, since a frame sent by the station was received from it.
+//
+// Mac addresses published by other nodes, or by the local node, are never learned, so a remote node can't draw the traffic of another node to itself.
+func (control *Control) Learn(mac net.HardwareAddr, mapping *common.Mapping) {
+	if common.IsMulticastMAC(mac) || bytes.Equal(mac, control.cfg.HardwareAddr) {
+		return
+	}
+	key := common.MACtoInt(mac)
+	ip := common.IPtoInt(mapping.PrivateIP)
+	now := time.Now()
+
+	// Refreshing an entry only needs the write lock once it is halfway through its life, which keeps the write lock off of the path of most frames.
+	control.mux.RLock()
+	s, ok := control.stations[key]
+	fresh := ok && s.ip == ip && now.Sub(s.seen) < stationAge/2
+	control.mux.RUnlock()
+	if fresh {
+		return
+	}
+
+	if owner, ok := control.owner(mac); ok && common.IPtoInt(owner.PrivateIP) != ip {
+		return
+	}
+
+	control.mux.Lock()
+	defer control.mux.Unlock()
+
+	if _, ok := control.stations[key]; !ok && len(control.stations) >= maxStations {
+		return
+	}
+	control.stations[key] = &station{ip: ip, seen: now}
+}
+
+// Station returns the mapping of the remote node to forward frames destined for the supplied mac address to, either learned from the frames it sent or published as the mac address of its TAP device, and false if the station is unknown.
+func (control *Control) Station(mac net.HardwareAddr) (*common.Mapping, bool) {
+	control.mux.RLock()
+	s, ok := control.stations[common.MACtoInt(mac)]
+	if ok {
+		ok = time.Since(s.seen) < stationAge
+	}
+	control.mux.RUnlock()
+
+	if ok {
+		if mapping, found := control.store.Mapping(s.ip); found {
+			return mapping, true
+		}
+	}
+	return control.owner(mac)
+}
+
+// age forgets the mac addresses that were not seen for longer than stationAge.
+func (control *Control) age(now time.Time) {
+	control.mux.Lock()
+	defer control.mux.Unlock()
+
+	for key, s := range control.stations {
+		if now.Sub(s.seen) >= stationAge {
+			delete(control.stations, key)
+		}
+	}
+}
+
+// Available returns false if the remote node represented by the mapping is known to be unreachable.
+func (control *Control) Available(mapping *common.Mapping) bool {
+	_, ok := control.Route(mapping)
+	return ok
+}
+
+// Route returns the mapping to use in order to reach the remote node represented by the supplied mapping over its currently reachable path, and false if the remote node is known to be unreachable.
+func (control *Control) Route(mapping *common.Mapping) (*common.Mapping, bool) {
+	p, ok := control.peers.Get(common.IPtoInt(mapping.PrivateIP))
+	if !ok {
+		return mapping, true
+	}
+	return p.Route(mapping), p.State() != peer.Down
+}
+
+// Relay returns the mapping to use in order to reach the relay node that forwards traffic to the unreachable remote node represented by the supplied mapping, and false if there is no relay available.
+func (control *Control) Relay(mapping *common.Mapping) (*common.Mapping, bool) {
+	control.mux.RLock()
+	relay := control.relay
+	control.mux.RUnlock()
+
+	if relay == nil || relay.PrivateIP.Equal(mapping.PrivateIP) {
+		return nil, false
+	}
+	return control.Route(relay)
+}
+
+// Forward encapsulates the supplied payload, which was already processed by the plugins for the remote node represented by the mapping, and sends it to the supplied relay node. The device MTU leaves room for the relay header and the second pass through the plugins, so full sized packets fit as well.
+func (control *Control) Forward(queue int, payload *common.Payload, mapping, relay *common.Mapping) bool {
+	if payload.Length+common.RelayHeaderSize > len(payload.Raw) {
+		payload.DropReason = common.OversizeDropReason
+		return false
+	}
+
+	copy(payload.Raw[common.RelayHeaderSize:], payload.Raw[:payload.Length])
+	copy(payload.Raw[common.PacketStart+common.ControlBodyStart:], mapping.PrivateIP.To4())
+
+	relayed := common.NewControlPayload(payload.Raw, common.RelayControl, common.IPLength+payload.Length)
+	relayed, ok := control.transmit(queue, relayed, relay)
+
+	// The drop is reported against the forwarded payload, so that packets too large to relay are counted as oversize.
+	payload.DropReason = relayed.DropReason
+	return ok
+}
+
+// Unwrap returns the quantum packet carried by a relay control packet destined for the local node, and false if the supplied payload is not one.
+func (control *Control) Unwrap(payload *common.Payload) (*common.Payload, bool) {
+	if common.ControlType(payload.Packet[common.ControlTypeStart]) != common.RelayControl {
+		return nil, false
+	}
+
+	body := common.ControlBody(payload.Packet)
+	if len(body) < common.IPLength+common.HeaderSize || !net.IP(body[:common.IPLength]).Equal(control.cfg.PrivateIP) {
+		return nil, false
+	}
+
+	// The socket only authenticated the relay node, which is carried along so that the inner packet is only trusted once a plugin authenticates the node it claims to come from.
+	inner := common.NewSockPayload(payload.Raw[common.RelayHeaderSize:], payload.Length-common.RelayHeaderSize)
+	inner.Peer = payload.Peer
+	return inner, true
+}
+
+// groom closes the stale sessions held by the socket, and reports the resulting session statistics.
+func (control *Control) groom(groomer socket.Groomer, now time.Time) {
+	control.aggregator.Metrics <- &metric.Metric{
+		Type:     metric.Session,
+		Sessions: groomer.Groom(now, control.store.Mappings()),
+	}
+}
+
+// reportPlugins hands the statistics kept by the plugins to the metric aggregator.
+func (control *Control) reportPlugins(reporters []plugin.Reporter) {
+	for i := 0; i < len(reporters); i++ {
+		control.aggregator.Metrics <- reporters[i].Report()
+	}
+}
+
+// watch notifies the plugins watching the mappings of remote nodes about every mapping added, changed, or removed since the last check.
+func (control *Control) watch(watchers []plugin.MappingWatcher) {
+	mappings := control.store.Mappings()
+	current := make(map[uint32]*common.Mapping, len(mappings))
+	for i := 0; i < len(mappings); i++ {
+		if mappings[i].MachineID != control.cfg.MachineID {
+			current[common.IPtoInt(mappings[i].PrivateIP)] = mappings[i]
+		}
+	}
+
+	for ip, mapping := range current {
+		str := mapping.String()
+		if w, ok := control.watched[ip]; ok && w.str == str {
+			continue
+		}
+		control.watched[ip] = &watched{mapping: mapping, str: str}
+
+		for i := 0; i < len(watchers); i++ {
+			watchers[i].OnMappingChange(mapping, false)
+		}
+	}
+
+	for ip, w := range control.watched {
+		if _, ok := current[ip]; ok {
+			continue
+		}
+		delete(control.watched, ip)
+
+		for i := 0; i < len(watchers); i++ {
+			watchers[i].OnMappingChange(w.mapping, true)
+		}
+	}
+}
+
+// inject sends the packets the plugin builds of its own to each reachable remote node, without passing them through the other plugins.
+func (control *Control) inject(buf []byte, injector plugin.Injector) {
+	mappings := control.store.Mappings()
+	for i := 0; i < len(mappings); i++ {
+		if mappings[i].MachineID == control.cfg.MachineID || mappings[i].Floating {
+			continue
+		}
+
+		route, direct := control.Route(mappings[i])
+		if !direct {
+			continue
+		}
+
+		payload, ok := injector.Inject(buf, route)
+		if !ok {
+			continue
+		}
+		control.stats(!control.sock.Write(controlQueue, payload, route), controlQueue, payload, route)
+	}
+}
+
+// Start probing remote nodes, initiating the handshakes requested by the encryption plugin, grooming the sessions held by the socket, reporting the statistics kept by the plugins, notifying the plugins watching the mappings of remote nodes, aging the learned mac addresses, and sending the packets injected or produced by the plugins.
+func (control *Control) Start() {
+	probing := control.cfg.KeepaliveInterval > 0
+	groomer, grooming := control.sock.(socket.Groomer)
+
+	var reporters []plugin.Reporter
+	var watchers []plugin.MappingWatcher
+	for i := 0; i < len(control.plugins); i++ {
+		if reporter, ok := control.plugins[i].(plugin.Reporter); ok {
+			reporters = append(reporters, reporter)
+		}
+		if watcher, ok := control.plugins[i].(plugin.MappingWatcher); ok {
+			watchers = append(watchers, watcher)
+		}
+		if injector, ok := control.plugins[i].(plugin.Injector); ok && injector.Interval() > 0 {
+			go control.injecting(injector)
+		}
+		if producer, ok := control.plugins[i].(plugin.Producer); ok && producer.FlushInterval() > 0 {
+			go control.flushing(i)
+		}
+	}
+
+	bridging := control.cfg.HardwareAddr != nil
+
+	if !probing && control.cfg.Sessions == nil && !grooming && len(reporters) == 0 && len(watchers) == 0 && !bridging {
+		return
+	}
+
+	go func() {
+		buf := make([]byte, common.MaxBufferLength)
+
+		var probes <-chan time.Time
+		var punches <-chan net.IP
+		if probing {
+			ticker := time.NewTicker(control.cfg.KeepaliveInterval)
+			defer ticker.Stop()
+			probes = ticker.C
+
+			if !control.cfg.DisableNATTraversal {
+				punches = control.store.Punches()
+			}
+		}
+
+		var handshakes <-chan uint32
+		var prunes <-chan time.Time
+		if control.cfg.Sessions != nil {
+			ticker := time.NewTicker(control.cfg.HandshakeInterval)
+			defer ticker.Stop()
+			prunes = ticker.C
+			handshakes = control.cfg.Sessions.Requests()
+		}
+
+		var grooms <-chan time.Time
+		if grooming {
+			ticker := time.NewTicker(groomInterval)
+			defer ticker.Stop()
+			grooms = ticker.C
+		}
+
+		var reports <-chan time.Time
+		if len(reporters) > 0 {
+			ticker := time.NewTicker(reportInterval)
+			defer ticker.Stop()
+			reports = ticker.C
+		}
+
+		var watches <-chan time.Time
+		if len(watchers) > 0 {
+			control.watch(watchers)
+
+			ticker := time.NewTicker(watchInterval)
+			defer ticker.Stop()
+			watches = ticker.C
+		}
+
+		var ages <-chan time.Time
+		if bridging {
+			ticker := time.NewTicker(stationAge)
+			defer ticker.Stop()
+			ages = ticker.C
+		}
+
+		for {
+			select {
+			case <-control.stop:
+				return
+			case <-probes:
+				control.probe(buf)
+			case ip := <-punches:
+				control.punch(buf, ip)
+			case ip := <-handshakes:
+				control.initiate(buf, ip)
+			case now := <-prunes:
+				control.cfg.Sessions.Prune(now)
+			case now := <-grooms:
+				control.groom(groomer, now)
+			case <-reports:
+				control.reportPlugins(reporters)
+			case <-watches:
+				control.watch(watchers)
+			case now := <-ages:
+				control.age(now)
+			}
+		}
+	}()
+}
+
+// flush sends the packets the plugins produced on top of the ones sent, which are usually drained by the outgoing workers, so that packets waiting on a timeout are sent even when there is no traffic.
+func (control *Control) flush(buf []byte, start int) {
+	producer := control.plugins[start].(plugin.Producer)
+	for payload, mapping, ok := producer.Produce(plugin.Outgoing, buf); ok; payload, mapping, ok = producer.Produce(plugin.Outgoing, buf) {
+		var relay *common.Mapping
+		route, direct := control.Route(mapping)
+		if !direct {
+			if relay, ok = control.Relay(route); !ok {
+				control.stats(true, controlQueue, payload, route)
+				continue
+			}
+		}
+
+		payload, ok = control.apply(controlQueue, start+1, payload, route)
+		if ok && relay != nil {
+			ok = control.Forward(controlQueue, payload, route, relay)
+		} else if ok {
+			ok = control.sock.Write(controlQueue, payload, route)
+		}
+		control.stats(!ok, controlQueue, payload, route)
+	}
+}
+
+// flushing periodically sends the packets produced by the plugin until the worker is stopped.
+func (control *Control) flushing(start int) {
+	buf := make([]byte, common.MaxBufferLength)
+	ticker := time.NewTicker(control.plugins[start].(plugin.Producer).FlushInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-control.stop:
+			return
+		case <-ticker.C:
+			control.flush(buf, start)
+		}
+	}
+}
+
+// injecting periodically sends the packets injected by the plugin until the worker is stopped.
+func (control *Control) injecting(injector plugin.Injector) {
+	buf := make([]byte, common.MaxBufferLength)
+	ticker := time.NewTicker(injector.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-control.stop:
+			return
+		case <-ticker.C:
+			control.inject(buf, injector)
+		}
+	}
+}
+
+// Stop probing remote nodes.
+func (control *Control) Stop() {
+	close(control.stop)
+}
+
+// NewControl generates a Control worker which once started will periodically probe the remote nodes in the quantum network, and handle the control packets they send to the local node.
+func NewControl(cfg *common.Config, aggregator *metric.Aggregator, store datastore.Datastore, plugins []plugin.Plugin, sock socket.Socket, peers *peer.Table) *Control {
+	// The plugins hiding packets on the wire are the last ones applied to outgoing packets.
+	wrapped := len(plugins)
+	for wrapped > 0 {
+		if _, ok := plugins[wrapped-1].(plugin.Resolver); !ok {
+			break
+		}
+		wrapped--
+	}
+
+	return &Control{
+		cfg:        cfg,
+		aggregator: aggregator,
+		plugins:    plugins,
+		wrapped:    wrapped,
+		sock:       sock,
+		store:      store,
+		peers:      peers,
+		stop:       make(chan struct{}),
+
+		observations: make(map[uint32]*observation),
+		rejections:   make(map[uint32]*rejection),
+		stations:     make(map[uint64]*station),
+
+		watched: make(map[uint32]*watched),
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package worker
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/socket"
+)
+
+const (
+	enrollmentCheckInterval = 10 * time.Second
+	enrollmentPollInterval  = time.Second
+
+	// Unanswered certificate requests expire from the datastore after this long, and are then posted again.
+	enrollmentTimeout = 5 * time.Minute
+)
+
+// Enrollment worker struct for obtaining and renewing the DTLS certificate of the local node from the built-in certificate authority, and for issuing the certificates requested by the remote nodes when the local node is a signer.
+type Enrollment struct {
+	cfg       *common.Config
+	store     datastore.Datastore
+	authority *common.Authority
+	key       crypto.Signer
+	pending   *common.CertificateRequest
+	requested time.Time
+	stop      chan struct{}
+}
+
+func (enrollment *Enrollment) enabled() bool {
+	cfg := enrollment.cfg
+	return cfg.NetworkConfig.Backend == socket.DTLSSocket && (cfg.DTLSCAKey != "" || cfg.DTLSJoinToken != "")
+}
+
+// loadKey loads the DTLS key of the local node, generating it if there is none yet.
+func (enrollment *Enrollment) loadKey() error {
+	key, err := common.LoadCertificateKey(enrollment.cfg.DTLSKey)
+	if os.IsNotExist(err) {
+		key, err = common.GenerateCertificateKey()
+		if err == nil {
+			err = common.SaveCertificateKey(enrollment.cfg.DTLSKey, key)
+		}
+	}
+	if err != nil {
+		return errors.New("error loading the DTLS key: " + err.Error())
+	}
+
+	enrollment.key = key
+	return nil
+}
+
+// certificate returns the DTLS certificate of the local node, or nil if there is none usable because it is missing, certifies another key or has expired.
+func (enrollment *Enrollment) certificate(now time.Time) *x509.Certificate {
+	data, err := ioutil.ReadFile(enrollment.cfg.DTLSCert)
+	if err != nil {
+		return nil
+	}
+
+	cert, err := common.ParseCertificatePEM(data)
+	if err != nil || !common.PublicKeysEqual(cert.PublicKey, enrollment.key.Public()) || !now.Before(cert.NotAfter) {
+		return nil
+	}
+	return cert
+}
+
+// request obtains a new certificate for the local key, which signers issue to themselves right away while the other nodes ask the signers for it. A node that holds a usable certificate renews it, otherwise it enrolls using its join token.
+func (enrollment *Enrollment) request(now time.Time, cert *x509.Certificate) error {
+	cfg := enrollment.cfg
+
+	if enrollment.authority != nil {
+		issued, err := enrollment.authority.Issue(cfg.MachineID, enrollment.key.Public(), now, cfg.DTLSCertTTL)
+		if err != nil {
+			return err
+		}
+		return enrollment.save(&common.IssuedCertificate{Certificate: issued, CA: enrollment.authority.Certificate()}, now)
+	}
+
+	csr, err := common.NewCSR(enrollment.key, cfg.MachineID)
+	if err != nil {
+		return err
+	}
+
+	request := &common.CertificateRequest{
+		MachineID: cfg.MachineID,
+		CSR:       csr,
+	}
+	if cert != nil {
+		request.Certificate = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	} else {
+		request.Token = cfg.DTLSJoinToken
+	}
+
+	if err := enrollment.store.Enroll(request); err != nil {
+		return err
+	}
+
+	enrollment.pending, enrollment.requested = request, now
+	cfg.Log.Info.Println("[ENROLL]", "Requested a DTLS certificate from the built-in certificate authority")
+	return nil
+}
+
+// collect saves the certificate issued in response to the pending request once there is one, and gives up on the request once it has expired unanswered. It returns whether or not the request was answered.
+func (enrollment *Enrollment) collect(now time.Time) (bool, error) {
+	issued, err := enrollment.store.Issued(enrollment.cfg.MachineID)
+	if err != nil {
+		return false, err
+	}
+
+	if issued != nil {
+		current := enrollment.certificate(now)
+
+		// The previous certificate certifies the same key when renewing, so only a newer one answers the request.
+		cert, err := common.ParseCertificatePEM(issued.Certificate)
+		if err == nil && common.PublicKeysEqual(cert.PublicKey, enrollment.key.Public()) && now.Before(cert.NotAfter) &&
+			(current == nil || (cert.SerialNumber.Cmp(current.SerialNumber) != 0 && cert.NotAfter.After(current.NotAfter))) {
+			enrollment.pending = nil
+			return true, enrollment.save(issued, now)
+		}
+	}
+
+	if now.Sub(enrollment.requested) >= enrollmentTimeout {
+		enrollment.pending = nil
+		return false, errors.New("the certificate request expired without being answered by a signer")
+	}
+	return false, nil
+}
+
+// save writes the issued certificate, the DTLS socket reloads it once it notices the change. The certificate of the authority is only written if there is none yet, otherwise the issued certificate has to be signed by the one in place.
+func (enrollment *Enrollment) save(issued *common.IssuedCertificate, now time.Time) error {
+	cfg := enrollment.cfg
+
+	ca, err := ioutil.ReadFile(cfg.DTLSCA)
+	exists := err == nil
+	if os.IsNotExist(err) {
+		ca, err = issued.CA, nil
+	}
+	if err != nil {
+		return errors.New("error reading the DTLS CA certificate: " + err.Error())
+	}
+
+	cert, err := common.ParseCertificatePEM(issued.Certificate)
+	if err != nil {
+		return errors.New("error parsing the issued DTLS certificate: " + err.Error())
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: now, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return errors.New("error verifying the issued DTLS certificate: " + err.Error())
+	}
+
+	if !exists {
+		if err := common.WriteFileAtomic(cfg.DTLSCA, ca, 0644); err != nil {
+			return errors.New("error writing the DTLS CA certificate: " + err.Error())
+		}
+	}
+	if err := common.WriteFileAtomic(cfg.DTLSCert, issued.Certificate, 0644); err != nil {
+		return errors.New("error writing the issued DTLS certificate: " + err.Error())
+	}
+
+	cfg.Log.Info.Println("[ENROLL]", "Saved the DTLS certificate issued by the built-in certificate authority, which expires at", cert.NotAfter.String())
+	return nil
+}
+
+// issue validates the request of a remote node and returns the certificate issued in response to it.
+//
+// Renewals have to present the certificate being renewed, which must be valid, unrevoked, issued to the requesting machine and certify the same key. Enrollments have to redeem a join token, and are refused to machines that already hold a valid certificate so that a join token can't be used to take over the identity of another node.
+func (enrollment *Enrollment) issue(request *common.CertificateRequest, now time.Time) (*common.IssuedCertificate, error) {
+	authority := enrollment.authority
+
+	if _, err := hex.DecodeString(request.MachineID); err != nil || request.MachineID == "" {
+		return nil, errors.New("the machine id is invalid")
+	}
+
+	csr, err := common.ParseCSR(request.CSR)
+	if err != nil {
+		return nil, errors.New("the certificate signing request is invalid: " + err.Error())
+	}
+
+	if request.Certificate != nil {
+		cert, err := authority.Verify(request.Certificate, now)
+		switch {
+		case err != nil:
+			return nil, errors.New("the certificate to renew is invalid: " + err.Error())
+		case common.NewPeerIdentity(cert).MachineID != request.MachineID:
+			return nil, errors.New("the certificate to renew was issued to another machine")
+		case enrollment.cfg.Revocations.Revoked(common.CertificateSerial(cert)):
+			return nil, errors.New("the certificate to renew has been revoked")
+		case !common.PublicKeysEqual(cert.PublicKey, csr.PublicKey):
+			return nil, errors.New("the certificate to renew certifies another key")
+		}
+	} else {
+		current, err := enrollment.store.Issued(request.MachineID)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil {
+			if cert, err := authority.Verify(current.Certificate, now); err == nil && !enrollment.cfg.Revocations.Revoked(common.CertificateSerial(cert)) {
+				return nil, errors.New("the machine already holds a valid certificate, which has to be revoked before it can enroll again")
+			}
+		}
+
+		if err := enrollment.store.Redeem(request.Token); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := authority.Issue(request.MachineID, csr.PublicKey, now, enrollment.cfg.DTLSCertTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &common.IssuedCertificate{Certificate: cert, CA: authority.Certificate()}, nil
+}
+
+// sign handles the pending certificate requests of the remote nodes.
+func (enrollment *Enrollment) sign(now time.Time) {
+	requests, err := enrollment.store.Requests()
+	if err != nil {
+		enrollment.cfg.Log.Error.Println("[ENROLL]", "Error retrieving the certificate requests:", err.Error())
+		return
+	}
+
+	for i := 0; i < len(requests); i++ {
+		issued, err := enrollment.issue(requests[i], now)
+		if err != nil {
+			enrollment.cfg.Log.Warn.Println("[ENROLL]", "Rejected the certificate request of", requests[i].MachineID+":", err.Error())
+			if err := enrollment.store.Reject(requests[i]); err != nil {
+				enrollment.cfg.Log.Error.Println("[ENROLL]", "Error rejecting a certificate request:", err.Error())
+			}
+			continue
+		}
+
+		if err := enrollment.store.Issue(requests[i], issued); err != nil {
+			enrollment.cfg.Log.Error.Println("[ENROLL]", "Error issuing a certificate:", err.Error())
+			continue
+		}
+		enrollment.cfg.Log.Info.Println("[ENROLL]", "Issued a DTLS certificate to", requests[i].MachineID)
+	}
+}
+
+func (enrollment *Enrollment) check(now time.Time) {
+	if enrollment.authority != nil {
+		enrollment.sign(now)
+	}
+
+	if enrollment.pending != nil {
+		if _, err := enrollment.collect(now); err != nil {
+			enrollment.cfg.Log.Error.Println("[ENROLL]", "Error collecting the requested DTLS certificate:", err.Error())
+		}
+		return
+	}
+
+	if cert := enrollment.certificate(now); cert == nil || common.RenewalDue(cert, now) {
+		if err := enrollment.request(now, cert); err != nil {
+			enrollment.cfg.Log.Error.Println("[ENROLL]", "Error renewing the DTLS certificate:", err.Error())
+		}
+	}
+}
+
+// Init makes sure the local node holds a usable DTLS certificate before the DTLS socket is created. Signers issue it to themselves, while the other nodes enroll using their join token and wait for a signer to issue it.
+func (enrollment *Enrollment) Init() error {
+	if !enrollment.enabled() {
+		return nil
+	}
+
+	cfg := enrollment.cfg
+	if cfg.DTLSCAKey != "" {
+		authority, err := common.LoadAuthority(cfg.DTLSCA, cfg.DTLSCAKey)
+		if err != nil {
+			return err
+		}
+		enrollment.authority = authority
+	}
+
+	if err := enrollment.loadKey(); err != nil {
+		return err
+	}
+
+	// A certificate that is due for renewal is still usable, so it is renewed in the background.
+	now := time.Now()
+	if enrollment.certificate(now) != nil {
+		return nil
+	}
+
+	if err := enrollment.request(now, nil); err != nil {
+		return errors.New("error requesting a DTLS certificate: " + err.Error())
+	}
+
+	for enrollment.pending != nil {
+		time.Sleep(enrollmentPollInterval)
+
+		if _, err := enrollment.collect(time.Now()); err != nil {
+			return errors.New("error enrolling with the built-in certificate authority: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Start periodically renewing the DTLS certificate of the local node, and issuing the certificates requested by the remote nodes when the local node is a signer.
+func (enrollment *Enrollment) Start() {
+	if !enrollment.enabled() {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(enrollmentCheckInterval)
+
+	loop:
+		for {
+			select {
+			case <-enrollment.stop:
+				break loop
+			case now := <-ticker.C:
+				enrollment.check(now)
+			}
+		}
+
+		ticker.Stop()
+	}()
+}
+
+// Stop renewing and issuing certificates.
+func (enrollment *Enrollment) Stop() {
+	close(enrollment.stop)
+}
+
+// NewEnrollment generates an Enrollment worker which manages the DTLS certificate of the local node through the built-in certificate authority, it does nothing unless the DTLS backend is used and the node is either a signer or has a join token.
+func NewEnrollment(cfg *common.Config, store datastore.Datastore) *Enrollment {
+	return &Enrollment{
+		cfg:   cfg,
+		store: store,
+		stop:  make(chan struct{}),
+	}
+}
@@ -20,13 +20,23 @@ type Incoming struct {
 	cfg        *common.Config
 	aggregator *metric.Aggregator
 	plugins    []plugin.Plugin
+	resolvers  []plugin.Resolver
+	wrapped    int
+	producers  []int
 	dev        device.Device
 	sock       socket.Socket
 	store      datastore.Datastore
+	control    *Control
 	stop       bool
 }
 
 func (incoming *Incoming) resolve(payload *common.Payload) (*common.Payload, *common.Mapping, bool) {
+	for i := 0; i < len(incoming.resolvers); i++ {
+		if incoming.resolvers[i].Resolve(payload) {
+			break
+		}
+	}
+
 	dip := binary.LittleEndian.Uint32(payload.IPAddress)
 
 	if mapping, ok := incoming.store.Mapping(dip); ok {
@@ -45,6 +55,7 @@ func (incoming *Incoming) stats(dropped bool, queue int, payload *common.Payload
 
 	if payload != nil {
 		metric.Bytes += uint64(payload.Length)
+		metric.Reason = payload.DropReason
 	}
 
 	if mapping != nil {
@@ -60,18 +71,78 @@ func (incoming *Incoming) pipeline(buf []byte, queue int) bool {
 		incoming.stats(true, queue, payload, nil)
 		return ok
 	}
+	return incoming.process(queue, payload, false)
+}
+
+func (incoming *Incoming) process(queue int, payload *common.Payload, relayed bool) bool {
 	payload, mapping, ok := incoming.resolve(payload)
 	if !ok {
 		incoming.stats(true, queue, payload, mapping)
 		return ok
 	}
-	for i := 0; i < len(incoming.plugins); i++ {
-		payload, mapping, ok = incoming.plugins[i].Apply(plugin.Incoming, payload, mapping)
+	if !relayed && !payload.Peer.Matches(mapping) {
+		// The remote node authenticated by the socket is sending on behalf of another node.
+		payload.DropReason = common.IdentityMismatchDropReason
+		incoming.stats(true, queue, payload, mapping)
+		return false
+	}
+	// Handshakes are hidden on the wire like any other packet, so the plugins hiding them are undone before looking for one.
+	for i := 0; i < incoming.wrapped; i++ {
+		if payload, mapping, ok = incoming.plugins[i].Apply(plugin.Incoming, queue, payload, mapping); !ok {
+			incoming.drop(queue, payload, mapping)
+			return ok
+		}
+	}
+	if incoming.control.Handshake(payload, mapping) {
+		ok = incoming.control.Handle(queue, payload, mapping)
+		incoming.stats(!ok, queue, payload, mapping)
+		return ok
+	}
+	return incoming.deliver(queue, incoming.wrapped, payload, mapping, relayed)
+}
+
+// drop records a payload rejected by one of the plugins, other than the parity packets consumed by the fec plugin which it reports on its own.
+func (incoming *Incoming) drop(queue int, payload *common.Payload, mapping *common.Mapping) {
+	switch payload.DropReason {
+	case common.ParityDropReason:
+		return
+	case common.UnauthenticatedDropReason:
+		incoming.control.Rejected(mapping)
+	}
+	incoming.stats(true, queue, payload, mapping)
+}
+
+// deliver passes the payload through the plugins starting at the supplied index, and hands it to the control worker or writes it to the device, learning the station that sent it when it carries an ethernet frame.
+func (incoming *Incoming) deliver(queue, start int, payload *common.Payload, mapping *common.Mapping, relayed bool) bool {
+	var ok bool
+	for i := start; i < len(incoming.plugins); i++ {
+		payload, mapping, ok = incoming.plugins[i].Apply(plugin.Incoming, queue, payload, mapping)
 		if !ok {
-			incoming.stats(true, queue, payload, mapping)
+			incoming.drop(queue, payload, mapping)
 			return ok
 		}
 	}
+	if relayed && payload.Peer != nil && !payload.Authenticated {
+		// The socket authenticated the relay node rather than the node the relayed packet claims to come from, and no plugin authenticated that node either.
+		payload.DropReason = common.IdentityMismatchDropReason
+		incoming.stats(true, queue, payload, mapping)
+		return false
+	}
+	if !relayed {
+		// Only packets received straight from the remote node prove that the direct path to it works.
+		incoming.control.Seen(mapping, payload)
+	}
+	if common.IsControl(payload.Packet) {
+		if inner, ok := incoming.control.Unwrap(payload); ok && !relayed {
+			return incoming.process(queue, inner, true)
+		}
+		ok = incoming.control.Handle(queue, payload, mapping)
+		incoming.stats(!ok, queue, payload, mapping)
+		return ok
+	}
+	if common.IsFrame(payload.Packet) {
+		incoming.control.Learn(common.SourceMAC(payload.Packet), mapping)
+	}
 	ok = incoming.dev.Write(queue, payload)
 	if !ok {
 		incoming.stats(true, queue, payload, mapping)
@@ -81,15 +152,35 @@ func (incoming *Incoming) pipeline(buf []byte, queue int) bool {
 	return true
 }
 
+// produce delivers the packets the plugins produced on top of the ones received, like the packets rebuilt by forward error correction, through the plugins that come after the producing plugin.
+func (incoming *Incoming) produce(buf []byte, queue int) {
+	for i := 0; i < len(incoming.producers); i++ {
+		start := incoming.producers[i]
+		producer := incoming.plugins[start].(plugin.Producer)
+		for payload, mapping, ok := producer.Produce(plugin.Incoming, buf); ok; payload, mapping, ok = producer.Produce(plugin.Incoming, buf) {
+			incoming.deliver(queue, start+1, payload, mapping, false)
+		}
+	}
+}
+
 // Start handling packets.
 func (incoming *Incoming) Start(queue int) {
 	go func() {
 		// We want to pin this routine to a specific thread to reduce switching costs.
 		runtime.LockOSThread()
 
-		buf := make([]byte, common.MaxPacketLength)
+		flusher, flushing := incoming.dev.(device.Flusher)
+		backlogger, backlogging := incoming.sock.(socket.Backlogger)
+
+		buf := make([]byte, common.MaxBufferLength)
 		for !incoming.stop {
 			incoming.pipeline(buf, queue)
+			incoming.produce(buf, queue)
+
+			// Packets held back by the device are written once the burst they belong to has been read, rather than waiting on the next packet.
+			if flushing && (!backlogging || !backlogger.Backlogged(queue)) {
+				flusher.Flush(queue)
+			}
 		}
 	}()
 }
@@ -100,14 +191,34 @@ func (incoming *Incoming) Stop() {
 }
 
 // NewIncoming generates a new Incoming worker which once started will handle packets coming from the remote nodes in the quantum network destined for the local node.
-func NewIncoming(cfg *common.Config, aggregator *metric.Aggregator, store datastore.Datastore, plugins []plugin.Plugin, dev device.Device, sock socket.Socket) *Incoming {
+func NewIncoming(cfg *common.Config, aggregator *metric.Aggregator, store datastore.Datastore, plugins []plugin.Plugin, dev device.Device, sock socket.Socket, control *Control) *Incoming {
+	var resolvers []plugin.Resolver
+	var producers []int
+	wrapped := 0
+	for i := 0; i < len(plugins); i++ {
+		if resolver, ok := plugins[i].(plugin.Resolver); ok {
+			resolvers = append(resolvers, resolver)
+			// The plugins hiding packets on the wire are the first ones applied to incoming packets.
+			if wrapped == i {
+				wrapped++
+			}
+		}
+		if _, ok := plugins[i].(plugin.Producer); ok {
+			producers = append(producers, i)
+		}
+	}
+
 	return &Incoming{
 		cfg:        cfg,
 		aggregator: aggregator,
 		plugins:    plugins,
+		resolvers:  resolvers,
+		wrapped:    wrapped,
+		producers:  producers,
 		dev:        dev,
 		sock:       sock,
 		store:      store,
+		control:    control,
 		stop:       false,
 	}
 }
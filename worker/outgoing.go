@@ -6,6 +6,7 @@ package worker
 import (
 	"encoding/binary"
 	"runtime"
+	"sync"
 
 	"github.com/supernomad/quantum/common"
 	"github.com/supernomad/quantum/datastore"
@@ -20,9 +21,12 @@ type Outgoing struct {
 	cfg        *common.Config
 	aggregator *metric.Aggregator
 	plugins    []plugin.Plugin
+	producers  []int
 	dev        device.Device
 	sock       socket.Socket
 	store      datastore.Datastore
+	control    *Control
+	frames     sync.Pool
 	stop       bool
 }
 
@@ -46,6 +50,7 @@ func (outgoing *Outgoing) stats(dropped bool, queue int, payload *common.Payload
 
 	if payload != nil {
 		metric.Bytes += uint64(payload.Length)
+		metric.Reason = payload.DropReason
 	}
 
 	if mapping != nil {
@@ -61,19 +66,92 @@ func (outgoing *Outgoing) pipeline(buf []byte, queue int) bool {
 		outgoing.stats(true, queue, payload, nil)
 		return ok
 	}
+	if common.IsFrame(payload.Packet) {
+		return outgoing.bridge(queue, payload)
+	}
 	payload, mapping, ok := outgoing.resolve(payload)
 	if !ok {
 		outgoing.stats(true, queue, payload, mapping)
-		return ok
+		return false
+	}
+	return outgoing.send(queue, payload, mapping)
+}
+
+// send routes the payload to the remote node represented by the mapping, through a relay node when the remote node is unreachable.
+func (outgoing *Outgoing) send(queue int, payload *common.Payload, mapping *common.Mapping) bool {
+	var relay *common.Mapping
+	mapping, direct := outgoing.control.Route(mapping)
+	if !direct {
+		var ok bool
+		if relay, ok = outgoing.control.Relay(mapping); !ok {
+			outgoing.stats(true, queue, payload, mapping)
+			return false
+		}
+	}
+	return outgoing.transmit(queue, 0, payload, mapping, relay)
+}
+
+// bridge sends the ethernet frame read off of a TAP device to the remote node the station it is destined for sits behind, and floods broadcast, multicast and unknown unicast frames to every remote node using a TAP device.
+func (outgoing *Outgoing) bridge(queue int, payload *common.Payload) bool {
+	copy(payload.IPAddress, outgoing.cfg.PrivateIP.To4())
+
+	dst := common.DestinationMAC(payload.Packet)
+	if !common.IsMulticastMAC(dst) {
+		if mapping, ok := outgoing.control.Station(dst); ok {
+			return outgoing.send(queue, payload, mapping)
+		}
 	}
-	for i := 0; i < len(outgoing.plugins); i++ {
-		payload, mapping, ok = outgoing.plugins[i].Apply(plugin.Outgoing, payload, mapping)
+	return outgoing.flood(queue, payload)
+}
+
+// flood sends a copy of the ethernet frame to every remote node using a TAP device, since the plugins transform each copy in place.
+func (outgoing *Outgoing) flood(queue int, payload *common.Payload) bool {
+	raw := payload.Raw
+	length := len(payload.Packet)
+
+	frame := outgoing.frames.Get().([]byte)
+	defer outgoing.frames.Put(frame)
+	copy(frame, raw[:common.PacketStart+length])
+
+	sent, flooded := false, false
+	mappings := outgoing.store.Mappings()
+	for i := 0; i < len(mappings); i++ {
+		if mappings[i].MAC == "" || mappings[i].Floating || mappings[i].MachineID == outgoing.cfg.MachineID {
+			continue
+		}
+
+		if flooded {
+			copy(raw, frame[:common.PacketStart+length])
+			payload = common.NewTunPayload(raw, length)
+		}
+		flooded = true
+
+		if outgoing.send(queue, payload, mappings[i]) {
+			sent = true
+		}
+	}
+
+	if !flooded {
+		outgoing.stats(true, queue, payload, nil)
+	}
+	return sent
+}
+
+// transmit passes the payload through the plugins starting at the supplied index, and sends it to the remote node represented by the mapping, through the relay node if one is supplied.
+func (outgoing *Outgoing) transmit(queue, start int, payload *common.Payload, mapping, relay *common.Mapping) bool {
+	var ok bool
+	for i := start; i < len(outgoing.plugins); i++ {
+		payload, mapping, ok = outgoing.plugins[i].Apply(plugin.Outgoing, queue, payload, mapping)
 		if !ok {
 			outgoing.stats(true, queue, payload, mapping)
 			return ok
 		}
 	}
-	ok = outgoing.sock.Write(queue, payload, mapping)
+	if relay != nil {
+		ok = outgoing.control.Forward(queue, payload, mapping, relay)
+	} else {
+		ok = outgoing.sock.Write(queue, payload, mapping)
+	}
 	if !ok {
 		outgoing.stats(true, queue, payload, mapping)
 		return ok
@@ -82,15 +160,35 @@ func (outgoing *Outgoing) pipeline(buf []byte, queue int) bool {
 	return true
 }
 
+// produce sends the packets the plugins produced on top of the ones sent, like the parity packets of forward error correction, through the plugins that come after the producing plugin.
+func (outgoing *Outgoing) produce(buf []byte, queue int) {
+	for i := 0; i < len(outgoing.producers); i++ {
+		start := outgoing.producers[i]
+		producer := outgoing.plugins[start].(plugin.Producer)
+		for payload, mapping, ok := producer.Produce(plugin.Outgoing, buf); ok; payload, mapping, ok = producer.Produce(plugin.Outgoing, buf) {
+			var relay *common.Mapping
+			route, direct := outgoing.control.Route(mapping)
+			if !direct {
+				if relay, ok = outgoing.control.Relay(route); !ok {
+					outgoing.stats(true, queue, payload, route)
+					continue
+				}
+			}
+			outgoing.transmit(queue, start+1, payload, route, relay)
+		}
+	}
+}
+
 // Start handling packets.
 func (outgoing *Outgoing) Start(queue int) {
 	go func() {
 		// We want to pin this routine to a specific thread to reduce switching costs.
 		runtime.LockOSThread()
 
-		buf := make([]byte, common.MaxPacketLength)
+		buf := make([]byte, common.MaxBufferLength)
 		for !outgoing.stop {
 			outgoing.pipeline(buf, queue)
+			outgoing.produce(buf, queue)
 		}
 	}()
 }
@@ -101,14 +199,28 @@ func (outgoing *Outgoing) Stop() {
 }
 
 // NewOutgoing generates an Outgoing worker which once started will handle packets coming from the local node destined for remote nodes in the quantum network.
-func NewOutgoing(cfg *common.Config, aggregator *metric.Aggregator, store datastore.Datastore, plugins []plugin.Plugin, dev device.Device, sock socket.Socket) *Outgoing {
+func NewOutgoing(cfg *common.Config, aggregator *metric.Aggregator, store datastore.Datastore, plugins []plugin.Plugin, dev device.Device, sock socket.Socket, control *Control) *Outgoing {
+	var producers []int
+	for i := 0; i < len(plugins); i++ {
+		if _, ok := plugins[i].(plugin.Producer); ok {
+			producers = append(producers, i)
+		}
+	}
+
 	return &Outgoing{
 		cfg:        cfg,
 		aggregator: aggregator,
 		plugins:    plugins,
+		producers:  producers,
 		dev:        dev,
 		sock:       sock,
 		store:      store,
-		stop:       false,
+		control:    control,
+		frames: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, common.MaxBufferLength)
+			},
+		},
+		stop: false,
 	}
 }
@@ -0,0 +1,93 @@
+// Copyright (c) 2016-2017 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package worker
+
+import (
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+)
+
+const (
+	rekeyCheckInterval = 10 * time.Second
+	cipherCacheSyncs   = 3
+)
+
+// Rekey worker struct for rotating the keys used by the encryption plugin, and publishing them to the remote nodes.
+type Rekey struct {
+	cfg     *common.Config
+	store   datastore.Datastore
+	stop    chan struct{}
+	pending bool
+}
+
+func (rekey *Rekey) check(now time.Time) {
+	keys := rekey.cfg.Keys
+
+	// Every mapping refresh asks for the AES objects it needs, so anything left unused for a few syncs belongs to keys that are gone.
+	keys.Prune(now.Add(-cipherCacheSyncs * rekey.cfg.DatastoreSyncInterval))
+
+	switch {
+	case keys.Expired(now, rekey.cfg.RekeyInterval, uint64(rekey.cfg.RekeyVolume)):
+		key := keys.Rotate(now)
+		rekey.cfg.Log.Info.Println("[REKEY]", "Rotated to key", key.ID)
+		rekey.pending = true
+	case !rekey.pending && keys.Settle(now, rekey.cfg.RekeyGracePeriod):
+		rekey.cfg.Log.Info.Println("[REKEY]", "Retired the previous key, now using key", keys.Current().ID)
+		rekey.pending = true
+	}
+
+	if !rekey.pending {
+		return
+	}
+
+	if err := keys.Save(); err != nil {
+		rekey.cfg.Log.Error.Println("[REKEY]", "Error persisting the local keys:", err.Error())
+	}
+
+	// Keep retrying until the keys are published, and hold off on retiring the previous key until they are.
+	if err := rekey.store.Publish(); err != nil {
+		rekey.cfg.Log.Error.Println("[REKEY]", "Error publishing the local keys:", err.Error())
+		return
+	}
+	rekey.pending = false
+}
+
+// Start periodically checking whether or not the local keys need to be rotated.
+func (rekey *Rekey) Start() {
+	if rekey.cfg.Keys == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(rekeyCheckInterval)
+
+	loop:
+		for {
+			select {
+			case <-rekey.stop:
+				break loop
+			case now := <-ticker.C:
+				rekey.check(now)
+			}
+		}
+
+		ticker.Stop()
+	}()
+}
+
+// Stop rotating the local keys.
+func (rekey *Rekey) Stop() {
+	close(rekey.stop)
+}
+
+// NewRekey generates a Rekey worker which once started will rotate the keys used by the encryption plugin based on their age and the volume of data they have encrypted.
+func NewRekey(cfg *common.Config, store datastore.Datastore) *Rekey {
+	return &Rekey{
+		cfg:   cfg,
+		store: store,
+		stop:  make(chan struct{}),
+	}
+}
@@ -5,7 +5,14 @@ package worker
 
 import (
 	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"path"
 	"testing"
 	"time"
 
@@ -13,6 +20,7 @@ import (
 	"github.com/supernomad/quantum/datastore"
 	"github.com/supernomad/quantum/device"
 	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/peer"
 	"github.com/supernomad/quantum/plugin"
 	"github.com/supernomad/quantum/socket"
 )
@@ -21,6 +29,7 @@ var (
 	testMapping *common.Mapping
 	outgoing    *Outgoing
 	incoming    *Incoming
+	control     *Control
 	store       *datastore.Mock
 
 	dev       device.Device
@@ -39,7 +48,7 @@ func init() {
 	key := make([]byte, 32)
 	rand.Read(key)
 
-	testMapping = &common.Mapping{IPv4: ip, IPv6: ipv6}
+	testMapping = &common.Mapping{IPv4: ip, IPv6: ipv6, PrivateIP: net.ParseIP(privateIP), MachineID: "remote", Capabilities: []string{common.KeepaliveCapability}}
 	store.InternalMapping = testMapping
 
 	aggregator := metric.New(
@@ -49,8 +58,9 @@ func init() {
 		})
 	aggregator.Start()
 
-	incoming = NewIncoming(&common.Config{NumWorkers: 1, PrivateIP: ip, IsIPv6Enabled: true, IsIPv4Enabled: true}, aggregator, store, []plugin.Plugin{}, dev, sock)
-	outgoing = NewOutgoing(&common.Config{NumWorkers: 1, PrivateIP: ip, IsIPv6Enabled: true, IsIPv4Enabled: true}, aggregator, store, []plugin.Plugin{}, dev, sock)
+	control = NewControl(&common.Config{NumWorkers: 1, PrivateIP: ip, MachineID: "local", KeepaliveInterval: time.Millisecond, KeepaliveTimeout: time.Millisecond, Log: common.NewLogger(common.NoopLogger)}, aggregator, store, []plugin.Plugin{}, sock, peer.New())
+	incoming = NewIncoming(&common.Config{NumWorkers: 1, PrivateIP: ip, IsIPv6Enabled: true, IsIPv4Enabled: true}, aggregator, store, []plugin.Plugin{}, dev, sock, control)
+	outgoing = NewOutgoing(&common.Config{NumWorkers: 1, PrivateIP: ip, IsIPv6Enabled: true, IsIPv4Enabled: true}, aggregator, store, []plugin.Plugin{}, dev, sock, control)
 }
 
 func benchmarkIncomingPipeline(buf []byte, queue int, b *testing.B) {
@@ -63,21 +73,138 @@ func benchmarkIncomingPipeline(buf []byte, queue int, b *testing.B) {
 func BenchmarkIncomingPipeline(b *testing.B) {
 	buf := make([]byte, common.MaxPacketLength)
 	rand.Read(buf)
+	buf[common.PacketStart] = 0x45
 
-	payload := common.NewTunPayload(buf, common.MTU)
+	payload := common.NewTunPayload(buf, common.MaxMTU)
 	benchmarkIncomingPipeline(payload.Raw, 0, b)
 }
 
 func TestIncomingPipeline(t *testing.T) {
 	buf := make([]byte, common.MaxPacketLength)
 	rand.Read(buf)
+	buf[common.PacketStart] = 0x45
 
-	payload := common.NewTunPayload(buf, common.MTU)
+	payload := common.NewTunPayload(buf, common.MaxMTU)
 	if !incoming.pipeline(payload.Raw, 0) {
 		panic("Pipeline failed something is wrong.")
 	}
 }
 
+func TestIncomingPeerIdentity(t *testing.T) {
+	buf := make([]byte, common.MaxPacketLength)
+	rand.Read(buf)
+	buf[common.PacketStart] = 0x45
+
+	payload := common.NewSockPayload(buf, common.HeaderSize+20)
+	payload.Authenticated = true
+	payload.Peer = &common.PeerIdentity{MachineID: "other"}
+	if incoming.process(0, payload, false) || payload.DropReason != common.IdentityMismatchDropReason {
+		t.Fatal("Incoming accepted a packet sent on behalf of another node.")
+	}
+
+	payload = common.NewSockPayload(buf, common.HeaderSize+20)
+	payload.Authenticated = true
+	payload.Peer = &common.PeerIdentity{IPs: []net.IP{testMapping.IPv4}}
+	if !incoming.process(0, payload, false) {
+		t.Fatal("Incoming dropped a packet sent by the authenticated node.")
+	}
+
+	// A relay control packet from the authenticated node, wrapping a packet that claims to come from another node.
+	buf = make([]byte, common.MaxBufferLength)
+	buf[common.PacketStart] = byte(common.RelayControl)
+	copy(buf[common.PacketStart+common.ControlBodyStart:], control.cfg.PrivateIP.To4())
+	copy(buf[common.RelayHeaderSize:], net.ParseIP("10.1.1.9").To4())
+	buf[common.RelayHeaderSize+common.PacketStart] = 0x45
+
+	payload = common.NewSockPayload(buf, common.RelayHeaderSize+common.HeaderSize+20)
+	payload.Authenticated = true
+	payload.Peer = &common.PeerIdentity{IPs: []net.IP{testMapping.IPv4}}
+	if incoming.process(0, payload, false) {
+		t.Fatal("Incoming accepted a relayed packet that no plugin authenticated.")
+	}
+
+	inner, _ := control.Unwrap(payload)
+	if inner.Peer != payload.Peer || incoming.process(0, inner, true) || inner.DropReason != common.IdentityMismatchDropReason {
+		t.Fatal("Incoming didn't reject a relayed packet on behalf of another node.")
+	}
+	inner.Authenticated = true
+	if !incoming.process(0, inner, true) {
+		t.Fatal("Incoming dropped a relayed packet authenticated by a plugin.")
+	}
+}
+
+func TestIncomingResolve(t *testing.T) {
+	newCfg := func(ip, machineID string) *common.Config {
+		return &common.Config{
+			NumWorkers:   1,
+			PrivateIP:    net.ParseIP(ip),
+			MachineID:    machineID,
+			Plugins:      []string{plugin.ObfuscationPlugin},
+			PluginConfig: common.PluginSections{plugin.ObfuscationPlugin: {"key": "secret"}},
+		}
+	}
+	localCfg, remoteCfg := newCfg("10.8.0.1", "local"), newCfg(privateIP, "remote")
+
+	local, _ := plugin.New(plugin.ObfuscationPlugin, localCfg)
+	remote, _ := plugin.New(plugin.ObfuscationPlugin, remoteCfg)
+	if err := plugin.Init([]plugin.Plugin{local}, store); err != nil {
+		t.Fatal("Failed to initialize the obfuscation plugin:", err)
+	}
+
+	buf := make([]byte, common.MaxBufferLength)
+	payload := common.NewTunPayload(buf, 64)
+	copy(payload.IPAddress, remoteCfg.PrivateIP.To4())
+	payload, _, ok := remote.Apply(plugin.Outgoing, 0, payload, common.NewMapping(localCfg))
+	if !ok || net.IP(payload.IPAddress).Equal(remoteCfg.PrivateIP) {
+		t.Fatal("The obfuscation plugin didn't hide the private ip of the remote node.")
+	}
+
+	resolving := NewIncoming(localCfg, control.aggregator, store, []plugin.Plugin{local}, dev, sock, control)
+	if _, _, ok := resolving.resolve(common.NewSockPayload(payload.Raw, payload.Length)); !ok || !net.IP(payload.IPAddress).Equal(remoteCfg.PrivateIP) {
+		t.Fatal("Incoming didn't restore the private ip hidden by the remote node before looking it up.")
+	}
+}
+
+func TestIncomingProduce(t *testing.T) {
+	newCfg := func(ip, machineID string) *common.Config {
+		return &common.Config{
+			NumWorkers:   1,
+			PrivateIP:    net.ParseIP(ip),
+			MachineID:    machineID,
+			Plugins:      []string{plugin.FECPlugin},
+			PluginConfig: common.PluginSections{plugin.FECPlugin: {"data": "2", "parity": "1", "timeout": "1h"}},
+		}
+	}
+	localCfg, remoteCfg := newCfg("10.8.0.1", "local"), newCfg(privateIP, "remote")
+	local, _ := plugin.New(plugin.FECPlugin, localCfg)
+	remote, _ := plugin.New(plugin.FECPlugin, remoteCfg)
+	localMapping, remoteMapping := common.NewMapping(localCfg), common.NewMapping(remoteCfg)
+
+	buf := make([]byte, common.MaxBufferLength)
+	var packets [][]byte
+	for i := 0; i < 2; i++ {
+		payload := common.NewTunPayload(buf, 64)
+		payload, _, _ = remote.Apply(plugin.Outgoing, 0, payload, localMapping)
+		packets = append(packets, append([]byte(nil), payload.Raw[:payload.Length]...))
+	}
+	payload, _, _ := remote.(plugin.Producer).Produce(plugin.Outgoing, buf)
+	packets = append(packets, append([]byte(nil), payload.Raw[:payload.Length]...))
+
+	producing := NewIncoming(localCfg, control.aggregator, store, []plugin.Plugin{local}, dev, sock, control)
+	for _, i := range []int{0, 2} {
+		copy(buf, packets[i])
+		producing.deliver(0, 0, common.NewSockPayload(buf, len(packets[i])), remoteMapping, true)
+	}
+
+	producing.produce(buf, 0)
+	if _, _, ok := local.(plugin.Producer).Produce(plugin.Incoming, buf); ok {
+		t.Fatal("Incoming didn't deliver the packet rebuilt by the fec plugin.")
+	}
+	if stats := local.(plugin.Reporter).Report().FEC[privateIP]; stats == nil || stats.Recovered != 1 {
+		t.Fatal("The fec plugin didn't rebuild the lost packet.")
+	}
+}
+
 func TestIncoming(t *testing.T) {
 	incoming.Start(0)
 	time.Sleep(5 * time.Millisecond)
@@ -113,3 +240,546 @@ func TestOutgoing(t *testing.T) {
 	time.Sleep(5 * time.Millisecond)
 	outgoing.Stop()
 }
+
+func TestControl(t *testing.T) {
+	buf := make([]byte, common.MaxPacketLength)
+
+	control.probe(buf)
+
+	p, ok := control.peers.Get(common.IPtoInt(testMapping.PrivateIP))
+	if !ok {
+		t.Fatal("Control probe did not start tracking the remote peer.")
+	}
+	if p.State() != peer.Unknown {
+		t.Fatal("Control probe should leave an unanswered peer in the unknown state.")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	control.probe(buf)
+
+	if p.State() != peer.Down || control.Available(testMapping) {
+		t.Fatal("Control probe did not mark an unanswered peer as down.")
+	}
+
+	ping := common.NewControlPayload(buf, common.PingControl, common.PingBodySize)
+	common.PutTimestamp(common.ControlBody(ping.Packet), time.Now())
+	ping.Sockaddr = common.NewSockaddr(net.ParseIP("1.2.3.4"), 40000)
+	if !control.Handle(0, ping, testMapping) {
+		t.Fatal("Control failed to handle a ping.")
+	}
+	if common.ControlType(buf[common.PacketStart]) != common.PongControl {
+		t.Fatal("Control did not respond to a ping with a pong.")
+	}
+
+	pong := common.NewSockPayload(buf, common.HeaderSize+common.ControlHeaderSize+common.PingBodySize+1+net.IPv4len+2)
+	if !control.Handle(0, pong, testMapping) {
+		t.Fatal("Control failed to handle a pong.")
+	}
+	if p.State() != peer.Up || !control.Available(testMapping) {
+		t.Fatal("Control did not mark an answering peer as up.")
+	}
+
+	control.discover(time.Now())
+	if ip, port := control.cfg.Reflexive(); !ip.Equal(net.ParseIP("1.2.3.4")) || port != 40000 || store.Published != 1 {
+		t.Fatal("Control did not publish the endpoint observed by the remote peer.")
+	}
+
+	control.discover(time.Now())
+	if store.Published != 1 {
+		t.Fatal("Control published an unchanged reflexive endpoint.")
+	}
+}
+
+func TestControlPipeline(t *testing.T) {
+	buf := make([]byte, common.MaxPacketLength)
+
+	ping := common.NewControlPayload(buf, common.PingControl, common.PingBodySize)
+	common.PutTimestamp(common.ControlBody(ping.Packet), time.Now())
+
+	if !incoming.pipeline(buf[:ping.Length], 0) {
+		t.Fatal("Incoming pipeline failed to handle a control packet.")
+	}
+}
+
+func TestControlRelay(t *testing.T) {
+	buf := make([]byte, common.MaxBufferLength)
+	buf[common.PacketStart] = 0x45
+
+	relayMapping := &common.Mapping{PrivateIP: net.ParseIP("10.1.1.2"), MachineID: "relay", Capabilities: []string{common.KeepaliveCapability, common.RelayCapability}}
+	control.peers.Track(relayMapping).Seen(time.Now())
+	control.elect([]*common.Mapping{testMapping, relayMapping})
+
+	relay, ok := control.Relay(testMapping)
+	if !ok || !relay.PrivateIP.Equal(relayMapping.PrivateIP) {
+		t.Fatal("Control did not elect the reachable relay node.")
+	}
+	if _, ok := control.Relay(relayMapping); ok {
+		t.Fatal("Control returned a relay node for traffic destined to itself.")
+	}
+
+	local := &common.Mapping{PrivateIP: control.cfg.PrivateIP, MachineID: "local"}
+	payload := common.NewTunPayload(buf, 20)
+	copy(payload.IPAddress, testMapping.PrivateIP.To4())
+	if !control.Forward(0, payload, local, relay) {
+		t.Fatal("Control failed to forward a packet to the relay node.")
+	}
+	if common.ControlType(buf[common.PacketStart]) != common.RelayControl {
+		t.Fatal("Control did not encapsulate the forwarded packet in a relay control packet.")
+	}
+
+	relayed := common.NewSockPayload(buf, common.RelayHeaderSize+common.HeaderSize+20)
+	inner, ok := control.Unwrap(relayed)
+	if !ok || inner.Packet[0] != 0x45 || len(inner.Packet) != 20 || !net.IP(inner.IPAddress).Equal(testMapping.PrivateIP) {
+		t.Fatal("Control did not unwrap a relay control packet destined for the local node.")
+	}
+
+	if control.Handle(0, relayed, testMapping) {
+		t.Fatal("Control relayed a packet without being configured as a relay node.")
+	}
+
+	copy(buf[common.PacketStart+common.ControlBodyStart:], testMapping.PrivateIP.To4())
+	control.cfg.Relay = true
+	defer func() { control.cfg.Relay = false }()
+	if _, ok := control.Unwrap(relayed); ok {
+		t.Fatal("Control unwrapped a relay control packet destined for a remote node.")
+	}
+	if !control.Handle(0, relayed, testMapping) {
+		t.Fatal("Control failed to relay a packet to its destination.")
+	}
+
+	control.peers.Prune([]*common.Mapping{testMapping})
+	control.elect([]*common.Mapping{testMapping})
+	if _, ok := control.Relay(testMapping); ok {
+		t.Fatal("Control kept a relay node that is no longer tracked.")
+	}
+}
+
+func TestControlRelayMTU(t *testing.T) {
+	newCfg := func(ip, machineID string) *common.Config {
+		return &common.Config{
+			NumWorkers:    1,
+			PrivateIP:     net.ParseIP(ip),
+			PublicIPv4:    net.ParseIP("1.1.1.1"),
+			IsIPv4Enabled: true,
+			MachineID:     machineID,
+			Plugins:       []string{plugin.EncryptionPlugin},
+			Keys:          common.NewKeyring(common.NewKey(0)),
+			Log:           common.NewLogger(common.NoopLogger),
+		}
+	}
+	localCfg := newCfg("10.8.0.1", "local")
+	remote, _ := common.ParseMapping(common.NewMapping(newCfg("10.1.1.5", "remote")).String(), localCfg)
+	relay, _ := common.ParseMapping(common.NewMapping(newCfg("10.1.1.6", "relay")).String(), localCfg)
+
+	encryption, _ := plugin.New(plugin.EncryptionPlugin, localCfg)
+	plugins := []plugin.Plugin{encryption}
+	if err := plugin.Check(localCfg, plugins); err != nil {
+		t.Fatal("Check rejected the encryption plugin:", err)
+	}
+
+	relaying := NewControl(localCfg, control.aggregator, store, plugins, sock, peer.New())
+	sending := NewOutgoing(localCfg, control.aggregator, store, plugins, dev, sock, relaying)
+
+	buf := make([]byte, common.MaxBufferLength)
+	payload := common.NewTunPayload(buf, localCfg.MTU)
+	if !sending.transmit(0, 0, payload, remote, relay) || payload.Length > common.MaxPacketLength {
+		t.Fatal("Outgoing failed to send a full sized packet through a relay node.")
+	}
+
+	// Without the room reserved for relaying, a full sized packet outgrows the maximum packet size once wrapped and encrypted again.
+	payload = common.NewTunPayload(buf, plugin.MTU(plugins))
+	if sending.transmit(0, 0, payload, remote, relay) || payload.DropReason != common.OversizeDropReason {
+		t.Fatal("Outgoing sent a packet larger than the maximum packet size through a relay node.")
+	}
+}
+
+func TestControlRoaming(t *testing.T) {
+	p := control.peers.Track(testMapping)
+
+	buf := make([]byte, common.MaxBufferLength)
+	payload := common.NewSockPayload(buf, common.HeaderSize+20)
+	payload.Sockaddr = common.NewSockaddr(net.ParseIP("5.6.7.8"), 50000)
+
+	control.Seen(testMapping, payload)
+	if route, _ := control.Route(testMapping); common.SockaddrEquals(route.Sockaddr, payload.Sockaddr) {
+		t.Fatal("Control followed an unauthenticated packet to a new endpoint.")
+	}
+
+	payload.Authenticated = true
+	control.Seen(testMapping, payload)
+	if route, _ := control.Route(testMapping); !common.SockaddrEquals(route.Sockaddr, payload.Sockaddr) || route.Port != 50000 {
+		t.Fatal("Control did not follow an authenticated packet to a new endpoint.")
+	}
+	if p.State() != peer.Up {
+		t.Fatal("Control did not mark the roaming peer as up.")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	keys := common.NewKeyring(common.NewKey(0))
+	rekeyStore := &datastore.Mock{}
+	rekey := NewRekey(&common.Config{Keys: keys, RekeyInterval: time.Hour, RekeyGracePeriod: time.Minute, Log: common.NewLogger(common.NoopLogger)}, rekeyStore)
+	now := time.Now()
+
+	rekey.check(now)
+	if keys.Current().ID != 0 || rekeyStore.Published != 0 {
+		t.Fatal("Rekey rotated a fresh key.")
+	}
+
+	rekey.check(now.Add(time.Hour))
+	if keys.Current().ID != 1 || keys.Previous() == nil || rekeyStore.Published != 1 {
+		t.Fatal("Rekey did not rotate and publish an expired key.")
+	}
+
+	rekey.check(now.Add(time.Hour + time.Minute))
+	if keys.Previous() != nil || rekeyStore.Published != 2 {
+		t.Fatal("Rekey did not retire and unpublish the previous key after the grace period.")
+	}
+}
+
+func TestControlRejected(t *testing.T) {
+	fetches := make(chan net.IP, 1)
+	store.Fetches = fetches
+	defer func() { store.Fetches = nil }()
+
+	control.mux.Lock()
+	delete(control.rejections, common.IPtoInt(testMapping.PrivateIP))
+	control.mux.Unlock()
+
+	// Rejected decides whether to fetch before it returns, so a fetch it didn't start can never arrive later.
+	for i := 0; i < rejectThreshold-1; i++ {
+		control.Rejected(testMapping)
+	}
+	select {
+	case <-fetches:
+		t.Fatal("Control fetched a mapping before authentication failures repeated.")
+	default:
+	}
+
+	control.Rejected(testMapping)
+	select {
+	case ip := <-fetches:
+		if !ip.Equal(testMapping.PrivateIP) {
+			t.Fatal("Control fetched the mapping of the wrong peer.")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Control did not fetch the mapping of a peer failing authentication.")
+	}
+
+	for i := 0; i < rejectThreshold; i++ {
+		control.Rejected(testMapping)
+	}
+	select {
+	case <-fetches:
+		t.Fatal("Control did not rate limit fetching the mapping of a peer failing authentication.")
+	default:
+	}
+}
+
+func TestControlStation(t *testing.T) {
+	published, _ := net.ParseMAC("02:00:00:00:00:02")
+	learned, _ := net.ParseMAC("02:00:00:00:00:03")
+	local, _ := net.ParseMAC("02:00:00:00:00:01")
+	broadcast, _ := net.ParseMAC("ff:ff:ff:ff:ff:ff")
+
+	remote := &common.Mapping{IPv4: testMapping.IPv4, PrivateIP: testMapping.PrivateIP, MachineID: "remote", MAC: published.String()}
+	other := &common.Mapping{IPv4: testMapping.IPv4, PrivateIP: net.ParseIP("10.1.1.2"), MachineID: "other"}
+	bridging := NewControl(&common.Config{MachineID: "local", HardwareAddr: local, Log: common.NewLogger(common.NoopLogger)}, control.aggregator, &datastore.Mock{InternalMapping: remote}, []plugin.Plugin{}, sock, peer.New())
+
+	if mapping, ok := bridging.Station(published); !ok || mapping != remote {
+		t.Fatal("Control didn't forward frames destined for the mac address published by a remote node to it.")
+	}
+	if _, ok := bridging.Station(learned); ok {
+		t.Fatal("Control forwarded frames destined for an unknown station rather than flooding them.")
+	}
+
+	bridging.Learn(learned, remote)
+	if mapping, ok := bridging.Station(learned); !ok || mapping != remote {
+		t.Fatal("Control didn't learn the station behind the remote node.")
+	}
+
+	bridging.Learn(published, other)
+	bridging.Learn(local, other)
+	bridging.Learn(broadcast, other)
+	if len(bridging.stations) != 1 {
+		t.Fatal("Control learned a multicast mac address, or a mac address published by another node.")
+	}
+
+	bridging.age(time.Now().Add(stationAge))
+	if len(bridging.stations) != 0 {
+		t.Fatal("Control didn't forget the stations that weren't seen for too long.")
+	}
+}
+
+func TestOutgoingBridge(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:02")
+	remote := &common.Mapping{IPv4: testMapping.IPv4, PrivateIP: testMapping.PrivateIP, MachineID: "remote", MAC: mac.String()}
+	bridgeStore := &datastore.Mock{InternalMapping: remote}
+	bridgeCfg := &common.Config{NumWorkers: 1, PrivateIP: net.ParseIP("10.8.0.1"), MachineID: "local", IsIPv4Enabled: true}
+	bridging := NewOutgoing(bridgeCfg, control.aggregator, bridgeStore, []plugin.Plugin{}, dev, sock, NewControl(bridgeCfg, control.aggregator, bridgeStore, []plugin.Plugin{}, sock, peer.New()))
+
+	frame := func(dst string) *common.Payload {
+		buf := make([]byte, common.MaxBufferLength)
+		buf[common.PacketStart] = common.FrameMarker
+		addr, _ := net.ParseMAC(dst)
+		copy(buf[common.PacketStart+common.FrameStart:], addr)
+		return common.NewTunPayload(buf, common.FrameHeaderSize+common.EthernetHeaderSize+20)
+	}
+
+	if !bridging.bridge(0, frame("02:00:00:00:00:02")) {
+		t.Fatal("Outgoing didn't send the frame to the remote node publishing its destination mac address.")
+	}
+	if !bridging.bridge(0, frame("ff:ff:ff:ff:ff:ff")) || !bridging.bridge(0, frame("02:00:00:00:00:09")) {
+		t.Fatal("Outgoing didn't flood broadcast or unknown unicast frames to the remote node using a TAP device.")
+	}
+
+	bridgeStore.InternalMapping = testMapping
+	if bridging.bridge(0, frame("ff:ff:ff:ff:ff:ff")) {
+		t.Fatal("Outgoing flooded a frame to a remote node that isn't using a TAP device.")
+	}
+}
+
+func TestControlWatch(t *testing.T) {
+	watcher := &plugin.Mock{}
+	watchStore := &datastore.Mock{InternalMapping: testMapping}
+	watching := NewControl(&common.Config{MachineID: "local", Log: common.NewLogger(common.NoopLogger)}, control.aggregator, watchStore, []plugin.Plugin{watcher}, sock, peer.New())
+
+	watching.watch([]plugin.MappingWatcher{watcher})
+	watching.watch([]plugin.MappingWatcher{watcher})
+	if len(watcher.Changed) != 1 || watcher.Changed[0] != testMapping {
+		t.Fatal("Control did not notify the plugin about a new mapping exactly once.")
+	}
+
+	changed := &common.Mapping{IPv4: testMapping.IPv4, PrivateIP: testMapping.PrivateIP, MachineID: "remote", Capabilities: []string{common.RelayCapability}}
+	watchStore.InternalMapping = changed
+	watching.watch([]plugin.MappingWatcher{watcher})
+	if len(watcher.Changed) != 2 || watcher.Changed[1] != changed {
+		t.Fatal("Control did not notify the plugin about a changed mapping.")
+	}
+
+	watchStore.InternalMapping = &common.Mapping{PrivateIP: net.ParseIP("10.8.0.1"), MachineID: "local"}
+	watching.watch([]plugin.MappingWatcher{watcher})
+	if len(watcher.Removed) != 1 || watcher.Removed[0] != changed || len(watcher.Changed) != 2 {
+		t.Fatal("Control did not notify the plugin about a removed mapping, or notified it about the local mapping.")
+	}
+}
+
+func TestControlHandshake(t *testing.T) {
+	newCfg := func(ip, machineID string) *common.Config {
+		keys := common.NewKeyring(common.NewKey(0))
+		return &common.Config{
+			NumWorkers:   1,
+			PrivateIP:    net.ParseIP(ip),
+			MachineID:    machineID,
+			Capabilities: []string{common.HandshakeCapability},
+			Keys:         keys,
+			Sessions:     common.NewSessions(keys, time.Minute),
+			Log:          common.NewLogger(common.NoopLogger),
+		}
+	}
+	localCfg, remoteCfg := newCfg("10.8.0.1", "local"), newCfg("10.1.1.3", "remote")
+	local, remote := common.NewMapping(localCfg), common.NewMapping(remoteCfg)
+
+	handshakes := NewControl(localCfg, control.aggregator, store, []plugin.Plugin{}, sock, peer.New())
+
+	buf := make([]byte, common.MaxBufferLength)
+	msg, _ := remoteCfg.Sessions.Initiate(time.Now(), local)
+	init := common.NewControlPayload(buf, common.HandshakeInitControl, len(msg))
+	copy(common.ControlBody(init.Packet), msg)
+	copy(init.IPAddress, remote.PrivateIP.To4())
+	common.SealHandshake(init)
+
+	received := common.NewSockPayload(buf, init.Length)
+	if control.Handshake(received, remote) {
+		t.Fatal("Control accepted a handshake without supporting handshakes.")
+	}
+	if !handshakes.Handshake(received, remote) {
+		t.Fatal("Control did not recognize a handshake control packet.")
+	}
+	if !handshakes.Handle(0, received, remote) {
+		t.Fatal("Control failed to answer a handshake init.")
+	}
+
+	response := common.NewSockPayload(buf, common.HeaderSize+common.ControlHeaderSize+common.HandshakeResponseSize+common.SessionKindSize)
+	if !common.OpenHandshake(response) || common.ControlType(response.Packet[common.ControlTypeStart]) != common.HandshakeResponseControl {
+		t.Fatal("Control did not send a handshake response.")
+	}
+	if err := remoteCfg.Sessions.Complete(time.Now(), local, common.ControlBody(response.Packet)); err != nil {
+		t.Fatalf("Control sent an invalid handshake response: %s", err)
+	}
+
+	if _, ok := localCfg.Sessions.Sending(common.IPtoInt(remote.PrivateIP)); !ok {
+		t.Fatal("Control did not establish a session with the initiator.")
+	}
+}
+
+func TestControlHandshakeObfuscated(t *testing.T) {
+	newCfg := func(ip, machineID string) *common.Config {
+		keys := common.NewKeyring(common.NewKey(0))
+		return &common.Config{
+			NumWorkers:   1,
+			PrivateIP:    net.ParseIP(ip),
+			MachineID:    machineID,
+			Capabilities: []string{common.HandshakeCapability},
+			Keys:         keys,
+			Sessions:     common.NewSessions(keys, time.Minute),
+			Plugins:      []string{plugin.ObfuscationPlugin},
+			PluginConfig: common.PluginSections{plugin.ObfuscationPlugin: {"key": "secret"}},
+			Log:          common.NewLogger(common.NoopLogger),
+		}
+	}
+	localCfg, remoteCfg := newCfg("10.8.0.1", "local"), newCfg("10.1.1.3", "remote")
+	local, remote := common.NewMapping(localCfg), common.NewMapping(remoteCfg)
+
+	localObf, _ := plugin.New(plugin.ObfuscationPlugin, localCfg)
+	remoteObf, _ := plugin.New(plugin.ObfuscationPlugin, remoteCfg)
+	localObf.(plugin.MappingWatcher).OnMappingChange(remote, false)
+	remoteObf.(plugin.MappingWatcher).OnMappingChange(local, false)
+
+	defer func(mapping *common.Mapping) { store.InternalMapping = mapping }(store.InternalMapping)
+	store.InternalMapping = remote
+
+	handshakes := NewControl(localCfg, control.aggregator, store, []plugin.Plugin{localObf}, sock, peer.New())
+	receiving := NewIncoming(localCfg, control.aggregator, store, []plugin.Plugin{localObf}, dev, sock, handshakes)
+	initiating := NewControl(remoteCfg, control.aggregator, store, []plugin.Plugin{remoteObf}, sock, peer.New())
+
+	buf := make([]byte, common.MaxBufferLength)
+	msg, _ := remoteCfg.Sessions.Initiate(time.Now(), local)
+	init := common.NewControlPayload(buf, common.HandshakeInitControl, len(msg))
+	copy(common.ControlBody(init.Packet), msg)
+	if !initiating.handshake(0, init, local) || init.Length != 256 || net.IP(init.IPAddress).Equal(remote.PrivateIP) {
+		t.Fatal("Control did not pad the handshake and hide the private ip in its header.")
+	}
+
+	if !receiving.process(0, common.NewSockPayload(buf, init.Length), false) {
+		t.Fatal("Incoming did not hand an obfuscated handshake to the control worker.")
+	}
+
+	response := common.NewSockPayload(buf, 256)
+	if !remoteObf.(plugin.Resolver).Resolve(response) {
+		t.Fatal("Control did not hide the private ip in the header of the handshake response.")
+	}
+	response, _, ok := remoteObf.Apply(plugin.Incoming, 0, response, local)
+	if !ok || !common.OpenHandshake(response) || common.ControlType(response.Packet[common.ControlTypeStart]) != common.HandshakeResponseControl {
+		t.Fatal("Control did not send an obfuscated handshake response.")
+	}
+	if err := remoteCfg.Sessions.Complete(time.Now(), local, common.ControlBody(response.Packet)); err != nil {
+		t.Fatalf("Control sent an invalid handshake response: %s", err)
+	}
+}
+
+func TestEnrollment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quantum-enrollment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caKey, _ := common.GenerateCertificateKey()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "quantum test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	common.WriteFileAtomic(path.Join(dir, "ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	common.SaveCertificateKey(path.Join(dir, "ca.key"), caKey)
+
+	enrollStore := &datastore.Mock{Tokens: map[string]bool{"token": true}}
+	newConfig := func(machineID string) *common.Config {
+		return &common.Config{
+			MachineID:     machineID,
+			NetworkConfig: &common.NetworkConfig{Backend: socket.DTLSSocket},
+			DTLSCert:      path.Join(dir, machineID+".crt"),
+			DTLSKey:       path.Join(dir, machineID+".key"),
+			DTLSCA:        path.Join(dir, machineID+"-ca.crt"),
+			DTLSCertTTL:   3 * time.Hour,
+			Revocations:   common.NewRevocations(),
+			Log:           common.NewLogger(common.NoopLogger),
+		}
+	}
+
+	signerCfg := newConfig("aa")
+	signerCfg.DTLSCA, signerCfg.DTLSCAKey = path.Join(dir, "ca.crt"), path.Join(dir, "ca.key")
+	signer := NewEnrollment(signerCfg, enrollStore)
+	if err := signer.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if cert := signer.certificate(time.Now()); cert == nil || common.NewPeerIdentity(cert).MachineID != "aa" {
+		t.Fatal("Init did not issue the signer its own certificate.")
+	}
+
+	nodeCfg := newConfig("bb")
+	nodeCfg.DTLSJoinToken = "token"
+	node := NewEnrollment(nodeCfg, enrollStore)
+	if err := node.loadKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if err := node.request(now, nil); err != nil || len(enrollStore.Pending) != 1 {
+		t.Fatal("request did not post a certificate request.")
+	}
+	signer.sign(now)
+	if ok, err := node.collect(now); !ok || err != nil {
+		t.Fatal("collect did not save the issued certificate:", err)
+	}
+	cert := node.certificate(now)
+	if cert == nil || common.NewPeerIdentity(cert).MachineID != "bb" || enrollStore.Tokens["token"] {
+		t.Fatal("The node was not enrolled using its join token.")
+	}
+	if _, err := os.Stat(nodeCfg.DTLSCA); err != nil {
+		t.Fatal("The CA certificate was not saved.")
+	}
+
+	// Join tokens are only usable once, and never to take over a machine holding a valid certificate.
+	other := NewEnrollment(newConfig("cc"), enrollStore)
+	other.cfg.DTLSJoinToken = "token"
+	other.loadKey()
+	other.request(now, nil)
+	hijack := NewEnrollment(newConfig("bb"), enrollStore)
+	hijack.cfg.DTLSCert = path.Join(dir, "hijack.crt")
+	hijack.cfg.DTLSKey = path.Join(dir, "hijack.key")
+	hijack.cfg.DTLSJoinToken = "other"
+	enrollStore.Tokens["other"] = true
+	hijack.loadKey()
+	hijack.request(now, nil)
+	signer.sign(now)
+	if enrollStore.Certificates["cc"] != nil || len(enrollStore.Pending) != 0 || !enrollStore.Tokens["other"] {
+		t.Fatal("sign did not reject the invalid enrollments.")
+	}
+
+	later := now.Add(2 * time.Hour)
+	if err := node.request(later, cert); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := node.collect(later); ok {
+		t.Fatal("collect accepted the certificate being renewed.")
+	}
+	signer.sign(later)
+	if ok, err := node.collect(later); !ok || err != nil {
+		t.Fatal("collect did not save the renewed certificate:", err)
+	}
+	renewed := node.certificate(later)
+	if renewed == nil || renewed.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+		t.Fatal("The certificate was not renewed.")
+	}
+
+	signerCfg.Revocations.Set([]string{common.CertificateSerial(renewed)})
+	issued := enrollStore.Certificates["bb"]
+	node.request(later, renewed)
+	signer.sign(later)
+	if len(enrollStore.Pending) != 0 || enrollStore.Certificates["bb"] != issued {
+		t.Fatal("sign did not reject the renewal of a revoked certificate.")
+	}
+	if ok, _ := node.collect(later); ok {
+		t.Fatal("A revoked certificate was renewed.")
+	}
+}